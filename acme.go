@@ -0,0 +1,24 @@
+package main
+
+import (
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// newACMEManager creates a manager that obtains and renews the server
+// certificate from an ACME provider such as Let's Encrypt. Certificates are
+// only requested for the configured domains.
+func newACMEManager(c ACMEConfig) *autocert.Manager {
+	m := &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		HostPolicy: autocert.HostWhitelist(c.domains...),
+		Email:      c.email,
+	}
+	if c.cacheDir != "" {
+		m.Cache = autocert.DirCache(c.cacheDir)
+	}
+	if c.directory != "" {
+		m.Client = &acme.Client{DirectoryURL: c.directory}
+	}
+	return m
+}
@@ -0,0 +1,24 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+func TestNewACMEManager(t *testing.T) {
+	m := newACMEManager(ACMEConfig{
+		domains:   []string{"inbox.example.org"},
+		email:     "admin@example.org",
+		cacheDir:  "/tmp/acme",
+		directory: "https://acme-staging-v02.api.letsencrypt.org/directory",
+	})
+
+	assert.Equal(t, "admin@example.org", m.Email)
+	assert.Equal(t, autocert.DirCache("/tmp/acme"), m.Cache)
+	assert.Equal(t, "https://acme-staging-v02.api.letsencrypt.org/directory", m.Client.DirectoryURL)
+	assert.NoError(t, m.HostPolicy(context.Background(), "inbox.example.org"))
+	assert.Error(t, m.HostPolicy(context.Background(), "other.example.org"))
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"net/http"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// The admin endpoints change how the proxy runs, so they are served on an
+// address of their own, apart from the health checks, and only when
+// server.admin is set. server.adminListen defaults to localhost:8002 and
+// must name the host to listen on:
+//
+//	GET and PUT /log read and change the level and format of the log
+//	GET /spool and POST /spool/replay look at and replay the spool
+//	GET and PUT /debug/capture read and switch the capture of requests
+
+// adminServer serves the admin endpoints of the parts of the proxy that
+// have them
+type adminServer struct {
+	// spool of the events that could not be sent, nil if there is none
+	spool *SpoolingMessenger
+	// records the changes made on the endpoints, nil if there is no audit
+	// log
+	audit *auditLog
+	// capture of the requests for debugging, nil if there is none
+	capture *debugCapture
+}
+
+// handler serves the admin endpoints
+func (a *adminServer) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("/log", a.audit.adminHandler(logHandler()))
+	if a.capture != nil {
+		mux.Handle("/debug/capture", a.audit.adminHandler(captureHandler(a.capture)))
+	}
+	if a.spool != nil {
+		mux.Handle("/spool", a.audit.adminHandler(spoolHandler(a.spool)))
+		mux.Handle("/spool/", a.audit.adminHandler(spoolHandler(a.spool)))
+	}
+	return mux
+}
+
+// serve serves the admin endpoints on the address, it should be run as a go
+// routine. The proxy goes on without them if they can't be served.
+func (a *adminServer) serve(address string) {
+	log.Infof("serving admin endpoints on %s", address)
+	if err := http.ListenAndServe(address, a.handler()); err != nil {
+		log.Errorf("failed to serve admin endpoints: %v", err)
+	}
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAdminServer(t *testing.T) {
+	resetLogging(t)
+	capture, err := newDebugCapture(debugConfig{captureBuffer: defaultCaptureBuffer})
+	assert.NoError(t, err)
+	handler := (&adminServer{capture: capture}).handler()
+
+	for path, code := range map[string]int{
+		"/log":           http.StatusOK,
+		"/debug/capture": http.StatusOK,
+		// Without a spool there is nothing to replay
+		"/spool":    http.StatusNotFound,
+		"/metrics":  http.StatusNotFound,
+		"/ready":    http.StatusNotFound,
+		"/user/abc": http.StatusNotFound,
+	} {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		assert.Equal(t, code, w.Code, path)
+	}
+}
+
+func (suite *TestSuite) TestConfigAdminListen() {
+	config, err := NewConfig()
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), "", config.Server.adminListen)
+
+	viper.Set("server.admin", true)
+	config, err = NewConfig()
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), "localhost:8002", config.Server.adminListen)
+
+	viper.Set("server.adminListen", "10.0.0.5:9002")
+	config, err = NewConfig()
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), "10.0.0.5:9002", config.Server.adminListen)
+
+	viper.Set("server.adminListen", ":9002")
+	_, err = NewConfig()
+	assert.Error(suite.T(), err, "the host is needed")
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"filippo.io/age"
+	"filippo.io/age/armor"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/kms"
+	"github.com/spf13/viper"
+)
+
+// Settings can be encrypted with age (https://age-encryption.org), so the
+// configuration file can be kept in git. The value is the ASCII armored
+// file of
+//
+//	echo -n secret | age -a -r age1...
+//
+// and is decrypted at startup with the identities of secrets.ageKey, which
+// like other secrets can be read from secrets.ageKeyFile, an environment
+// variable or the AWS secret of secrets.ageKeySecret. The identities can
+// also be kept encrypted with AWS KMS, in secrets.ageKeyKMS as the base64
+// ciphertext of
+//
+//	aws kms encrypt --key-id alias/s3inbox --plaintext fileb://key.txt \
+//	  --output text --query CiphertextBlob
+
+// decryptedSettings are the settings that were encrypted, they are masked
+// like secrets when the configuration is printed
+var decryptedSettings = map[string]bool{}
+
+// decryptSettings replaces the settings encrypted with age by what they
+// decrypt to
+func decryptSettings() error {
+	decryptedSettings = map[string]bool{}
+	var encrypted []string
+	for _, key := range viper.AllKeys() {
+		if value, ok := viper.Get(key).(string); ok && strings.HasPrefix(strings.TrimSpace(value), armor.Header) {
+			encrypted = append(encrypted, key)
+		}
+	}
+	if len(encrypted) == 0 {
+		return nil
+	}
+
+	key, err := readAgeKey()
+	if err != nil {
+		return err
+	}
+	if key == "" {
+		return fmt.Errorf("%s is encrypted, but neither secrets.ageKey nor secrets.ageKeyKMS is set", encrypted[0])
+	}
+	identities, err := age.ParseIdentities(strings.NewReader(key))
+	if err != nil {
+		return fmt.Errorf("secrets.ageKey: %v", err)
+	}
+
+	for _, setting := range encrypted {
+		plaintext, err := ageDecrypt(viper.GetString(setting), identities)
+		if err != nil {
+			return fmt.Errorf("%s: %v", setting, err)
+		}
+		viper.Set(setting, strings.TrimRight(string(plaintext), "\r\n"))
+		decryptedSettings[setting] = true
+	}
+	return nil
+}
+
+// readAgeKey returns the age identities of the secrets section, decrypted
+// with KMS if they are kept encrypted, or empty if there are none
+func readAgeKey() (string, error) {
+	secrets, err := readSecretsConfig()
+	if err != nil {
+		return "", err
+	}
+	key, _, err := readSecret("secrets.ageKey", secrets)
+	if err != nil {
+		return "", err
+	}
+	if !viper.IsSet("secrets.ageKeyKMS") {
+		return key, nil
+	}
+	if key != "" {
+		return "", errors.New("only one of secrets.ageKey and secrets.ageKeyKMS can be set")
+	}
+	if key, err = kmsDecrypt(viper.GetString("secrets.ageKeyKMS"), viper.GetString("secrets.kmsRegion"), secrets); err != nil {
+		return "", fmt.Errorf("secrets.ageKeyKMS: %v", err)
+	}
+	return key, nil
+}
+
+// kmsDecrypt decrypts the base64 ciphertext of AWS KMS, with the
+// credentials of the secrets section
+func kmsDecrypt(ciphertext, region string, secrets secretsConfig) (string, error) {
+	blob, err := base64.StdEncoding.DecodeString(strings.TrimSpace(ciphertext))
+	if err != nil {
+		return "", fmt.Errorf("not base64: %v", err)
+	}
+	if region == "" {
+		return "", errors.New("secrets.kmsRegion is needed")
+	}
+	provider, err := secrets.credentials()
+	if err != nil {
+		return "", err
+	}
+	options := kms.Options{Region: region, Credentials: provider}
+	if secrets.endpoint != "" {
+		options.BaseEndpoint = aws.String(secrets.endpoint)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), secrets.timeout)
+	defer cancel()
+	output, err := kms.New(options).Decrypt(ctx, &kms.DecryptInput{CiphertextBlob: blob})
+	if err != nil {
+		return "", err
+	}
+	return string(output.Plaintext), nil
+}
+
+// ageDecrypt decrypts an ASCII armored age file with one of the identities
+func ageDecrypt(armored string, identities []age.Identity) ([]byte, error) {
+	r, err := age.Decrypt(armor.NewReader(strings.NewReader(strings.TrimSpace(armored)+"\n")), identities...)
+	if err != nil {
+		return nil, err
+	}
+	return io.ReadAll(r)
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"filippo.io/age"
+	"filippo.io/age/armor"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+// ageFixtureKey and ageFixture were made with age v1.2.1:
+//
+//	age-keygen -o key.txt
+//	printf 'encryptedsecret\n' | age -a -R <(age-keygen -y key.txt)
+const ageFixtureKey = `# created: 2026-10-16T19:40:07Z
+# public key: age1pxhfy0ql4j2mrjtnxs5d08yrx387zp888l4nct3aduh0g5yk0pgq6tcrrv
+AGE-SECRET-KEY-124S24GZ4F8N9C4JDJ3W737RJ26JNAJDX46ATF2ZWX7MQA5KLGCEQHSS6CZ
+`
+
+const ageFixture = `-----BEGIN AGE ENCRYPTED FILE-----
+YWdlLWVuY3J5cHRpb24ub3JnL3YxCi0+IFgyNTUxOSBtUnhWRjMvcXJVMFp5TDVR
+eEovaUFCTWVEMHdza29xSDRHTGxJdTVNOFJVCjJqSlpVS2xMbjN4T3dFdHJNTzFt
+aXU1MlA0VFdweXgrQ0hvUkZRS2luWWMKLS0tIFR1Ri9Mc3Z5UzljWW5kZ2ZrOXpC
+UXFKWWVyWWxwdE5Obmd5WWYySWN1U0UK5I1lL50rwoZ7d+BC0yY95OxQGrm6rX0D
+lX0TzNuSaU4NaH5WURCO8wOW5xzkVnHs
+-----END AGE ENCRYPTED FILE-----
+`
+
+// ageEncrypt encrypts the plaintext to the recipient like age -a does
+func ageEncrypt(t *testing.T, recipient age.Recipient, plaintext string) string {
+	var armored strings.Builder
+	a := armor.NewWriter(&armored)
+	w, err := age.Encrypt(a, recipient)
+	assert.NoError(t, err)
+	_, err = w.Write([]byte(plaintext))
+	assert.NoError(t, err)
+	assert.NoError(t, w.Close())
+	assert.NoError(t, a.Close())
+	return armored.String()
+}
+
+func TestAgeDecrypt(t *testing.T) {
+	identities, err := age.ParseIdentities(strings.NewReader(ageFixtureKey))
+	assert.NoError(t, err)
+	plaintext, err := ageDecrypt(ageFixture, identities)
+	assert.NoError(t, err)
+	assert.Equal(t, "encryptedsecret\n", string(plaintext))
+
+	// Without the last newline, as YAML may leave it
+	plaintext, err = ageDecrypt(strings.TrimSpace(ageFixture), identities)
+	assert.NoError(t, err)
+	assert.Equal(t, "encryptedsecret\n", string(plaintext))
+
+	other, err := age.GenerateX25519Identity()
+	assert.NoError(t, err)
+	_, err = ageDecrypt(ageFixture, []age.Identity{other})
+	assert.Error(t, err, "only the recipient can decrypt")
+
+	tampered := strings.Replace(ageFixture, "lX0T", "lX0U", 1)
+	_, err = ageDecrypt(tampered, identities)
+	assert.Error(t, err)
+}
+
+// fakeKMS decrypts the ciphertexts of KMS by taking the prefix "kms:" off
+func fakeKMS(t *testing.T) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "TrentService.Decrypt", r.Header.Get("X-Amz-Target"))
+		var request struct{ CiphertextBlob []byte }
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&request))
+		plaintext, ok := strings.CutPrefix(string(request.CiphertextBlob), "kms:")
+		if !ok {
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte(`{"__type":"InvalidCiphertextException","message":"not ours"}`))
+			return
+		}
+		w.Header().Set("Content-Type", "application/x-amz-json-1.1")
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{"KeyId": "arn:aws:kms:eu-north-1:123456789012:key/1", "Plaintext": []byte(plaintext)})
+	}))
+}
+
+func (suite *TestSuite) TestConfigAgeEncrypted() {
+	keyFile := filepath.Join(suite.T().TempDir(), "age-key")
+	assert.NoError(suite.T(), ioutil.WriteFile(keyFile, []byte(ageFixtureKey), 0600))
+
+	viper.Set("aws.secretkey", ageFixture)
+	_, err := NewConfig()
+	assert.Error(suite.T(), err, "the key is needed")
+
+	viper.Set("secrets.ageKeyFile", keyFile)
+	config, err := NewConfig()
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), "encryptedsecret", config.S3.secretKey)
+
+	identity, err := age.ParseX25519Identity(strings.TrimSpace(strings.Split(ageFixtureKey, "\n")[2]))
+	assert.NoError(suite.T(), err)
+	viper.Set("aws.bucket", ageEncrypt(suite.T(), identity.Recipient(), "encryptedbucket"))
+	config, err = NewConfig()
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), "encryptedbucket", config.S3.bucket)
+	assert.Equal(suite.T(), redacted, redactSetting("aws.bucket", config.S3.bucket), "decrypted settings are not printed")
+}
+
+func (suite *TestSuite) TestConfigAgeKeyKMS() {
+	server := fakeKMS(suite.T())
+	defer server.Close()
+	viper.Set("secrets.endpoint", server.URL)
+	viper.Set("secrets.accessKey", "access")
+	viper.Set("secrets.secretKey", "secret")
+	viper.Set("aws.secretkey", ageFixture)
+	viper.Set("secrets.ageKeyKMS", base64.StdEncoding.EncodeToString([]byte("kms:"+ageFixtureKey)))
+
+	_, err := NewConfig()
+	assert.Error(suite.T(), err, "the region is needed")
+
+	viper.Set("secrets.kmsRegion", "eu-north-1")
+	config, err := NewConfig()
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), "encryptedsecret", config.S3.secretKey)
+
+	// The settings were replaced by what they decrypt to
+	viper.Set("aws.secretkey", ageFixture)
+	viper.Set("secrets.ageKeyKMS", base64.StdEncoding.EncodeToString([]byte(ageFixtureKey)))
+	_, err = NewConfig()
+	assert.Error(suite.T(), err, "KMS can not decrypt it")
+
+	viper.Set("secrets.ageKeyKMS", base64.StdEncoding.EncodeToString([]byte("kms:"+ageFixtureKey)))
+	viper.Set("secrets.ageKey", ageFixtureKey)
+	_, err = NewConfig()
+	assert.Error(suite.T(), err, "only one source of the key")
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/streadway/amqp"
+)
+
+// amqpBatch is events that are published together, as one message with a
+// JSON array of the events. The broker confirms or rejects the batch as a
+// whole, and a rejected batch is published again like single events are.
+// The message id of the batch is derived from those of its events, so a
+// batch published again has the same id, and the ids of the events are in
+// the x-message-ids header for consumers that deduplicate events one by one.
+type amqpBatch struct {
+	events     []Event
+	requestIDs []interface{}
+	messageIDs []interface{}
+	timer      *time.Timer
+	// done is closed with err set once the batch is confirmed or failed
+	done chan struct{}
+	err  error
+}
+
+// sendBatched adds the event to the batch being filled, and waits until the
+// batch is sent
+func (m *AMQPMessenger) sendBatched(message Event) error {
+	m.batchLock.Lock()
+	batch := m.batch
+	if batch == nil {
+		batch = &amqpBatch{done: make(chan struct{})}
+		batch.timer = time.AfterFunc(m.batchInterval, func() { m.flushBatch(batch) })
+		m.batch = batch
+	}
+	batch.events = append(batch.events, message)
+	batch.messageIDs = append(batch.messageIDs, messageID(message))
+	if message.RequestID != "" {
+		batch.requestIDs = append(batch.requestIDs, message.RequestID)
+	}
+	full := len(batch.events) >= m.batchSize
+	m.batchLock.Unlock()
+
+	if full {
+		m.flushBatch(batch)
+	}
+	<-batch.done
+	return batch.err
+}
+
+// flushBatch publishes the batch if it hasn't been already
+func (m *AMQPMessenger) flushBatch(batch *amqpBatch) {
+	m.batchLock.Lock()
+	if m.batch != batch {
+		m.batchLock.Unlock()
+		return
+	}
+	m.batch = nil
+	batch.timer.Stop()
+
+	// The batch is handed on before the next one can be, so they keep
+	// their order
+	event, err := m.batchEvent(batch)
+	published := false
+	if err == nil {
+		published, err = m.enqueue(event)
+	}
+	m.batchLock.Unlock()
+
+	if published {
+		err = <-event.done
+	}
+	batch.err = err
+	close(batch.done)
+}
+
+// batchEvent creates the message of a batch
+func (m *AMQPMessenger) batchEvent(batch *amqpBatch) (*amqpEvent, error) {
+	body, err := m.format.encodeBatch(batch.events)
+	if err != nil {
+		return nil, err
+	}
+
+	headers := amqp.Table{"x-batch-size": int32(len(batch.events)), "x-message-ids": batch.messageIDs}
+	if len(batch.requestIDs) > 0 {
+		headers["x-request-ids"] = batch.requestIDs
+	}
+
+	event := &amqpEvent{
+		publishing: amqp.Publishing{
+			Headers:         headers,
+			ContentEncoding: m.format.contentEncoding("UTF-8"),
+			ContentType:     m.format.batchContentType(),
+			DeliveryMode:    m.deliveryMode,
+			CorrelationId:   uuid.New().String(),
+			MessageId:       batch.messageID(),
+			Body:            body,
+		},
+		done: make(chan error, 1),
+	}
+	m.sign(&event.publishing)
+	return event, nil
+}
+
+// messageID is the id the batch is sent with, derived from the message ids
+// of its events in their order
+func (b *amqpBatch) messageID() string {
+	h := sha256.New()
+	for _, id := range b.messageIDs {
+		fmt.Fprintf(h, "%s\x00", id)
+	}
+	return fmt.Sprintf("%x", h.Sum(nil))[:32]
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAMQPMessenger_batch(t *testing.T) {
+	m, sessions := newTestAMQPMessenger()
+	m.batchSize = 3
+	m.batchInterval = time.Hour
+	go m.supervise()
+	session, channel := newFakeSession()
+	sessions <- session
+
+	// A full batch is published as one message
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			assert.NoError(t, m.SendMessage(Event{Operation: "upload", Username: "user", Filepath: fmt.Sprintf("user/%d.c4gh", i), RequestID: fmt.Sprint(i)}))
+		}(i)
+	}
+	wg.Wait()
+	assert.Equal(t, 1, channel.count())
+	var events []Event
+	assert.NoError(t, json.Unmarshal([]byte(channel.body(0)), &events))
+	assert.Len(t, events, 3)
+	assert.Equal(t, int32(3), channel.published[0].Headers["x-batch-size"])
+	assert.Len(t, channel.published[0].Headers["x-request-ids"], 3)
+	ids := channel.published[0].Headers["x-message-ids"].([]interface{})
+	assert.Len(t, ids, 3)
+	for i, event := range events {
+		assert.Equal(t, messageID(event), ids[i])
+	}
+	assert.Len(t, channel.published[0].MessageId, 32)
+
+	// Batches that don't fill up are sent after the interval, rejected
+	// ones are published again
+	m.batchInterval = 10 * time.Millisecond
+	channel.setOutcomes("nack")
+	assert.NoError(t, m.SendMessage(Event{Operation: "upload", Username: "user", Filepath: "user/a.c4gh"}))
+	assert.Equal(t, 3, channel.count())
+	assert.Equal(t, channel.body(1), channel.body(2))
+	assert.Equal(t, channel.published[1].MessageId, channel.published[2].MessageId, "a batch published again keeps its id")
+	assert.NotEqual(t, channel.published[0].MessageId, channel.published[1].MessageId)
+	assert.Contains(t, channel.body(2), "user/a.c4gh")
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"hash/fnv"
+	"sync"
+
+	"github.com/streadway/amqp"
+)
+
+// amqpConnector shares one connection to the broker between the channels of
+// a pool, it dials again once the connection is closed
+type amqpConnector struct {
+	lock       sync.Mutex
+	dial       func() (*amqp.Connection, error)
+	connection *amqp.Connection
+}
+
+// get returns the open connection, or dials a new one
+func (c *amqpConnector) get() (*amqp.Connection, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.connection == nil || c.connection.IsClosed() {
+		connection, err := c.dial()
+		if err != nil {
+			return nil, err
+		}
+		c.connection = connection
+	}
+	return c.connection, nil
+}
+
+// AMQPPool is a Messenger that publishes on several channels of a connection,
+// so concurrent uploads don't wait for each other's confirms and a channel the
+// broker closes only holds up its share of the events. Each channel is looked
+// after like the channel of an AMQPMessenger. The events of a user always go
+// on the same channel, so they keep their order.
+type AMQPPool struct {
+	channels []*AMQPMessenger
+}
+
+// NewAMQPPool creates a messenger with broker.channels channels on one
+// connection, which is opened in the background
+func NewAMQPPool(c BrokerConfig, tlsConfig *tls.Config) *AMQPPool {
+	connector := &amqpConnector{dial: func() (*amqp.Connection, error) { return dialBroker(c, tlsConfig) }}
+	pool := &AMQPPool{}
+	for i := 0; i < c.channels; i++ {
+		pool.channels = append(pool.channels, newAMQPMessenger(c, func() (*amqpSession, error) {
+			connection, err := connector.get()
+			if err != nil {
+				return nil, err
+			}
+			return openAMQPChannel(connection, c)
+		}))
+	}
+	return pool
+}
+
+// SendMessage sends the event on the channel of its user
+func (p *AMQPPool) SendMessage(message Event) error {
+	return p.channel(message.Username).SendMessage(message)
+}
+
+// flush waits until the events on all channels are confirmed
+func (p *AMQPPool) flush(ctx context.Context) error {
+	for _, channel := range p.channels {
+		if err := channel.flush(ctx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// channel returns the channel the events of the user are published on
+func (p *AMQPPool) channel(username string) *AMQPMessenger {
+	h := fnv.New32a()
+	h.Write([]byte(username))
+	return p.channels[h.Sum32()%uint32(len(p.channels))]
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAMQPPool(t *testing.T) {
+	first, firstSessions := newTestAMQPMessenger()
+	second, secondSessions := newTestAMQPMessenger()
+	pool := &AMQPPool{[]*AMQPMessenger{first, second}}
+	go first.supervise()
+	go second.supervise()
+	firstSession, firstChannel := newFakeSession()
+	firstSessions <- firstSession
+	secondSession, secondChannel := newFakeSession()
+	secondSessions <- secondSession
+
+	// The events of a user stay on one channel
+	assert.Same(t, pool.channel("user"), pool.channel("user"))
+	var stalled, other string
+	for i := 0; stalled == "" || other == ""; i++ {
+		user := fmt.Sprintf("user%d", i)
+		if pool.channel(user) == first {
+			stalled = user
+		} else {
+			other = user
+		}
+	}
+
+	// A channel that doesn't get its confirms doesn't hold up the other
+	firstChannel.setOutcomes("ignore")
+	done := make(chan error)
+	go func() {
+		done <- pool.SendMessage(Event{Operation: "upload", Username: stalled, Filepath: stalled + "/a.c4gh"})
+	}()
+	assert.Eventually(t, func() bool { return firstChannel.count() == 1 }, time.Second, time.Millisecond)
+	assert.NoError(t, pool.SendMessage(Event{Operation: "upload", Username: other, Filepath: other + "/b.c4gh"}))
+	assert.Equal(t, 1, secondChannel.count())
+	select {
+	case <-done:
+		t.Error("the event without a confirm was done")
+	default:
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+
+	"github.com/streadway/amqp"
+)
+
+// Signed messages carry x-signature. With broker.signingMode hmac, the
+// default, it is the hex encoded HMAC-SHA256 of the body prefixed with
+// sha256=, the same as the signatures of the web hooks. It lets consumers
+// check that an event came from the proxy and wasn't changed on the way, but
+// they need the key to check it and could sign events with it too. With jws
+// the key is an Ed25519 private key in PKCS #8 PEM, as made by
+//
+//	openssl genpkey -algorithm ed25519
+//
+// and x-signature is a JWS with the body as detached content (RFC 7515,
+// appendix F), signed with EdDSA, so consumers only need the public key. The
+// kid of the JWS header is the JWK thumbprint of the public key (RFC 7638).
+
+const (
+	hmacSigning = "hmac"
+	jwsSigning  = "jws"
+)
+
+// eventSignature returns the signature of a message body
+func eventSignature(key, body []byte) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// parseSigningKey reads the Ed25519 private key of the JWS signatures
+func parseSigningKey(key string) (ed25519.PrivateKey, error) {
+	block, _ := pem.Decode([]byte(key))
+	if block == nil {
+		return nil, errors.New("not a PEM encoded key")
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	private, ok := parsed.(ed25519.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("%T is not an Ed25519 key", parsed)
+	}
+	return private, nil
+}
+
+// jwkThumbprint returns the JWK thumbprint of the Ed25519 public key
+func jwkThumbprint(key ed25519.PublicKey) string {
+	// The members in lexicographic order, without whitespace
+	jwk := fmt.Sprintf(`{"crv":"Ed25519","kty":"OKP","x":"%s"}`, base64.RawURLEncoding.EncodeToString(key))
+	sum := sha256.Sum256([]byte(jwk))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// eventJWS returns the JWS of a message body, without the body
+func eventJWS(key ed25519.PrivateKey, body []byte) string {
+	header, _ := json.Marshal(map[string]string{"alg": "EdDSA", "kid": jwkThumbprint(key.Public().(ed25519.PublicKey))})
+	protected := base64.RawURLEncoding.EncodeToString(header)
+	signature := ed25519.Sign(key, []byte(protected+"."+base64.RawURLEncoding.EncodeToString(body)))
+	return protected + ".." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+// sign adds the signature to the message when there is a signing key
+func (m *AMQPMessenger) sign(publishing *amqp.Publishing) {
+	switch {
+	case m.jwsKey != nil:
+		publishing.Headers["x-signature"] = eventJWS(m.jwsKey, publishing.Body)
+	case len(m.signingKey) > 0:
+		publishing.Headers["x-signature"] = eventSignature(m.signingKey, publishing.Body)
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEventSignature(t *testing.T) {
+	assert.Equal(t, "sha256=37ceff96f8a1369fb143b2383b38eaecd4121c97e2a481da0c3ff8fe82584839", eventSignature([]byte("hunter2"), []byte(`{"operation":"upload"}`)))
+	assert.NotEqual(t, eventSignature([]byte("hunter2"), []byte("a")), eventSignature([]byte("hunter3"), []byte("a")))
+	assert.NotEqual(t, eventSignature([]byte("hunter2"), []byte("a")), eventSignature([]byte("hunter2"), []byte("b")))
+}
+
+// testSigningKey returns an Ed25519 key and its PKCS #8 PEM
+func testSigningKey(t *testing.T) (ed25519.PrivateKey, string) {
+	_, key, err := ed25519.GenerateKey(nil)
+	assert.NoError(t, err)
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	assert.NoError(t, err)
+	return key, string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}))
+}
+
+// verifyJWS checks the detached JWS of the body with the public key
+func verifyJWS(t *testing.T, key ed25519.PublicKey, jws string, body []byte) bool {
+	parts := strings.Split(jws, ".")
+	if !assert.Len(t, parts, 3) || !assert.Empty(t, parts[1], "the content is detached") {
+		return false
+	}
+	header, err := base64.RawURLEncoding.DecodeString(parts[0])
+	assert.NoError(t, err)
+	var fields map[string]string
+	assert.NoError(t, json.Unmarshal(header, &fields))
+	assert.Equal(t, "EdDSA", fields["alg"])
+	assert.Equal(t, jwkThumbprint(key), fields["kid"])
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	assert.NoError(t, err)
+	return ed25519.Verify(key, []byte(parts[0]+"."+base64.RawURLEncoding.EncodeToString(body)), signature)
+}
+
+func TestEventJWS(t *testing.T) {
+	key, encoded := testSigningKey(t)
+	parsed, err := parseSigningKey(encoded)
+	assert.NoError(t, err)
+	assert.Equal(t, key, parsed)
+
+	jws := eventJWS(key, []byte(`{"operation":"upload"}`))
+	assert.True(t, verifyJWS(t, key.Public().(ed25519.PublicKey), jws, []byte(`{"operation":"upload"}`)))
+	assert.False(t, verifyJWS(t, key.Public().(ed25519.PublicKey), jws, []byte(`{"operation":"remove"}`)))
+
+	// The example of RFC 8037, appendix A.3
+	x, _ := base64.RawURLEncoding.DecodeString("11qYAYKxCrfVS_7TyWQHOg7hcvPapiMlrwIaaPcHURo")
+	assert.Equal(t, "kPrK_qmxVWaYVA9wwBF6Iuo3vVzz7TxHCTwXBygrS4k", jwkThumbprint(x))
+
+	_, err = parseSigningKey("hunter2")
+	assert.Error(t, err)
+}
+
+func TestAMQPMessenger_signing(t *testing.T) {
+	m, sessions := newTestAMQPMessenger()
+	go m.supervise()
+	session, channel := newFakeSession()
+	sessions <- session
+
+	// Unsigned without a key
+	assert.NoError(t, m.SendMessage(Event{Operation: "upload", Username: "user", Filepath: "user/a.c4gh"}))
+	assert.Eventually(t, func() bool { return channel.count() == 1 }, time.Second, time.Millisecond)
+	assert.NotContains(t, channel.published[0].Headers, "x-signature")
+
+	m.signingKey = []byte("hunter2")
+	assert.NoError(t, m.SendMessage(Event{Operation: "upload", Username: "user", Filepath: "user/b.c4gh"}))
+	assert.Equal(t, eventSignature([]byte("hunter2"), channel.published[1].Body), channel.published[1].Headers["x-signature"])
+
+	// Batches are signed as a whole
+	m.batchSize = 2
+	m.batchInterval = time.Millisecond
+	assert.NoError(t, m.SendMessage(Event{Operation: "upload", Username: "user", Filepath: "user/c.c4gh"}))
+	var events []Event
+	assert.NoError(t, json.Unmarshal(channel.published[2].Body, &events))
+	assert.Equal(t, eventSignature([]byte("hunter2"), channel.published[2].Body), channel.published[2].Headers["x-signature"])
+
+	// Or with a JWS
+	key, _ := testSigningKey(t)
+	m.batchSize = 1
+	m.jwsKey = key
+	assert.NoError(t, m.SendMessage(Event{Operation: "upload", Username: "user", Filepath: "user/d.c4gh"}))
+	assert.True(t, verifyJWS(t, key.Public().(ed25519.PublicKey), channel.published[3].Headers["x-signature"].(string), channel.published[3].Body))
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"github.com/streadway/amqp"
+)
+
+// Topology modes: declare what is configured and otherwise check the
+// exchange, only check that the exchanges are there, or leave it all to the
+// broker. The proxy user needs configure permissions to declare.
+const (
+	topologyAuto    = "auto"
+	topologyPassive = "passive"
+	topologyNone    = "none"
+)
+
+// amqpTopology is how the exchange of the events is set up on the broker.
+// Unless something is configured the exchange has to be there already, as a
+// durable topic exchange.
+type amqpTopology struct {
+	mode string
+	// declare the exchange instead of checking that it is there
+	declare      bool
+	exchangeType string
+	durable      bool
+	// arguments of the exchange, and of the queues the proxy declares, such
+	// as x-queue-type for quorum queues
+	arguments      amqp.Table
+	queueArguments amqp.Table
+	// exchange that gets the messages no queue is bound for, they are kept
+	// in a queue of the same name instead of being dropped
+	alternateExchange string
+	// exchange that gets the messages rejected or expired in the queue of
+	// the alternate exchange, or in queues set up by the operator, kept in a
+	// queue of the same name
+	deadLetterExchange string
+}
+
+// readAMQPTopology reads the topology settings of the broker section
+func readAMQPTopology() (amqpTopology, error) {
+	t := amqpTopology{
+		exchangeType:       "topic",
+		durable:            true,
+		alternateExchange:  viper.GetString("broker.alternateExchange"),
+		deadLetterExchange: viper.GetString("broker.deadLetterExchange"),
+	}
+	t.declare = t.alternateExchange != "" || t.deadLetterExchange != ""
+
+	if viper.IsSet("broker.exchangeType") {
+		// Plugins add types, so any is passed on to the broker
+		t.exchangeType = viper.GetString("broker.exchangeType")
+		t.declare = true
+	}
+	if viper.IsSet("broker.exchangeDurable") {
+		t.durable = viper.GetBool("broker.exchangeDurable")
+		t.declare = true
+	}
+
+	for key, arguments := range map[string]*amqp.Table{
+		"broker.exchangeArguments": &t.arguments,
+		"broker.queueArguments":    &t.queueArguments,
+	} {
+		if !viper.IsSet(key) {
+			continue
+		}
+		*arguments = amqp.Table(viper.GetStringMap(key))
+		if err := arguments.Validate(); err != nil {
+			return t, fmt.Errorf("%s: %v", key, err)
+		}
+		t.declare = true
+	}
+
+	t.mode = topologyAuto
+	if viper.IsSet("broker.topology") {
+		t.mode = strings.ToLower(viper.GetString("broker.topology"))
+	}
+	switch t.mode {
+	case topologyAuto:
+	case topologyPassive, topologyNone:
+		t.declare = false
+	default:
+		return t, fmt.Errorf("broker.topology %q is not one of %s, %s or %s", t.mode, topologyAuto, topologyPassive, topologyNone)
+	}
+
+	return t, nil
+}
+
+// amqpDeclarer is the part of a channel the topology is set up with
+type amqpDeclarer interface {
+	ExchangeDeclare(name, kind string, durable, autoDelete, internal, noWait bool, args amqp.Table) error
+	ExchangeDeclarePassive(name, kind string, durable, autoDelete, internal, noWait bool, args amqp.Table) error
+	QueueDeclare(name string, durable, autoDelete, exclusive, noWait bool, args amqp.Table) (amqp.Queue, error)
+	QueueBind(name, key, exchange string, noWait bool, args amqp.Table) error
+}
+
+// declareTopology checks that the exchange is there, or declares it along
+// with the alternate and dead letter exchanges when they are configured. A
+// declared exchange has to match the one on the broker, an existing exchange
+// with other settings has to be deleted first.
+func declareTopology(channel amqpDeclarer, exchange string, t amqpTopology) error {
+	switch {
+	case t.mode == topologyNone:
+		log.Debug("exchange not checked, the topology is left to the broker")
+		return nil
+	case !t.declare:
+		return checkTopology(channel, exchange, t)
+	}
+
+	if t.deadLetterExchange != "" {
+		if err := declareKeptExchange(channel, t.deadLetterExchange, t.queueArguments); err != nil {
+			return err
+		}
+	}
+
+	arguments := amqp.Table{}
+	for key, value := range t.arguments {
+		arguments[key] = value
+	}
+	if t.alternateExchange != "" {
+		queueArguments := amqp.Table{}
+		for key, value := range t.queueArguments {
+			queueArguments[key] = value
+		}
+		if t.deadLetterExchange != "" {
+			queueArguments["x-dead-letter-exchange"] = t.deadLetterExchange
+		}
+		if err := declareKeptExchange(channel, t.alternateExchange, queueArguments); err != nil {
+			return err
+		}
+		arguments["alternate-exchange"] = t.alternateExchange
+	}
+
+	log.Debugf("declaring exchange %s", exchange)
+	if err := channel.ExchangeDeclare(exchange, t.exchangeType, t.durable, false, false, false, arguments); err != nil {
+		return fmt.Errorf("exchange declare: %s", err)
+	}
+	return nil
+}
+
+// declareKeptExchange declares a durable fanout exchange with a queue of the
+// same name, which keeps all the messages sent to the exchange
+func declareKeptExchange(channel amqpDeclarer, name string, queueArguments amqp.Table) error {
+	log.Debugf("declaring exchange and queue %s", name)
+	if err := channel.ExchangeDeclare(name, "fanout", true, false, false, false, nil); err != nil {
+		return fmt.Errorf("exchange declare %s: %s", name, err)
+	}
+	if _, err := channel.QueueDeclare(name, true, false, false, false, queueArguments); err != nil {
+		return fmt.Errorf("queue declare %s: %s", name, err)
+	}
+	if err := channel.QueueBind(name, "", name, false, nil); err != nil {
+		return fmt.Errorf("queue bind %s: %s", name, err)
+	}
+	return nil
+}
+
+// checkTopology checks that the exchange is there, and the alternate and dead
+// letter exchanges if they are configured, without declaring anything
+func checkTopology(channel amqpDeclarer, exchange string, t amqpTopology) error {
+	if err := channel.ExchangeDeclarePassive(
+		exchange,       // name
+		t.exchangeType, // type
+		t.durable,      // durable
+		false,          // auto-deleted
+		false,          // internal
+		false,          // noWait
+		nil,            // arguments
+	); err != nil {
+		return fmt.Errorf("exchange declare: %s", err)
+	}
+	for _, name := range []string{t.alternateExchange, t.deadLetterExchange} {
+		if name == "" {
+			continue
+		}
+		if err := channel.ExchangeDeclarePassive(name, "fanout", true, false, false, false, nil); err != nil {
+			return fmt.Errorf("exchange declare %s: %s", name, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/streadway/amqp"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeDeclarer records what is declared on it
+type fakeDeclarer struct {
+	declared []string
+	args     map[string]amqp.Table
+}
+
+func newFakeDeclarer() *fakeDeclarer {
+	return &fakeDeclarer{args: make(map[string]amqp.Table)}
+}
+
+func (f *fakeDeclarer) ExchangeDeclare(name, kind string, _, _, _, _ bool, args amqp.Table) error {
+	f.declared = append(f.declared, "exchange "+kind+" "+name)
+	f.args["exchange "+name] = args
+	return nil
+}
+
+func (f *fakeDeclarer) ExchangeDeclarePassive(name, kind string, _, _, _, _ bool, _ amqp.Table) error {
+	f.declared = append(f.declared, "passive "+kind+" "+name)
+	return nil
+}
+
+func (f *fakeDeclarer) QueueDeclare(name string, _, _, _, _ bool, args amqp.Table) (amqp.Queue, error) {
+	f.declared = append(f.declared, "queue "+name)
+	f.args["queue "+name] = args
+	return amqp.Queue{Name: name}, nil
+}
+
+func (f *fakeDeclarer) QueueBind(name, _, exchange string, _ bool, _ amqp.Table) error {
+	f.declared = append(f.declared, "bind "+name+" "+exchange)
+	return nil
+}
+
+func TestDeclareTopology(t *testing.T) {
+	// The exchange is only checked by default
+	channel := newFakeDeclarer()
+	assert.NoError(t, declareTopology(channel, "inbox", amqpTopology{exchangeType: "topic", durable: true}))
+	assert.Equal(t, []string{"passive topic inbox"}, channel.declared)
+
+	channel = newFakeDeclarer()
+	assert.NoError(t, declareTopology(channel, "inbox", amqpTopology{declare: true, exchangeType: "topic", durable: true, alternateExchange: "unroutable", deadLetterExchange: "dead"}))
+	assert.Equal(t, []string{
+		"exchange fanout dead", "queue dead", "bind dead dead",
+		"exchange fanout unroutable", "queue unroutable", "bind unroutable unroutable",
+		"exchange topic inbox",
+	}, channel.declared)
+	assert.Equal(t, amqp.Table{"alternate-exchange": "unroutable"}, channel.args["exchange inbox"])
+	assert.Equal(t, amqp.Table{"x-dead-letter-exchange": "dead"}, channel.args["queue unroutable"])
+
+	// Arguments are added to the configured ones
+	channel = newFakeDeclarer()
+	assert.NoError(t, declareTopology(channel, "inbox", amqpTopology{
+		declare:            true,
+		exchangeType:       "direct",
+		arguments:          amqp.Table{"x-custom": "yes"},
+		queueArguments:     amqp.Table{"x-queue-type": "quorum"},
+		alternateExchange:  "unroutable",
+		deadLetterExchange: "dead",
+	}))
+	assert.Contains(t, channel.declared, "exchange direct inbox")
+	assert.Equal(t, amqp.Table{"x-custom": "yes", "alternate-exchange": "unroutable"}, channel.args["exchange inbox"])
+	assert.Equal(t, amqp.Table{"x-queue-type": "quorum"}, channel.args["queue dead"])
+	assert.Equal(t, amqp.Table{"x-queue-type": "quorum", "x-dead-letter-exchange": "dead"}, channel.args["queue unroutable"])
+
+	// Passive and none don't declare anything
+	channel = newFakeDeclarer()
+	assert.NoError(t, declareTopology(channel, "inbox", amqpTopology{mode: topologyPassive, exchangeType: "topic", durable: true, alternateExchange: "unroutable"}))
+	assert.Equal(t, []string{"passive topic inbox", "passive fanout unroutable"}, channel.declared)
+
+	channel = newFakeDeclarer()
+	assert.NoError(t, declareTopology(channel, "inbox", amqpTopology{mode: topologyNone, exchangeType: "topic", durable: true}))
+	assert.Empty(t, channel.declared)
+}
@@ -0,0 +1,289 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// The audit log records what was done with the files and the proxy, apart
+// from the log: the uploads, deletions and renames, the requests that were
+// denied and the changes made on the admin endpoints. Each record is a line
+// of JSON appended to a file, which is rotated when it grows past maxSize or
+// gets older than rotateInterval, and can be sent to syslog as well:
+//
+//	audit:
+//	  output: "/var/log/s3inbox/audit.log"
+//	  maxSize: 104857600
+//	  rotateInterval: "24h"
+//	  maxBackups: 30
+//	  syslog: true
+
+// auditConfig stores the settings of the audit log
+type auditConfig struct {
+	// file the records are appended to, empty for none
+	output string
+	// size and age at which the file is rotated, 0 for no limit
+	maxSize        int64
+	rotateInterval time.Duration
+	// rotated files kept, 0 keeps all
+	maxBackups int
+	// send the records to syslog too
+	syslog        bool
+	syslogAddress string
+	syslogTag     string
+}
+
+// readAuditConfig reads the audit section of the configuration
+func readAuditConfig() (auditConfig, error) {
+	c := auditConfig{
+		output:        viper.GetString("audit.output"),
+		maxSize:       viper.GetInt64("audit.maxSize"),
+		maxBackups:    viper.GetInt("audit.maxBackups"),
+		syslog:        viper.GetBool("audit.syslog"),
+		syslogAddress: viper.GetString("audit.syslogAddress"),
+		syslogTag:     "s3inbox-audit",
+	}
+	if viper.IsSet("audit.rotateInterval") {
+		c.rotateInterval = viper.GetDuration("audit.rotateInterval")
+	}
+	if viper.IsSet("audit.syslogTag") {
+		c.syslogTag = viper.GetString("audit.syslogTag")
+	}
+	switch {
+	case c.maxSize < 0:
+		return c, fmt.Errorf("audit.maxSize can not be negative")
+	case c.rotateInterval < 0:
+		return c, fmt.Errorf("audit.rotateInterval can not be negative")
+	case c.maxBackups < 0:
+		return c, fmt.Errorf("audit.maxBackups can not be negative")
+	case c.output == "" && (c.maxSize > 0 || c.rotateInterval > 0):
+		return c, fmt.Errorf("audit.output must be set to rotate the audit log")
+	}
+	return c, nil
+}
+
+// auditLog writes the records of the audit log, a nil one records nothing
+type auditLog struct {
+	logger *log.Logger
+	file   *rotatingFile
+}
+
+// newAuditLog opens the audit log of the configuration, it is nil if the
+// records go nowhere
+func newAuditLog(c auditConfig) (*auditLog, error) {
+	if c.output == "" && !c.syslog {
+		return nil, nil
+	}
+	a := &auditLog{logger: log.New()}
+	a.logger.SetFormatter(auditFormatter{})
+	a.logger.SetOutput(io.Discard)
+	if c.output != "" {
+		file, err := openRotatingFile(c.output, c.maxSize, c.rotateInterval, c.maxBackups)
+		if err != nil {
+			return nil, fmt.Errorf("audit.output: %v", err)
+		}
+		a.file = file
+		a.logger.SetOutput(file)
+	}
+	if c.syslog {
+		hook, err := newSyslogHook(c.syslogAddress, c.syslogTag)
+		if err != nil {
+			return nil, fmt.Errorf("audit.syslog: %v", err)
+		}
+		a.logger.AddHook(hook)
+	}
+	return a, nil
+}
+
+// record writes a record of the action with the fields
+func (a *auditLog) record(action string, fields log.Fields) {
+	if a == nil {
+		return
+	}
+	a.logger.WithFields(fields).Info(action)
+}
+
+// event records the upload, removal or rename the event is of
+func (a *auditLog) event(e Event) {
+	fields := log.Fields{"user": e.Username, "filepath": e.Filepath, "request_id": e.RequestID}
+	if e.Operation == "upload" {
+		fields["filesize"] = e.Filesize
+	}
+	if e.OldPath != "" {
+		fields["oldpath"] = e.OldPath
+	}
+	if e.ClientIP != "" {
+		fields["client_ip"] = e.ClientIP
+	}
+	a.record(e.Operation, fields)
+}
+
+// denied records a request the proxy refused
+func (a *auditLog) denied(r *http.Request, status int, reason string) {
+	a.record("denied", log.Fields{
+		"user":       requestUser(r),
+		"method":     r.Method,
+		"path":       r.URL.Path,
+		"status":     status,
+		"reason":     reason,
+		"client_ip":  requestClientIP(r),
+		"request_id": requestID(r),
+	})
+}
+
+// adminHandler records the changes made with the requests to the handler,
+// those that don't just look
+func (a *auditLog) adminHandler(handler http.Handler) http.Handler {
+	if a == nil {
+		return handler
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet || r.Method == http.MethodHead {
+			handler.ServeHTTP(w, r)
+			return
+		}
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		handler.ServeHTTP(recorder, r)
+		a.record("admin", log.Fields{
+			"method":    r.Method,
+			"path":      r.URL.Path,
+			"query":     r.URL.RawQuery,
+			"status":    recorder.status,
+			"client_ip": clientIP(r, nil),
+		})
+	})
+}
+
+// statusRecorder remembers the status of the response
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (s *statusRecorder) WriteHeader(status int) {
+	s.status = status
+	s.ResponseWriter.WriteHeader(status)
+}
+
+// auditFormatter writes the records as lines of JSON, with the time, the
+// action and the fields of the record
+type auditFormatter struct{}
+
+func (auditFormatter) Format(entry *log.Entry) ([]byte, error) {
+	record := map[string]interface{}{}
+	for key, value := range entry.Data {
+		record[key] = value
+	}
+	record["time"] = entry.Time.UTC().Format(time.RFC3339Nano)
+	record["action"] = entry.Message
+	line, err := json.Marshal(record)
+	if err != nil {
+		return nil, err
+	}
+	return append(line, '\n'), nil
+}
+
+// rotatingFile is a file that is only appended to, and moved away to a name
+// with the time it was rotated at when it gets too large or too old
+type rotatingFile struct {
+	lock       sync.Mutex
+	path       string
+	maxSize    int64
+	interval   time.Duration
+	maxBackups int
+	file       *os.File
+	size       int64
+	opened     time.Time
+	now        func() time.Time
+}
+
+// rotatedSuffix is the time format of the names of the rotated files,
+// which sort in the order they were rotated
+const rotatedSuffix = "20060102T150405.000000000"
+
+// openRotatingFile opens the file at path for appending
+func openRotatingFile(path string, maxSize int64, interval time.Duration, maxBackups int) (*rotatingFile, error) {
+	f := &rotatingFile{path: path, maxSize: maxSize, interval: interval, maxBackups: maxBackups, now: time.Now}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *rotatingFile) open() error {
+	file, err := os.OpenFile(f.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600) // #nosec this path comes from our configuration
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	f.file, f.size, f.opened = file, info.Size(), f.now()
+	return nil
+}
+
+func (f *rotatingFile) Write(p []byte) (int, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	tooLarge := f.maxSize > 0 && f.size > 0 && f.size+int64(len(p)) > f.maxSize
+	tooOld := f.interval > 0 && f.now().Sub(f.opened) >= f.interval
+	if tooLarge || tooOld {
+		if err := f.rotate(); err != nil {
+			// The records are kept in the file that is open
+			log.Errorf("failed to rotate %s: %v", f.path, err)
+		}
+	}
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	return n, err
+}
+
+// rotate moves the file away and opens a new one, removing the oldest of
+// the rotated files beyond maxBackups
+func (f *rotatingFile) rotate() error {
+	rotated := f.path + "." + f.now().UTC().Format(rotatedSuffix)
+	if err := os.Rename(f.path, rotated); err != nil {
+		return err
+	}
+	old := f.file
+	if err := f.open(); err != nil {
+		// Go on appending to the file that was moved away
+		return err
+	}
+	old.Close()
+
+	if f.maxBackups == 0 {
+		return nil
+	}
+	backups, err := filepath.Glob(f.path + ".*")
+	if err != nil {
+		return err
+	}
+	sort.Strings(backups)
+	for len(backups) > f.maxBackups {
+		if err := os.Remove(backups[0]); err != nil {
+			return err
+		}
+		backups = backups[1:]
+	}
+	return nil
+}
+
+// Close closes the file
+func (f *rotatingFile) Close() error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.file.Close()
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+// auditRecords reads the records of the audit log file
+func auditRecords(t *testing.T, path string) []map[string]interface{} {
+	content, err := os.ReadFile(path)
+	assert.NoError(t, err)
+	var records []map[string]interface{}
+	for _, line := range strings.Split(strings.TrimSpace(string(content)), "\n") {
+		if line == "" {
+			continue
+		}
+		var record map[string]interface{}
+		assert.NoError(t, json.Unmarshal([]byte(line), &record))
+		records = append(records, record)
+	}
+	return records
+}
+
+func TestAuditLog_records(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	audit, err := newAuditLog(auditConfig{output: path})
+	assert.NoError(t, err)
+	defer audit.file.Close()
+
+	proxy := NewProxy(S3Config{}, NewAlwaysAllow(), NewMockMessenger(), new(tls.Config))
+	proxy.audit = audit
+	proxy.sendEvent(Event{Operation: "upload", Username: "user", Filepath: "user/file.c4gh", Filesize: 17, RequestID: "req-1"})
+
+	// Deletes are not enabled
+	r, _ := http.NewRequest("DELETE", "/user/file.c4gh", nil)
+	r.Header.Set("X-Request-Id", "req-2")
+	w := httptest.NewRecorder()
+	proxy.ServeHTTP(w, r)
+	assert.Equal(t, 403, w.Result().StatusCode)
+
+	records := auditRecords(t, path)
+	if assert.Len(t, records, 2) {
+		assert.Equal(t, "upload", records[0]["action"])
+		assert.Equal(t, "user/file.c4gh", records[0]["filepath"])
+		assert.Equal(t, float64(17), records[0]["filesize"])
+		assert.Equal(t, "req-1", records[0]["request_id"])
+		assert.NotEmpty(t, records[0]["time"])
+
+		assert.Equal(t, "denied", records[1]["action"])
+		assert.Equal(t, "user", records[1]["user"])
+		assert.Equal(t, "DELETE", records[1]["method"])
+		assert.Equal(t, float64(403), records[1]["status"])
+		assert.Equal(t, "req-2", records[1]["request_id"])
+	}
+
+	// Without an audit log nothing is recorded
+	audit, err = newAuditLog(auditConfig{})
+	assert.NoError(t, err)
+	assert.Nil(t, audit)
+	audit.record("upload", nil)
+}
+
+func TestAuditLog_admin(t *testing.T) {
+	resetLogging(t)
+	path := filepath.Join(t.TempDir(), "audit.log")
+	audit, err := newAuditLog(auditConfig{output: path})
+	assert.NoError(t, err)
+	defer audit.file.Close()
+	handler := audit.adminHandler(logHandler())
+
+	// Looking is not recorded, changes are
+	for _, method := range []string{"GET", "PUT"} {
+		r := httptest.NewRequest(method, "/log?level=debug", nil)
+		handler.ServeHTTP(httptest.NewRecorder(), r)
+	}
+	r := httptest.NewRequest("PUT", "/log?level=loud", nil)
+	handler.ServeHTTP(httptest.NewRecorder(), r)
+
+	records := auditRecords(t, path)
+	if assert.Len(t, records, 2) {
+		assert.Equal(t, "admin", records[0]["action"])
+		assert.Equal(t, "PUT", records[0]["method"])
+		assert.Equal(t, "/log", records[0]["path"])
+		assert.Equal(t, "level=debug", records[0]["query"])
+		assert.Equal(t, float64(200), records[0]["status"])
+		assert.Equal(t, float64(400), records[1]["status"])
+	}
+}
+
+func TestRotatingFile(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "audit.log")
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	f, err := openRotatingFile(path, 10, time.Hour, 2)
+	assert.NoError(t, err)
+	defer f.Close()
+	f.now = func() time.Time { return now }
+	f.opened = now
+
+	// The file is rotated before it would grow past the size
+	for _, line := range []string{"first\n", "second\n", "third\n"} {
+		now = now.Add(time.Second)
+		_, err = f.Write([]byte(line))
+		assert.NoError(t, err)
+	}
+	backups, _ := filepath.Glob(path + ".*")
+	assert.Len(t, backups, 2)
+	content, _ := os.ReadFile(path)
+	assert.Equal(t, "third\n", string(content))
+
+	// and when it gets too old, only the last backups are kept
+	now = now.Add(time.Hour)
+	_, err = f.Write([]byte("4\n"))
+	assert.NoError(t, err)
+	backups, _ = filepath.Glob(path + ".*")
+	if assert.Len(t, backups, 2) {
+		content, _ = os.ReadFile(backups[0])
+		assert.Equal(t, "second\n", string(content))
+		content, _ = os.ReadFile(backups[1])
+		assert.Equal(t, "third\n", string(content))
+	}
+	content, _ = os.ReadFile(path)
+	assert.Equal(t, "4\n", string(content))
+
+	// The file is appended to when it is opened again
+	f2, err := openRotatingFile(path, 0, 0, 0)
+	assert.NoError(t, err)
+	_, err = f2.Write([]byte("5\n"))
+	assert.NoError(t, err)
+	assert.NoError(t, f2.Close())
+	content, _ = os.ReadFile(path)
+	assert.Equal(t, "4\n5\n", string(content))
+}
+
+func (suite *TestSuite) TestConfigAudit() {
+	config, err := NewConfig()
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), "", config.Audit.output)
+
+	viper.Set("audit.output", "/var/log/s3inbox/audit.log")
+	viper.Set("audit.maxSize", 1024)
+	viper.Set("audit.rotateInterval", "24h")
+	viper.Set("audit.maxBackups", 7)
+	config, err = NewConfig()
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), auditConfig{
+		output:         "/var/log/s3inbox/audit.log",
+		maxSize:        1024,
+		rotateInterval: 24 * time.Hour,
+		maxBackups:     7,
+		syslogTag:      "s3inbox-audit",
+	}, config.Audit)
+
+	viper.Set("audit.maxBackups", -1)
+	_, err = NewConfig()
+	assert.Error(suite.T(), err)
+
+	viper.Set("audit.maxBackups", 0)
+	viper.Set("audit.output", "")
+	_, err = NewConfig()
+	assert.Error(suite.T(), err, "rotating without a file")
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"encoding/binary"
+)
+
+// avroSchema is the Avro schema of the events, with the fields of the JSON
+// events in the same order. Optional fields are unions with null, and the
+// static fields are in a map at the end.
+const avroSchema = `{
+  "type": "record",
+  "name": "Event",
+  "namespace": "s3inbox",
+  "fields": [
+    {"name": "operation", "type": "string"},
+    {"name": "user", "type": "string"},
+    {"name": "filepath", "type": "string"},
+    {"name": "filesize", "type": "long"},
+    {"name": "encrypted_checksums", "type": {"type": "array", "items": {
+      "type": "record", "name": "Checksum", "fields": [
+        {"name": "type", "type": "string"},
+        {"name": "value", "type": "string"}
+      ]}}},
+    {"name": "client_ip", "type": ["null", "string"], "default": null},
+    {"name": "version_id", "type": ["null", "string"], "default": null},
+    {"name": "duplicate", "type": "boolean", "default": false},
+    {"name": "decrypted_checksums", "type": {"type": "array", "items": "Checksum"}, "default": []},
+    {"name": "oldpath", "type": ["null", "string"], "default": null},
+    {"name": "schema_version", "type": ["null", "int"], "default": null},
+    {"name": "timestamp", "type": ["null", "string"], "default": null},
+    {"name": "user_agent", "type": ["null", "string"], "default": null},
+    {"name": "client_identity", "type": ["null", "string"], "default": null},
+    {"name": "fields", "type": {"type": "map", "values": "string"}, "default": {}}
+  ]
+}`
+
+// avroEvent returns the Avro binary encoding of an event with the static
+// fields
+func avroEvent(message Event, fields map[string]string) []byte {
+	var b []byte
+	b = avroString(b, message.Operation)
+	b = avroString(b, message.Username)
+	b = avroString(b, message.Filepath)
+	b = avroLong(b, message.Filesize)
+	b = avroChecksums(b, checksumsOf(message.Checksum))
+	b = avroOptionalString(b, message.ClientIP)
+	b = avroOptionalString(b, message.VersionID)
+	b = avroBoolean(b, message.Duplicate)
+	b = avroChecksums(b, checksumsOf(message.DecryptedChecksums))
+	b = avroOptionalString(b, message.OldPath)
+	if message.SchemaVersion == 0 {
+		b = avroLong(b, 0)
+	} else {
+		b = avroLong(avroLong(b, 1), int64(message.SchemaVersion))
+	}
+	b = avroOptionalString(b, message.Timestamp)
+	b = avroOptionalString(b, message.UserAgent)
+	b = avroOptionalString(b, message.ClientIdentity)
+	return avroMap(b, fields)
+}
+
+// avroLong appends an int or a long, which are zigzag varints
+func avroLong(b []byte, v int64) []byte {
+	return binary.AppendVarint(b, v)
+}
+
+func avroBoolean(b []byte, v bool) []byte {
+	if v {
+		return append(b, 1)
+	}
+	return append(b, 0)
+}
+
+// avroString appends a string, which is its length and the bytes
+func avroString(b []byte, s string) []byte {
+	return append(avroLong(b, int64(len(s))), s...)
+}
+
+// avroOptionalString appends a union of null and string, with the empty
+// string as null
+func avroOptionalString(b []byte, s string) []byte {
+	if s == "" {
+		return avroLong(b, 0)
+	}
+	return avroString(avroLong(b, 1), s)
+}
+
+// avroMap appends a map of strings, as one block of them
+func avroMap(b []byte, fields map[string]string) []byte {
+	if len(fields) > 0 {
+		b = avroLong(b, int64(len(fields)))
+		for _, name := range sortedNames(fields) {
+			b = avroString(b, name)
+			b = avroString(b, fields[name])
+		}
+	}
+	return avroLong(b, 0)
+}
+
+// avroChecksums appends an array of checksums, as one block of them
+func avroChecksums(b []byte, checksums []Checksum) []byte {
+	if len(checksums) > 0 {
+		b = avroLong(b, int64(len(checksums)))
+		for _, checksum := range checksums {
+			b = avroString(b, checksum.Type)
+			b = avroString(b, checksum.Value)
+		}
+	}
+	return avroLong(b, 0)
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAvroSchema(t *testing.T) {
+	assert.True(t, json.Valid([]byte(avroSchema)))
+}
+
+func TestAvroEvent(t *testing.T) {
+	event := Event{Operation: "upload", Username: "u", Filepath: "u/f", Filesize: 5, Checksum: []interface{}{Checksum{Type: "sha256", Value: "ab"}}}
+	expected := []byte{0x0c}
+	expected = append(expected, "upload"...)
+	expected = append(expected, 0x02, 'u', 0x06, 'u', '/', 'f', 0x0a)
+	expected = append(expected, 0x02, 0x0c)
+	expected = append(expected, "sha256"...)
+	expected = append(expected, 0x04, 'a', 'b', 0x00)
+	// client_ip, version_id, duplicate, decrypted_checksums, oldpath,
+	// schema_version, timestamp, user_agent, client_identity and fields
+	expected = append(expected, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0)
+	assert.Equal(t, expected, avroEvent(event, nil))
+
+	// Optional fields are the second branch of their unions
+	event = Event{ClientIP: "::1", Duplicate: true, SchemaVersion: 2}
+	encoded := avroEvent(event, nil)
+	assert.Equal(t, []byte{0, 0, 0, 0, 0, 0x02, 0x06, ':', ':', '1', 0, 1, 0, 0, 0x02, 0x04, 0, 0, 0, 0}, encoded)
+
+	// The static fields are a map at the end
+	encoded = avroEvent(Event{}, map[string]string{"site": "se"})
+	assert.Equal(t, []byte{0x02, 0x08, 's', 'i', 't', 'e', 0x04, 's', 'e', 0}, encoded[len(encoded)-10:])
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/service/sns"
+	snstypes "github.com/aws/aws-sdk-go-v2/service/sns/types"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	sqstypes "github.com/aws/aws-sdk-go-v2/service/sqs/types"
+	"github.com/google/uuid"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// awsMessengerConfig stores the settings of the SQS and SNS messengers. The
+// credentials and region are those of the S3 backend unless they are set in
+// the broker section.
+type awsMessengerConfig struct {
+	// queue URL for SQS, topic ARN for SNS
+	target    string
+	region    string
+	endpoint  string
+	accessKey string
+	secretKey string
+	// how long to wait for an event to be accepted
+	timeout time.Duration
+}
+
+func init() {
+	registerMessenger("sqs", messengerType{
+		required: []string{"broker.sqs.queueUrl"},
+		create: func(c BrokerConfig, tlsConfig *tls.Config) (Messenger, error) {
+			return NewSQSMessenger(c, tlsConfig), nil
+		},
+		check: checkSQS,
+	})
+	registerMessenger("sns", messengerType{
+		required: []string{"broker.sns.topicArn"},
+		create: func(c BrokerConfig, tlsConfig *tls.Config) (Messenger, error) {
+			return NewSNSMessenger(c, tlsConfig), nil
+		},
+		check: checkSNS,
+	})
+}
+
+// readAWSMessengerConfig reads the broker.sqs or broker.sns section of the
+// configuration, with the S3 backend settings as defaults
+func readAWSMessengerConfig(section, targetKey string, s3 S3Config) (awsMessengerConfig, error) {
+	a := awsMessengerConfig{
+		target:    viper.GetString(section + "." + targetKey),
+		region:    s3.region,
+		accessKey: s3.accessKey,
+		secretKey: s3.secretKey,
+		endpoint:  viper.GetString(section + ".endpoint"),
+		timeout:   10 * time.Second,
+	}
+
+	if viper.IsSet(section + ".region") {
+		a.region = viper.GetString(section + ".region")
+	}
+	if viper.IsSet(section+".accessKey") || viper.IsSet(section+".secretKey") {
+		if !(viper.IsSet(section+".accessKey") && viper.IsSet(section+".secretKey")) {
+			return a, fmt.Errorf("both %s.accessKey and %s.secretKey are needed", section, section)
+		}
+		a.accessKey = viper.GetString(section + ".accessKey")
+		a.secretKey = viper.GetString(section + ".secretKey")
+	}
+	if viper.IsSet(section + ".timeout") {
+		a.timeout = viper.GetDuration(section + ".timeout")
+		if a.timeout <= 0 {
+			return a, fmt.Errorf("%s.timeout must be positive", section)
+		}
+	}
+
+	return a, nil
+}
+
+// eventAttributes are the attributes sent along with an event, the same as
+// the headers of the Kafka messages
+func eventAttributes(message Event, corrID string, format eventFormat) map[string]string {
+	attributes := map[string]string{
+		"content-type":   format.contentType(),
+		"correlation-id": corrID,
+		"message-id":     messageID(message),
+	}
+	if message.RequestID != "" {
+		attributes["x-request-id"] = message.RequestID
+	}
+	if encoding := format.contentEncoding(""); encoding != "" {
+		attributes["content-encoding"] = encoding
+	}
+	return attributes
+}
+
+// sqsAPI is the part of the SQS client the messenger uses
+type sqsAPI interface {
+	SendMessage(ctx context.Context, params *sqs.SendMessageInput, optFns ...func(*sqs.Options)) (*sqs.SendMessageOutput, error)
+}
+
+// SQSMessenger is a Messenger that sends events to an SQS queue. Events to
+// FIFO queues are grouped by user, so the events of a user keep their order.
+type SQSMessenger struct {
+	client   sqsAPI
+	queueURL string
+	timeout  time.Duration
+	format   eventFormat
+}
+
+// newSQSClient creates a client for the configured SQS endpoint
+func newSQSClient(c BrokerConfig, tlsConfig *tls.Config) *sqs.Client {
+	options := sqs.Options{
+		Region:      c.aws.region,
+		HTTPClient:  brokerHTTPClient(c, tlsConfig),
+		Credentials: credentials.NewStaticCredentialsProvider(c.aws.accessKey, c.aws.secretKey, ""),
+	}
+	if c.aws.endpoint != "" {
+		options.BaseEndpoint = aws.String(c.aws.endpoint)
+	}
+	return sqs.New(options)
+}
+
+// NewSQSMessenger creates a new messenger that sends to an SQS queue
+func NewSQSMessenger(c BrokerConfig, tlsConfig *tls.Config) *SQSMessenger {
+	return &SQSMessenger{newSQSClient(c, tlsConfig), c.aws.target, c.aws.timeout, c.format}
+}
+
+// checkSQS verifies that the queue exists and can be reached
+func checkSQS(c BrokerConfig, tlsConfig *tls.Config) error {
+	ctx, cancel := context.WithTimeout(context.Background(), c.aws.timeout)
+	defer cancel()
+	_, err := newSQSClient(c, tlsConfig).GetQueueAttributes(ctx, &sqs.GetQueueAttributesInput{QueueUrl: aws.String(c.aws.target)})
+	return err
+}
+
+// SendMessage sends the event to the queue
+func (m *SQSMessenger) SendMessage(message Event) error {
+	body, err := m.format.encode(message)
+	if err != nil {
+		return err
+	}
+
+	corrID, _ := uuid.NewRandom()
+
+	input := &sqs.SendMessageInput{
+		QueueUrl:          aws.String(m.queueURL),
+		MessageBody:       aws.String(string(body)),
+		MessageAttributes: map[string]sqstypes.MessageAttributeValue{},
+	}
+	for name, value := range eventAttributes(message, corrID.String(), m.format) {
+		input.MessageAttributes[name] = sqstypes.MessageAttributeValue{DataType: aws.String("String"), StringValue: aws.String(value)}
+	}
+	if strings.HasSuffix(m.queueURL, ".fifo") {
+		input.MessageGroupId = aws.String(message.Username)
+		input.MessageDeduplicationId = aws.String(messageID(message))
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), m.timeout)
+	defer cancel()
+	result, err := m.client.SendMessage(ctx, input)
+	if err != nil {
+		return err
+	}
+	log.Debugf("event sent to %s as %s", m.queueURL, aws.ToString(result.MessageId))
+	return nil
+}
+
+// snsAPI is the part of the SNS client the messenger uses
+type snsAPI interface {
+	Publish(ctx context.Context, params *sns.PublishInput, optFns ...func(*sns.Options)) (*sns.PublishOutput, error)
+}
+
+// SNSMessenger is a Messenger that publishes events to an SNS topic. Events
+// to FIFO topics are grouped by user, like those to FIFO queues.
+type SNSMessenger struct {
+	client   snsAPI
+	topicARN string
+	timeout  time.Duration
+	format   eventFormat
+}
+
+// newSNSClient creates a client for the configured SNS endpoint
+func newSNSClient(c BrokerConfig, tlsConfig *tls.Config) *sns.Client {
+	options := sns.Options{
+		Region:      c.aws.region,
+		HTTPClient:  brokerHTTPClient(c, tlsConfig),
+		Credentials: credentials.NewStaticCredentialsProvider(c.aws.accessKey, c.aws.secretKey, ""),
+	}
+	if c.aws.endpoint != "" {
+		options.BaseEndpoint = aws.String(c.aws.endpoint)
+	}
+	return sns.New(options)
+}
+
+// NewSNSMessenger creates a new messenger that publishes to an SNS topic
+func NewSNSMessenger(c BrokerConfig, tlsConfig *tls.Config) *SNSMessenger {
+	return &SNSMessenger{newSNSClient(c, tlsConfig), c.aws.target, c.aws.timeout, c.format}
+}
+
+// checkSNS verifies that the topic exists and can be reached
+func checkSNS(c BrokerConfig, tlsConfig *tls.Config) error {
+	ctx, cancel := context.WithTimeout(context.Background(), c.aws.timeout)
+	defer cancel()
+	_, err := newSNSClient(c, tlsConfig).GetTopicAttributes(ctx, &sns.GetTopicAttributesInput{TopicArn: aws.String(c.aws.target)})
+	return err
+}
+
+// SendMessage publishes the event to the topic
+func (m *SNSMessenger) SendMessage(message Event) error {
+	body, err := m.format.encode(message)
+	if err != nil {
+		return err
+	}
+
+	corrID, _ := uuid.NewRandom()
+
+	input := &sns.PublishInput{
+		TopicArn:          aws.String(m.topicARN),
+		Message:           aws.String(string(body)),
+		MessageAttributes: map[string]snstypes.MessageAttributeValue{},
+	}
+	for name, value := range eventAttributes(message, corrID.String(), m.format) {
+		input.MessageAttributes[name] = snstypes.MessageAttributeValue{DataType: aws.String("String"), StringValue: aws.String(value)}
+	}
+	if strings.HasSuffix(m.topicARN, ".fifo") {
+		input.MessageGroupId = aws.String(message.Username)
+		input.MessageDeduplicationId = aws.String(messageID(message))
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), m.timeout)
+	defer cancel()
+	result, err := m.client.Publish(ctx, input)
+	if err != nil {
+		return err
+	}
+	log.Debugf("event published to %s as %s", m.topicARN, aws.ToString(result.MessageId))
+	return nil
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sns"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeSQS records the messages sent to it
+type fakeSQS struct {
+	inputs []*sqs.SendMessageInput
+	err    error
+}
+
+func (f *fakeSQS) SendMessage(_ context.Context, params *sqs.SendMessageInput, _ ...func(*sqs.Options)) (*sqs.SendMessageOutput, error) {
+	if f.err != nil {
+		return nil, f.err
+	}
+	f.inputs = append(f.inputs, params)
+	return &sqs.SendMessageOutput{MessageId: aws.String("1")}, nil
+}
+
+// fakeSNS records the messages published to it
+type fakeSNS struct {
+	inputs []*sns.PublishInput
+	err    error
+}
+
+func (f *fakeSNS) Publish(_ context.Context, params *sns.PublishInput, _ ...func(*sns.Options)) (*sns.PublishOutput, error) {
+	if f.err != nil {
+		return nil, f.err
+	}
+	f.inputs = append(f.inputs, params)
+	return &sns.PublishOutput{MessageId: aws.String("1")}, nil
+}
+
+func TestSQSMessenger_SendMessage(t *testing.T) {
+	client := &fakeSQS{}
+	m := &SQSMessenger{client: client, queueURL: "https://sqs.example.com/1/inbox", timeout: time.Second}
+
+	event := Event{Operation: "upload", Username: "user", Filepath: "user/file.c4gh", Filesize: 10, RequestID: "abc"}
+	assert.NoError(t, m.SendMessage(event))
+	if assert.Len(t, client.inputs, 1) {
+		input := client.inputs[0]
+		assert.Equal(t, "https://sqs.example.com/1/inbox", aws.ToString(input.QueueUrl))
+		assert.Equal(t, "abc", aws.ToString(input.MessageAttributes["x-request-id"].StringValue))
+		assert.NotEmpty(t, aws.ToString(input.MessageAttributes["correlation-id"].StringValue))
+		assert.Nil(t, input.MessageGroupId, "standard queues have no message groups")
+
+		var sent Event
+		assert.NoError(t, json.Unmarshal([]byte(aws.ToString(input.MessageBody)), &sent))
+		assert.Equal(t, "user/file.c4gh", sent.Filepath)
+	}
+
+	m.queueURL = "https://sqs.example.com/1/inbox.fifo"
+	assert.NoError(t, m.SendMessage(event))
+	if assert.Len(t, client.inputs, 2) {
+		assert.Equal(t, "user", aws.ToString(client.inputs[1].MessageGroupId))
+		assert.Equal(t, aws.ToString(client.inputs[1].MessageAttributes["message-id"].StringValue), aws.ToString(client.inputs[1].MessageDeduplicationId))
+	}
+
+	client.err = errors.New("AccessDenied")
+	assert.Error(t, m.SendMessage(event))
+}
+
+func TestSNSMessenger_SendMessage(t *testing.T) {
+	client := &fakeSNS{}
+	m := &SNSMessenger{client: client, topicARN: "arn:aws:sns:eu-north-1:1:inbox", timeout: time.Second}
+
+	event := Event{Operation: "upload", Username: "user", Filepath: "user/file.c4gh", Filesize: 10}
+	assert.NoError(t, m.SendMessage(event))
+	if assert.Len(t, client.inputs, 1) {
+		input := client.inputs[0]
+		assert.Equal(t, "arn:aws:sns:eu-north-1:1:inbox", aws.ToString(input.TopicArn))
+		_, ok := input.MessageAttributes["x-request-id"]
+		assert.False(t, ok, "no request id to pass on")
+		assert.Nil(t, input.MessageGroupId)
+	}
+
+	m.topicARN = "arn:aws:sns:eu-north-1:1:inbox.fifo"
+	assert.NoError(t, m.SendMessage(event))
+	if assert.Len(t, client.inputs, 2) {
+		assert.Equal(t, "user", aws.ToString(client.inputs[1].MessageGroupId))
+		assert.NotEmpty(t, aws.ToString(client.inputs[1].MessageDeduplicationId))
+	}
+
+	client.err = errors.New("NotFound")
+	assert.Error(t, m.SendMessage(event))
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	v4 "github.com/aws/aws-sdk-go-v2/aws/signer/v4"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/credentials/endpointcreds"
+	"github.com/spf13/viper"
+)
+
+// Secrets are looked up in AWS Secrets Manager or SSM Parameter Store by the
+// ARN in a Secret setting, like
+//
+//	broker.passwordSecret: "arn:aws:secretsmanager:eu-north-1:123456789012:secret:s3inbox-AbCdEf#password"
+//	aws.secretKeySecret: "arn:aws:ssm:eu-north-1:123456789012:parameter/s3inbox/secret-key"
+//
+// where #password picks a field of a secret that holds JSON. The secrets are
+// read at startup, and every secrets.refreshInterval if it is set.
+
+// secretsConfig stores the settings of the lookups in AWS
+type secretsConfig struct {
+	// endpoint replaces the one of the service, for tests and LocalStack
+	endpoint  string
+	accessKey string
+	secretKey string
+	// how often the secrets are read again, zero only reads them at startup
+	refreshInterval time.Duration
+	timeout         time.Duration
+}
+
+// readSecretsConfig reads the secrets section of the configuration
+func readSecretsConfig() (secretsConfig, error) {
+	s := secretsConfig{
+		endpoint:  viper.GetString("secrets.endpoint"),
+		accessKey: viper.GetString("secrets.accessKey"),
+		secretKey: viper.GetString("secrets.secretKey"),
+		timeout:   10 * time.Second,
+	}
+
+	if viper.IsSet("secrets.accessKey") != viper.IsSet("secrets.secretKey") {
+		return s, fmt.Errorf("both secrets.accessKey and secrets.secretKey are needed")
+	}
+	if viper.IsSet("secrets.refreshInterval") {
+		s.refreshInterval = viper.GetDuration("secrets.refreshInterval")
+		if s.refreshInterval < 0 {
+			return s, fmt.Errorf("secrets.refreshInterval can not be negative")
+		}
+	}
+	if viper.IsSet("secrets.timeout") {
+		s.timeout = viper.GetDuration("secrets.timeout")
+		if s.timeout <= 0 {
+			return s, fmt.Errorf("secrets.timeout must be positive")
+		}
+	}
+
+	return s, nil
+}
+
+// credentials returns the credentials the secrets are read with: those of
+// the secrets section, the AWS_ environment variables, or those of the ECS
+// task or EKS pod from the container credentials endpoint
+func (s secretsConfig) credentials() (aws.CredentialsProvider, error) {
+	if s.accessKey != "" {
+		return credentials.NewStaticCredentialsProvider(s.accessKey, s.secretKey, ""), nil
+	}
+	if os.Getenv("AWS_ACCESS_KEY_ID") != "" {
+		return credentials.NewStaticCredentialsProvider(os.Getenv("AWS_ACCESS_KEY_ID"), os.Getenv("AWS_SECRET_ACCESS_KEY"), os.Getenv("AWS_SESSION_TOKEN")), nil
+	}
+
+	endpoint := os.Getenv("AWS_CONTAINER_CREDENTIALS_FULL_URI")
+	if relative := os.Getenv("AWS_CONTAINER_CREDENTIALS_RELATIVE_URI"); relative != "" {
+		endpoint = "http://169.254.170.2" + relative
+	}
+	if endpoint == "" {
+		return nil, fmt.Errorf("no AWS credentials, set secrets.accessKey and secrets.secretKey or the AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY environment variables")
+	}
+	return aws.NewCredentialsCache(endpointcreds.New(endpoint, func(o *endpointcreds.Options) {
+		o.AuthorizationToken = os.Getenv("AWS_CONTAINER_AUTHORIZATION_TOKEN")
+		if file := os.Getenv("AWS_CONTAINER_AUTHORIZATION_TOKEN_FILE"); file != "" {
+			o.AuthorizationTokenProvider = endpointcreds.TokenProviderFunc(func() (string, error) {
+				token, err := os.ReadFile(file) // #nosec this file comes from the environment of the container
+				return strings.TrimSpace(string(token)), err
+			})
+		}
+	})), nil
+}
+
+// awsSecret is a secret in Secrets Manager or Parameter Store
+type awsSecret struct {
+	arn     string
+	service string
+	region  string
+	// field of a JSON secret that is the secret, empty for the whole
+	field       string
+	config      secretsConfig
+	credentials aws.CredentialsProvider
+	client      *http.Client
+
+	lock  sync.RWMutex
+	value string
+}
+
+// newAWSSecret sets up the lookup of the secret with the ARN, and an
+// optional #field of a JSON secret
+func newAWSSecret(reference string, config secretsConfig) (*awsSecret, error) {
+	arn, field, _ := strings.Cut(reference, "#")
+	// arn:partition:service:region:account:resource
+	parts := strings.SplitN(arn, ":", 6)
+	if len(parts) != 6 || parts[0] != "arn" || parts[3] == "" {
+		return nil, fmt.Errorf("%q is not the ARN of a secret", arn)
+	}
+	if parts[2] != "secretsmanager" && parts[2] != "ssm" {
+		return nil, fmt.Errorf("%q is not a Secrets Manager secret or an SSM parameter", arn)
+	}
+
+	provider, err := config.credentials()
+	if err != nil {
+		return nil, err
+	}
+	return &awsSecret{
+		arn:         arn,
+		service:     parts[2],
+		region:      parts[3],
+		field:       field,
+		config:      config,
+		credentials: provider,
+		client:      &http.Client{Timeout: config.timeout},
+	}, nil
+}
+
+func (s *awsSecret) String() string {
+	return s.arn
+}
+
+func (s *awsSecret) get() string {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.value
+}
+
+// reload looks the secret up again
+func (s *awsSecret) reload() (bool, error) {
+	value, err := s.lookup()
+	if err != nil {
+		return false, err
+	}
+	if s.field != "" {
+		var fields map[string]interface{}
+		if err := json.Unmarshal([]byte(value), &fields); err != nil {
+			return false, fmt.Errorf("secret is not JSON with the field %s: %v", s.field, err)
+		}
+		field, ok := fields[s.field].(string)
+		if !ok {
+			return false, fmt.Errorf("secret has no string field %s", s.field)
+		}
+		value = field
+	}
+	if value == "" {
+		return false, fmt.Errorf("secret is empty")
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	changed := value != s.value
+	s.value = value
+	return changed, nil
+}
+
+// lookup fetches the secret from the service, both speak JSON over POST
+// with the operation in a header
+func (s *awsSecret) lookup() (string, error) {
+	var target string
+	var request interface{}
+	if s.service == "secretsmanager" {
+		target = "secretsmanager.GetSecretValue"
+		request = map[string]interface{}{"SecretId": s.arn}
+	} else {
+		target = "AmazonSSM.GetParameter"
+		request = map[string]interface{}{"Name": s.arn, "WithDecryption": true}
+	}
+	body, err := json.Marshal(request)
+	if err != nil {
+		return "", err
+	}
+
+	endpoint := s.config.endpoint
+	if endpoint == "" {
+		endpoint = fmt.Sprintf("https://%s.%s.amazonaws.com", s.service, s.region)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), s.config.timeout)
+	defer cancel()
+	r, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint+"/", bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	r.Header.Set("Content-Type", "application/x-amz-json-1.1")
+	r.Header.Set("X-Amz-Target", target)
+
+	credentials, err := s.credentials.Retrieve(ctx)
+	if err != nil {
+		return "", fmt.Errorf("AWS credentials: %v", err)
+	}
+	payloadHash := fmt.Sprintf("%x", sha256.Sum256(body))
+	if err := v4.NewSigner().SignHTTP(ctx, credentials, r, payloadHash, s.service, s.region, time.Now()); err != nil {
+		return "", err
+	}
+
+	response, err := s.client.Do(r)
+	if err != nil {
+		return "", err
+	}
+	defer response.Body.Close()
+	responseBody, err := io.ReadAll(io.LimitReader(response.Body, 1024*1024))
+	if err != nil {
+		return "", err
+	}
+	if response.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("%s returned %s: %s", target, response.Status, strings.TrimSpace(string(responseBody)))
+	}
+
+	var result struct {
+		SecretString string
+		Parameter    struct {
+			Value string
+		}
+	}
+	if err := json.Unmarshal(responseBody, &result); err != nil {
+		return "", fmt.Errorf("%s returned unreadable JSON: %v", target, err)
+	}
+	if s.service == "secretsmanager" {
+		return result.SecretString, nil
+	}
+	return result.Parameter.Value, nil
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeSecretsService answers GetSecretValue and GetParameter with the
+// secrets by ARN
+func fakeSecretsService(t *testing.T, secrets map[string]string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.True(t, strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=access/"), "requests are signed")
+		var request map[string]interface{}
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&request))
+		switch r.Header.Get("X-Amz-Target") {
+		case "secretsmanager.GetSecretValue":
+			secret, ok := secrets[request["SecretId"].(string)]
+			if !ok {
+				w.WriteHeader(http.StatusBadRequest)
+				_, _ = w.Write([]byte(`{"__type":"ResourceNotFoundException"}`))
+				return
+			}
+			_ = json.NewEncoder(w).Encode(map[string]interface{}{"SecretString": secret})
+		case "AmazonSSM.GetParameter":
+			assert.Equal(t, true, request["WithDecryption"])
+			_ = json.NewEncoder(w).Encode(map[string]interface{}{"Parameter": map[string]interface{}{"Value": secrets[request["Name"].(string)]}})
+		default:
+			w.WriteHeader(http.StatusBadRequest)
+		}
+	}))
+}
+
+func TestAWSSecret(t *testing.T) {
+	const (
+		plain      = "arn:aws:secretsmanager:eu-north-1:123456789012:secret:plain-AbCdEf"
+		structured = "arn:aws:secretsmanager:eu-north-1:123456789012:secret:broker-AbCdEf"
+		parameter  = "arn:aws:ssm:eu-north-1:123456789012:parameter/s3inbox/secret-key"
+	)
+	secrets := map[string]string{plain: "hunter2", structured: `{"user":"inbox","password":"swordfish"}`, parameter: "paramsecret"}
+	service := fakeSecretsService(t, secrets)
+	defer service.Close()
+	config := secretsConfig{endpoint: service.URL, accessKey: "access", secretKey: "secret", timeout: time.Second}
+
+	for reference, expected := range map[string]string{plain: "hunter2", structured + "#password": "swordfish", parameter: "paramsecret"} {
+		s, err := newAWSSecret(reference, config)
+		if !assert.NoError(t, err) {
+			continue
+		}
+		changed, err := s.reload()
+		assert.NoError(t, err, reference)
+		assert.True(t, changed)
+		assert.Equal(t, expected, s.get(), reference)
+	}
+
+	// A rotated secret is picked up when it is read again
+	s, err := newAWSSecret(plain, config)
+	assert.NoError(t, err)
+	_, _ = s.reload()
+	secrets[plain] = "hunter3"
+	changed, err := s.reload()
+	assert.NoError(t, err)
+	assert.True(t, changed)
+	assert.Equal(t, "hunter3", s.get())
+
+	for _, reference := range []string{
+		"arn:aws:secretsmanager:eu-north-1:123456789012:secret:missing-AbCdEf",
+		structured + "#nosuchfield",
+		plain + "#password",
+	} {
+		s, err := newAWSSecret(reference, config)
+		assert.NoError(t, err)
+		_, err = s.reload()
+		assert.Error(t, err, reference)
+	}
+
+	for _, reference := range []string{"hunter2", "arn:aws:s3:::bucket", "arn:aws:secretsmanager::123456789012:secret:noregion"} {
+		_, err := newAWSSecret(reference, config)
+		assert.Error(t, err, reference)
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+)
+
+var backendUp = prometheus.NewGauge(prometheus.GaugeOpts{
+	Name: "s3proxy_backend_up",
+	Help: "Whether the last probe of the S3 backend bucket succeeded.",
+})
+
+func init() {
+	prometheus.MustRegister(backendUp)
+}
+
+// backendMonitor probes the bucket of the S3 backend periodically, so
+// problems with the backend show in the health checks and metrics before
+// users run into them
+type backendMonitor struct {
+	config S3Config
+	client *s3.Client
+
+	lock    sync.Mutex
+	checked bool
+	err     error
+}
+
+// newBackendMonitor creates a monitor of the bucket of the S3 backend
+func newBackendMonitor(config S3Config) *backendMonitor {
+	return &backendMonitor{
+		config: config,
+		client: newS3Client(config, &http.Client{Transport: transportConfigS3(config)}),
+	}
+}
+
+// Run probes the backend every interval until ctx is done, it should be run
+// as a go routine
+func (m *backendMonitor) Run(ctx context.Context) {
+	ticker := time.NewTicker(m.config.monitorInterval)
+	defer ticker.Stop()
+
+	for {
+		m.probe(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// probe checks that the bucket can be reached and logs when that changes
+func (m *backendMonitor) probe(ctx context.Context) {
+	ctx, cancel := s3Context(ctx, m.config)
+	defer cancel()
+	_, err := m.client.HeadBucket(ctx, &s3.HeadBucketInput{Bucket: aws.String(m.config.bucket)})
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	switch {
+	case err != nil && (m.err == nil || !m.checked):
+		log.Errorf("S3 backend is unavailable: %v", err)
+	case err == nil && m.err != nil:
+		log.Info("S3 backend is available again")
+	}
+	m.checked = true
+	m.err = err
+
+	if err != nil {
+		backendUp.Set(0)
+	} else {
+		backendUp.Set(1)
+	}
+}
+
+// Check returns the result of the latest probe, it is used as a readiness
+// check
+func (m *backendMonitor) Check() error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if !m.checked {
+		return errors.New("S3 backend not probed yet")
+	}
+	return m.err
+}
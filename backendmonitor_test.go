@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBackendMonitor(t *testing.T) {
+	status := http.StatusOK
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, http.MethodHead, r.Method)
+		w.WriteHeader(status)
+	}))
+	defer backend.Close()
+
+	s3conf := testS3Config(backend.URL)
+	s3conf.retryMaxAttempts = 1
+	m := newBackendMonitor(s3conf)
+	assert.Error(t, m.Check(), "backend should not be ready before it is probed")
+
+	m.probe(context.Background())
+	assert.NoError(t, m.Check())
+	assert.Equal(t, float64(1), testutil.ToFloat64(backendUp))
+
+	status = http.StatusForbidden
+	m.probe(context.Background())
+	assert.Error(t, m.Check())
+	assert.Equal(t, float64(0), testutil.ToFloat64(backendUp))
+
+	status = http.StatusOK
+	m.probe(context.Background())
+	assert.NoError(t, m.Check())
+}
+
+func TestBackendMonitor_Run(t *testing.T) {
+	probed := make(chan struct{}, 10)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		probed <- struct{}{}
+	}))
+	defer backend.Close()
+
+	s3conf := testS3Config(backend.URL)
+	s3conf.retryMaxAttempts = 1
+	s3conf.monitorInterval = 10 * time.Millisecond
+	m := newBackendMonitor(s3conf)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		m.Run(ctx)
+		close(done)
+	}()
+	<-probed
+	cancel()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Error("the monitor should stop when its context is done")
+	}
+
+	// Probes are made with the given context
+	m.probe(ctx)
+	assert.ErrorIs(t, m.Check(), context.Canceled)
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// backendProfile holds the known quirks of an S3 implementation, so the
+// proxy can work with MinIO, Ceph RadosGW and AWS alike. Quirks are only
+// added together with a reference to where the backend documents them.
+type backendProfile struct {
+	name string
+	// headers the backend rejects or doesn't implement, they are not
+	// passed on
+	unsupportedHeaders []string
+}
+
+var backendProfiles = map[string]backendProfile{
+	// generic makes no assumptions beyond the S3 API
+	"generic": {name: "generic"},
+	"minio":   {name: "minio"},
+	"ceph":    {name: "ceph"},
+	"aws":     {name: "aws"},
+}
+
+// getBackendProfile returns the profile of the named backend flavor
+func getBackendProfile(flavor string) (backendProfile, error) {
+	profile, ok := backendProfiles[strings.ToLower(flavor)]
+	if !ok {
+		return profile, fmt.Errorf("unknown backend flavor %q", flavor)
+	}
+	return profile, nil
+}
+
+// supportsHeader tells if the header can be sent to the backend
+func (b backendProfile) supportsHeader(header string) bool {
+	for _, h := range b.unsupportedHeaders {
+		if strings.EqualFold(h, header) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,25 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGetBackendProfile(t *testing.T) {
+	profile, err := getBackendProfile("Ceph")
+	assert.NoError(t, err)
+	assert.Equal(t, "ceph", profile.name)
+
+	_, err = getBackendProfile("swift")
+	assert.Error(t, err)
+}
+
+func TestSupportsHeader(t *testing.T) {
+	profile := backendProfile{name: "test", unsupportedHeaders: []string{"X-Amz-Request-Payer"}}
+	assert.False(t, profile.supportsHeader("x-amz-request-payer"))
+	assert.True(t, profile.supportsHeader("X-Amz-Storage-Class"))
+
+	aws, _ := getBackendProfile("aws")
+	assert.True(t, aws.supportsHeader("X-Amz-Request-Payer"))
+}
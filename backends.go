@@ -0,0 +1,132 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+
+	"github.com/spf13/viper"
+)
+
+// Besides the aws section, which is the default backend, more S3 backends
+// can be defined by name in the backends section, like
+//
+//	backends:
+//	  archive:
+//	    url: "https://s3.example.org"
+//	    bucket: "archive"
+//	    accessKeyFile: "/run/secrets/archive/access-key"
+//	    secretKeyFile: "/run/secrets/archive/secret-key"
+//
+// for other parts of the configuration to refer to. A backend has its own
+// address, bucket, region, keys and certificates, the rest of the settings,
+// like timeouts and retries, are those of the aws section.
+
+// defaultBackend is the name of the backend of the aws section
+const defaultBackend = "default"
+
+// readBackends reads the named backends of the backends section, starting
+// from the settings of the default backend
+func readBackends(base S3Config, secrets secretsConfig) (map[string]S3Config, error) {
+	names := make([]string, 0)
+	for name := range viper.GetStringMap("backends") {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	backends := make(map[string]S3Config, len(names))
+	for _, name := range names {
+		if name == defaultBackend {
+			return nil, fmt.Errorf("backends.%s: the name is taken by the aws section", name)
+		}
+		b, err := readBackend("backends."+name, base, secrets)
+		if err != nil {
+			return nil, err
+		}
+		backends[name] = b
+	}
+	return backends, nil
+}
+
+// readBackend reads the settings of one backend
+func readBackend(section string, base S3Config, secrets secretsConfig) (S3Config, error) {
+	b := base
+	b.url = viper.GetString(section + ".url")
+	b.bucket = viper.GetString(section + ".bucket")
+	if b.url == "" || b.bucket == "" {
+		return b, fmt.Errorf("%s needs both url and bucket", section)
+	}
+	if u, err := url.Parse(b.url); err != nil || u.Scheme == "" || u.Host == "" {
+		return b, fmt.Errorf("%s.url %q is not a valid URL", section, b.url)
+	}
+
+	var err error
+	if b.accessKey, b.accessKeySource, err = readSecret(section+".accessKey", secrets); err != nil {
+		return b, err
+	}
+	if b.secretKey, b.secretKeySource, err = readSecret(section+".secretKey", secrets); err != nil {
+		return b, err
+	}
+	if b.accessKey == "" || b.secretKey == "" {
+		return b, fmt.Errorf("%s needs both accessKey and secretKey", section)
+	}
+	if b.readAccessKey, b.readAccessKeySource, err = readSecret(section+".readAccessKey", secrets); err != nil {
+		return b, err
+	}
+	if b.readSecretKey, b.readSecretKeySource, err = readSecret(section+".readSecretKey", secrets); err != nil {
+		return b, err
+	}
+	if (b.readAccessKey == "") != (b.readSecretKey == "") {
+		return b, fmt.Errorf("both %s.readAccessKey and %s.readSecretKey are needed", section, section)
+	}
+
+	b.region = "us-east-1"
+	if viper.IsSet(section + ".region") {
+		b.region = viper.GetString(section + ".region")
+	}
+	// The certificates of one backend are not sent to another
+	b.readypath = viper.GetString(section + ".readypath")
+	b.cacert = viper.GetString(section + ".cacert")
+	b.clientCert = viper.GetString(section + ".clientCert")
+	b.clientKey = viper.GetString(section + ".clientKey")
+	if (b.clientCert == "") != (b.clientKey == "") {
+		return b, fmt.Errorf("both %s.clientCert and %s.clientKey are needed for client certificate authentication", section, section)
+	}
+	// Transfer acceleration is set up for the bucket of the aws section
+	b.accelerateEndpoint = ""
+
+	return b, nil
+}
+
+// backend returns the settings of the named backend, the aws section for
+// an empty name or default
+func (c *Config) backend(name string) (S3Config, error) {
+	if name == "" || strings.EqualFold(name, defaultBackend) {
+		return c.S3, nil
+	}
+	b, ok := c.Backends[strings.ToLower(name)]
+	if !ok {
+		return b, fmt.Errorf("no backend named %q", name)
+	}
+	return b, nil
+}
+
+// backendNames returns the names of the named backends in order
+func (c *Config) backendNames() []string {
+	names := make([]string, 0, len(c.Backends))
+	for name := range c.Backends {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// backendList returns the named backends ordered by name
+func (c *Config) backendList() []S3Config {
+	backends := make([]S3Config, 0, len(c.Backends))
+	for _, name := range c.backendNames() {
+		backends = append(backends, c.Backends[name])
+	}
+	return backends
+}
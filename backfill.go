@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+// backfillFlushTimeout is how long the backfill waits for the broker to
+// confirm the last events
+const backfillFlushTimeout = 5 * time.Minute
+
+// flusher is a messenger that can be waited on until the events it has
+// taken are sent
+type flusher interface {
+	flush(ctx context.Context) error
+}
+
+// newBackfillCommand creates the backfill command
+func newBackfillCommand() *cobra.Command {
+	var prefix string
+	var readBack, dryRun bool
+	cmd := &cobra.Command{
+		Use:   "backfill",
+		Short: "send upload events for the objects already in the bucket",
+		Args:  cobra.NoArgs,
+	}
+	cmd.Flags().StringVar(&prefix, "prefix", "", "only send events for the objects with keys starting with `prefix`, like user/")
+	cmd.Flags().BoolVar(&readBack, "read-back", false, "read the objects without a stored sha256 checksum to compute their checksums")
+	cmd.Flags().BoolVar(&dryRun, "dry-run", false, "log the events instead of sending them")
+	configFlags := addConfigFlags(cmd.Flags())
+	cmd.RunE = func(*cobra.Command, []string) error {
+		configFlags.apply()
+		return runBackfill(prefix, readBack, dryRun)
+	}
+	return cmd
+}
+
+// runBackfill is the backfill subcommand, it sends upload events for the
+// objects in the backend bucket that pre-date the proxy or were uploaded
+// while the events could not be sent. It takes the configuration of the
+// proxy.
+func runBackfill(prefix string, readBack, dryRun bool) error {
+	config, err := NewConfig()
+	if err != nil {
+		return err
+	}
+	tlsProxy, err := TLSConfigProxy(config)
+	if err != nil {
+		return err
+	}
+
+	var base Messenger = &DryRunMessenger{format: config.Broker.format}
+	messenger := base
+	if !dryRun {
+		tlsBroker, err := TLSConfigBroker(config)
+		if err != nil {
+			return err
+		}
+		if base, err = NewMessenger(config.Broker, tlsBroker); err != nil {
+			return err
+		}
+		if messenger, err = wrapMessenger(base, config.Broker); err != nil {
+			return err
+		}
+	}
+
+	proxy := NewProxy(config.S3, nil, messenger, tlsProxy)
+	proxy.schemaVersion = config.Broker.schemaVersion
+	proxy.c4ghKey = config.Server.c4ghKey
+	proxy.clientContext = clientContextNone
+
+	sent, err := backfill(context.Background(), proxy, prefix, readBack || config.S3.readBackChecksums)
+	if flushErr := flushEvents(base); flushErr != nil && err == nil {
+		err = flushErr
+	}
+	log.Infof("sent events for %d objects in %s", sent, config.S3.bucket)
+	return err
+}
+
+// flushEvents waits until the events the messenger, not wrapped in retries,
+// has taken are sent, for commands that stop once they have sent theirs
+func flushEvents(messenger Messenger) error {
+	f, ok := messenger.(flusher)
+	if !ok {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), backfillFlushTimeout)
+	defer cancel()
+	return f.flush(ctx)
+}
+
+// backfill sends an upload event for each object with the prefix, in the
+// order they are listed. It stops at the first event that can't be sent,
+// and returns how many were.
+func backfill(ctx context.Context, p *Proxy, prefix string, readBack bool) (int, error) {
+	paginator := s3.NewListObjectsV2Paginator(p.newS3ReadClient(), &s3.ListObjectsV2Input{
+		Bucket: aws.String(p.s3.bucket),
+		Prefix: aws.String(prefix),
+	})
+
+	sent := 0
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return sent, fmt.Errorf("listing bucket %s: %v", p.s3.bucket, err)
+		}
+		for _, object := range page.Contents {
+			key := aws.ToString(object.Key)
+			// Only files of users are uploaded through the proxy
+			username, file, _ := strings.Cut(key, "/")
+			if username == "" || file == "" || strings.HasSuffix(key, "/") {
+				log.Debugf("skipping %s, it is not a file of a user", key)
+				continue
+			}
+			event, err := p.backfillEvent(ctx, key, readBack)
+			if err != nil {
+				return sent, err
+			}
+			if err := p.messenger.SendMessage(event); err != nil {
+				return sent, fmt.Errorf("sending event of %s: %v", key, err)
+			}
+			sent++
+		}
+	}
+	return sent, nil
+}
+
+// backfillEvent creates the upload event of an object in the bucket, with
+// the sha256 checksum the backend stores or the checksums of the content
+// when it is read back
+func (p *Proxy) backfillEvent(ctx context.Context, key string, readBack bool) (Event, error) {
+	object, err := p.headObject(ctx, key, "")
+	if err != nil {
+		return Event{}, err
+	}
+	info := objectInfo{checksum: object.checksum, size: object.size}
+	if object.checksum == "" && readBack {
+		if info, err = p.objectChecksum(ctx, key, ""); err != nil {
+			return Event{}, err
+		}
+	}
+	if info.checksum == "" {
+		log.Infof("no checksum available for %s", key)
+	}
+
+	// The event is made like the one of an upload request of the object
+	r := (&http.Request{Method: http.MethodPut, URL: &url.URL{Path: "/" + p.s3.bucket + "/" + key}, Header: http.Header{}}).WithContext(ctx)
+	event := p.fileEvent(r, "upload")
+	p.setUpload(&event, info, "")
+	return event, nil
+}
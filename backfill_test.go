@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/johannesboyne/gofakes3"
+	"github.com/johannesboyne/gofakes3/backend/s3mem"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBackfill(t *testing.T) {
+	backend := httptest.NewServer(gofakes3.New(s3mem.New()).Server())
+	defer backend.Close()
+	s3conf := S3Config{url: backend.URL, accessKey: "access", secretKey: "secret", bucket: "inbox", region: "us-east-1"}
+	client := newS3Client(s3conf, http.DefaultClient)
+	ctx := context.Background()
+	_, err := client.CreateBucket(ctx, &s3.CreateBucketInput{Bucket: aws.String("inbox")})
+	assert.NoError(t, err)
+	for _, key := range []string{"alice/a.c4gh", "alice/dir/b.c4gh", "bob/c.c4gh", "loose.txt"} {
+		_, err := client.PutObject(ctx, &s3.PutObjectInput{Bucket: aws.String("inbox"), Key: aws.String(key), Body: strings.NewReader("content")})
+		assert.NoError(t, err)
+	}
+
+	messenger := &recordingMessenger{}
+	proxy := NewProxy(s3conf, nil, messenger, new(tls.Config))
+	proxy.clientContext = clientContextNone
+
+	// Only the files of users get events
+	sent, err := backfill(ctx, proxy, "alice/", true)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, sent)
+	if assert.Len(t, messenger.events, 2) {
+		event := messenger.events[0]
+		assert.Equal(t, "upload", event.Operation)
+		assert.Equal(t, "alice", event.Username)
+		assert.Equal(t, "alice/a.c4gh", event.Filepath)
+		assert.Equal(t, int64(7), event.Filesize)
+		assert.Equal(t, Checksum{Type: "sha256", Value: "ed7002b439e9ac845f22357d822bac1444730fbdb6016d3ec9432297b9ec9f73"}, event.Checksum[0])
+		assert.NotEmpty(t, event.Timestamp)
+		assert.Empty(t, event.ClientIP)
+		assert.Equal(t, "alice/dir/b.c4gh", messenger.events[1].Filepath)
+	}
+
+	// Without reading them back there may be no checksums
+	messenger.events = nil
+	sent, err = backfill(ctx, proxy, "", false)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, sent)
+	assert.Equal(t, "bob/c.c4gh", messenger.events[2].Filepath)
+	assert.Equal(t, int64(7), messenger.events[2].Filesize)
+}
@@ -1,61 +1,150 @@
 package main
 
 import (
+	"context"
 	"crypto/tls"
 	"crypto/x509"
 	"io/ioutil"
 	"net/http"
 	"reflect"
-	"strings"
+	"time"
 
 	"github.com/pkg/errors"
 	log "github.com/sirupsen/logrus"
 
-	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/awserr"
-	"github.com/aws/aws-sdk-go/aws/credentials"
-	"github.com/aws/aws-sdk-go/aws/session"
-	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/smithy-go"
+	smithyhttp "github.com/aws/smithy-go/transport/http"
 )
 
+// checkS3Bucket verifies that the backend bucket is there. The bucket is
+// created, and configured, if it is missing and creation is enabled.
 func checkS3Bucket(config S3Config) error {
 	s3Transport := transportConfigS3(config)
-	client := http.Client{Transport: s3Transport}
-	s3Session := session.Must(session.NewSession(
-		&aws.Config{
-			Endpoint:         aws.String(config.url),
-			Region:           aws.String(config.region),
-			HTTPClient:       &client,
-			S3ForcePathStyle: aws.Bool(true),
-			DisableSSL:       aws.Bool(strings.HasPrefix(config.url, "http:")),
-			Credentials:      credentials.NewStaticCredentials(config.accessKey, config.secretKey, ""),
-		},
-	))
-
-	_, err := s3.New(s3Session).CreateBucket(&s3.CreateBucketInput{
+	client := newS3Client(config, &http.Client{Transport: s3Transport})
+	ctx, cancel := s3Context(context.Background(), config)
+	defer cancel()
+
+	if !config.createBucket {
+		_, err := client.HeadBucket(ctx, &s3.HeadBucketInput{
+			Bucket: aws.String(config.bucket),
+		})
+		if err != nil {
+			return errors.Errorf("Bucket %s is not accessible: %v", config.bucket, err)
+		}
+		return nil
+	}
+
+	input := &s3.CreateBucketInput{
 		Bucket: aws.String(config.bucket),
-	})
+	}
+	if config.objectLockMode != "" || config.objectLockLegalHold {
+		// Object lock can only be enabled when the bucket is created
+		input.ObjectLockEnabledForBucket = aws.Bool(true)
+	}
+	_, err := client.CreateBucket(ctx, input)
 	log.Infoln(err)
 	if err != nil {
-		if aerr, ok := err.(awserr.Error); ok {
-			if aerr.Code() != s3.ErrCodeBucketAlreadyOwnedByYou &&
-				aerr.Code() != s3.ErrCodeBucketAlreadyExists {
-				return errors.Errorf("Unexpected issue while creating bucket: %v", err)
-			}
+		var owned *types.BucketAlreadyOwnedByYou
+		var exists *types.BucketAlreadyExists
+		if errors.As(err, &owned) || errors.As(err, &exists) {
 			return nil
 		}
+		var apiErr smithy.APIError
+		if errors.As(err, &apiErr) {
+			return errors.Errorf("Unexpected issue while creating bucket: %v", err)
+		}
 		return errors.New("Verifying bucket failed, check S3 configuration")
 	}
 
+	log.Infof("created bucket %s", config.bucket)
+	return configureBucket(ctx, client, config)
+}
+
+// configureBucket applies the configured versioning and default encryption
+// to a newly created bucket. Existing buckets are left as they are.
+func configureBucket(ctx context.Context, client *s3.Client, config S3Config) error {
+	if config.bucketVersioning {
+		_, err := client.PutBucketVersioning(ctx, &s3.PutBucketVersioningInput{
+			Bucket: aws.String(config.bucket),
+			VersioningConfiguration: &types.VersioningConfiguration{
+				Status: types.BucketVersioningStatusEnabled,
+			},
+		})
+		if err != nil {
+			return errors.Errorf("Failed to enable versioning on bucket %s: %v", config.bucket, err)
+		}
+	}
+
+	if config.bucketEncryption != "" {
+		rule := &types.ServerSideEncryptionByDefault{
+			SSEAlgorithm: types.ServerSideEncryption(config.bucketEncryption),
+		}
+		if config.bucketKMSKeyID != "" {
+			rule.KMSMasterKeyID = aws.String(config.bucketKMSKeyID)
+		}
+		_, err := client.PutBucketEncryption(ctx, &s3.PutBucketEncryptionInput{
+			Bucket: aws.String(config.bucket),
+			ServerSideEncryptionConfiguration: &types.ServerSideEncryptionConfiguration{
+				Rules: []types.ServerSideEncryptionRule{{ApplyServerSideEncryptionByDefault: rule}},
+			},
+		})
+		if err != nil {
+			return errors.Errorf("Failed to set encryption on bucket %s: %v", config.bucket, err)
+		}
+	}
+
 	return nil
 }
 
+// newS3Client creates a client for the S3 backend that sends its requests
+// with the given http client.
+func newS3Client(config S3Config, client *http.Client) *s3.Client {
+	options := s3.Options{
+		BaseEndpoint:     aws.String(config.url),
+		Region:           config.region,
+		UsePathStyle:     !config.virtualHosted,
+		HTTPClient:       client,
+		Credentials:      s3Credentials(config),
+		RetryMaxAttempts: config.retryMaxAttempts,
+	}
+	if config.requesterPays {
+		options.APIOptions = append(options.APIOptions, smithyhttp.SetHeaderValue("X-Amz-Request-Payer", "requester"))
+	}
+	return s3.New(options)
+}
+
+// s3Credentials provides the keys of the backend, which are looked up for
+// every request when they are read from where they may change
+func s3Credentials(config S3Config) aws.CredentialsProvider {
+	if config.accessKeySource == nil && config.secretKeySource == nil {
+		return credentials.NewStaticCredentialsProvider(config.accessKey, config.secretKey, "")
+	}
+	return aws.CredentialsProviderFunc(func(context.Context) (aws.Credentials, error) {
+		accessKey, secretKey := config.keys()
+		// Expiring right away makes the cache of the SDK ask every time
+		return aws.Credentials{AccessKeyID: accessKey, SecretAccessKey: secretKey, Source: "rotating secrets", CanExpire: true, Expires: time.Now()}, nil
+	})
+}
+
+// s3Context limits ctx with the configured timeout for S3 requests
+func s3Context(ctx context.Context, config S3Config) (context.Context, context.CancelFunc) {
+	if config.timeout > 0 {
+		return context.WithTimeout(ctx, config.timeout)
+	}
+	return context.WithCancel(ctx)
+}
+
 // transportConfigS3 is a helper method to setup TLS for the S3 client.
 func transportConfigS3(config S3Config) http.RoundTripper {
 	cfg := new(tls.Config)
 
-	// Enforce TLS1.2 or higher
-	cfg.MinVersion = 2
+	// Enforce TLS1.2 or higher, unless configured otherwise
+	cfg.MinVersion = tls.VersionTLS12
+	config.tls.apply(cfg)
 
 	// Read system CAs
 	var systemCAs, _ = x509.SystemCertPool()
@@ -75,8 +164,17 @@ func transportConfigS3(config S3Config) http.RoundTripper {
 		}
 	}
 
+	if config.clientCert != "" && config.clientKey != "" {
+		cert, e := tls.LoadX509KeyPair(config.clientCert, config.clientKey)
+		if e != nil {
+			log.Fatalf("failed to load client certificate %q: %v", config.clientCert, e)
+		}
+		cfg.Certificates = append(cfg.Certificates, cert)
+	}
+
 	var trConfig http.RoundTripper = &http.Transport{
 		TLSClientConfig:   cfg,
+		Proxy:             httpProxyFunc(config.proxy, config.proxyFromEnvironment),
 		ForceAttemptHTTP2: true}
 
 	return trConfig
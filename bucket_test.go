@@ -1,12 +1,17 @@
 package main
 
 import (
+	"context"
+	"net/http"
 	"net/http/httptest"
 	"os"
 	"testing"
 
 	log "github.com/sirupsen/logrus"
 
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
 	"github.com/johannesboyne/gofakes3"
 	"github.com/johannesboyne/gofakes3/backend/s3mem"
 	"github.com/spf13/viper"
@@ -70,3 +75,40 @@ func (suite *TestSuite) TestBucketFail() {
 	err = checkS3Bucket(config.S3)
 	assert.Error(suite.T(), err)
 }
+
+func (suite *TestSuite) TestBucketNoCreate() {
+	viper.Set("aws.url", ts.URL)
+	viper.Set("aws.bucket", "notcreated")
+	viper.Set("aws.createBucket", false)
+	config, err := NewConfig()
+	assert.NoError(suite.T(), err)
+
+	err = checkS3Bucket(config.S3)
+	assert.Error(suite.T(), err, "missing bucket should not be created")
+
+	viper.Set("aws.createBucket", true)
+	config, err = NewConfig()
+	assert.NoError(suite.T(), err)
+	assert.NoError(suite.T(), checkS3Bucket(config.S3))
+
+	viper.Set("aws.createBucket", false)
+	config, err = NewConfig()
+	assert.NoError(suite.T(), err)
+	assert.NoError(suite.T(), checkS3Bucket(config.S3))
+}
+
+func (suite *TestSuite) TestBucketVersioning() {
+	viper.Set("aws.url", ts.URL)
+	viper.Set("aws.bucket", "versioned")
+	viper.Set("aws.bucketVersioning", true)
+	config, err := NewConfig()
+	assert.NoError(suite.T(), err)
+
+	err = checkS3Bucket(config.S3)
+	assert.NoError(suite.T(), err)
+
+	client := newS3Client(config.S3, http.DefaultClient)
+	versioning, err := client.GetBucketVersioning(context.Background(), &s3.GetBucketVersioningInput{Bucket: aws.String("versioned")})
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), types.BucketVersioningStatusEnabled, versioning.Status)
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"encoding/xml"
+	"net/http"
+	"strings"
+)
+
+// s3Namespace is the XML namespace of S3 responses
+const s3Namespace = "http://s3.amazonaws.com/doc/2006-03-01/"
+
+// bucketInfoResources are the subresources of the user's bucket that are
+// answered by the proxy from its configuration. Clients like mc and rclone
+// ask for them before they start uploading.
+var bucketInfoResources = []string{"location", "versioning", "requestPayment", "accelerate"}
+
+// bucketInfoResource returns the informational subresource the request asks
+// for, if it is a GET of one for the user's bucket
+func bucketInfoResource(r *http.Request) (string, bool) {
+	if r.Method != http.MethodGet || strings.Contains(strings.Trim(r.URL.Path, "/"), "/") {
+		return "", false
+	}
+	query := r.URL.Query()
+	for _, resource := range bucketInfoResources {
+		if _, ok := query[resource]; ok {
+			return resource, true
+		}
+	}
+	return "", false
+}
+
+// bucketInfoResponse answers informational requests for the user's bucket
+// without asking the backend, the user's "bucket" is a prefix in the
+// backend bucket and shares its settings
+func (p *Proxy) bucketInfoResponse(w http.ResponseWriter, r *http.Request) {
+	if err := p.auth.Authenticate(r); err != nil {
+		requestLog(r).Debugf("Request not authenticated (%v)", err)
+		p.notAuthorized(w, r)
+		return
+	}
+
+	resource, _ := bucketInfoResource(r)
+	requestLog(r).Debugf("answering %s request for bucket", resource)
+
+	var body interface{}
+	switch resource {
+	case "location":
+		// us-east-1 is the default location, which is told with an empty
+		// constraint
+		location := p.s3.region
+		if location == "us-east-1" {
+			location = ""
+		}
+		body = struct {
+			XMLName  xml.Name `xml:"LocationConstraint"`
+			Xmlns    string   `xml:"xmlns,attr"`
+			Location string   `xml:",chardata"`
+		}{Xmlns: s3Namespace, Location: location}
+	case "versioning":
+		status := ""
+		if p.s3.bucketVersioning {
+			status = "Enabled"
+		}
+		body = struct {
+			XMLName xml.Name `xml:"VersioningConfiguration"`
+			Xmlns   string   `xml:"xmlns,attr"`
+			Status  string   `xml:",omitempty"`
+		}{Xmlns: s3Namespace, Status: status}
+	case "requestPayment":
+		payer := "BucketOwner"
+		if p.s3.requesterPays {
+			payer = "Requester"
+		}
+		body = struct {
+			XMLName xml.Name `xml:"RequestPaymentConfiguration"`
+			Xmlns   string   `xml:"xmlns,attr"`
+			Payer   string
+		}{Xmlns: s3Namespace, Payer: payer}
+	case "accelerate":
+		status := ""
+		if p.s3.accelerateEndpoint != "" {
+			status = "Enabled"
+		}
+		body = struct {
+			XMLName xml.Name `xml:"AccelerateConfiguration"`
+			Xmlns   string   `xml:"xmlns,attr"`
+			Status  string   `xml:",omitempty"`
+		}{Xmlns: s3Namespace, Status: status}
+	}
+
+	data, err := xml.Marshal(body)
+	if err != nil {
+		p.internalServerError(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write([]byte(xml.Header))
+	_, _ = w.Write(data)
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBucketInfoResource(t *testing.T) {
+	for path, expected := range map[string]string{
+		"/username?location":        "location",
+		"/username/?versioning":     "versioning",
+		"/username?requestPayment":  "requestPayment",
+		"/username/?accelerate":     "accelerate",
+		"/username/file?location":   "",
+		"/username/?delimiter=/":    "",
+		"/username/?uploads&prefix": "",
+	} {
+		r, _ := http.NewRequest("GET", path, nil)
+		resource, ok := bucketInfoResource(r)
+		assert.Equal(t, expected, resource, path)
+		assert.Equal(t, expected != "", ok, path)
+	}
+
+	r, _ := http.NewRequest("PUT", "/username?versioning", nil)
+	_, ok := bucketInfoResource(r)
+	assert.False(t, ok)
+}
+
+func TestServeHTTP_bucketInfo(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("unexpected backend request %s %s", r.Method, r.URL)
+	}))
+	defer backend.Close()
+
+	s3conf := S3Config{
+		url:              backend.URL,
+		bucket:           "buckbuck",
+		region:           "eu-north-1",
+		bucketVersioning: true,
+	}
+	proxy := NewProxy(s3conf, NewAlwaysAllow(), NewMockMessenger(), new(tls.Config))
+
+	for path, expected := range map[string]string{
+		"/username?location":        `<LocationConstraint xmlns="http://s3.amazonaws.com/doc/2006-03-01/">eu-north-1</LocationConstraint>`,
+		"/username/?versioning":     `<VersioningConfiguration xmlns="http://s3.amazonaws.com/doc/2006-03-01/"><Status>Enabled</Status></VersioningConfiguration>`,
+		"/username/?requestPayment": `<RequestPaymentConfiguration xmlns="http://s3.amazonaws.com/doc/2006-03-01/"><Payer>BucketOwner</Payer></RequestPaymentConfiguration>`,
+		"/username/?accelerate":     `<AccelerateConfiguration xmlns="http://s3.amazonaws.com/doc/2006-03-01/"></AccelerateConfiguration>`,
+	} {
+		r, _ := http.NewRequest("GET", path, nil)
+		w := httptest.NewRecorder()
+		proxy.ServeHTTP(w, r)
+		assert.Equal(t, 200, w.Code, path)
+		assert.Contains(t, w.Body.String(), expected, path)
+	}
+
+	// The default region has an empty location
+	proxy.s3.region = "us-east-1"
+	r, _ := http.NewRequest("GET", "/username?location", nil)
+	w := httptest.NewRecorder()
+	proxy.ServeHTTP(w, r)
+	assert.Contains(t, w.Body.String(), `<LocationConstraint xmlns="http://s3.amazonaws.com/doc/2006-03-01/"></LocationConstraint>`)
+
+	// Users must still authenticate
+	proxy = NewProxy(s3conf, &AlwaysDeny{}, NewMockMessenger(), new(tls.Config))
+	r, _ = http.NewRequest("GET", "/username?location", nil)
+	w = httptest.NewRecorder()
+	proxy.ServeHTTP(w, r)
+	assert.Equal(t, 401, w.Code)
+}
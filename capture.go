@@ -0,0 +1,256 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// For debugging, the requests to the proxy and its responses can be
+// captured, with the secrets in them redacted and without the bodies. The
+// captures are kept in memory, the last captureBuffer of them, and written
+// to captureDir if it is set:
+//
+//	debug:
+//	  capture: true
+//	  captureDir: "/var/tmp/s3inbox-captures"
+//	  captureBuffer: 100
+//
+// Capturing is switched on and off while the proxy runs, on the admin
+// endpoints:
+//
+//	GET /debug/capture lists the captures in memory
+//	PUT /debug/capture?enabled=true starts capturing, false stops it
+
+// defaultCaptureBuffer is how many captures are kept in memory when they
+// are not written to a directory
+const defaultCaptureBuffer = 50
+
+// redactedHeaders are the headers whose values are not captured
+var redactedHeaders = []string{
+	"Authorization", "Proxy-Authorization", "Cookie", "Set-Cookie",
+	"X-Amz-Security-Token", "X-Amz-Server-Side-Encryption-Customer-Key",
+	"X-Amz-Copy-Source-Server-Side-Encryption-Customer-Key",
+}
+
+// redactedParameters are the query parameters whose values are not
+// captured, those of presigned URLs
+var redactedParameters = []string{"X-Amz-Signature", "X-Amz-Credential", "X-Amz-Security-Token", "token"}
+
+// debugConfig stores the settings of the debug section
+type debugConfig struct {
+	// capture the requests from startup
+	capture bool
+	// directory the captures are written to, empty for none
+	captureDir string
+	// how many captures are kept in memory
+	captureBuffer int
+	// internal address the profiles are served on, empty for none
+	pprofListen string
+}
+
+// readDebugConfig reads the debug section of the configuration
+func readDebugConfig() (debugConfig, error) {
+	c := debugConfig{
+		capture:       viper.GetBool("debug.capture"),
+		captureDir:    viper.GetString("debug.captureDir"),
+		captureBuffer: defaultCaptureBuffer,
+	}
+	if c.captureDir != "" {
+		c.captureBuffer = 0
+	}
+	if viper.IsSet("debug.captureBuffer") {
+		c.captureBuffer = viper.GetInt("debug.captureBuffer")
+	}
+	if c.captureBuffer < 0 {
+		return c, fmt.Errorf("debug.captureBuffer can not be negative")
+	}
+	if viper.GetBool("debug.pprof") {
+		c.pprofListen = "localhost:6060"
+		if viper.IsSet("debug.pprofListen") {
+			c.pprofListen = viper.GetString("debug.pprofListen")
+		}
+		if host, _, err := net.SplitHostPort(c.pprofListen); err != nil || host == "" {
+			return c, fmt.Errorf("debug.pprofListen %q must be an internal host and port, like localhost:6060", c.pprofListen)
+		}
+	}
+	return c, nil
+}
+
+// capturedExchange is a captured request and the response to it
+type capturedExchange struct {
+	Time      time.Time `json:"time"`
+	RequestID string    `json:"request_id,omitempty"`
+	Request   string    `json:"request"`
+	Response  string    `json:"response"`
+}
+
+// debugCapture captures the requests that pass through it while it is
+// enabled
+type debugCapture struct {
+	lock    sync.Mutex
+	enabled bool
+	dir     string
+	// the last captures, oldest first
+	buffer []capturedExchange
+	size   int
+}
+
+// newDebugCapture sets up the capture of the configuration
+func newDebugCapture(c debugConfig) (*debugCapture, error) {
+	if c.captureDir != "" {
+		if err := os.MkdirAll(c.captureDir, 0700); err != nil {
+			return nil, fmt.Errorf("debug.captureDir: %v", err)
+		}
+	}
+	return &debugCapture{enabled: c.capture, dir: c.captureDir, size: c.captureBuffer}, nil
+}
+
+// isEnabled tells if requests are captured
+func (c *debugCapture) isEnabled() bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.enabled
+}
+
+// setEnabled starts or stops capturing
+func (c *debugCapture) setEnabled(enabled bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if enabled != c.enabled {
+		log.Warnf("capture of requests enabled: %v", enabled)
+	}
+	c.enabled = enabled
+}
+
+// captures returns the captures kept in memory, oldest first
+func (c *debugCapture) captures() []capturedExchange {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return append([]capturedExchange{}, c.buffer...)
+}
+
+// wrap captures the requests to the handler and its responses
+func (c *debugCapture) wrap(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !c.isEnabled() {
+			handler.ServeHTTP(w, r)
+			return
+		}
+		exchange := capturedExchange{Time: time.Now().UTC(), Request: dumpRequest(r)}
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		handler.ServeHTTP(recorder, r)
+		exchange.RequestID = w.Header().Get("X-Amz-Request-Id")
+		exchange.Response = dumpResponse(recorder.status, w.Header())
+		c.add(exchange)
+	})
+}
+
+// add keeps the capture and writes it to the directory
+func (c *debugCapture) add(exchange capturedExchange) {
+	c.lock.Lock()
+	if c.size > 0 {
+		if len(c.buffer) == c.size {
+			c.buffer = c.buffer[1:]
+		}
+		c.buffer = append(c.buffer, exchange)
+	}
+	c.lock.Unlock()
+
+	if c.dir == "" {
+		return
+	}
+	name := exchange.Time.Format("20060102T150405.000000000")
+	if exchange.RequestID != "" {
+		name += "-" + exchange.RequestID
+	}
+	content := exchange.Request + "\n" + exchange.Response
+	path := filepath.Join(c.dir, name+".dump")
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		log.Warnf("failed to write capture of request %s: %v", exchange.RequestID, err)
+	}
+}
+
+// dumpRequest returns the request line and headers of the request, with
+// the secrets redacted
+func dumpRequest(r *http.Request) string {
+	redactedRequest := r.Clone(r.Context())
+	redactedRequest.Header = redactHeaders(r.Header)
+	u := *r.URL
+	query := u.Query()
+	for _, parameter := range redactedParameters {
+		if query.Has(parameter) {
+			query.Set(parameter, redacted)
+		}
+	}
+	u.RawQuery = query.Encode()
+	redactedRequest.URL = &u
+	redactedRequest.RequestURI = ""
+	dump, err := httputil.DumpRequest(redactedRequest, false)
+	if err != nil {
+		return fmt.Sprintf("request not captured: %v", err)
+	}
+	return string(dump)
+}
+
+// dumpResponse returns the status line and headers of a response, with
+// the secrets redacted
+func dumpResponse(status int, header http.Header) string {
+	var dump bytes.Buffer
+	fmt.Fprintf(&dump, "HTTP/1.1 %s %s\r\n", strconv.Itoa(status), http.StatusText(status))
+	_ = redactHeaders(header).Write(&dump)
+	dump.WriteString("\r\n")
+	return dump.String()
+}
+
+// redactHeaders returns a copy of the headers with the values of the
+// secret ones redacted
+func redactHeaders(header http.Header) http.Header {
+	redactedHeader := header.Clone()
+	for _, name := range redactedHeaders {
+		if _, ok := redactedHeader[name]; ok {
+			redactedHeader.Set(name, redacted)
+		}
+	}
+	return redactedHeader
+}
+
+// captureHandler serves the captures in memory and switches capturing on
+// and off with a PUT with the enabled parameter
+func captureHandler(c *debugCapture) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+		case http.MethodPut, http.MethodPost:
+			enabled, err := strconv.ParseBool(strings.TrimSpace(r.FormValue("enabled")))
+			if err != nil {
+				http.Error(w, "enabled must be true or false", http.StatusBadRequest)
+				return
+			}
+			c.setEnabled(enabled)
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(struct {
+			Enabled  bool               `json:"enabled"`
+			Captures []capturedExchange `json:"captures"`
+		}{c.isEnabled(), c.captures()}); err != nil {
+			log.Errorf("writing capture response: %v", err)
+		}
+	})
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDebugCapture(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "captures")
+	capture, err := newDebugCapture(debugConfig{captureDir: dir, captureBuffer: 2})
+	assert.NoError(t, err)
+	handler := capture.wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Amz-Request-Id", "req-"+r.URL.Query().Get("n"))
+		w.Header().Set("Set-Cookie", "session=secret")
+		w.WriteHeader(http.StatusForbidden)
+	}))
+
+	// Nothing is captured until it is enabled
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/user/file?n=0", nil))
+	assert.Empty(t, capture.captures())
+
+	capture.setEnabled(true)
+	for _, n := range []string{"1", "2", "3"} {
+		r := httptest.NewRequest("PUT", "/user/file?n="+n+"&X-Amz-Signature=abcdef", nil)
+		r.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential=access/20240501/us-east-1/s3/aws4_request, Signature=abcdef")
+		r.Header.Set("X-Amz-Security-Token", "sessiontoken")
+		handler.ServeHTTP(httptest.NewRecorder(), r)
+	}
+
+	// The last ones are kept in memory, all are written to the directory
+	captures := capture.captures()
+	if assert.Len(t, captures, 2) {
+		assert.Equal(t, "req-2", captures[0].RequestID)
+		assert.Equal(t, "req-3", captures[1].RequestID)
+		assert.Contains(t, captures[1].Request, "PUT /user/file?")
+		assert.Contains(t, captures[1].Request, "Authorization: "+redacted)
+		assert.Contains(t, captures[1].Response, "HTTP/1.1 403 Forbidden")
+		for _, dump := range []string{captures[1].Request, captures[1].Response} {
+			for _, secret := range []string{"abcdef", "sessiontoken", "session=secret"} {
+				assert.NotContains(t, dump, secret)
+			}
+		}
+	}
+	files, _ := filepath.Glob(filepath.Join(dir, "*-req-*.dump"))
+	assert.Len(t, files, 3)
+	if len(files) > 0 {
+		content, _ := os.ReadFile(files[0])
+		assert.Contains(t, string(content), "X-Amz-Security-Token: "+redacted)
+	}
+}
+
+func TestCaptureHandler(t *testing.T) {
+	capture, err := newDebugCapture(debugConfig{captureBuffer: defaultCaptureBuffer})
+	assert.NoError(t, err)
+	handler := captureHandler(capture)
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("PUT", "/debug/capture?enabled=true", nil))
+	assert.Equal(t, 200, w.Code)
+	assert.True(t, capture.isEnabled())
+
+	capture.wrap(http.NotFoundHandler()).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/user/file", nil))
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/debug/capture", nil))
+	var listing struct {
+		Enabled  bool               `json:"enabled"`
+		Captures []capturedExchange `json:"captures"`
+	}
+	assert.NoError(t, json.NewDecoder(w.Body).Decode(&listing))
+	assert.True(t, listing.Enabled)
+	assert.Len(t, listing.Captures, 1)
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("PUT", "/debug/capture?enabled=maybe", nil))
+	assert.Equal(t, 400, w.Code)
+	assert.True(t, capture.isEnabled())
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("PUT", "/debug/capture?enabled=false", nil))
+	assert.False(t, capture.isEnabled())
+}
+
+func (suite *TestSuite) TestConfigDebug() {
+	config, err := NewConfig()
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), debugConfig{captureBuffer: defaultCaptureBuffer}, config.Debug)
+
+	viper.Set("debug.capture", true)
+	viper.Set("debug.captureDir", "/var/tmp/captures")
+	config, err = NewConfig()
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), debugConfig{capture: true, captureDir: "/var/tmp/captures"}, config.Debug)
+
+	viper.Set("debug.captureBuffer", -1)
+	_, err = NewConfig()
+	assert.Error(suite.T(), err)
+}
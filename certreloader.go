@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// CertReloader keeps the server certificate in sync with the certificate and
+// key files on disk, so rotated certificates are picked up without a restart.
+// Connections that are already established keep using the old certificate.
+type CertReloader struct {
+	certFile string
+	keyFile  string
+	lock     sync.RWMutex
+	cert     *tls.Certificate
+	modTime  time.Time
+}
+
+// NewCertReloader loads the certificate and key from the given files
+func NewCertReloader(certFile, keyFile string) (*CertReloader, error) {
+	c := &CertReloader{certFile: certFile, keyFile: keyFile}
+	if err := c.reload(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// reload reads the certificate and key from disk and replaces the one
+// currently in use.
+func (c *CertReloader) reload() error {
+	modTime, err := c.lastModified()
+	if err != nil {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return err
+	}
+
+	c.lock.Lock()
+	c.cert = &cert
+	c.modTime = modTime
+	c.lock.Unlock()
+
+	return nil
+}
+
+// lastModified returns the latest modification time of the certificate and
+// the key file.
+func (c *CertReloader) lastModified() (time.Time, error) {
+	var latest time.Time
+	for _, f := range []string{c.certFile, c.keyFile} {
+		fi, err := os.Stat(f)
+		if err != nil {
+			return latest, err
+		}
+		if fi.ModTime().After(latest) {
+			latest = fi.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+// GetCertificate returns the current certificate, it is meant to be used as
+// the GetCertificate callback of a tls.Config.
+func (c *CertReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.cert, nil
+}
+
+// Watch reloads the certificate whenever the files change on disk, which is
+// checked every interval, or when the process receives SIGHUP. It should be
+// run as a go routine, and returns when ctx is done.
+func (c *CertReloader) Watch(ctx context.Context, interval time.Duration) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+			log.Info("SIGHUP received, reloading server certificate")
+		case <-ticker.C:
+			modTime, err := c.lastModified()
+			if err != nil {
+				log.Errorf("failed to check server certificate: %v", err)
+				continue
+			}
+			c.lock.RLock()
+			changed := modTime.After(c.modTime)
+			c.lock.RUnlock()
+			if !changed {
+				continue
+			}
+			log.Info("server certificate changed on disk, reloading")
+		}
+
+		// Keep serving the old certificate if the new one is broken, it might
+		// be caught in the middle of an update
+		if err := c.reload(); err != nil {
+			log.Errorf("failed to reload server certificate: %v", err)
+		}
+	}
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func copyFile(t *testing.T, src, dst string) {
+	data, err := ioutil.ReadFile(src)
+	assert.NoError(t, err)
+	assert.NoError(t, ioutil.WriteFile(dst, data, 0600))
+}
+
+func TestCertReloader(t *testing.T) {
+	dir, err := ioutil.TempDir("", "certs")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	certFile := filepath.Join(dir, "server.crt")
+	keyFile := filepath.Join(dir, "server.key")
+	copyFile(t, "dev_utils/certs/proxy.crt", certFile)
+	copyFile(t, "dev_utils/certs/proxy.key", keyFile)
+
+	c, err := NewCertReloader(certFile, keyFile)
+	assert.NoError(t, err)
+	first, err := c.GetCertificate(nil)
+	assert.NoError(t, err)
+	assert.NotNil(t, first)
+
+	// Rotate the certificate and make sure it is picked up
+	copyFile(t, "dev_utils/certs/s3.crt", certFile)
+	copyFile(t, "dev_utils/certs/s3.key", keyFile)
+	later := time.Now().Add(time.Second)
+	assert.NoError(t, os.Chtimes(certFile, later, later))
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		c.Watch(ctx, 10*time.Millisecond)
+		close(done)
+	}()
+	time.Sleep(100 * time.Millisecond)
+	cancel()
+	<-done
+
+	second, err := c.GetCertificate(nil)
+	assert.NoError(t, err)
+	assert.NotEqual(t, first.Certificate[0], second.Certificate[0])
+
+	_, err = NewCertReloader(filepath.Join(dir, "missing.crt"), keyFile)
+	assert.Error(t, err)
+}
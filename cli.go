@@ -0,0 +1,118 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+	"github.com/spf13/viper"
+)
+
+// newRootCommand creates the s3inbox command with its subcommands. Without
+// a subcommand the proxy is run, as with serve.
+func newRootCommand() *cobra.Command {
+	root := newServeCommand()
+	root.Use = "s3inbox"
+	root.Long = "s3inbox is an S3 proxy for uploads to the inbox of the archive, it runs the proxy unless told otherwise"
+	root.Version = currentVersion().String()
+	root.SetVersionTemplate("{{.Version}}\n")
+	// The errors are logged by main, the usage is shown with -h
+	root.SilenceErrors = true
+	root.SilenceUsage = true
+	root.AddCommand(
+		newServeCommand(),
+		newCheckCommand(),
+		newBackfillCommand(),
+		newReplayCommand(),
+		newConfigDumpCommand(),
+		newVersionCommand(),
+		newSchemaCommand(),
+	)
+	return root
+}
+
+// runCommand runs the subcommand named first in the arguments with the rest
+// of them
+func runCommand(args []string) error {
+	root := newRootCommand()
+	root.SetArgs(longFlags(args))
+	return root.Execute()
+}
+
+// longFlags returns the arguments with the flags written with one dash, like
+// -config of the earlier versions, written with two
+func longFlags(args []string) []string {
+	long := make([]string, len(args))
+	for i, arg := range args {
+		long[i] = arg
+		if arg == "--" {
+			copy(long[i:], args[i:])
+			break
+		}
+		name, _, _ := strings.Cut(arg, "=")
+		if len(name) > 2 && name[0] == '-' && name[1] != '-' {
+			long[i] = "-" + arg
+		}
+	}
+	return long
+}
+
+// configOverrides are the settings given on the command line as key=value
+type configOverrides map[string]string
+
+func (o configOverrides) String() string {
+	pairs := make([]string, 0, len(o))
+	for key, value := range o {
+		pairs = append(pairs, key+"="+value)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+func (o configOverrides) Type() string {
+	return "setting=value"
+}
+
+func (o configOverrides) Set(value string) error {
+	key, setting, found := strings.Cut(value, "=")
+	if !found || key == "" {
+		return fmt.Errorf("%q is not setting=value", value)
+	}
+	o[key] = setting
+	return nil
+}
+
+// configFlags are the flags every command takes to pick its configuration
+type configFlags struct {
+	file    string
+	profile string
+	set     configOverrides
+}
+
+// addConfigFlags adds --config, the YAML configuration file, --profile, the
+// profile of the file to use, and --set, the settings that override the
+// configuration, to the flags of a command
+func addConfigFlags(flags *pflag.FlagSet) *configFlags {
+	c := &configFlags{set: configOverrides{}}
+	flags.StringVar(&c.file, "config", "", "read the configuration from the YAML `file`, instead of config.yaml in the working directory")
+	flags.StringVar(&c.profile, "profile", "", "use the `profile` of the configuration file, instead of the one of PROXY_PROFILE or the file")
+	flags.Var(c.set, "set", "override a `setting=value` of the configuration, like log.level=debug, it may be given many times")
+	return c
+}
+
+// apply makes NewConfig read the configuration file and the overrides, it
+// is called once the flags are parsed. A file given with --config must exist,
+// and the overrides win over both it and the environment.
+func (c *configFlags) apply() {
+	if c.file != "" {
+		viper.Set("server.confFile", c.file)
+	}
+	if c.profile != "" {
+		viper.Set("profile", c.profile)
+	}
+	for key, value := range c.set {
+		viper.Set(key, value)
+	}
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRunCommand(t *testing.T) {
+	assert.Error(t, runCommand([]string{"frobnicate"}), "unknown commands are refused")
+	assert.NoError(t, runCommand([]string{"help"}))
+	assert.NoError(t, runCommand([]string{"--version"}))
+	assert.NoError(t, runCommand([]string{"version"}))
+	assert.Error(t, runCommand([]string{"check", "--nosuchflag"}))
+	assert.Error(t, runCommand([]string{"schema", "extra"}), "the commands take no arguments")
+}
+
+func TestLongFlags(t *testing.T) {
+	assert.Equal(t, []string{"check", "--config", "c.yaml", "--set=log.level=debug", "-h"}, longFlags([]string{"check", "-config", "c.yaml", "-set=log.level=debug", "-h"}))
+	assert.Equal(t, []string{"--config", "c.yaml", "--", "-set"}, longFlags([]string{"--config", "c.yaml", "--", "-set"}))
+}
+
+func TestConfigOverrides(t *testing.T) {
+	o := configOverrides{}
+	assert.NoError(t, o.Set("log.level=debug"))
+	assert.NoError(t, o.Set("broker.routingKey=a=b"))
+	assert.Equal(t, "broker.routingKey=a=b,log.level=debug", o.String())
+
+	assert.Error(t, o.Set("log.level"))
+	assert.Error(t, o.Set("=debug"))
+}
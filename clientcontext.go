@@ -0,0 +1,74 @@
+package main
+
+import (
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+
+	"github.com/spf13/viper"
+)
+
+// What is told about the client in the events. Only the address is sent by
+// default, the user agent and the identity of the TLS client certificate can
+// tell a lot about a person so they are only sent when asked for.
+const (
+	clientContextNone = "none"
+	clientContextIP   = "ip"
+	clientContextFull = "full"
+)
+
+// readClientContext reads what is told about the clients in the events from
+// server.clientContext
+func readClientContext() (string, error) {
+	if !viper.IsSet("server.clientContext") {
+		return clientContextIP, nil
+	}
+	switch context := viper.GetString("server.clientContext"); context {
+	case clientContextNone, clientContextIP, clientContextFull:
+		return context, nil
+	default:
+		return "", fmt.Errorf("server.clientContext %q is not one of %s, %s or %s", context, clientContextNone, clientContextIP, clientContextFull)
+	}
+}
+
+// readClientCAs reads the CAs of the client certificates the listeners
+// accept from the file in server.clientCA, nil when clients are not asked
+// for certificates
+func readClientCAs() (*x509.CertPool, error) {
+	if !viper.IsSet("server.clientCA") {
+		return nil, nil
+	}
+	pem, err := os.ReadFile(viper.GetString("server.clientCA")) // #nosec this file comes from our configuration
+	if err != nil {
+		return nil, fmt.Errorf("server.clientCA: %v", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, errors.New("server.clientCA has no certificates")
+	}
+	return pool, nil
+}
+
+// setClientContext fills in what is told about the client of the request
+func (p *Proxy) setClientContext(r *http.Request, event *Event) {
+	if p.clientContext == clientContextNone {
+		return
+	}
+	event.ClientIP = requestClientIP(r)
+	if p.clientContext != clientContextFull {
+		return
+	}
+	event.UserAgent = r.UserAgent()
+	event.ClientIdentity = clientIdentity(r)
+}
+
+// clientIdentity returns the subject of the verified client certificate of
+// the request, if there is one
+func clientIdentity(r *http.Request) string {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return ""
+	}
+	return r.TLS.VerifiedChains[0][0].Subject.String()
+}
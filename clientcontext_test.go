@@ -0,0 +1,41 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSetClientContext(t *testing.T) {
+	r, _ := http.NewRequest("PUT", "/bucket/user/file", nil)
+	r.RemoteAddr = "192.0.2.1:4321"
+	r.Header.Set("User-Agent", "aws-cli/2.15")
+	r.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{
+		{Subject: pkix.Name{CommonName: "uploader", Organization: []string{"Archive"}}},
+	}}}
+
+	// The address is sent by default
+	p := &Proxy{}
+	var event Event
+	p.setClientContext(r, &event)
+	assert.Equal(t, Event{ClientIP: "192.0.2.1"}, event)
+
+	p.clientContext = clientContextNone
+	event = Event{}
+	p.setClientContext(r, &event)
+	assert.Equal(t, Event{}, event)
+
+	p.clientContext = clientContextFull
+	p.setClientContext(r, &event)
+	assert.Equal(t, "192.0.2.1", event.ClientIP)
+	assert.Equal(t, "aws-cli/2.15", event.UserAgent)
+	assert.Equal(t, "CN=uploader,O=Archive", event.ClientIdentity)
+
+	// Clients without a certificate have no identity
+	r.TLS = &tls.ConnectionState{}
+	assert.Equal(t, "", clientIdentity(r))
+}
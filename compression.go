@@ -0,0 +1,55 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Compressions of the message bodies, they are also the content encodings
+// of the messages
+const (
+	gzipCompression = "gzip"
+	zstdCompression = "zstd"
+)
+
+// zstdEncoder compresses all zstd messages, it is made the first time it is
+// needed
+var (
+	zstdOnce    sync.Once
+	zstdEncoder *zstd.Encoder
+)
+
+// compress compresses a message body with the compression of the format
+func (f eventFormat) compress(body []byte) ([]byte, error) {
+	switch f.compression {
+	case gzipCompression:
+		var buf bytes.Buffer
+		w := gzip.NewWriter(&buf)
+		if _, err := w.Write(body); err != nil {
+			return nil, err
+		}
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	case zstdCompression:
+		zstdOnce.Do(func() {
+			// Without options making the encoder can't fail
+			zstdEncoder, _ = zstd.NewWriter(nil)
+		})
+		return zstdEncoder.EncodeAll(body, nil), nil
+	}
+	return body, nil
+}
+
+// contentEncoding is the content encoding of compressed messages, or the
+// given one of uncompressed messages
+func (f eventFormat) contentEncoding(uncompressed string) string {
+	if f.compression != "" {
+		return f.compression
+	}
+	return uncompressed
+}
@@ -1,13 +1,19 @@
 package main
 
 import (
+	"crypto/ed25519"
 	"crypto/tls"
 	"crypto/x509"
 	"fmt"
 	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
 	"path"
 	"reflect"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/pkg/errors"
 	log "github.com/sirupsen/logrus"
@@ -23,13 +29,87 @@ var (
 
 // S3Config stores information about the S3 backend
 type S3Config struct {
-	url       string
-	readypath string
-	accessKey string
-	secretKey string
-	bucket    string
-	region    string
-	cacert    string
+	url        string
+	readypath  string
+	accessKey  string
+	secretKey  string
+	bucket     string
+	region     string
+	cacert     string
+	clientCert string
+	clientKey  string
+	proxy      string
+	// where the keys are read from and watched, nil when they are given in
+	// the configuration
+	accessKeySource rotatingSecret
+	secretKeySource rotatingSecret
+	// keys of the lookups that only read from the backend, the keys above
+	// are used when they are empty
+	readAccessKey       string
+	readSecretKey       string
+	readAccessKeySource rotatingSecret
+	readSecretKeySource rotatingSecret
+	// use HTTP_PROXY, HTTPS_PROXY and NO_PROXY from the environment
+	proxyFromEnvironment bool
+	// retryMaxAttempts is the number of attempts the SDK makes for the
+	// requests the proxy sends on its own, e.g. the lookup after uploads
+	retryMaxAttempts int
+	// timeout limits those requests, zero means no limit
+	timeout time.Duration
+	// how long to wait for the backend to accept the body of requests with
+	// Expect: 100-continue, zero sends it right away
+	expectContinueTimeout time.Duration
+	// connections to the backend kept open between requests, zero values
+	// leave the Go defaults
+	maxIdleConnsPerHost int
+	idleConnTimeout     time.Duration
+	keepAlive           time.Duration
+	// how long and how many object lookups are cached, zero disables
+	lookupCacheTTL  time.Duration
+	lookupCacheSize int
+	// read completed multipart uploads back to checksum them, when the
+	// checksum is not known otherwise
+	readBackChecksums bool
+	// create the bucket at startup when missing, with these settings
+	createBucket     bool
+	bucketVersioning bool
+	bucketEncryption string
+	bucketKMSKeyID   string
+	// storage class of uploaded objects, empty leaves it to the client
+	storageClass string
+	// object lock applied to uploaded objects, empty mode leaves it to the
+	// client
+	objectLockMode      string
+	objectLockRetention time.Duration
+	objectLockLegalHold bool
+	// acknowledge that the proxy pays for requests to the bucket
+	requesterPays bool
+	// signature version of proxied requests, v4 or v4a for multi-region
+	// access points valid in the regions of the region set
+	signatureVersion string
+	regionSet        string
+	// known quirks of the backend implementation
+	profile backendProfile
+	// TLS versions and cipher suites of connections to the backend
+	tls tlsSettings
+	// address the bucket in the host name rather than the path
+	virtualHosted bool
+	// endpoint of S3 Transfer Acceleration for the bucket, proxied requests
+	// go there instead of url when set
+	accelerateEndpoint string
+	// how often incomplete multipart uploads older than staleUploadAge are
+	// aborted, zero disables the janitor
+	janitorInterval time.Duration
+	staleUploadAge  time.Duration
+	// single uploads larger than splitUploadSize are uploaded in parts of
+	// splitPartSize, zero disables
+	splitUploadSize int64
+	splitPartSize   int64
+	// how often the bucket is probed for the health checks, zero disables
+	monitorInterval time.Duration
+	// sign proxied requests with the standard library's crypto, which is
+	// the FIPS-validated module in BoringCrypto builds
+	fips bool
 }
 
 // BrokerConfig stores information about the message broker
@@ -42,11 +122,74 @@ type BrokerConfig struct {
 	exchange   string
 	routingKey string
 	ssl        bool
-	verifyPeer bool
-	cacert     string
-	clientCert string
-	clientKey  string
-	serverName string
+	// where the password is read from and watched, nil when it is given in
+	// the configuration
+	passwordSource rotatingSecret
+	verifyPeer     bool
+	cacert         string
+	clientCert     string
+	clientKey      string
+	serverName     string
+	// skip verifying the certificate of the broker, for testing only
+	insecureSkipVerify bool
+	// SASL mechanism of the AMQP connection, plain with user and password
+	// or external with the client certificate
+	authMechanism string
+	// publish AMQP messages as persistent, so they survive broker restarts
+	persistent bool
+	// interval of the AMQP heartbeats, which find dead connections
+	heartbeat time.Duration
+	// AMQP channels the events are published on
+	channels int
+	// publish AMQP messages with batches of events, for bulk uploads
+	batchSize     int
+	batchInterval time.Duration
+	// key of the signatures of the AMQP messages, empty sends them
+	// unsigned, with the JWS key parsed from it when signingMode is jws
+	signingKey  string
+	signingMode string
+	jwsKey      ed25519.PrivateKey
+	// how the AMQP exchange is set up
+	topology amqpTopology
+	// format of the messages, the events as they are or CloudEvents
+	format eventFormat
+	// schema of the events, legacySchema or versionedSchema
+	schemaVersion int
+	proxy         string
+	// use HTTPS_PROXY, HTTP_PROXY and NO_PROXY from the environment
+	proxyFromEnvironment bool
+	// TLS versions and cipher suites of connections to the broker
+	tls tlsSettings
+	// registered messenger used to send events
+	messengerType string
+	kafka         kafkaConfig
+	nats          natsConfig
+	aws           awsMessengerConfig
+	pubsub        pubsubConfig
+	webhook       webhookConfig
+	outbox        outboxConfig
+	file          fileConfig
+	fanout        fanoutConfig
+	// retries of the events that could not be sent
+	retry retryConfig
+	// local spool of the events that could not be sent
+	spool spoolConfig
+	// record of the message ids of the events sent recently
+	dedup dedupConfig
+	// liveness messages telling the pipeline the inbox is there
+	liveness livenessConfig
+}
+
+// ACMEConfig stores the settings for getting the server certificate from an
+// ACME provider
+type ACMEConfig struct {
+	domains   []string
+	email     string
+	cacheDir  string
+	directory string
+	// address serving the http-01 challenge, if empty only the tls-alpn-01
+	// challenge is available
+	httpAddress string
 }
 
 // ServerConfig stores general server information
@@ -56,18 +199,92 @@ type ServerConfig struct {
 	users         string
 	jwtpubkeypath string
 	jwtpubkeyurl  string
+	listen        []ListenAddress
+	// address of the health checks and metrics
+	healthListen string
+	// internal address of the admin endpoints, empty for none
+	adminListen string
+	// how often to check the certificate files for changes
+	certReloadInterval time.Duration
+	// how often to check the files of the secrets for changes
+	secretReloadInterval time.Duration
+	acme                 ACMEConfig
+	trustedProxies       []*net.IPNet
+	maxUploadSize        int64
+	forwardHeaders       []string
+	returnHeaders        []string
+	contentTypes         []string
+	renameWindow         time.Duration
+	fips                 bool
+	// Crypt4GH key of the archive, nil unless decrypted checksums are sent
+	c4ghKey *[32]byte
+	// TLS versions and cipher suites accepted from clients
+	tls tlsSettings
+	// CAs of the accepted client certificates, nil if clients aren't asked
+	// for one
+	clientCAs *x509.CertPool
+	// what is told about the clients in the events
+	clientContext string
 }
 
 // Config is a parent object for all the different configuration parts
 type Config struct {
-	S3     S3Config
-	Broker BrokerConfig
-	Server ServerConfig
+	S3 S3Config
+	// the named backends besides S3
+	Backends map[string]S3Config
+	Broker   BrokerConfig
+	Server   ServerConfig
+	// lookups of the secrets kept in AWS
+	Secrets secretsConfig
+	// the behaviours switched on
+	Features featureFlags
+	// the settings of the files below prefixes of the inboxes
+	Overrides []overrideConfig
+	// where the audit log goes
+	Audit auditConfig
+	// what is captured for debugging
+	Debug debugConfig
+	// where the errors are reported
+	Reporting reportingConfig
+}
+
+// envPrefix starts the names of the environment variables that override the
+// configuration
+const envPrefix = "PROXY_"
+
+// envOverride is an environment variable starting with envPrefix. Viper
+// looks at the variables without the prefix before the ones bound to a
+// setting, so these are bound as flags instead, which win over the
+// environment and the configuration file but not over the --set flag.
+type envOverride struct {
+	name  string
+	value string
+}
+
+func (e envOverride) HasChanged() bool    { return true }
+func (e envOverride) Name() string        { return e.name }
+func (e envOverride) ValueString() string { return e.value }
+func (e envOverride) ValueType() string   { return "string" }
+
+// setEnvOverrides binds the configuration to the environment variables
+// starting with envPrefix, which win over both the configuration file and
+// the variables without the prefix. The parts of the names are separated by
+// _, so PROXY_BROKER_SPOOL_MAXSIZE sets broker.spool.maxSize.
+func setEnvOverrides() {
+	for _, env := range os.Environ() {
+		name, value, _ := strings.Cut(env, "=")
+		if !strings.HasPrefix(name, envPrefix) || name == envPrefix {
+			continue
+		}
+		key := strings.ToLower(strings.ReplaceAll(strings.TrimPrefix(name, envPrefix), "_", "."))
+		_ = viper.BindFlagValue(key, envOverride{name, value})
+	}
 }
 
 // NewConfig initializes and parses the config file and/or environment using
 // the viper library.
 func NewConfig() (*Config, error) {
+	setEnvOverrides()
 	viper.SetConfigName("config")
 	viper.AddConfigPath(".")
 	viper.AutomaticEnv()
@@ -87,37 +304,63 @@ func NewConfig() (*Config, error) {
 	if viper.IsSet("server.confFile") {
 		viper.SetConfigFile(viper.GetString("server.confFile"))
 	}
+	viper.SetDefault("broker.type", "amqp")
 	if err := viper.ReadInConfig(); err != nil {
 		if _, ok := err.(viper.ConfigFileNotFoundError); ok {
 			log.Infoln("No config file found, using ENVs only")
 		} else {
 			return nil, err
 		}
+	} else if err := decryptSopsFile(viper.GetViper()); err != nil {
+		return nil, err
+	}
+	if err := applyProfile(); err != nil {
+		return nil, err
+	}
+	if err := applyRemoteConfig(); err != nil {
+		return nil, err
+	}
+	if err := decryptSettings(); err != nil {
+		return nil, err
 	}
 
-	requiredConfVars = []string{
-		"broker.host", "broker.port", "broker.user", "broker.password", "broker.exchange", "broker.routingkey", "aws.url", "aws.accesskey", "aws.secretkey", "aws.bucket",
+	messenger, err := getMessengerType(viper.GetString("broker.type"))
+	if err != nil {
+		return nil, fmt.Errorf("broker.type: %v", err)
+	}
+	requiredConfVars = append([]string{}, messenger.required...)
+	if viper.GetString("broker.type") == "outbox" {
+		// The events are relayed onward with another messenger
+		relay, err := getMessengerType(viper.GetString("broker.outbox.relay"))
+		if err != nil {
+			return nil, fmt.Errorf("broker.outbox.relay: %v", err)
+		}
+		requiredConfVars = append(requiredConfVars, relay.required...)
+	}
+	if viper.GetString("broker.type") == "fanout" {
+		// The events are sent with each of the destinations
+		for _, name := range viper.GetStringSlice("broker.fanout.destinations") {
+			destination, err := getMessengerType(name)
+			if err != nil {
+				return nil, fmt.Errorf("broker.fanout.destinations: %v", err)
+			}
+			requiredConfVars = append(requiredConfVars, destination.required...)
+		}
 	}
+	requiredConfVars = append(requiredConfVars, "aws.url", "aws.accesskey", "aws.secretkey", "aws.bucket")
 
 	for _, s := range requiredConfVars {
-		if !viper.IsSet(s) {
+		if !viper.IsSet(s) && !secretSourceSet(s) {
 			return nil, fmt.Errorf("%s not set", s)
 		}
 	}
 
-	if viper.IsSet("log.level") {
-		stringLevel := viper.GetString("log.level")
-		intLevel, err := log.ParseLevel(stringLevel)
-		if err != nil {
-			log.Infof("Log level '%s' not supported, setting to 'trace'", stringLevel)
-			intLevel = log.TraceLevel
-		}
-		log.SetLevel(intLevel)
-		log.Infof("Setting log level to '%s'", stringLevel)
+	if err := configureLogging(); err != nil {
+		return nil, err
 	}
 
 	c := &Config{}
-	err := c.readConfig()
+	err = c.readConfig()
 	if err != nil {
 		return nil, err
 	}
@@ -128,10 +371,29 @@ func NewConfig() (*Config, error) {
 func (c *Config) readConfig() error {
 	s3 := S3Config{}
 
+	// The secrets may be kept in AWS
+	var err error
+	if c.Secrets, err = readSecretsConfig(); err != nil {
+		return err
+	}
+
 	// All these are required
 	s3.url = viper.GetString("aws.url")
-	s3.accessKey = viper.GetString("aws.accessKey")
-	s3.secretKey = viper.GetString("aws.secretKey")
+	if s3.accessKey, s3.accessKeySource, err = readSecret("aws.accessKey", c.Secrets); err != nil {
+		return err
+	}
+	if s3.secretKey, s3.secretKeySource, err = readSecret("aws.secretKey", c.Secrets); err != nil {
+		return err
+	}
+	if s3.readAccessKey, s3.readAccessKeySource, err = readSecret("aws.readAccessKey", c.Secrets); err != nil {
+		return err
+	}
+	if s3.readSecretKey, s3.readSecretKeySource, err = readSecret("aws.readSecretKey", c.Secrets); err != nil {
+		return err
+	}
+	if (s3.readAccessKey == "") != (s3.readSecretKey == "") {
+		return errors.New("both aws.readAccessKey and aws.readSecretKey are needed")
+	}
 	s3.bucket = viper.GetString("aws.bucket")
 
 	// Optional settings
@@ -146,16 +408,219 @@ func (c *Config) readConfig() error {
 	if viper.IsSet("aws.cacert") {
 		s3.cacert = viper.GetString("aws.cacert")
 	}
+	if viper.IsSet("aws.clientCert") || viper.IsSet("aws.clientKey") {
+		// Client certificates for the S3 backend need both parts.
+		if !(viper.IsSet("aws.clientCert") && viper.IsSet("aws.clientKey")) {
+			return errors.New("both aws.clientCert and aws.clientKey are needed for client certificate authentication")
+		}
+		s3.clientCert = viper.GetString("aws.clientCert")
+		s3.clientKey = viper.GetString("aws.clientKey")
+	}
+
+	if viper.IsSet("aws.proxy") {
+		s3.proxy = viper.GetString("aws.proxy")
+		if err := validateProxy(s3.proxy); err != nil {
+			return fmt.Errorf("aws.proxy: %v", err)
+		}
+	}
+	if viper.IsSet("aws.proxyFromEnvironment") {
+		s3.proxyFromEnvironment = viper.GetBool("aws.proxyFromEnvironment")
+	}
+
+	s3.retryMaxAttempts = 3
+	if viper.IsSet("aws.retryMaxAttempts") {
+		s3.retryMaxAttempts = viper.GetInt("aws.retryMaxAttempts")
+		if s3.retryMaxAttempts < 1 {
+			return errors.New("aws.retryMaxAttempts must be at least 1")
+		}
+	}
+	if viper.IsSet("aws.timeout") {
+		s3.timeout = viper.GetDuration("aws.timeout")
+		if s3.timeout < 0 {
+			return errors.New("aws.timeout can not be negative")
+		}
+	}
+
+	s3.expectContinueTimeout = time.Second
+	if viper.IsSet("aws.expectContinueTimeout") {
+		s3.expectContinueTimeout = viper.GetDuration("aws.expectContinueTimeout")
+		if s3.expectContinueTimeout < 0 {
+			return errors.New("aws.expectContinueTimeout can not be negative")
+		}
+	}
+
+	// Multipart uploads send many requests in bursts, keep enough
+	// connections around for them
+	s3.maxIdleConnsPerHost = 32
+	if viper.IsSet("aws.maxIdleConnsPerHost") {
+		s3.maxIdleConnsPerHost = viper.GetInt("aws.maxIdleConnsPerHost")
+		if s3.maxIdleConnsPerHost < 1 {
+			return errors.New("aws.maxIdleConnsPerHost must be at least 1")
+		}
+	}
+	s3.idleConnTimeout = 90 * time.Second
+	if viper.IsSet("aws.idleConnTimeout") {
+		s3.idleConnTimeout = viper.GetDuration("aws.idleConnTimeout")
+	}
+	s3.keepAlive = 30 * time.Second
+	if viper.IsSet("aws.keepAlive") {
+		s3.keepAlive = viper.GetDuration("aws.keepAlive")
+	}
+
+	s3.lookupCacheTTL = time.Minute
+	if viper.IsSet("aws.lookupCacheTTL") {
+		s3.lookupCacheTTL = viper.GetDuration("aws.lookupCacheTTL")
+	}
+	s3.lookupCacheSize = 1000
+	if viper.IsSet("aws.lookupCacheSize") {
+		s3.lookupCacheSize = viper.GetInt("aws.lookupCacheSize")
+	}
+	s3.readBackChecksums = viper.GetBool("aws.readBackChecksums")
+
+	s3.createBucket = true
+	if viper.IsSet("aws.createBucket") {
+		s3.createBucket = viper.GetBool("aws.createBucket")
+	}
+	if viper.IsSet("aws.bucketVersioning") {
+		s3.bucketVersioning = viper.GetBool("aws.bucketVersioning")
+	}
+	if viper.IsSet("aws.bucketEncryption") {
+		s3.bucketEncryption = viper.GetString("aws.bucketEncryption")
+		if s3.bucketEncryption != "AES256" && s3.bucketEncryption != "aws:kms" {
+			return fmt.Errorf("aws.bucketEncryption must be AES256 or aws:kms, not %q", s3.bucketEncryption)
+		}
+	}
+	if viper.IsSet("aws.bucketKMSKeyID") {
+		s3.bucketKMSKeyID = viper.GetString("aws.bucketKMSKeyID")
+		if s3.bucketEncryption != "aws:kms" {
+			return errors.New("aws.bucketKMSKeyID needs aws.bucketEncryption set to aws:kms")
+		}
+	}
+
+	if viper.IsSet("aws.storageClass") {
+		s3.storageClass = viper.GetString("aws.storageClass")
+	}
+
+	if viper.IsSet("aws.objectLockMode") {
+		s3.objectLockMode = strings.ToUpper(viper.GetString("aws.objectLockMode"))
+		if s3.objectLockMode != "GOVERNANCE" && s3.objectLockMode != "COMPLIANCE" {
+			return fmt.Errorf("aws.objectLockMode must be GOVERNANCE or COMPLIANCE, not %q", s3.objectLockMode)
+		}
+		s3.objectLockRetention = viper.GetDuration("aws.objectLockRetention")
+		if s3.objectLockRetention <= 0 {
+			return errors.New("aws.objectLockRetention must be set to a positive duration with aws.objectLockMode")
+		}
+	}
+	if viper.IsSet("aws.objectLockLegalHold") {
+		s3.objectLockLegalHold = viper.GetBool("aws.objectLockLegalHold")
+	}
+
+	if viper.IsSet("aws.requesterPays") {
+		s3.requesterPays = viper.GetBool("aws.requesterPays")
+	}
+
+	s3.signatureVersion = "v4"
+	if viper.IsSet("aws.signatureVersion") {
+		s3.signatureVersion = strings.ToLower(viper.GetString("aws.signatureVersion"))
+		if s3.signatureVersion != "v4" && s3.signatureVersion != "v4a" {
+			return fmt.Errorf("aws.signatureVersion must be v4 or v4a, not %q", s3.signatureVersion)
+		}
+	}
+	s3.regionSet = "*"
+	if viper.IsSet("aws.regionSet") {
+		s3.regionSet = viper.GetString("aws.regionSet")
+	}
+
+	flavor := "generic"
+	if viper.IsSet("aws.flavor") {
+		flavor = viper.GetString("aws.flavor")
+	}
+	profile, err := getBackendProfile(flavor)
+	if err != nil {
+		return fmt.Errorf("aws.flavor: %v", err)
+	}
+	s3.profile = profile
+	if s3.requesterPays && !profile.supportsHeader("X-Amz-Request-Payer") {
+		return fmt.Errorf("requester pays is not supported by %s backends", profile.name)
+	}
+
+	if viper.IsSet("aws.addressing") {
+		switch addressing := strings.ToLower(viper.GetString("aws.addressing")); addressing {
+		case "path":
+		case "virtual":
+			s3.virtualHosted = true
+		default:
+			return fmt.Errorf("aws.addressing must be path or virtual, not %q", addressing)
+		}
+	}
+
+	if viper.IsSet("aws.accelerateEndpoint") {
+		s3.accelerateEndpoint = strings.TrimSuffix(viper.GetString("aws.accelerateEndpoint"), "/")
+		if u, err := url.Parse(s3.accelerateEndpoint); err != nil || u.Scheme == "" || u.Host == "" {
+			return fmt.Errorf("aws.accelerateEndpoint %q is not a valid URL", s3.accelerateEndpoint)
+		}
+	} else if viper.GetBool("aws.accelerate") {
+		s3.accelerateEndpoint = "https://" + s3.bucket + ".s3-accelerate.amazonaws.com"
+	}
+	if s3.accelerateEndpoint != "" && strings.Contains(s3.bucket, ".") {
+		return errors.New("transfer acceleration does not support bucket names with dots")
+	}
+
+	if viper.IsSet("aws.janitorInterval") {
+		s3.janitorInterval = viper.GetDuration("aws.janitorInterval")
+		if s3.janitorInterval < 0 {
+			return errors.New("aws.janitorInterval can not be negative")
+		}
+	}
+	if viper.IsSet("aws.splitUploadSize") {
+		s3.splitUploadSize = viper.GetInt64("aws.splitUploadSize")
+	}
+	// The smallest part S3 accepts is 5 MiB
+	s3.splitPartSize = 100 * 1024 * 1024
+	if viper.IsSet("aws.splitPartSize") {
+		s3.splitPartSize = viper.GetInt64("aws.splitPartSize")
+		if s3.splitPartSize < 5*1024*1024 {
+			return errors.New("aws.splitPartSize must be at least 5 MiB")
+		}
+		// and the largest 5 GiB
+		if s3.splitPartSize > 5*1024*1024*1024 {
+			return errors.New("aws.splitPartSize can not be larger than 5 GiB")
+		}
+	}
+	if s3.splitUploadSize > 0 && s3.splitUploadSize < s3.splitPartSize {
+		return errors.New("aws.splitUploadSize can not be smaller than aws.splitPartSize")
+	}
+
+	if viper.IsSet("aws.monitorInterval") {
+		s3.monitorInterval = viper.GetDuration("aws.monitorInterval")
+		if s3.monitorInterval < 0 {
+			return errors.New("aws.monitorInterval can not be negative")
+		}
+	}
+	s3.staleUploadAge = 7 * 24 * time.Hour
+	if viper.IsSet("aws.staleUploadAge") {
+		s3.staleUploadAge = viper.GetDuration("aws.staleUploadAge")
+		if s3.staleUploadAge <= 0 {
+			return errors.New("aws.staleUploadAge must be positive")
+		}
+	}
+
+	if s3.tls, err = readTLSSettings("aws"); err != nil {
+		return err
+	}
 
 	c.S3 = s3
 
 	// Setup broker
 	b := BrokerConfig{}
 
+	b.messengerType = viper.GetString("broker.type")
 	b.host = viper.GetString("broker.host")
 	b.port = viper.GetString("broker.port")
 	b.user = viper.GetString("broker.user")
-	b.password = viper.GetString("broker.password")
+	if b.password, b.passwordSource, err = readSecret("broker.password", c.Secrets); err != nil {
+		return err
+	}
 	b.exchange = viper.GetString("broker.exchange")
 	b.routingKey = viper.GetString("broker.routingKey")
 	b.serverName = viper.GetString("broker.serverName")
@@ -187,6 +652,128 @@ func (c *Config) readConfig() error {
 	if viper.IsSet("broker.cacert") {
 		b.cacert = viper.GetString("broker.cacert")
 	}
+	if viper.IsSet("broker.insecureSkipVerify") {
+		b.insecureSkipVerify = viper.GetBool("broker.insecureSkipVerify")
+	}
+
+	b.persistent = true
+	if viper.IsSet("broker.persistent") {
+		b.persistent = viper.GetBool("broker.persistent")
+	}
+
+	b.heartbeat = 10 * time.Second
+	if viper.IsSet("broker.heartbeat") {
+		b.heartbeat = viper.GetDuration("broker.heartbeat")
+		if b.heartbeat < 0 {
+			return errors.New("broker.heartbeat can not be negative")
+		}
+	}
+
+	b.channels = 1
+	if viper.IsSet("broker.channels") {
+		b.channels = viper.GetInt("broker.channels")
+		if b.channels < 1 {
+			return errors.New("broker.channels must be at least 1")
+		}
+	}
+
+	b.batchSize = 1
+	if viper.IsSet("broker.batchSize") {
+		b.batchSize = viper.GetInt("broker.batchSize")
+		if b.batchSize < 1 {
+			return errors.New("broker.batchSize must be at least 1")
+		}
+	}
+	b.batchInterval = 100 * time.Millisecond
+	if viper.IsSet("broker.batchInterval") {
+		b.batchInterval = viper.GetDuration("broker.batchInterval")
+		if b.batchInterval <= 0 {
+			return errors.New("broker.batchInterval must be positive")
+		}
+	}
+
+	if b.signingKey, _, err = readSecret("broker.signingKey", c.Secrets); err != nil {
+		return err
+	}
+	b.signingKey = strings.TrimSpace(b.signingKey)
+	if b.signingKey == "" && (viper.IsSet("broker.signingKey") || viper.IsSet("broker.signingKeyFile") || viper.IsSet("broker.signingKeySecret")) {
+		return errors.New("broker.signingKey is empty")
+	}
+	b.signingMode = hmacSigning
+	if viper.IsSet("broker.signingMode") {
+		b.signingMode = strings.ToLower(viper.GetString("broker.signingMode"))
+	}
+	switch b.signingMode {
+	case hmacSigning:
+	case jwsSigning:
+		if b.signingKey == "" {
+			return errors.New("broker.signingMode jws needs broker.signingKey")
+		}
+		if b.jwsKey, err = parseSigningKey(b.signingKey); err != nil {
+			return fmt.Errorf("broker.signingKey: %v", err)
+		}
+	default:
+		return fmt.Errorf("broker.signingMode %q is not one of %s or %s", b.signingMode, hmacSigning, jwsSigning)
+	}
+
+	b.schemaVersion = legacySchema
+	if viper.IsSet("broker.schemaVersion") {
+		b.schemaVersion = viper.GetInt("broker.schemaVersion")
+		if b.schemaVersion != legacySchema && b.schemaVersion != versionedSchema {
+			return fmt.Errorf("broker.schemaVersion %d is not one of %d or %d", b.schemaVersion, legacySchema, versionedSchema)
+		}
+	}
+
+	if b.format, err = readEventFormat(); err != nil {
+		return err
+	}
+
+	b.authMechanism = "plain"
+	if viper.IsSet("broker.authMechanism") {
+		b.authMechanism = strings.ToLower(viper.GetString("broker.authMechanism"))
+	}
+	switch b.authMechanism {
+	case "plain":
+	case "external":
+		if !b.ssl || !b.verifyPeer {
+			return errors.New("broker.authMechanism external needs broker.ssl and a client certificate with broker.verifyPeer")
+		}
+	default:
+		return fmt.Errorf("broker.authMechanism %q is not one of plain or external", b.authMechanism)
+	}
+
+	if viper.IsSet("broker.proxy") {
+		b.proxy = viper.GetString("broker.proxy")
+		if err := validateProxy(b.proxy); err != nil {
+			return fmt.Errorf("broker.proxy: %v", err)
+		}
+	}
+	if viper.IsSet("broker.proxyFromEnvironment") {
+		b.proxyFromEnvironment = viper.GetBool("broker.proxyFromEnvironment")
+	}
+
+	if b.tls, err = readTLSSettings("broker"); err != nil {
+		return err
+	}
+
+	if err = b.readMessengerConfig(b.messengerType, s3); err != nil {
+		return err
+	}
+	if err = b.checkFormat(); err != nil {
+		return err
+	}
+	if b.retry, err = readRetryConfig(); err != nil {
+		return err
+	}
+	if b.spool, err = readSpoolConfig(); err != nil {
+		return err
+	}
+	if b.dedup, err = readDedupConfig(); err != nil {
+		return err
+	}
+	if b.liveness, err = readLivenessConfig(b.messengerType); err != nil {
+		return err
+	}
 
 	c.Broker = b
 
@@ -217,9 +804,251 @@ func (c *Config) readConfig() error {
 	if viper.IsSet("server.key") {
 		s.key = viper.GetString("server.key")
 	}
+	s.certReloadInterval = time.Minute
+	if viper.IsSet("server.certReloadInterval") {
+		s.certReloadInterval = viper.GetDuration("server.certReloadInterval")
+		if s.certReloadInterval <= 0 {
+			return errors.New("server.certReloadInterval must be a positive duration")
+		}
+	}
+	s.secretReloadInterval = time.Minute
+	if viper.IsSet("server.secretReloadInterval") {
+		s.secretReloadInterval = viper.GetDuration("server.secretReloadInterval")
+		if s.secretReloadInterval <= 0 {
+			return errors.New("server.secretReloadInterval must be a positive duration")
+		}
+	}
+
+	if viper.IsSet("server.acme.domains") {
+		if s.cert != "" || s.key != "" {
+			return errors.New("server.acme can not be used together with server.cert and server.key")
+		}
+		s.acme.domains = viper.GetStringSlice("server.acme.domains")
+		s.acme.email = viper.GetString("server.acme.email")
+		s.acme.cacheDir = viper.GetString("server.acme.cacheDir")
+		s.acme.directory = viper.GetString("server.acme.directory")
+		s.acme.httpAddress = viper.GetString("server.acme.httpAddress")
+	}
+	useTLS := (s.cert != "" && s.key != "") || len(s.acme.domains) > 0
+
+	s.healthListen = ":8001"
+	if viper.IsSet("server.healthListen") {
+		s.healthListen = viper.GetString("server.healthListen")
+		if _, _, err := net.SplitHostPort(s.healthListen); err != nil {
+			return fmt.Errorf("server.healthListen: %v", err)
+		}
+	}
+	if viper.GetBool("server.admin") {
+		s.adminListen = "localhost:8002"
+		if viper.IsSet("server.adminListen") {
+			s.adminListen = viper.GetString("server.adminListen")
+		}
+		if host, _, err := net.SplitHostPort(s.adminListen); err != nil || host == "" {
+			return fmt.Errorf("server.adminListen %q must be an internal host and port, like localhost:8002", s.adminListen)
+		}
+	}
+
+	addresses := []string{":8000"}
+	if viper.IsSet("server.listen") {
+		addresses = viper.GetStringSlice("server.listen")
+	}
+	for _, address := range addresses {
+		l, err := parseListenAddress(address, useTLS)
+		if err != nil {
+			return err
+		}
+		if l.tls && !useTLS {
+			return fmt.Errorf("listen address %s needs either server.cert and server.key or server.acme", address)
+		}
+		if l.network == "unix" && viper.IsSet("server.socketMode") {
+			mode, err := strconv.ParseUint(viper.GetString("server.socketMode"), 8, 32)
+			if err != nil {
+				return fmt.Errorf("server.socketMode must be an octal file mode: %v", err)
+			}
+			l.mode = os.FileMode(mode)
+		}
+		s.listen = append(s.listen, l)
+	}
+
+	if viper.IsSet("server.trustedProxies") {
+		trusted, err := parseTrustedProxies(viper.GetStringSlice("server.trustedProxies"))
+		if err != nil {
+			return err
+		}
+		s.trustedProxies = trusted
+	}
+
+	if viper.IsSet("server.maxUploadSize") {
+		s.maxUploadSize = viper.GetInt64("server.maxUploadSize")
+		if s.maxUploadSize < 0 {
+			return errors.New("server.maxUploadSize can not be negative")
+		}
+	}
+
+	if viper.IsSet("server.forwardHeaders") {
+		s.forwardHeaders = viper.GetStringSlice("server.forwardHeaders")
+	}
+	if viper.IsSet("server.returnHeaders") {
+		s.returnHeaders = viper.GetStringSlice("server.returnHeaders")
+	}
+
+	if viper.IsSet("server.allowedContentTypes") {
+		s.contentTypes = viper.GetStringSlice("server.allowedContentTypes")
+	}
+
+	if viper.IsSet("server.renameWindow") {
+		s.renameWindow = viper.GetDuration("server.renameWindow")
+		if s.renameWindow < 0 {
+			return errors.New("server.renameWindow can not be negative")
+		}
+	}
+
+	// FIPS mode needs the BoringCrypto build, the restrictions on TLS and
+	// signing are set below
+	if viper.IsSet("server.fips") {
+		s.fips = viper.GetBool("server.fips")
+		if s.fips && !fipsAvailable() {
+			return errors.New("server.fips needs a build with GOEXPERIMENT=boringcrypto and cgo enabled")
+		}
+	}
+
+	if s.tls, err = readTLSSettings("server"); err != nil {
+		return err
+	}
+
+	if s.c4ghKey, err = readC4GHKey(); err != nil {
+		return err
+	}
+
+	if s.clientContext, err = readClientContext(); err != nil {
+		return err
+	}
+	if s.clientCAs, err = readClientCAs(); err != nil {
+		return err
+	}
+	if s.clientCAs != nil && !useTLS {
+		return errors.New("server.clientCA needs either server.cert and server.key or server.acme")
+	}
 
 	c.Server = s
 
+	if s.fips {
+		if err := c.S3.tls.restrictToFIPS("aws"); err != nil {
+			return err
+		}
+		if err := c.Broker.tls.restrictToFIPS("broker"); err != nil {
+			return err
+		}
+		if err := c.Server.tls.restrictToFIPS("server"); err != nil {
+			return err
+		}
+		c.S3.fips = true
+	}
+
+	// The other backends start from the settings of the aws section
+	if c.Backends, err = readBackends(c.S3, c.Secrets); err != nil {
+		return err
+	}
+
+	if c.Features, err = readFeatures(); err != nil {
+		return err
+	}
+
+	if c.Overrides, err = readOverrides(c); err != nil {
+		return err
+	}
+
+	if c.Audit, err = readAuditConfig(); err != nil {
+		return err
+	}
+
+	if c.Debug, err = readDebugConfig(); err != nil {
+		return err
+	}
+
+	if c.Reporting, err = readReportingConfig(c.Secrets); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// readMessengerConfig reads the settings of the named messenger, the outbox
+// and the fan-out also read those of the messengers they send events with
+func (b *BrokerConfig) readMessengerConfig(name string, s3 S3Config) error {
+	var err error
+	switch name {
+	case "amqp":
+		if b.authMechanism == "plain" && (b.user == "" || b.password == "") {
+			return errors.New("broker.user and broker.password are needed unless broker.authMechanism is external")
+		}
+		b.topology, err = readAMQPTopology()
+	case "kafka":
+		b.kafka, err = readKafkaConfig()
+	case "nats":
+		b.nats, err = readNATSConfig()
+	case "sqs":
+		b.aws, err = readAWSMessengerConfig("broker.sqs", "queueUrl", s3)
+	case "sns":
+		b.aws, err = readAWSMessengerConfig("broker.sns", "topicArn", s3)
+	case "pubsub":
+		b.pubsub, err = readPubSubConfig()
+	case "webhook":
+		b.webhook, err = readWebhookConfig()
+	case "file":
+		b.file, err = readFileConfig()
+	case "outbox":
+		if b.outbox, err = readOutboxConfig(); err != nil {
+			return err
+		}
+		err = b.readMessengerConfig(b.outbox.relay, s3)
+	case "fanout":
+		if b.fanout, err = readFanoutConfig(); err != nil {
+			return err
+		}
+		for _, destination := range b.fanout.destinations {
+			if err = b.readMessengerConfig(destination, s3); err != nil {
+				return err
+			}
+		}
+	}
+	return err
+}
+
+// checkFormat checks that Avro, Protobuf and compressed events can be sent,
+// the text based messengers only take JSON and the batches aren't binary
+func (b *BrokerConfig) checkFormat() error {
+	if b.format.text() {
+		return nil
+	}
+	messengers := []string{b.messengerType}
+	switch b.messengerType {
+	case "outbox":
+		messengers = []string{b.outbox.relay}
+	case "fanout":
+		messengers = b.fanout.destinations
+	}
+	for _, messenger := range messengers {
+		switch messenger {
+		case "file", "sqs", "sns":
+			return fmt.Errorf("broker.format %s with broker.compression %q can not be sent with broker.type %s", b.format.name, b.format.compression, messenger)
+		}
+	}
+	if b.format.binary() && b.batchSize > 1 {
+		return fmt.Errorf("broker.format %s can not be sent in batches, broker.batchSize has to be 1", b.format.name)
+	}
+	return nil
+}
+
+// validateProxy checks that an outbound proxy is given as an http URL
+func validateProxy(proxy string) error {
+	u, err := url.Parse(proxy)
+	if err != nil {
+		return err
+	}
+	if u.Scheme != "http" || u.Host == "" {
+		return fmt.Errorf("proxy should be given as http://host:port, got %s", proxy)
+	}
 	return nil
 }
 
@@ -229,8 +1058,9 @@ func TLSConfigBroker(c *Config) (*tls.Config, error) {
 
 	log.Debug("setting up TLS for broker connection")
 
-	// Enforce TLS1.2 or higher
-	cfg.MinVersion = 2
+	// Enforce TLS1.2 or higher, unless configured otherwise
+	cfg.MinVersion = tls.VersionTLS12
+	c.Broker.tls.apply(cfg)
 
 	// Read system CAs
 	var systemCAs, _ = x509.SystemCertPool()
@@ -240,13 +1070,9 @@ func TLSConfigBroker(c *Config) (*tls.Config, error) {
 	}
 	cfg.RootCAs = systemCAs
 
-	// Add CAs for broker and s3
-	for _, cacert := range []string{c.Broker.cacert, c.S3.cacert} {
-		if cacert == "" {
-			continue
-		}
-
-		cacert, e := ioutil.ReadFile(cacert) // #nosec this file comes from our configuration
+	// Add CA for the broker, the S3 CA is kept separate
+	if c.Broker.cacert != "" {
+		cacert, e := ioutil.ReadFile(c.Broker.cacert) // #nosec this file comes from our configuration
 		if e != nil {
 			return nil, fmt.Errorf("failed to append %q to RootCAs: %v", cacert, e)
 		}
@@ -260,30 +1086,43 @@ func TLSConfigBroker(c *Config) (*tls.Config, error) {
 		cfg.ServerName = c.Broker.serverName
 	}
 
+	if c.Broker.insecureSkipVerify {
+		log.Warn("the certificate of the broker is not verified, this is insecure")
+		cfg.InsecureSkipVerify = true // #nosec explicitly asked for in the configuration
+	}
+
 	if c.Broker.verifyPeer {
 		cert, e := ioutil.ReadFile(c.Broker.clientCert)
 		if e != nil {
-			return nil, fmt.Errorf("failed to read client cert %q, reason: %v", c.Broker.clientKey, e)
+			return nil, fmt.Errorf("failed to read client cert %q, reason: %v", c.Broker.clientCert, e)
 		}
 		key, e := ioutil.ReadFile(c.Broker.clientKey)
 		if e != nil {
 			return nil, fmt.Errorf("failed to read client key %q, reason: %v", c.Broker.clientKey, e)
 		}
-		if certs, e := tls.X509KeyPair(cert, key); e == nil {
-			cfg.Certificates = append(cfg.Certificates, certs)
+		certs, e := tls.X509KeyPair(cert, key)
+		if e != nil {
+			return nil, fmt.Errorf("failed to load client certificate %q for the broker, reason: %v", c.Broker.clientCert, e)
 		}
+		cfg.Certificates = append(cfg.Certificates, certs)
 	}
 	return cfg, nil
 }
 
 // TLSConfigProxy is a helper method to setup TLS for the S3 backend.
 func TLSConfigProxy(c *Config) (*tls.Config, error) {
+	return tlsConfigBackend(c.S3)
+}
+
+// tlsConfigBackend sets up TLS for the connections to a backend
+func tlsConfigBackend(s3 S3Config) (*tls.Config, error) {
 	cfg := new(tls.Config)
 
 	log.Debug("setting up TLS for S3 connection")
 
-	// Enforce TLS1.2 or higher
-	cfg.MinVersion = 2
+	// Enforce TLS1.2 or higher, unless configured otherwise
+	cfg.MinVersion = tls.VersionTLS12
+	s3.tls.apply(cfg)
 
 	// Read system CAs
 	var systemCAs, _ = x509.SystemCertPool()
@@ -293,8 +1132,8 @@ func TLSConfigProxy(c *Config) (*tls.Config, error) {
 	}
 	cfg.RootCAs = systemCAs
 
-	if c.S3.cacert != "" {
-		cacert, e := ioutil.ReadFile(c.S3.cacert) // #nosec this file comes from our configuration
+	if s3.cacert != "" {
+		cacert, e := ioutil.ReadFile(s3.cacert) // #nosec this file comes from our configuration
 		if e != nil {
 			return nil, fmt.Errorf("failed to append %q to RootCAs: %v", cacert, e)
 		}
@@ -303,5 +1142,13 @@ func TLSConfigProxy(c *Config) (*tls.Config, error) {
 		}
 	}
 
+	if s3.clientCert != "" && s3.clientKey != "" {
+		cert, e := tls.LoadX509KeyPair(s3.clientCert, s3.clientKey)
+		if e != nil {
+			return nil, fmt.Errorf("failed to load client certificate %q for S3, reason: %v", s3.clientCert, e)
+		}
+		cfg.Certificates = append(cfg.Certificates, cert)
+	}
+
 	return cfg, nil
 }
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+// redacted replaces the secrets in the dumped configuration
+const redacted = "********"
+
+// secretSettingNames are the last parts of the names of the settings that
+// hold secrets, or connection strings that may contain one
+var secretSettingNames = []string{"password", "passphrase", "accesskey", "secretkey", "readaccesskey", "readsecretkey", "dsn", "token", "signingkey"}
+
+// configSections are the sections of the configuration and how many parts
+// the names of their settings have at most. Environment variables starting
+// with a section are settings, unless their names have more parts, like
+// AWS_ACCESS_KEY_ID of the AWS SDK.
+var configSections = map[string]int{"server": 3, "aws": 2, "backends": 3, "broker": 3, "c4gh": 2, "log": 2, "secrets": 2, "features": 2, "remote": 2, "audit": 2, "debug": 2, "reporting": 2}
+
+// effectiveSetting is a setting of the resolved configuration and where its
+// value comes from
+type effectiveSetting struct {
+	key    string
+	value  interface{}
+	source string
+}
+
+// newConfigDumpCommand creates the config command
+func newConfigDumpCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "config",
+		Short: "print the resolved configuration, with the secrets masked, and where each value comes from",
+		Args:  cobra.NoArgs,
+	}
+	configFlags := addConfigFlags(cmd.Flags())
+	cmd.RunE = func(*cobra.Command, []string) error {
+		return runConfigDump(configFlags)
+	}
+	return cmd
+}
+
+// runConfigDump is the config command, it prints the resolved configuration
+// with the secrets masked, and where each value comes from
+func runConfigDump(configFlags *configFlags) error {
+	configFlags.apply()
+
+	// The settings are printed even when they don't make a valid
+	// configuration, that is when they are needed the most
+	_, configErr := NewConfig()
+
+	flagged := map[string]string{}
+	for key := range configFlags.set {
+		flagged[strings.ToLower(key)] = "--set"
+	}
+	if configFlags.file != "" {
+		flagged["server.conffile"] = "--config"
+	}
+	if configFlags.profile != "" {
+		flagged["profile"] = "--profile"
+	}
+	settings := effectiveSettings(flagged)
+	if file := viper.ConfigFileUsed(); file != "" {
+		fmt.Fprintf(os.Stdout, "# configuration file %s\n", file)
+	}
+	printSettings(os.Stdout, settings)
+
+	if configErr != nil {
+		return fmt.Errorf("the configuration is not valid: %v", configErr)
+	}
+	return nil
+}
+
+// effectiveSettings returns the settings of the configuration ordered by
+// name, with the secrets masked. flagged are the settings given on the
+// command line, with the flag they were given with.
+func effectiveSettings(flagged map[string]string) []effectiveSetting {
+	// The file is read again on its own, to tell which settings are in it
+	// and its profiles
+	file := readConfigFile()
+	var profiles []string
+	if file != nil && viper.GetString("profile") != "" {
+		profiles, _ = profileChain(file, viper.GetString("profile"))
+	}
+
+	keys := map[string]bool{}
+	for _, key := range viper.AllKeys() {
+		keys[key] = true
+	}
+	// Settings only given in the environment are not among the keys
+	for _, env := range os.Environ() {
+		name, _, _ := strings.Cut(env, "=")
+		key := strings.ToLower(strings.ReplaceAll(strings.TrimPrefix(name, envPrefix), "_", "."))
+		parts := strings.Split(key, ".")
+		if depth, ok := configSections[parts[0]]; ok && len(parts) > 1 && len(parts) <= depth {
+			keys[key] = true
+		}
+	}
+
+	settings := make([]effectiveSetting, 0, len(keys))
+	for key := range keys {
+		settings = append(settings, effectiveSetting{
+			key:    key,
+			value:  redactSetting(key, viper.Get(key)),
+			source: settingSource(key, flagged, file, profiles),
+		})
+	}
+	sort.Slice(settings, func(i, j int) bool { return settings[i].key < settings[j].key })
+	return settings
+}
+
+// settingSource tells where the value of the setting comes from, in the
+// order viper picks them. profiles are the ones applied, the last wins.
+func settingSource(key string, flagged map[string]string, file *viper.Viper, profiles []string) string {
+	if flag, ok := flagged[key]; ok {
+		return flag + " flag"
+	}
+	env := strings.ToUpper(strings.ReplaceAll(key, ".", "_"))
+	if _, ok := os.LookupEnv(envPrefix + env); ok {
+		return envPrefix + env
+	}
+	if _, ok := os.LookupEnv(env); ok {
+		return env
+	}
+	if source, ok := remoteSource(key); ok {
+		return source
+	}
+	for i := len(profiles) - 1; i >= 0; i-- {
+		if file.IsSet("profiles." + profiles[i] + "." + key) {
+			return "profile " + profiles[i]
+		}
+	}
+	if file != nil && file.IsSet(key) {
+		return "config file"
+	}
+	return "default"
+}
+
+// redactSetting masks the value of a setting that holds a secret or was
+// encrypted, and the passwords in URLs
+func redactSetting(key string, value interface{}) interface{} {
+	if decryptedSettings[key] {
+		return redacted
+	}
+	parts := strings.Split(key, ".")
+	name := parts[len(parts)-1]
+	for _, s := range secretSettingNames {
+		if name == s {
+			return redacted
+		}
+	}
+
+	switch v := value.(type) {
+	case string:
+		return redactURL(v)
+	case []string:
+		urls := make([]string, len(v))
+		for i, s := range v {
+			urls[i] = redactURL(s)
+		}
+		return urls
+	case []interface{}:
+		values := make([]interface{}, len(v))
+		for i, s := range v {
+			values[i] = s
+			if s, ok := s.(string); ok {
+				values[i] = redactURL(s)
+			}
+		}
+		return values
+	}
+	return value
+}
+
+// redactURL masks the password of a URL, other strings are left as they are
+func redactURL(s string) string {
+	if !strings.Contains(s, "://") {
+		return s
+	}
+	u, err := url.Parse(s)
+	if err != nil {
+		return s
+	}
+	return u.Redacted()
+}
+
+// printSettings writes the settings, one per line with the value as JSON
+// and where it comes from
+func printSettings(w io.Writer, settings []effectiveSetting) {
+	for _, s := range settings {
+		value, err := json.Marshal(s.value)
+		if err != nil {
+			value = []byte(fmt.Sprintf("%q", fmt.Sprint(s.value)))
+		}
+		fmt.Fprintf(w, "%s: %s  # %s\n", s.key, value, s.source)
+	}
+}
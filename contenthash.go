@@ -0,0 +1,142 @@
+package main
+
+import (
+	"crypto/md5" // #nosec md5 is one of the checksums consumers ask for
+	"crypto/sha256"
+	"encoding"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// contentHash computes the checksums of content as it passes through
+type contentHash struct {
+	sha256 hash.Hash
+	md5    hash.Hash
+	// checksums of the decrypted content, when there is a Crypt4GH key
+	decrypted *decryptedHash
+}
+
+func newContentHash() *contentHash {
+	return &contentHash{sha256: sha256.New(), md5: md5.New()} // #nosec see above
+}
+
+// newDecryptingHash computes the checksums of the decrypted content as well
+// when there is a key
+func newDecryptingHash(key *[32]byte) *contentHash {
+	h := newContentHash()
+	if key != nil {
+		h.decrypted = newDecryptedHash(key)
+	}
+	return h
+}
+
+func (h *contentHash) Write(b []byte) (int, error) {
+	h.sha256.Write(b)
+	h.md5.Write(b)
+	if h.decrypted != nil {
+		_, _ = h.decrypted.Write(b)
+	}
+	return len(b), nil
+}
+
+// info returns the checksums of the content so far, with its size. The
+// content ends here for the decryption.
+func (h *contentHash) info(size int64) objectInfo {
+	info := objectInfo{checksum: fmt.Sprintf("%x", h.sha256.Sum(nil)), md5: fmt.Sprintf("%x", h.md5.Sum(nil)), size: size}
+	if h.decrypted != nil {
+		info.decrypted = h.decrypted.result()
+	}
+	return info
+}
+
+// close stops the decryption of content that is not used
+func (h *contentHash) close() {
+	if h.decrypted != nil {
+		h.decrypted.close()
+	}
+}
+
+// state returns the state of the hashes, to continue from later. The
+// decryption can't be continued, so it is left out.
+func (h *contentHash) state() ([][]byte, error) {
+	var state [][]byte
+	for _, hash := range []hash.Hash{h.sha256, h.md5} {
+		s, err := hash.(encoding.BinaryMarshaler).MarshalBinary()
+		if err != nil {
+			return nil, err
+		}
+		state = append(state, s)
+	}
+	return state, nil
+}
+
+// resumeContentHash continues hashing from a state returned by state
+func resumeContentHash(state [][]byte) (*contentHash, error) {
+	h := newContentHash()
+	hashes := []hash.Hash{h.sha256, h.md5}
+	if len(state) != len(hashes) {
+		return nil, fmt.Errorf("hash state has %d parts, not %d", len(state), len(hashes))
+	}
+	for i, hash := range hashes {
+		if err := hash.(encoding.BinaryUnmarshaler).UnmarshalBinary(state[i]); err != nil {
+			return nil, err
+		}
+	}
+	return h, nil
+}
+
+// hashedBody computes the checksums of a request body as it is forwarded
+type hashedBody struct {
+	body io.ReadCloser
+	hash *contentHash
+	size int64
+	// the whole body was read
+	done bool
+}
+
+// hashBody starts hashing the body of a single upload, it returns nil for
+// bodies that are not hashed. Bodies in the
+// aws-chunked encoding carry chunk signatures besides the content, and empty
+// bodies are kept as they are so they are not sent chunked, the checksums of
+// those are looked up afterwards instead. With a Crypt4GH key the decrypted
+// content is checksummed as well.
+func hashBody(r *http.Request, key *[32]byte) *hashedBody {
+	if r.Method != http.MethodPut || !createsObject(r) || r.Body == nil || r.Body == http.NoBody ||
+		r.Header.Get("X-Amz-Copy-Source") != "" ||
+		strings.HasPrefix(r.Header.Get("X-Amz-Content-Sha256"), "STREAMING-") {
+		return nil
+	}
+	body := &hashedBody{body: r.Body, hash: newDecryptingHash(key)}
+	r.Body = body
+	return body
+}
+
+func (b *hashedBody) Read(p []byte) (int, error) {
+	n, err := b.body.Read(p)
+	b.hash.Write(p[:n])
+	b.size += int64(n)
+	if err == io.EOF {
+		b.done = true
+	}
+	return n, err
+}
+
+// Close ends the content for the decryption, it is closed once the body is
+// sent or the request is done
+func (b *hashedBody) Close() error {
+	b.hash.close()
+	return b.body.Close()
+}
+
+// uploadedBody returns the checksums of the body of the upload, if it was
+// hashed on the way to the backend
+func uploadedBody(r *http.Request) (objectInfo, bool) {
+	body, ok := r.Body.(*hashedBody)
+	if !ok || !body.done {
+		return objectInfo{}, false
+	}
+	return body.hash.info(body.size), true
+}
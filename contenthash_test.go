@@ -0,0 +1,64 @@
+package main
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestContentHash_resume(t *testing.T) {
+	h := newContentHash()
+	_, _ = h.Write([]byte("abc"))
+	state, err := h.state()
+	assert.NoError(t, err)
+
+	resumed, err := resumeContentHash(state)
+	assert.NoError(t, err)
+	_, _ = resumed.Write([]byte("def"))
+	info := resumed.info(6)
+	assert.Equal(t, fmt.Sprintf("%x", sha256.Sum256([]byte("abcdef"))), info.checksum)
+	assert.Equal(t, fmt.Sprintf("%x", md5.Sum([]byte("abcdef"))), info.md5)
+
+	_, err = resumeContentHash(state[:1])
+	assert.Error(t, err)
+}
+
+func TestHashBody(t *testing.T) {
+	r, _ := http.NewRequest("PUT", "/user/file", strings.NewReader("some file content"))
+	hashBody(r, nil)
+	_, ok := uploadedBody(r)
+	assert.False(t, ok, "the body has not been read yet")
+
+	_, _ = io.Copy(io.Discard, r.Body)
+	info, ok := uploadedBody(r)
+	assert.True(t, ok)
+	assert.Equal(t, fmt.Sprintf("%x", sha256.Sum256([]byte("some file content"))), info.checksum)
+	assert.Equal(t, fmt.Sprintf("%x", md5.Sum([]byte("some file content"))), info.md5)
+	assert.Equal(t, int64(17), info.size)
+
+	// Parts, copies and aws-chunked bodies are not hashed
+	for _, r := range []*http.Request{
+		newBodyRequest("PUT", "/user/file?partNumber=1&uploadId=1", nil),
+		newBodyRequest("PUT", "/user/file", http.Header{"X-Amz-Copy-Source": {"/user/other"}}),
+		newBodyRequest("PUT", "/user/file", http.Header{"X-Amz-Content-Sha256": {"STREAMING-AWS4-HMAC-SHA256-PAYLOAD"}}),
+		newBodyRequest("POST", "/user/file?uploadId=1", nil),
+	} {
+		hashBody(r, nil)
+		_, hashed := r.Body.(*hashedBody)
+		assert.False(t, hashed, r.URL.String())
+	}
+}
+
+func newBodyRequest(method, path string, header http.Header) *http.Request {
+	r, _ := http.NewRequest(method, path, strings.NewReader("content"))
+	for name, values := range header {
+		r.Header[name] = values
+	}
+	return r
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/neicnordic/crypt4gh/keys"
+	"github.com/neicnordic/crypt4gh/streaming"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// readC4GHKey reads the Crypt4GH private key of the archive from the file in
+// c4gh.filepath, unlocked with c4gh.passphrase. Without a key the checksums
+// of the decrypted content are not computed.
+func readC4GHKey() (*[32]byte, error) {
+	if !viper.IsSet("c4gh.filepath") {
+		return nil, nil
+	}
+
+	file, err := os.Open(viper.GetString("c4gh.filepath")) // #nosec this file comes from our configuration
+	if err != nil {
+		return nil, fmt.Errorf("c4gh.filepath: %v", err)
+	}
+	defer file.Close()
+
+	key, err := keys.ReadPrivateKey(file, []byte(viper.GetString("c4gh.passphrase")))
+	if err != nil {
+		return nil, fmt.Errorf("c4gh.filepath: %v", err)
+	}
+	return &key, nil
+}
+
+// decryptedHash computes the checksums of the decrypted content of a
+// Crypt4GH file written to it. The decryption runs alongside, content that
+// can't be decrypted with the key is still taken but gives no checksums.
+type decryptedHash struct {
+	writer *io.PipeWriter
+	done   chan struct{}
+	info   objectInfo
+	err    error
+}
+
+func newDecryptedHash(key *[32]byte) *decryptedHash {
+	reader, writer := io.Pipe()
+	d := &decryptedHash{writer: writer, done: make(chan struct{})}
+	go func() {
+		defer close(d.done)
+		// Whatever isn't decrypted is read anyway, so writes never block
+		defer func() { _, _ = io.Copy(io.Discard, reader) }()
+
+		c4gh, err := streaming.NewCrypt4GHReader(reader, *key, nil)
+		if err != nil {
+			d.err = err
+			return
+		}
+		defer c4gh.Close()
+
+		hash := newContentHash()
+		size, err := io.Copy(hash, c4gh)
+		if err != nil {
+			d.err = err
+			return
+		}
+		d.info = hash.info(size)
+	}()
+	return d
+}
+
+func (d *decryptedHash) Write(b []byte) (int, error) {
+	// Errors only mean the decryption stopped, which is told by result
+	_, _ = d.writer.Write(b)
+	return len(b), nil
+}
+
+// close ends the content, the decryption stops if it isn't done
+func (d *decryptedHash) close() {
+	_ = d.writer.Close()
+	<-d.done
+}
+
+// result returns the checksums of the decrypted content, once all of it is
+// written, or nil if it could not be decrypted
+func (d *decryptedHash) result() *objectInfo {
+	d.close()
+	if d.err != nil {
+		log.Infof("no decrypted checksums, the content could not be decrypted: %v", d.err)
+		return nil
+	}
+	return &d.info
+}
+
+// crypt4ghMagic starts every Crypt4GH file
+var crypt4ghMagic = []byte("crypt4gh")
+
+// startsCrypt4GH tells if an upload starts like a Crypt4GH file. Only the
+// single uploads and the first parts of multipart uploads start a file, the
+// others pass. The start of the body is read and put back.
+func startsCrypt4GH(r *http.Request) bool {
+	startsFile := (r.Method == http.MethodPut && createsObject(r)) || (uploadsPart(r) && r.URL.Query().Get("partNumber") == "1")
+	if !startsFile || r.Header.Get("X-Amz-Copy-Source") != "" {
+		return true
+	}
+
+	body := bufio.NewReader(r.Body)
+	r.Body = struct {
+		io.Reader
+		io.Closer
+	}{body, r.Body}
+	// Bodies shorter than this are peeked as they are
+	start, _ := body.Peek(512)
+	if strings.HasPrefix(r.Header.Get("X-Amz-Content-Sha256"), "STREAMING-") {
+		// The content follows the header of the first chunk
+		end := bytes.Index(start, []byte("\r\n"))
+		if end < 0 {
+			return false
+		}
+		start = start[end+2:]
+	}
+	return bytes.HasPrefix(start, crypt4ghMagic)
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha256"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/neicnordic/crypt4gh/keys"
+	"github.com/neicnordic/crypt4gh/streaming"
+	"github.com/stretchr/testify/assert"
+)
+
+// encryptC4GH encrypts the content for the public key
+func encryptC4GH(t *testing.T, content string, publicKey [32]byte) []byte {
+	_, writerKey, err := keys.GenerateKeyPair()
+	assert.NoError(t, err)
+	var encrypted bytes.Buffer
+	w, err := streaming.NewCrypt4GHWriter(&encrypted, writerKey, [][32]byte{publicKey}, nil)
+	assert.NoError(t, err)
+	_, err = w.Write([]byte(content))
+	assert.NoError(t, err)
+	assert.NoError(t, w.Close())
+	return encrypted.Bytes()
+}
+
+func TestDecryptedHash(t *testing.T) {
+	publicKey, privateKey, err := keys.GenerateKeyPair()
+	assert.NoError(t, err)
+	encrypted := encryptC4GH(t, "some file content", publicKey)
+
+	d := newDecryptedHash(&privateKey)
+	// Written in pieces like a streamed body
+	for i := 0; i < len(encrypted); i += 10 {
+		_, _ = d.Write(encrypted[i:min(i+10, len(encrypted))])
+	}
+	info := d.result()
+	if assert.NotNil(t, info) {
+		assert.Equal(t, fmt.Sprintf("%x", sha256.Sum256([]byte("some file content"))), info.checksum)
+		assert.Equal(t, fmt.Sprintf("%x", md5.Sum([]byte("some file content"))), info.md5)
+		assert.Equal(t, int64(17), info.size)
+	}
+
+	// Files for other keys and plain content are taken but not decrypted
+	_, otherKey, _ := keys.GenerateKeyPair()
+	d = newDecryptedHash(&otherKey)
+	_, _ = d.Write(encrypted)
+	assert.Nil(t, d.result())
+
+	d = newDecryptedHash(&privateKey)
+	_, _ = d.Write(bytes.Repeat([]byte("not crypt4gh"), 10000))
+	assert.Nil(t, d.result())
+}
+
+func TestServeHTTP_decryptedChecksums(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.Copy(io.Discard, r.Body)
+	}))
+	defer backend.Close()
+
+	s3conf := testS3Config(backend.URL)
+	messenger := NewMockMessenger()
+	proxy := NewProxy(s3conf, NewAlwaysAllow(), messenger, new(tls.Config))
+	publicKey, privateKey, err := keys.GenerateKeyPair()
+	assert.NoError(t, err)
+	proxy.c4ghKey = &privateKey
+
+	encrypted := encryptC4GH(t, "some file content", publicKey)
+	r, _ := http.NewRequest("PUT", "/username/file.c4gh", bytes.NewReader(encrypted))
+	w := httptest.NewRecorder()
+	proxy.ServeHTTP(w, r)
+	assert.Equal(t, 200, w.Result().StatusCode)
+	if assert.NotNil(t, messenger.lastEvent) {
+		assert.Equal(t, Checksum{Type: "sha256", Value: fmt.Sprintf("%x", sha256.Sum256(encrypted))}, messenger.lastEvent.Checksum[0])
+		assert.Equal(t, []interface{}{
+			Checksum{Type: "sha256", Value: fmt.Sprintf("%x", sha256.Sum256([]byte("some file content")))},
+			Checksum{Type: "md5", Value: fmt.Sprintf("%x", md5.Sum([]byte("some file content")))},
+		}, messenger.lastEvent.DecryptedChecksums)
+	}
+}
+
+func TestServeHTTP_strictCrypt4gh(t *testing.T) {
+	var received []byte
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received, _ = io.ReadAll(r.Body)
+	}))
+	defer backend.Close()
+
+	s3conf := testS3Config(backend.URL)
+	proxy := NewProxy(s3conf, NewAlwaysAllow(), NewMockMessenger(), new(tls.Config))
+	proxy.strictCrypt4gh = true
+	publicKey, _, err := keys.GenerateKeyPair()
+	assert.NoError(t, err)
+
+	encrypted := encryptC4GH(t, "some file content", publicKey)
+	r, _ := http.NewRequest("PUT", "/username/file.c4gh", bytes.NewReader(encrypted))
+	w := httptest.NewRecorder()
+	proxy.ServeHTTP(w, r)
+	assert.Equal(t, 200, w.Code)
+	assert.Equal(t, encrypted, received, "the peeked start should be sent as well")
+
+	received = nil
+	r, _ = http.NewRequest("PUT", "/username/file.txt", bytes.NewReader([]byte("some file content")))
+	w = httptest.NewRecorder()
+	proxy.ServeHTTP(w, r)
+	assert.Equal(t, 400, w.Code)
+	assert.Nil(t, received)
+
+	// Only the first part of a multipart upload starts the file
+	r, _ = http.NewRequest("PUT", "/username/file.c4gh?partNumber=2&uploadId=upload", bytes.NewReader([]byte("rest of the file")))
+	w = httptest.NewRecorder()
+	proxy.ServeHTTP(w, r)
+	assert.Equal(t, 200, w.Code)
+
+	r, _ = http.NewRequest("PUT", "/username/file.c4gh?partNumber=1&uploadId=upload", bytes.NewReader([]byte("some file content")))
+	w = httptest.NewRecorder()
+	proxy.ServeHTTP(w, r)
+	assert.Equal(t, 400, w.Code)
+}
+
+func TestStartsCrypt4GH_streaming(t *testing.T) {
+	body := "11;chunk-signature=abc\r\ncrypt4gh\x01\x00\x00\x00\x01\x00\x00\x00\x00\r\n"
+	r, _ := http.NewRequest("PUT", "/buckbuck/username/file.c4gh", bytes.NewReader([]byte(body)))
+	r.Header.Set("X-Amz-Content-Sha256", "STREAMING-AWS4-HMAC-SHA256-PAYLOAD")
+	assert.True(t, startsCrypt4GH(r))
+	read, err := io.ReadAll(r.Body)
+	assert.NoError(t, err)
+	assert.Equal(t, body, string(read))
+
+	r, _ = http.NewRequest("PUT", "/buckbuck/username/file.c4gh", bytes.NewReader([]byte("5;chunk-signature=abc\r\nplain\r\n")))
+	r.Header.Set("X-Amz-Content-Sha256", "STREAMING-AWS4-HMAC-SHA256-PAYLOAD")
+	assert.False(t, startsCrypt4GH(r))
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"regexp"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// sha256Hex is what a sha256 checksum in an event looks like
+var sha256Hex = regexp.MustCompile("^[0-9a-f]{64}$")
+
+func init() {
+	registerMessenger("dryrun", messengerType{
+		create: func(c BrokerConfig, _ *tls.Config) (Messenger, error) {
+			return DryRunMessenger{c.format}, nil
+		},
+	})
+}
+
+// DryRunMessenger is a Messenger that checks and logs the events instead of
+// sending them, for staging environments and rehearsing migrations
+type DryRunMessenger struct {
+	format eventFormat
+}
+
+// SendMessage logs the event that would have been sent, events that would
+// not be accepted downstream are errors
+func (m DryRunMessenger) SendMessage(message Event) error {
+	if err := validateEvent(message); err != nil {
+		return fmt.Errorf("invalid event: %v", err)
+	}
+
+	// Binary and compressed events are logged as JSON, which can be read
+	format := m.format
+	if !format.text() {
+		format = eventFormat{fields: format.fields}
+	}
+	body, err := format.encode(message)
+	if err != nil {
+		return err
+	}
+	log.WithField("request_id", message.RequestID).Infof("dry run, not sending event %s", body)
+	return nil
+}
+
+// validateEvent checks that the event has what the ingestion pipeline needs
+func validateEvent(message Event) error {
+	switch {
+	case message.Operation == "":
+		return fmt.Errorf("no operation")
+	case message.Username == "":
+		return fmt.Errorf("no user")
+	case !strings.HasPrefix(message.Filepath, message.Username+"/") || len(message.Filepath) == len(message.Username)+1:
+		return fmt.Errorf("filepath %q is not a file of user %s", message.Filepath, message.Username)
+	case message.Filesize < 0:
+		return fmt.Errorf("negative filesize %d", message.Filesize)
+	}
+
+	for _, c := range message.Checksum {
+		checksum, ok := c.(Checksum)
+		if !ok {
+			return fmt.Errorf("checksum %v is not a typed value", c)
+		}
+		if checksum.Type == "sha256" && !sha256Hex.MatchString(checksum.Value) {
+			return fmt.Errorf("sha256 checksum %q is not 64 hex digits", checksum.Value)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,27 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDryRunMessenger_SendMessage(t *testing.T) {
+	m := DryRunMessenger{}
+	checksum := Checksum{Type: "sha256", Value: "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"}
+
+	event := Event{Operation: "upload", Username: "user", Filepath: "user/file.c4gh", Checksum: []interface{}{checksum}}
+	assert.NoError(t, m.SendMessage(event))
+
+	for name, invalid := range map[string]Event{
+		"no operation":       {Username: "user", Filepath: "user/file.c4gh"},
+		"no user":            {Operation: "upload", Filepath: "user/file.c4gh"},
+		"other user":         {Operation: "upload", Username: "user", Filepath: "other/file.c4gh"},
+		"no file":            {Operation: "upload", Username: "user", Filepath: "user/"},
+		"negative size":      {Operation: "upload", Username: "user", Filepath: "user/file.c4gh", Filesize: -1},
+		"untyped checksum":   {Operation: "upload", Username: "user", Filepath: "user/file.c4gh", Checksum: []interface{}{"abc"}},
+		"malformed checksum": {Operation: "upload", Username: "user", Filepath: "user/file.c4gh", Checksum: []interface{}{Checksum{Type: "sha256", Value: "abc"}}},
+	} {
+		assert.Error(t, m.SendMessage(invalid), name)
+	}
+}
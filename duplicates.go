@@ -0,0 +1,55 @@
+package main
+
+import (
+	"encoding/hex"
+	"net/http"
+	"strings"
+)
+
+// duplicateOf returns the ETag of the object at the key of a single upload
+// if it has the same size and sha256 checksum as the upload, which are known
+// from the Content-Length and the signed payload hash. Uploads with unsigned
+// or streamed payloads are never duplicates, and neither are objects the
+// backend stores no full sha256 checksum for, since reading them back would
+// cost as much as the upload.
+func (p *Proxy) duplicateOf(r *http.Request) (string, bool) {
+	if r.Method != http.MethodPut || !createsObject(r) || r.Header.Get("X-Amz-Copy-Source") != "" {
+		return "", false
+	}
+	digest := strings.ToLower(r.Header.Get("X-Amz-Content-Sha256"))
+	if _, err := hex.DecodeString(digest); err != nil || len(digest) != 64 || r.ContentLength < 0 {
+		return "", false
+	}
+
+	key := strings.Replace(r.URL.Path, "/"+p.s3.bucket+"/", "", 1)
+	object, err := p.headObject(r.Context(), key, "")
+	if err != nil || object.size != r.ContentLength || object.checksum != digest {
+		return "", false
+	}
+
+	// The event of the duplicate carries the checksum
+	p.objectCache.add(p.objectCacheKey(key, object.etag), objectInfo{checksum: object.checksum, size: object.size})
+	return `"` + object.etag + `"`, true
+}
+
+// duplicateResponse answers an upload of content that is already stored at
+// its key as if it was uploaded, and announces it as a duplicate
+func (p *Proxy) duplicateResponse(w http.ResponseWriter, r *http.Request, etag string) {
+	requestLog(r).Infof("upload to %s is a duplicate of the stored object", r.URL.Path)
+
+	header := http.Header{}
+	header.Set("ETag", etag)
+	message, err := p.CreateMessageFromRequest(r, header)
+	if err != nil {
+		requestLog(r).Errorf("no message sent for upload: %v", err)
+	} else {
+		message.Duplicate = true
+		if err = p.messenger.SendMessage(message); err != nil {
+			requestLog(r).Debug("error when sending message")
+			requestLog(r).Debug(err)
+		}
+	}
+
+	w.Header().Set("ETag", etag)
+	w.WriteHeader(http.StatusOK)
+}
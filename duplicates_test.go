@@ -0,0 +1,83 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestServeHTTP_duplicate(t *testing.T) {
+	content := "some file content"
+	sum := sha256.Sum256([]byte(content))
+	storedChecksum := base64.StdEncoding.EncodeToString(sum[:])
+	uploaded, readBack := false, false
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ETag", `"stored"`)
+		switch r.Method {
+		case http.MethodHead:
+			w.Header().Set("Content-Length", fmt.Sprint(len(content)))
+			if storedChecksum != "" {
+				w.Header().Set("X-Amz-Checksum-Sha256", storedChecksum)
+			}
+		case http.MethodGet:
+			readBack = true
+		case http.MethodPut:
+			uploaded = true
+		}
+	}))
+	defer backend.Close()
+
+	s3conf := testS3Config(backend.URL)
+	s3conf.lookupCacheTTL = time.Minute
+	s3conf.lookupCacheSize = 10
+	messenger := NewMockMessenger()
+	proxy := NewProxy(s3conf, NewAlwaysAllow(), messenger, new(tls.Config))
+	proxy.detectDuplicates = true
+
+	r, _ := http.NewRequest("PUT", "/username/file", strings.NewReader(content))
+	r.Header.Set("X-Amz-Content-Sha256", fmt.Sprintf("%x", sha256.Sum256([]byte(content))))
+	w := httptest.NewRecorder()
+	proxy.ServeHTTP(w, r)
+	assert.Equal(t, 200, w.Code)
+	assert.Equal(t, `"stored"`, w.Header().Get("ETag"))
+	assert.False(t, uploaded, "duplicate should not be uploaded")
+	assert.False(t, readBack, "the stored checksum should be used")
+	if assert.NotNil(t, messenger.lastEvent) {
+		assert.True(t, messenger.lastEvent.Duplicate)
+		assert.Equal(t, "username/file", messenger.lastEvent.Filepath)
+	}
+
+	// Other content is uploaded
+	messenger.lastEvent = nil
+	other := "other file content"
+	r, _ = http.NewRequest("PUT", "/username/file", strings.NewReader(other))
+	r.Header.Set("X-Amz-Content-Sha256", fmt.Sprintf("%x", sha256.Sum256([]byte(other))))
+	w = httptest.NewRecorder()
+	proxy.ServeHTTP(w, r)
+	assert.True(t, uploaded)
+
+	// and so are unsigned payloads
+	uploaded = false
+	r, _ = http.NewRequest("PUT", "/username/file", strings.NewReader(content))
+	r.Header.Set("X-Amz-Content-Sha256", "UNSIGNED-PAYLOAD")
+	w = httptest.NewRecorder()
+	proxy.ServeHTTP(w, r)
+	assert.True(t, uploaded)
+
+	// and uploads over objects without a stored checksum
+	uploaded, storedChecksum = false, ""
+	r, _ = http.NewRequest("PUT", "/username/file", strings.NewReader(content))
+	r.Header.Set("X-Amz-Content-Sha256", fmt.Sprintf("%x", sum))
+	w = httptest.NewRecorder()
+	proxy.ServeHTTP(w, r)
+	assert.True(t, uploaded)
+	assert.False(t, readBack)
+}
@@ -0,0 +1,368 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"reflect"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/getsentry/sentry-go"
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// Panics and the errors that are logged can be reported to Sentry, or as
+// JSON to a webhook of another error tracker, with the stack trace and the
+// fields of the log entry, like the request id:
+//
+//	reporting:
+//	  dsn: "https://key@sentry.example.org/42"
+//	  webhook: "https://errors.example.org/hooks/s3inbox"
+//	  environment: "prod"
+//
+// The reports are sent to Sentry with its SDK. Both are sent in the
+// background, and dropped when too many are waiting to be sent. Nothing is
+// sent or logged while the log calls the hook, which holds the lock of the
+// log; the reports still waiting are flushed for a while before the proxy
+// exits.
+
+// maxQueuedReports is how many reports can wait to be sent
+const maxQueuedReports = 100
+
+var errorsUnreported = prometheus.NewCounter(prometheus.CounterOpts{
+	Name: "s3proxy_errors_unreported_total",
+	Help: "Number of errors that could not be reported to the webhook.",
+})
+
+func init() {
+	prometheus.MustRegister(errorsUnreported)
+}
+
+// appPackage starts the names of the functions of the proxy in stack
+// traces, it is main but for the tests
+var appPackage = reflect.TypeOf(errorReporter{}).PkgPath() + "."
+
+// reportingConfig stores the settings of the error reporting
+type reportingConfig struct {
+	// DSN of the Sentry project, empty for none
+	dsn string
+	// URL the reports are posted to as JSON, empty for none
+	webhook     string
+	environment string
+	timeout     time.Duration
+}
+
+// readReportingConfig reads the reporting section of the configuration
+func readReportingConfig(secrets secretsConfig) (reportingConfig, error) {
+	c := reportingConfig{
+		webhook:     viper.GetString("reporting.webhook"),
+		environment: viper.GetString("reporting.environment"),
+		timeout:     10 * time.Second,
+	}
+	var err error
+	if c.dsn, _, err = readSecret("reporting.dsn", secrets); err != nil {
+		return c, err
+	}
+	if c.dsn != "" {
+		if _, err := sentry.NewDsn(c.dsn); err != nil {
+			return c, fmt.Errorf("reporting.dsn: %v", err)
+		}
+	}
+	if c.webhook != "" && !strings.HasPrefix(c.webhook, "http://") && !strings.HasPrefix(c.webhook, "https://") {
+		return c, fmt.Errorf("reporting.webhook: %q is not an http or https url", c.webhook)
+	}
+	if viper.IsSet("reporting.timeout") {
+		c.timeout = viper.GetDuration("reporting.timeout")
+		if c.timeout <= 0 {
+			return c, fmt.Errorf("reporting.timeout must be positive")
+		}
+	}
+	return c, nil
+}
+
+// errorReport is a panic or a logged error
+type errorReport struct {
+	time    time.Time
+	level   log.Level
+	message string
+	// what the panic or error was, like *url.Error
+	kind   string
+	fields log.Fields
+	// the calls that led to it, the innermost first
+	frames []runtime.Frame
+}
+
+// errorReporter reports errors to Sentry and the webhook, it is a hook of
+// the log that reports the errors that are logged
+type errorReporter struct {
+	sentry      *sentry.Hub
+	webhook     string
+	environment string
+	release     string
+	hostname    string
+	client      *http.Client
+	queue       chan errorReport
+	// the reports for the webhook that are queued or being sent
+	pending sync.WaitGroup
+}
+
+// newErrorReporter sets up the reporting of the configuration, it is nil if
+// the errors are not reported
+func newErrorReporter(c reportingConfig) (*errorReporter, error) {
+	if c.dsn == "" && c.webhook == "" {
+		return nil, nil
+	}
+	r := &errorReporter{
+		webhook:     c.webhook,
+		environment: c.environment,
+		release:     "s3inbox@" + currentVersion().Version,
+		client:      &http.Client{Timeout: c.timeout},
+		queue:       make(chan errorReport, maxQueuedReports),
+	}
+	r.hostname, _ = os.Hostname()
+	if c.dsn != "" {
+		transport := sentry.NewHTTPTransport()
+		transport.Timeout = c.timeout
+		client, err := sentry.NewClient(sentry.ClientOptions{
+			Dsn:         c.dsn,
+			Environment: c.environment,
+			Release:     r.release,
+			ServerName:  r.hostname,
+			Transport:   transport,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("reporting.dsn: %v", err)
+		}
+		r.sentry = sentry.NewHub(client, sentry.NewScope())
+	}
+	return r, nil
+}
+
+// Run posts the reports in the queue to the webhook until the context is
+// done, it should be run as a go routine
+func (r *errorReporter) Run(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case report := <-r.queue:
+			if err := r.post(r.webhookEvent(report)); err != nil {
+				errorsUnreported.Inc()
+				// Not an error, which would be reported again
+				log.Warnf("failed to report error to %s: %v", redactURL(r.webhook), err)
+			}
+			r.pending.Done()
+		}
+	}
+}
+
+// flush waits at most timeout for the reports that are not sent yet, it is
+// called before the proxy exits
+func (r *errorReporter) flush(timeout time.Duration) {
+	if r == nil {
+		return
+	}
+	deadline := time.Now().Add(timeout)
+	if r.sentry != nil {
+		r.sentry.Flush(timeout)
+	}
+	sent := make(chan struct{})
+	go func() {
+		r.pending.Wait()
+		close(sent)
+	}()
+	select {
+	case <-sent:
+	case <-time.After(time.Until(deadline)):
+	}
+}
+
+// Levels are those of the entries of the log that are reported
+func (r *errorReporter) Levels() []log.Level {
+	return []log.Level{log.PanicLevel, log.FatalLevel, log.ErrorLevel}
+}
+
+// Fire reports the entry of the log
+func (r *errorReporter) Fire(entry *log.Entry) error {
+	report := errorReport{time: entry.Time, level: entry.Level, message: entry.Message, kind: "error", fields: log.Fields{}}
+	for key, value := range entry.Data {
+		if err, ok := value.(error); ok {
+			report.kind = fmt.Sprintf("%T", err)
+			value = err.Error()
+		}
+		report.fields[key] = value
+	}
+	report.frames = callers(logrusFrames)
+	r.report(report)
+	return nil
+}
+
+// recoverPanics reports the panics of the handler with the request they
+// happened in, and panics again so the server closes the connection. The
+// panics of the log were reported when they were logged.
+func (r *errorReporter) recoverPanics(handler http.Handler) http.Handler {
+	if r == nil {
+		return handler
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		defer func() {
+			recovered := recover()
+			if recovered == nil {
+				return
+			}
+			_, logged := recovered.(*log.Entry)
+			if recovered != http.ErrAbortHandler && !logged {
+				r.report(errorReport{
+					time:    time.Now(),
+					level:   log.PanicLevel,
+					message: fmt.Sprint(recovered),
+					kind:    "panic",
+					fields: log.Fields{
+						"method":     req.Method,
+						"path":       req.URL.Path,
+						"user":       requestUser(req),
+						"request_id": w.Header().Get("X-Amz-Request-Id"),
+						"client_ip":  clientIP(req, nil),
+					},
+					frames: callers(panicFrames),
+				})
+			}
+			panic(recovered)
+		}()
+		handler.ServeHTTP(w, req)
+	})
+}
+
+// report hands the report to Sentry and queues it for the webhook, without
+// waiting for either
+func (r *errorReporter) report(report errorReport) {
+	if r.sentry != nil {
+		r.sentry.CaptureEvent(r.sentryEvent(report))
+	}
+	if r.webhook == "" {
+		return
+	}
+	r.pending.Add(1)
+	select {
+	case r.queue <- report:
+	default:
+		r.pending.Done()
+		errorsUnreported.Inc()
+	}
+}
+
+// post posts the event to the webhook
+func (r *errorReporter) post(event interface{}) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, r.webhook, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	res, err := r.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	_, _ = io.Copy(io.Discard, io.LimitReader(res.Body, 1<<16))
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return fmt.Errorf("%s", res.Status)
+	}
+	return nil
+}
+
+// sentryEvent is the report as an event of Sentry
+func (r *errorReporter) sentryEvent(report errorReport) *sentry.Event {
+	// Sentry lists the frames the outermost first
+	frames := make([]sentry.Frame, 0, len(report.frames))
+	for i := len(report.frames) - 1; i >= 0; i-- {
+		frames = append(frames, sentry.NewFrame(report.frames[i]))
+	}
+	level := sentry.LevelError
+	if report.level <= log.FatalLevel {
+		level = sentry.LevelFatal
+	}
+	event := sentry.NewEvent()
+	event.Timestamp = report.time
+	event.Level = level
+	event.Logger = "s3inbox"
+	event.Message = report.message
+	event.Extra = map[string]interface{}(report.fields)
+	for _, key := range []string{"request_id", "user"} {
+		if value, ok := report.fields[key]; ok {
+			event.Tags[key] = fmt.Sprint(value)
+		}
+	}
+	event.Exception = []sentry.Exception{{
+		Type:       report.kind,
+		Value:      report.message,
+		Stacktrace: &sentry.Stacktrace{Frames: frames},
+	}}
+	return event
+}
+
+// webhookEvent is the report as it is posted to the webhook
+func (r *errorReporter) webhookEvent(report errorReport) map[string]interface{} {
+	stack := make([]string, 0, len(report.frames))
+	for _, f := range report.frames {
+		stack = append(stack, fmt.Sprintf("%s\n\t%s:%d", f.Function, f.File, f.Line))
+	}
+	return map[string]interface{}{
+		"time":        report.time.UTC().Format(time.RFC3339Nano),
+		"level":       report.level.String(),
+		"type":        report.kind,
+		"message":     report.message,
+		"fields":      report.fields,
+		"stack":       stack,
+		"release":     r.release,
+		"environment": r.environment,
+		"host":        r.hostname,
+	}
+}
+
+// logrusFrames and panicFrames tell the frames of the log and of the panic
+// apart from those of the call that logged or panicked
+func logrusFrames(f runtime.Frame) bool {
+	return strings.HasPrefix(f.Function, "github.com/sirupsen/logrus.") || strings.HasPrefix(f.Function, appPackage+"(*errorReporter).")
+}
+
+func panicFrames(f runtime.Frame) bool {
+	return strings.HasPrefix(f.Function, "runtime.") || strings.HasPrefix(f.Function, appPackage+"(*errorReporter).")
+}
+
+// callers returns the calls that led to the current one, the innermost first,
+// leaving out those at the top that the skip function picks
+func callers(skip func(runtime.Frame) bool) []runtime.Frame {
+	pcs := make([]uintptr, 64)
+	n := runtime.Callers(2, pcs)
+	iterator := runtime.CallersFrames(pcs[:n])
+	var frames []runtime.Frame
+	skipping := true
+	for {
+		frame, more := iterator.Next()
+		if skipping && skip(frame) {
+			if !more {
+				break
+			}
+			continue
+		}
+		skipping = false
+		frames = append(frames, frame)
+		if !more {
+			break
+		}
+	}
+	return frames
+}
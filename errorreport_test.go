@@ -0,0 +1,183 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+// errorTracker receives the reports of the reporter, the last line of the
+// envelopes of Sentry is the event
+func errorTracker() (*httptest.Server, chan *http.Request, chan map[string]interface{}) {
+	requests := make(chan *http.Request, 10)
+	events := make(chan map[string]interface{}, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		lines := bytes.Split(bytes.TrimSpace(body), []byte("\n"))
+		var event map[string]interface{}
+		_ = json.Unmarshal(lines[len(lines)-1], &event)
+		requests <- r
+		events <- event
+	}))
+	return server, requests, events
+}
+
+func TestErrorReporter_sentry(t *testing.T) {
+	server, requests, events := errorTracker()
+	defer server.Close()
+
+	reporter, err := newErrorReporter(reportingConfig{dsn: strings.Replace(server.URL, "http://", "http://key@", 1) + "/42", environment: "test", timeout: time.Second})
+	assert.NoError(t, err)
+	logger := log.New()
+	logger.SetOutput(&strings.Builder{})
+	logger.AddHook(reporter)
+
+	// Warnings are not reported, errors are
+	logger.Warn("something is odd")
+	logger.WithField("request_id", "req-1").WithError(errors.New("connection refused")).Error("event lost")
+	reporter.flush(time.Second)
+
+	r := <-requests
+	event := <-events
+	assert.Equal(t, "/api/42/envelope/", r.URL.Path)
+	assert.Contains(t, r.Header.Get("X-Sentry-Auth"), "sentry_key=key")
+	assert.Equal(t, "error", event["level"])
+	assert.Equal(t, "test", event["environment"])
+	assert.Equal(t, "req-1", event["tags"].(map[string]interface{})["request_id"])
+	assert.Equal(t, "connection refused", event["extra"].(map[string]interface{})["error"])
+	exception := event["exception"].([]interface{})[0].(map[string]interface{})
+	assert.Equal(t, "*errors.errorString", exception["type"])
+	assert.Equal(t, "event lost", exception["value"])
+	frames := exception["stacktrace"].(map[string]interface{})["frames"].([]interface{})
+	if assert.NotEmpty(t, frames) {
+		// The innermost frame, last for Sentry, is where the error was logged
+		frame := frames[len(frames)-1].(map[string]interface{})
+		assert.Equal(t, "TestErrorReporter_sentry", frame["function"])
+		assert.Equal(t, true, frame["in_app"])
+	}
+	assert.Empty(t, requests)
+}
+
+func TestErrorReporter_fatal(t *testing.T) {
+	server, requests, events := errorTracker()
+	defer server.Close()
+
+	reporter, err := newErrorReporter(reportingConfig{webhook: server.URL, timeout: time.Second})
+	assert.NoError(t, err)
+	logger := log.New()
+	logger.SetOutput(&strings.Builder{})
+	logger.AddHook(reporter)
+	exited := false
+	logger.ExitFunc = func(int) { exited = true }
+
+	// The hook only queues the report, so the log is not locked while it
+	// is sent, and the report is sent before the proxy exits
+	logger.Fatal("cannot go on")
+	assert.True(t, exited)
+	assert.Empty(t, requests)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go reporter.Run(ctx)
+	reporter.flush(time.Second)
+	assert.Len(t, requests, 1)
+	assert.Equal(t, "fatal", (<-events)["level"])
+
+	// The panics of the log are reported once
+	handler := reporter.recoverPanics(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		logger.Panic("cannot serve")
+	}))
+	assert.Panics(t, func() {
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/user/file", nil))
+	})
+	reporter.flush(time.Second)
+	assert.Len(t, events, 1)
+	assert.Equal(t, "cannot serve", (<-events)["message"])
+}
+
+func TestErrorReporter_panics(t *testing.T) {
+	server, requests, events := errorTracker()
+	defer server.Close()
+
+	reporter, err := newErrorReporter(reportingConfig{webhook: server.URL, timeout: time.Second})
+	assert.NoError(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go reporter.Run(ctx)
+	handler := reporter.recoverPanics(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Amz-Request-Id", "req-2")
+		var proxy *Proxy
+		proxy.ServeHTTP(w, r)
+	}))
+
+	// The panic goes on to the server after it is reported
+	assert.Panics(t, func() {
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("PUT", "/user/file", nil))
+	})
+	r := <-requests
+	event := <-events
+	assert.Equal(t, "application/json", r.Header.Get("Content-Type"))
+	assert.Equal(t, "panic", event["level"])
+	assert.Equal(t, "panic", event["type"])
+	assert.Contains(t, event["message"], "nil pointer dereference")
+	fields := event["fields"].(map[string]interface{})
+	assert.Equal(t, "req-2", fields["request_id"])
+	assert.Equal(t, "user", fields["user"])
+	assert.Equal(t, "/user/file", fields["path"])
+	stack := event["stack"].([]interface{})
+	if assert.NotEmpty(t, stack) {
+		assert.True(t, strings.HasPrefix(stack[0].(string), appPackage+"(*Proxy).ServeHTTP"), stack[0])
+	}
+
+	// Handlers that abort are not reported
+	handler = reporter.recoverPanics(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		panic(http.ErrAbortHandler)
+	}))
+	assert.Panics(t, func() {
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/user/file", nil))
+	})
+	assert.Empty(t, requests)
+
+	// Without a reporter the handler is left as it is
+	var none *errorReporter
+	none, err = newErrorReporter(reportingConfig{})
+	assert.NoError(t, err)
+	assert.Nil(t, none)
+	assert.NotNil(t, none.recoverPanics(http.NotFoundHandler()))
+}
+
+func (suite *TestSuite) TestConfigReporting() {
+	config, err := NewConfig()
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), "", config.Reporting.dsn)
+
+	viper.Set("reporting.dsn", "https://key@sentry.example.org/42")
+	viper.Set("reporting.webhook", "https://errors.example.org/hooks/s3inbox")
+	viper.Set("reporting.timeout", "5s")
+	config, err = NewConfig()
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), reportingConfig{
+		dsn:     "https://key@sentry.example.org/42",
+		webhook: "https://errors.example.org/hooks/s3inbox",
+		timeout: 5 * time.Second,
+	}, config.Reporting)
+
+	viper.Set("reporting.dsn", "sentry.example.org")
+	_, err = NewConfig()
+	assert.Error(suite.T(), err)
+
+	viper.Set("reporting.dsn", "")
+	viper.Set("reporting.webhook", "errors.example.org")
+	_, err = NewConfig()
+	assert.Error(suite.T(), err)
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"sort"
+
+	"github.com/spf13/viper"
+)
+
+// readStaticFields reads the fields added to every event from
+// broker.staticFields, so the events of different sites can be told apart
+func readStaticFields() (map[string]string, error) {
+	if !viper.IsSet("broker.staticFields") {
+		return nil, nil
+	}
+	fields := viper.GetStringMapString("broker.staticFields")
+	for name := range fields {
+		if name == "" {
+			return nil, errors.New("broker.staticFields can not have an empty name")
+		}
+	}
+	return fields, nil
+}
+
+// eventData is an event with the static fields, which are sent beside the
+// fields of the event in JSON
+type eventData struct {
+	Event
+	fields map[string]string
+}
+
+func (d eventData) MarshalJSON() ([]byte, error) {
+	body, err := json.Marshal(d.Event)
+	if err != nil || len(d.fields) == 0 {
+		return body, err
+	}
+
+	// The fields of the event take precedence
+	var present map[string]json.RawMessage
+	if err := json.Unmarshal(body, &present); err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	buf.Write(body[:len(body)-1])
+	for _, name := range sortedNames(d.fields) {
+		if _, ok := present[name]; ok {
+			continue
+		}
+		key, _ := json.Marshal(name)
+		value, _ := json.Marshal(d.fields[name])
+		buf.WriteByte(',')
+		buf.Write(key)
+		buf.WriteByte(':')
+		buf.Write(value)
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
+
+// sortedNames returns the names of the fields in order, so the events are
+// encoded the same every time
+func sortedNames(fields map[string]string) []string {
+	names := make([]string, 0, len(fields))
+	for name := range fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEventData(t *testing.T) {
+	event := Event{Operation: "upload", Username: "user", Filepath: "user/file"}
+
+	// Without fields the event is as it is
+	body, err := json.Marshal(eventData{Event: event})
+	assert.NoError(t, err)
+	expected, _ := json.Marshal(event)
+	assert.Equal(t, expected, body)
+
+	body, err = json.Marshal(eventData{event, map[string]string{"site": "NO-OSLO", "environment": "prod", "user": "other"}})
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{"operation":"upload","user":"user","filepath":"user/file","filesize":0,"encrypted_checksums":null,"environment":"prod","site":"NO-OSLO"}`, string(body))
+
+	// The event can still be read back
+	var read eventData
+	assert.NoError(t, json.Unmarshal(body, &read))
+	assert.Equal(t, event, read.Event)
+
+	// The fields are in the data of CloudEvents
+	format := eventFormat{name: cloudEventsFormat, fields: map[string]string{"site": "NO-OSLO"}}
+	body, err = format.encode(event)
+	assert.NoError(t, err)
+	var envelope struct {
+		Data map[string]interface{} `json:"data"`
+	}
+	assert.NoError(t, json.Unmarshal(body, &envelope))
+	assert.Equal(t, "NO-OSLO", envelope.Data["site"])
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/spf13/viper"
+)
+
+// Formats of the messages: the events as they are, wrapped in a CloudEvents
+// 1.0 envelope in the structured JSON mode, or encoded with Avro or Protobuf
+const (
+	jsonFormat        = "json"
+	cloudEventsFormat = "cloudevents"
+	avroFormat        = "avro"
+	protobufFormat    = "protobuf"
+)
+
+// eventFormat is how the events are encoded in the messages, the zero value
+// sends them as they are
+type eventFormat struct {
+	name string
+	// source of the CloudEvents, and the prefix of their types which end
+	// with the operation
+	source     string
+	typePrefix string
+	// registry of the Avro and Protobuf schemas, nil sends the events
+	// without the schema id
+	registry *schemaRegistry
+	// compression of the message bodies, empty leaves them uncompressed
+	compression string
+	// fields added to every event
+	fields map[string]string
+}
+
+// readEventFormat reads the format of the messages from broker.format,
+// broker.compression, broker.staticFields, the broker.cloudEvents and the
+// broker.schemaRegistry sections
+func readEventFormat() (eventFormat, error) {
+	f := eventFormat{name: jsonFormat, source: "/s3inbox", typePrefix: "s3inbox."}
+
+	if viper.IsSet("broker.format") {
+		f.name = strings.ToLower(viper.GetString("broker.format"))
+	}
+	switch f.name {
+	case jsonFormat, cloudEventsFormat, avroFormat, protobufFormat:
+	default:
+		return f, fmt.Errorf("broker.format %q is not one of %s, %s, %s or %s", f.name, jsonFormat, cloudEventsFormat, avroFormat, protobufFormat)
+	}
+
+	if viper.IsSet("broker.cloudEvents.source") {
+		f.source = viper.GetString("broker.cloudEvents.source")
+		if f.source == "" {
+			return f, fmt.Errorf("broker.cloudEvents.source can not be empty")
+		}
+	}
+	if viper.IsSet("broker.cloudEvents.typePrefix") {
+		f.typePrefix = viper.GetString("broker.cloudEvents.typePrefix")
+	}
+
+	if viper.IsSet("broker.compression") {
+		f.compression = strings.ToLower(viper.GetString("broker.compression"))
+	}
+	switch f.compression {
+	case "none":
+		f.compression = ""
+	case "", gzipCompression, zstdCompression:
+	default:
+		return f, fmt.Errorf("broker.compression %q is not one of none, %s or %s", f.compression, gzipCompression, zstdCompression)
+	}
+
+	var err error
+	if f.fields, err = readStaticFields(); err != nil {
+		return f, err
+	}
+	if f.registry, err = readSchemaRegistry(); err != nil {
+		return f, err
+	}
+	if f.registry != nil && !f.binary() {
+		return f, fmt.Errorf("broker.schemaRegistry needs broker.format %s or %s", avroFormat, protobufFormat)
+	}
+
+	return f, nil
+}
+
+// cloudEvent is the CloudEvents envelope of an event
+type cloudEvent struct {
+	SpecVersion     string    `json:"specversion"`
+	Type            string    `json:"type"`
+	Source          string    `json:"source"`
+	ID              string    `json:"id"`
+	Time            string    `json:"time"`
+	Subject         string    `json:"subject,omitempty"`
+	DataContentType string    `json:"datacontenttype"`
+	Data            eventData `json:"data"`
+}
+
+// envelope wraps the event in a CloudEvent, the file is its subject
+func (f eventFormat) envelope(message Event) cloudEvent {
+	timestamp := message.Timestamp
+	if timestamp == "" {
+		timestamp = time.Now().UTC().Format(time.RFC3339)
+	}
+	return cloudEvent{
+		SpecVersion:     "1.0",
+		Type:            f.typePrefix + message.Operation,
+		Source:          f.source,
+		ID:              uuid.New().String(),
+		Time:            timestamp,
+		Subject:         message.Filepath,
+		DataContentType: "application/json",
+		Data:            eventData{message, f.fields},
+	}
+}
+
+// encode returns the message body of an event
+func (f eventFormat) encode(message Event) ([]byte, error) {
+	body, err := f.serialize(message)
+	if err != nil {
+		return nil, err
+	}
+	return f.compress(body)
+}
+
+// serialize returns the event in the format
+func (f eventFormat) serialize(message Event) ([]byte, error) {
+	switch f.name {
+	case cloudEventsFormat:
+		return json.Marshal(f.envelope(message))
+	case avroFormat:
+		return f.framed(avroEvent(message, f.fields), avroSchema, "AVRO", nil)
+	case protobufFormat:
+		// The message indexes of the first message in the schema
+		return f.framed(protobufEvent(message, f.fields), protobufSchema, "PROTOBUF", []byte{0})
+	}
+	return json.Marshal(eventData{message, f.fields})
+}
+
+// framed starts the binary events with the id of their schema in the
+// registry, in the wire format of the Confluent serializers
+func (f eventFormat) framed(payload []byte, schema, schemaType string, indexes []byte) ([]byte, error) {
+	if f.registry == nil {
+		return payload, nil
+	}
+	id, err := f.registry.schemaID(schema, schemaType)
+	if err != nil {
+		return nil, err
+	}
+	b := make([]byte, 5, 5+len(indexes)+len(payload))
+	binary.BigEndian.PutUint32(b[1:], id)
+	b = append(b, indexes...)
+	return append(b, payload...), nil
+}
+
+// binary tells if the events are encoded in a binary format, which only
+// some messengers can take
+func (f eventFormat) binary() bool {
+	return f.name == avroFormat || f.name == protobufFormat
+}
+
+// text tells if the message bodies are text, neither binary nor compressed
+func (f eventFormat) text() bool {
+	return !f.binary() && f.compression == ""
+}
+
+// encodeBatch returns the message body of a batch of events, a JSON array
+// of them
+func (f eventFormat) encodeBatch(messages []Event) ([]byte, error) {
+	body, err := f.serializeBatch(messages)
+	if err != nil {
+		return nil, err
+	}
+	return f.compress(body)
+}
+
+func (f eventFormat) serializeBatch(messages []Event) ([]byte, error) {
+	switch {
+	case f.binary():
+		return nil, fmt.Errorf("events in %s are not sent in batches", f.name)
+	case f.name != cloudEventsFormat:
+		data := make([]eventData, len(messages))
+		for i, message := range messages {
+			data[i] = eventData{message, f.fields}
+		}
+		return json.Marshal(data)
+	}
+	envelopes := make([]cloudEvent, len(messages))
+	for i, message := range messages {
+		envelopes[i] = f.envelope(message)
+	}
+	return json.Marshal(envelopes)
+}
+
+// contentType is the content type of the message bodies
+func (f eventFormat) contentType() string {
+	switch f.name {
+	case cloudEventsFormat:
+		return "application/cloudevents+json"
+	case avroFormat:
+		return "application/avro"
+	case protobufFormat:
+		return "application/x-protobuf"
+	}
+	return "application/json"
+}
+
+// batchContentType is the content type of the message bodies of batches
+func (f eventFormat) batchContentType() string {
+	if f.name == cloudEventsFormat {
+		return "application/cloudevents-batch+json"
+	}
+	return "application/json"
+}
+
+// checksumsOf returns the checksums of an event, they are maps when the
+// event was read back from JSON
+func checksumsOf(list []interface{}) []Checksum {
+	checksums := make([]Checksum, 0, len(list))
+	for _, item := range list {
+		switch checksum := item.(type) {
+		case Checksum:
+			checksums = append(checksums, checksum)
+		case map[string]interface{}:
+			kind, _ := checksum["type"].(string)
+			value, _ := checksum["value"].(string)
+			checksums = append(checksums, Checksum{Type: kind, Value: value})
+		}
+	}
+	return checksums
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEventFormat(t *testing.T) {
+	event := Event{Operation: "upload", Username: "user", Filepath: "user/a.c4gh", Filesize: 5}
+
+	// The zero value sends the events as they are
+	var plain eventFormat
+	body, err := plain.encode(event)
+	assert.NoError(t, err)
+	expected, _ := json.Marshal(event)
+	assert.Equal(t, expected, body)
+	assert.Equal(t, "application/json", plain.contentType())
+
+	format := eventFormat{name: cloudEventsFormat, source: "/inbox/se", typePrefix: "org.example.inbox."}
+	body, err = format.encode(event)
+	assert.NoError(t, err)
+	var envelope map[string]interface{}
+	assert.NoError(t, json.Unmarshal(body, &envelope))
+	assert.Equal(t, "1.0", envelope["specversion"])
+	assert.Equal(t, "org.example.inbox.upload", envelope["type"])
+	assert.Equal(t, "/inbox/se", envelope["source"])
+	assert.Equal(t, "user/a.c4gh", envelope["subject"])
+	assert.Equal(t, "application/json", envelope["datacontenttype"])
+	assert.Len(t, envelope["id"], 36)
+	assert.NotEmpty(t, envelope["time"])
+	assert.Equal(t, "user/a.c4gh", envelope["data"].(map[string]interface{})["filepath"])
+	assert.Equal(t, "application/cloudevents+json", format.contentType())
+
+	// The time of the event is kept
+	event.Timestamp = "2024-01-02T03:04:05Z"
+	body, _ = format.encode(event)
+	assert.NoError(t, json.Unmarshal(body, &envelope))
+	assert.Equal(t, "2024-01-02T03:04:05Z", envelope["time"])
+
+	var envelopes []cloudEvent
+	body, err = format.encodeBatch([]Event{event, event})
+	assert.NoError(t, err)
+	assert.NoError(t, json.Unmarshal(body, &envelopes))
+	if assert.Len(t, envelopes, 2) {
+		assert.NotEqual(t, envelopes[0].ID, envelopes[1].ID, "every event has its own id")
+	}
+	assert.Equal(t, "application/cloudevents-batch+json", format.batchContentType())
+}
+
+func TestEventFormat_binary(t *testing.T) {
+	event := Event{Operation: "upload", Username: "user", Filepath: "user/a.c4gh"}
+
+	// Without a registry the events are just the encoded event
+	body, err := eventFormat{name: avroFormat}.encode(event)
+	assert.NoError(t, err)
+	assert.Equal(t, avroEvent(event, nil), body)
+	body, err = eventFormat{name: protobufFormat}.encode(event)
+	assert.NoError(t, err)
+	assert.Equal(t, protobufEvent(event, nil), body)
+	assert.Equal(t, "application/x-protobuf", eventFormat{name: protobufFormat}.contentType())
+
+	_, err = eventFormat{name: avroFormat}.encodeBatch([]Event{event})
+	assert.Error(t, err)
+}
+
+func TestEventFormat_compression(t *testing.T) {
+	event := Event{Operation: "upload", Username: "user", Filepath: "user/a.c4gh"}
+	expected, _ := json.Marshal(event)
+	assert.Equal(t, "UTF-8", eventFormat{}.contentEncoding("UTF-8"))
+	assert.True(t, eventFormat{}.text())
+
+	format := eventFormat{compression: gzipCompression}
+	assert.False(t, format.text())
+	assert.Equal(t, "gzip", format.contentEncoding("UTF-8"))
+	body, err := format.encode(event)
+	assert.NoError(t, err)
+	reader, err := gzip.NewReader(bytes.NewReader(body))
+	if assert.NoError(t, err) {
+		decompressed, err := io.ReadAll(reader)
+		assert.NoError(t, err)
+		assert.Equal(t, expected, decompressed)
+	}
+
+	format = eventFormat{compression: zstdCompression}
+	assert.Equal(t, "zstd", format.contentEncoding(""))
+	body, err = format.encode(event)
+	assert.NoError(t, err)
+	decoder, _ := zstd.NewReader(nil)
+	defer decoder.Close()
+	decompressed, err := decoder.DecodeAll(body, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, expected, decompressed)
+
+	// Batches are compressed as a whole
+	body, err = format.encodeBatch([]Event{event, event})
+	assert.NoError(t, err)
+	decompressed, err = decoder.DecodeAll(body, nil)
+	assert.NoError(t, err)
+	var events []Event
+	assert.NoError(t, json.Unmarshal(decompressed, &events))
+	assert.Len(t, events, 2)
+}
+
+func TestChecksumsOf(t *testing.T) {
+	// Spooled events have maps for checksums
+	var spooled Event
+	assert.NoError(t, json.Unmarshal([]byte(`{"encrypted_checksums": [{"type": "sha256", "value": "ab"}]}`), &spooled))
+	assert.Equal(t, []Checksum{{Type: "sha256", Value: "ab"}}, checksumsOf(spooled.Checksum))
+	assert.Equal(t, []Checksum{{Type: "md5", Value: "cd"}}, checksumsOf([]interface{}{Checksum{Type: "md5", Value: "cd"}}))
+}
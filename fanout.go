@@ -0,0 +1,151 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+var fanoutEvents = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "s3proxy_fanout_events_total",
+	Help: "Number of events sent to each fan-out destination, by whether they were sent or failed.",
+}, []string{"destination", "result"})
+
+func init() {
+	prometheus.MustRegister(fanoutEvents)
+	registerMessenger("fanout", messengerType{
+		required: []string{"broker.fanout.destinations"},
+		create: func(c BrokerConfig, tlsConfig *tls.Config) (Messenger, error) {
+			return NewFanoutMessenger(c, tlsConfig)
+		},
+		check: checkFanout,
+	})
+}
+
+// fanoutConfig stores the settings of the fan-out messenger
+type fanoutConfig struct {
+	// messenger types the events are sent with, each reads its own section
+	// of the configuration
+	destinations []string
+	// destinations that have to take an event for it to be sent, failures
+	// of the others are only logged
+	required []string
+}
+
+// readFanoutConfig reads the broker.fanout section of the configuration,
+// all destinations are required unless told otherwise
+func readFanoutConfig() (fanoutConfig, error) {
+	f := fanoutConfig{destinations: viper.GetStringSlice("broker.fanout.destinations")}
+	if len(f.destinations) == 0 {
+		return f, errors.New("broker.fanout.destinations can not be empty")
+	}
+	seen := make(map[string]bool)
+	for _, destination := range f.destinations {
+		switch destination {
+		case "fanout", "outbox":
+			return f, fmt.Errorf("broker.fanout.destinations can not have %s", destination)
+		}
+		if seen[destination] {
+			return f, fmt.Errorf("broker.fanout.destinations has %s twice", destination)
+		}
+		seen[destination] = true
+	}
+
+	f.required = f.destinations
+	if viper.IsSet("broker.fanout.required") {
+		f.required = viper.GetStringSlice("broker.fanout.required")
+		for _, destination := range f.required {
+			if !seen[destination] {
+				return f, fmt.Errorf("broker.fanout.required %s is not one of the destinations", destination)
+			}
+		}
+	}
+
+	return f, nil
+}
+
+// fanoutDestination is a messenger the events are fanned out to
+type fanoutDestination struct {
+	name      string
+	messenger Messenger
+	required  bool
+}
+
+// FanoutMessenger is a Messenger that sends every event to several
+// destinations at once, like a local broker and the one of a federation.
+// Each destination is retried on its own, so one that fails doesn't get
+// the others the same event twice.
+type FanoutMessenger struct {
+	destinations []fanoutDestination
+}
+
+// NewFanoutMessenger sets up the messengers of the destinations
+func NewFanoutMessenger(c BrokerConfig, tlsConfig *tls.Config) (*FanoutMessenger, error) {
+	required := make(map[string]bool)
+	for _, name := range c.fanout.required {
+		required[name] = true
+	}
+
+	m := &FanoutMessenger{}
+	for _, name := range c.fanout.destinations {
+		destinationConfig := c
+		destinationConfig.messengerType = name
+		messenger, err := NewMessenger(destinationConfig, tlsConfig)
+		if err != nil {
+			return nil, fmt.Errorf("fan-out to %s: %v", name, err)
+		}
+		if c.retry.attempts > 1 {
+			messenger = NewRetryingMessenger(messenger, c.retry)
+		}
+		m.destinations = append(m.destinations, fanoutDestination{name, messenger, required[name]})
+	}
+	return m, nil
+}
+
+// checkFanout verifies that events can be sent to every destination
+func checkFanout(c BrokerConfig, tlsConfig *tls.Config) error {
+	for _, name := range c.fanout.destinations {
+		destination, err := getMessengerType(name)
+		if err != nil {
+			return err
+		}
+		if destination.check == nil {
+			continue
+		}
+		destinationConfig := c
+		destinationConfig.messengerType = name
+		if err := destination.check(destinationConfig, tlsConfig); err != nil {
+			return fmt.Errorf("fan-out to %s: %v", name, err)
+		}
+	}
+	return nil
+}
+
+// SendMessage sends the event to all destinations at once, it fails if a
+// required destination didn't take it
+func (m *FanoutMessenger) SendMessage(message Event) error {
+	errs := make([]error, len(m.destinations))
+	var wg sync.WaitGroup
+	for i, destination := range m.destinations {
+		wg.Add(1)
+		go func(i int, destination fanoutDestination) {
+			defer wg.Done()
+			if err := destination.messenger.SendMessage(message); err != nil {
+				fanoutEvents.WithLabelValues(destination.name, "failed").Inc()
+				log.WithField("request_id", message.RequestID).Warnf("sending event to %s failed: %v", destination.name, err)
+				if destination.required {
+					errs[i] = fmt.Errorf("%s: %v", destination.name, err)
+				}
+				return
+			}
+			fanoutEvents.WithLabelValues(destination.name, "sent").Inc()
+		}(i, destination)
+	}
+	wg.Wait()
+	return errors.Join(errs...)
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFanoutMessenger(t *testing.T) {
+	local := &recordingMessenger{}
+	central := &recordingMessenger{}
+	m := &FanoutMessenger{[]fanoutDestination{
+		{"amqp", local, true},
+		{"webhook", central, false},
+	}}
+
+	event := Event{Operation: "upload", Filepath: "user/file"}
+	assert.NoError(t, m.SendMessage(event))
+	assert.Equal(t, []Event{event}, local.events)
+	assert.Equal(t, []Event{event}, central.events)
+
+	// Failures of destinations that aren't required are only counted
+	failed := testutil.ToFloat64(fanoutEvents.WithLabelValues("webhook", "failed"))
+	sent := testutil.ToFloat64(fanoutEvents.WithLabelValues("amqp", "sent"))
+	central.err = errors.New("unreachable")
+	assert.NoError(t, m.SendMessage(event))
+	assert.Len(t, local.events, 2)
+	assert.Equal(t, failed+1, testutil.ToFloat64(fanoutEvents.WithLabelValues("webhook", "failed")))
+	assert.Equal(t, sent+1, testutil.ToFloat64(fanoutEvents.WithLabelValues("amqp", "sent")))
+
+	local.err = errors.New("connection closed")
+	err := m.SendMessage(event)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "amqp: connection closed")
+		assert.NotContains(t, err.Error(), "webhook")
+	}
+}
+
+func TestNewFanoutMessenger(t *testing.T) {
+	c := BrokerConfig{
+		file:   fileConfig{path: filepath.Join(t.TempDir(), "events.jsonl")},
+		fanout: fanoutConfig{destinations: []string{"file", "dryrun"}, required: []string{"file"}},
+		retry:  retryConfig{attempts: 3},
+	}
+	m, err := NewFanoutMessenger(c, nil)
+	if assert.NoError(t, err) && assert.Len(t, m.destinations, 2) {
+		assert.True(t, m.destinations[0].required)
+		assert.False(t, m.destinations[1].required)
+		assert.IsType(t, &RetryingMessenger{}, m.destinations[0].messenger)
+	}
+	assert.NoError(t, checkFanout(c, nil))
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// Behaviours that not every site wants are switched on in the features
+// section, like
+//
+//	features:
+//	  downloads: true
+//	  strictCrypt4gh: true
+//
+// so new ones can ship disabled and be turned on site by site.
+
+// feature is a behaviour that can be switched on or off
+type feature struct {
+	name    string
+	summary string
+	// setting that switched it on before the features section, if any
+	legacy string
+}
+
+// knownFeatures are the features, all disabled unless switched on
+var knownFeatures = []feature{
+	{name: "downloads", summary: "users can download their own files", legacy: "server.downloads"},
+	{name: "deletes", summary: "users can delete their own files", legacy: "server.deletes"},
+	{name: "resumeUploads", summary: "new multipart uploads resume the one in progress", legacy: "server.resumeUploads"},
+	{name: "detectDuplicates", summary: "uploads of content already stored are skipped", legacy: "server.detectDuplicates"},
+	{name: "strictCrypt4gh", summary: "only uploads of Crypt4GH files are accepted"},
+}
+
+// featureFlags tells which features are enabled, by lower case name
+type featureFlags map[string]bool
+
+// enabled tells if the named feature is switched on
+func (f featureFlags) enabled(name string) bool {
+	return f[strings.ToLower(name)]
+}
+
+// readFeatures reads the features section, the settings the features had
+// before it are still read but a warning is logged
+func readFeatures() (featureFlags, error) {
+	known := map[string]bool{}
+	for _, feature := range knownFeatures {
+		known[strings.ToLower(feature.name)] = true
+	}
+	for name := range viper.GetStringMap("features") {
+		if !known[strings.ToLower(name)] {
+			return nil, fmt.Errorf("features.%s is not a known feature", name)
+		}
+	}
+
+	features := featureFlags{}
+	for _, feature := range knownFeatures {
+		key := strings.ToLower(feature.name)
+		switch {
+		case viper.IsSet("features." + feature.name):
+			features[key] = viper.GetBool("features." + feature.name)
+		case feature.legacy != "" && viper.IsSet(feature.legacy):
+			log.Warnf("%s is deprecated, use features.%s instead", feature.legacy, feature.name)
+			features[key] = viper.GetBool(feature.legacy)
+		}
+	}
+	return features, nil
+}
+
+// logFeatures tells which features are enabled at startup
+func logFeatures(features featureFlags) {
+	for _, feature := range knownFeatures {
+		if features.enabled(feature.name) {
+			log.Infof("feature %s enabled: %s", feature.name, feature.summary)
+		}
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+
+	"github.com/spf13/viper"
+)
+
+// fileConfig stores the settings of the file messenger
+type fileConfig struct {
+	// file the events are appended to, - for stdout
+	path string
+}
+
+func init() {
+	registerMessenger("file", messengerType{
+		required: []string{"broker.file.path"},
+		create: func(c BrokerConfig, _ *tls.Config) (Messenger, error) {
+			return NewFileMessenger(c)
+		},
+	})
+}
+
+// readFileConfig reads the broker.file section of the configuration
+func readFileConfig() (fileConfig, error) {
+	f := fileConfig{path: viper.GetString("broker.file.path")}
+	if f.path == "" {
+		return f, fmt.Errorf("broker.file.path can not be empty")
+	}
+	return f, nil
+}
+
+// FileMessenger is a Messenger that appends the events as JSON lines to a
+// file or stdout, for running the proxy without a broker
+type FileMessenger struct {
+	lock   sync.Mutex
+	out    io.Writer
+	format eventFormat
+}
+
+// NewFileMessenger opens the file the events are appended to
+func NewFileMessenger(c BrokerConfig) (*FileMessenger, error) {
+	if c.file.path == "-" {
+		return &FileMessenger{out: os.Stdout, format: c.format}, nil
+	}
+
+	out, err := os.OpenFile(c.file.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600) // #nosec this file comes from our configuration
+	if err != nil {
+		return nil, fmt.Errorf("broker.file.path: %v", err)
+	}
+	return &FileMessenger{out: out, format: c.format}, nil
+}
+
+// SendMessage appends the event to the file
+func (m *FileMessenger) SendMessage(message Event) error {
+	body, err := m.format.encode(message)
+	if err != nil {
+		return err
+	}
+
+	// One write per event keeps the lines whole
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	_, err = m.out.Write(append(body, '\n'))
+	return err
+}
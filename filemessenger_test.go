@@ -0,0 +1,37 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFileMessenger_SendMessage(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "events.jsonl")
+	m, err := NewFileMessenger(BrokerConfig{file: fileConfig{path: path}})
+	assert.NoError(t, err)
+
+	assert.NoError(t, m.SendMessage(Event{Operation: "upload", Username: "user", Filepath: "user/a.c4gh"}))
+	assert.NoError(t, m.SendMessage(Event{Operation: "upload", Username: "user", Filepath: "user/b.c4gh"}))
+
+	// Events are appended to what is already there
+	m, err = NewFileMessenger(BrokerConfig{file: fileConfig{path: path}})
+	assert.NoError(t, err)
+	assert.NoError(t, m.SendMessage(Event{Operation: "upload", Username: "user", Filepath: "user/c.c4gh"}))
+
+	data, err := ioutil.ReadFile(path)
+	assert.NoError(t, err)
+	lines := strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+	if assert.Len(t, lines, 3) {
+		var event Event
+		assert.NoError(t, json.Unmarshal([]byte(lines[2]), &event))
+		assert.Equal(t, "user/c.c4gh", event.Filepath)
+	}
+
+	_, err = NewFileMessenger(BrokerConfig{file: fileConfig{path: filepath.Join(path, "missing", "events.jsonl")}})
+	assert.Error(t, err)
+}
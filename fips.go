@@ -0,0 +1,13 @@
+//go:build boringcrypto
+
+package main
+
+import (
+	"crypto/boring"
+)
+
+// fipsAvailable tells if the program uses the FIPS-validated BoringCrypto
+// module, which needs a build with GOEXPERIMENT=boringcrypto
+func fipsAvailable() bool {
+	return boring.Enabled()
+}
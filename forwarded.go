@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// parseTrustedProxies parses a list of IP addresses and CIDR ranges of load
+// balancers whose X-Forwarded-For headers can be trusted.
+func parseTrustedProxies(proxies []string) ([]*net.IPNet, error) {
+	var trusted []*net.IPNet
+	for _, p := range proxies {
+		if !strings.Contains(p, "/") {
+			ip := net.ParseIP(p)
+			if ip == nil {
+				return nil, fmt.Errorf("bad trusted proxy address %s", p)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip = ip.To4()
+				bits = 8 * net.IPv4len
+			}
+			trusted = append(trusted, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(p)
+		if err != nil {
+			return nil, fmt.Errorf("bad trusted proxy range %s: %v", p, err)
+		}
+		trusted = append(trusted, network)
+	}
+	return trusted, nil
+}
+
+func isTrusted(ip net.IP, trusted []*net.IPNet) bool {
+	for _, network := range trusted {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIP returns the address of the client that made the request. The
+// X-Forwarded-For header is only used when the connection comes from a
+// trusted proxy, and then the right-most address that is not a trusted proxy
+// is the client.
+func clientIP(r *http.Request, trusted []*net.IPNet) string {
+	remote, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		remote = r.RemoteAddr
+	}
+
+	ip := net.ParseIP(remote)
+	if ip == nil || !isTrusted(ip, trusted) {
+		return remote
+	}
+
+	var forwarded []string
+	for _, h := range r.Header["X-Forwarded-For"] {
+		forwarded = append(forwarded, strings.Split(h, ",")...)
+	}
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(forwarded[i])
+		hopIP := net.ParseIP(hop)
+		if hopIP == nil {
+			// Garbage in the header, don't trust anything before it
+			return remote
+		}
+		remote = hop
+		if !isTrusted(hopIP, trusted) {
+			break
+		}
+	}
+
+	return remote
+}
+
+type clientIPKey struct{}
+
+// withClientIP stores the client address in the request context, since the
+// forwarding headers are removed before the request is sent to the backend.
+func withClientIP(r *http.Request, trusted []*net.IPNet) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), clientIPKey{}, clientIP(r, trusted)))
+}
+
+// requestClientIP returns the client address stored with withClientIP
+func requestClientIP(r *http.Request) string {
+	if ip, ok := r.Context().Value(clientIPKey{}).(string); ok {
+		return ip
+	}
+	return clientIP(r, nil)
+}
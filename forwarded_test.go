@@ -0,0 +1,52 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseTrustedProxies(t *testing.T) {
+	trusted, err := parseTrustedProxies([]string{"10.0.0.0/8", "192.168.1.1", "::1"})
+	assert.NoError(t, err)
+	assert.Len(t, trusted, 3)
+	assert.Equal(t, "192.168.1.1/32", trusted[1].String())
+	assert.Equal(t, "::1/128", trusted[2].String())
+
+	_, err = parseTrustedProxies([]string{"notanip"})
+	assert.Error(t, err)
+	_, err = parseTrustedProxies([]string{"10.0.0.0/99"})
+	assert.Error(t, err)
+}
+
+func TestClientIP(t *testing.T) {
+	trusted, _ := parseTrustedProxies([]string{"10.0.0.0/8"})
+	r, _ := http.NewRequest("GET", "/user/file", nil)
+
+	// No forwarding headers
+	r.RemoteAddr = "192.0.2.1:4321"
+	assert.Equal(t, "192.0.2.1", clientIP(r, trusted))
+
+	// Forwarding headers from an untrusted address are ignored
+	r.Header.Set("X-Forwarded-For", "198.51.100.7")
+	assert.Equal(t, "192.0.2.1", clientIP(r, trusted))
+
+	// Forwarding headers from the load balancer are used
+	r.RemoteAddr = "10.1.1.1:4321"
+	assert.Equal(t, "198.51.100.7", clientIP(r, trusted))
+
+	// Spoofed addresses before the real client are skipped
+	r.Header.Set("X-Forwarded-For", "203.0.113.9, 198.51.100.7, 10.2.2.2")
+	assert.Equal(t, "198.51.100.7", clientIP(r, trusted))
+
+	// Garbage in the header falls back to the connection address
+	r.Header.Set("X-Forwarded-For", "garbage")
+	assert.Equal(t, "10.1.1.1", clientIP(r, trusted))
+
+	// The address survives removal of the headers
+	r.Header.Set("X-Forwarded-For", "198.51.100.7")
+	r = withClientIP(r, trusted)
+	r.Header.Del("X-Forwarded-For")
+	assert.Equal(t, "198.51.100.7", requestClientIP(r))
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+)
+
+// hopHeaders only apply to a single connection and are never passed on, see
+// RFC 7230 section 6.1.
+var hopHeaders = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Proxy-Connection",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// frontendHeaders are set by the client or the load balancers in front of the
+// proxy and are not passed on to the backend. The security token holds the
+// user's credentials for the proxy, not for the backend.
+var frontendHeaders = []string{
+	"X-Amz-Security-Token",
+	"X-Correlation-Id",
+	"X-Forwarded-Port",
+	"X-Forwarded-Proto",
+	"X-Forwarded-Host",
+	"X-Forwarded-For",
+	"X-Original-Uri",
+	"X-Real-Ip",
+	"X-Request-Id",
+	"X-Scheme",
+}
+
+// requiredRequestHeaders are always forwarded to the backend, even when the
+// forwarded headers are restricted, since S3 requests can't work without them.
+var requiredRequestHeaders = []string{
+	"Authorization",
+	"Content-Encoding",
+	"Content-Length",
+	"Content-Md5",
+	"Content-Type",
+	"Expect",
+	"If-Match",
+	"If-Modified-Since",
+	"If-None-Match",
+	"If-Range",
+	"If-Unmodified-Since",
+	"Range",
+	"X-Amz-Content-Sha256",
+	"X-Amz-Copy-Source",
+	"X-Amz-Copy-Source-If-Match",
+	"X-Amz-Copy-Source-If-Modified-Since",
+	"X-Amz-Copy-Source-If-None-Match",
+	"X-Amz-Copy-Source-If-Unmodified-Since",
+	"X-Amz-Copy-Source-Range",
+	"X-Amz-Date",
+	"X-Amz-Decoded-Content-Length",
+	"X-Amz-Metadata-Directive",
+}
+
+// requiredResponseHeaders are always returned to the client, even when the
+// returned headers are restricted.
+var requiredResponseHeaders = []string{
+	"Accept-Ranges",
+	"Content-Length",
+	"Content-Range",
+	"Content-Type",
+	"Etag",
+	"Last-Modified",
+}
+
+// removeHopHeaders removes the hop-by-hop headers, including any headers
+// listed in the Connection header.
+func removeHopHeaders(h http.Header) {
+	for _, v := range h["Connection"] {
+		for _, name := range strings.Split(v, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				h.Del(name)
+			}
+		}
+	}
+	for _, name := range hopHeaders {
+		h.Del(name)
+	}
+}
+
+// filterHeaders removes all headers that are not in either of the lists.
+// Header names are matched case insensitively.
+func filterHeaders(h http.Header, required, allowed []string) {
+	keep := make(map[string]bool)
+	for _, lists := range [][]string{required, allowed} {
+		for _, name := range lists {
+			keep[http.CanonicalHeaderKey(name)] = true
+		}
+	}
+	for name := range h {
+		if !keep[http.CanonicalHeaderKey(name)] {
+			delete(h, name)
+		}
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRemoveHopHeaders(t *testing.T) {
+	h := http.Header{}
+	h.Set("Connection", "keep-alive, X-Custom-Hop")
+	h.Set("Keep-Alive", "timeout=5")
+	h.Set("Transfer-Encoding", "chunked")
+	h.Set("Upgrade", "h2c")
+	h.Set("X-Custom-Hop", "1")
+	h.Set("X-Amz-Date", "20200101T000000Z")
+
+	removeHopHeaders(h)
+	assert.Equal(t, http.Header{"X-Amz-Date": []string{"20200101T000000Z"}}, h)
+}
+
+func TestFilterHeaders(t *testing.T) {
+	h := http.Header{}
+	h.Set("Content-Length", "10")
+	h.Set("X-Amz-Meta-Project", "p1")
+	h.Set("X-Amz-Meta-Secret", "s")
+	h.Set("Cookie", "c")
+
+	filterHeaders(h, requiredRequestHeaders, []string{"x-amz-meta-project"})
+	assert.Equal(t, http.Header{
+		"Content-Length":     []string{"10"},
+		"X-Amz-Meta-Project": []string{"p1"},
+	}, h)
+}
+
+func TestServeHTTP_copyForwardHeaders(t *testing.T) {
+	var received http.Header
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPut {
+			received = r.Header.Clone()
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer backend.Close()
+
+	proxy := NewProxy(testS3Config(backend.URL), NewAlwaysAllow(), NewMockMessenger(), new(tls.Config))
+	proxy.forwardHeaders = []string{"x-amz-meta-project"}
+
+	// A copy, and the copy of a range into a part, still reach the backend
+	// with their sources
+	r, _ := http.NewRequest("PUT", "/username/new", nil)
+	r.Header.Set("X-Amz-Copy-Source", "/username/old")
+	r.Header.Set("X-Amz-Copy-Source-If-Match", `"abc"`)
+	r.Header.Set("X-Amz-Metadata-Directive", "REPLACE")
+	r.Header.Set("X-Amz-Meta-Project", "p1")
+	r.Header.Set("X-Amz-Meta-Secret", "s")
+	w := httptest.NewRecorder()
+	proxy.ServeHTTP(w, r)
+	assert.Equal(t, 200, w.Result().StatusCode)
+	assert.Equal(t, "/buckbuck/username/old", received.Get("X-Amz-Copy-Source"))
+	assert.Equal(t, `"abc"`, received.Get("X-Amz-Copy-Source-If-Match"))
+	assert.Equal(t, "REPLACE", received.Get("X-Amz-Metadata-Directive"))
+	assert.Equal(t, "p1", received.Get("X-Amz-Meta-Project"))
+	assert.Empty(t, received.Get("X-Amz-Meta-Secret"))
+
+	r, _ = http.NewRequest("PUT", "/username/big?partNumber=2&uploadId=1", nil)
+	r.Header.Set("X-Amz-Copy-Source", "/username/old")
+	r.Header.Set("X-Amz-Copy-Source-Range", "bytes=0-9")
+	w = httptest.NewRecorder()
+	proxy.ServeHTTP(w, r)
+	assert.Equal(t, 200, w.Result().StatusCode)
+	assert.Equal(t, "/buckbuck/username/old", received.Get("X-Amz-Copy-Source"))
+	assert.Equal(t, "bytes=0-9", received.Get("X-Amz-Copy-Source-Range"))
+}
@@ -3,36 +3,55 @@ package main
 import (
 	"crypto/tls"
 	"fmt"
+	"net"
 	"net/http"
-	"strconv"
 	"time"
 
 	"github.com/heptiolabs/healthcheck"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	log "github.com/sirupsen/logrus"
 )
 
 // HealthCheck registers and endpoint for healthchecking the service
 type HealthCheck struct {
-	port      int
-	s3URL     string
-	brokerURL string
-	tlsConfig *tls.Config
+	address    string
+	s3URL      string
+	s3Proxy    string
+	s3ProxyEnv bool
+	brokerURL  string
+	brokerDial func(network, addr string) (net.Conn, error)
+	tlsConfig  *tls.Config
+	s3TLS      tlsSettings
+	// backendCheck reports the state of the monitored S3 bucket, if the
+	// backend is monitored
+	backendCheck healthcheck.Check
 }
 
-// NewHealthCheck creates a new healthchecker. It needs to know where to find
-// the backend S3 storage and the Message Broker so it can report readiness.
-func NewHealthCheck(port int, s3 S3Config, broker BrokerConfig, tlsConfig *tls.Config) *HealthCheck {
+// NewHealthCheck creates a new healthchecker listening on the address. It
+// needs to know where to find the backend S3 storage and the Message Broker
+// so it can report readiness.
+func NewHealthCheck(address string, s3 S3Config, broker BrokerConfig, tlsConfig *tls.Config) *HealthCheck {
 	s3URL := s3.url
 	if s3.readypath != "" {
 		s3URL = s3.url + s3.readypath
 	}
 
-	brokerURL := broker.host + ":" + broker.port
+	// Only AMQP brokers are checked, other messengers have no host
+	brokerURL := ""
+	if broker.host != "" {
+		brokerURL = broker.host + ":" + broker.port
+	}
+
+	brokerDial, err := proxyDialer(broker)
+	if err != nil {
+		log.Errorf("failed to set up proxy for broker health check: %v", err)
+	}
 
-	return &HealthCheck{port, s3URL, brokerURL, tlsConfig}
+	return &HealthCheck{address: address, s3URL: s3URL, s3Proxy: s3.proxy, s3ProxyEnv: s3.proxyFromEnvironment, brokerURL: brokerURL, brokerDial: brokerDial, tlsConfig: tlsConfig, s3TLS: s3.tls}
 }
 
 // RunHealthChecks should be run as a go routine in the main app. It registers
-// the healthcheck handler on the port specified in when creating a new
+// the healthcheck handler on the address specified when creating a new
 // healthcheck.
 func (h *HealthCheck) RunHealthChecks() {
 	health := healthcheck.NewHandler()
@@ -40,11 +59,23 @@ func (h *HealthCheck) RunHealthChecks() {
 	health.AddLivenessCheck("goroutine-threshold", healthcheck.GoroutineCountCheck(100))
 
 	health.AddReadinessCheck("S3-backend-http", h.httpsGetCheck(h.s3URL, 5000*time.Millisecond))
+	if h.backendCheck != nil {
+		health.AddReadinessCheck("S3-backend-bucket", h.backendCheck)
+	}
 
-	health.AddReadinessCheck("broker-tcp", healthcheck.TCPDialCheck(h.brokerURL, 50*time.Millisecond))
+	if h.brokerURL == "" {
+		log.Debug("no broker to check")
+	} else if h.brokerDial != nil {
+		health.AddReadinessCheck("broker-tcp", h.proxyDialCheck(h.brokerURL))
+	} else {
+		health.AddReadinessCheck("broker-tcp", healthcheck.TCPDialCheck(h.brokerURL, 50*time.Millisecond))
+	}
 
-	addr := ":" + strconv.Itoa(h.port)
-	if err := http.ListenAndServe(addr, health); err != nil {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	mux.Handle("/version", versionHandler())
+	mux.Handle("/", health)
+	if err := http.ListenAndServe(h.address, mux); err != nil {
 		panic(err)
 	}
 }
@@ -52,7 +83,8 @@ func (h *HealthCheck) RunHealthChecks() {
 func (h *HealthCheck) httpsGetCheck(url string, timeout time.Duration) healthcheck.Check {
 	cfg := &tls.Config{}
 	cfg.RootCAs = h.tlsConfig.RootCAs
-	tr := &http.Transport{TLSClientConfig: cfg}
+	h.s3TLS.apply(cfg)
+	tr := &http.Transport{TLSClientConfig: cfg, Proxy: httpProxyFunc(h.s3Proxy, h.s3ProxyEnv)}
 	client := http.Client{
 		Transport: tr,
 		Timeout:   timeout,
@@ -73,3 +105,15 @@ func (h *HealthCheck) httpsGetCheck(url string, timeout time.Duration) healthche
 		return nil
 	}
 }
+
+// proxyDialCheck checks that a tunnel to the address can be opened through
+// the outbound proxy
+func (h *HealthCheck) proxyDialCheck(addr string) healthcheck.Check {
+	return func() error {
+		conn, err := h.brokerDial("tcp", addr)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	}
+}
@@ -14,7 +14,7 @@ import (
 )
 
 func TestHttpsGetCheck(t *testing.T) {
-	h := NewHealthCheck(8888,
+	h := NewHealthCheck(":8888",
 		S3Config{url: "http://localhost:8080", readypath: "/"},
 		BrokerConfig{host: "localhost", port: "8080"},
 		new(tls.Config))
@@ -34,7 +34,7 @@ func TestHealthchecks(t *testing.T) {
 	ts.Listener = l
 	ts.Start()
 
-	h := NewHealthCheck(8888,
+	h := NewHealthCheck(":8888",
 		S3Config{url: "http://localhost:8080", readypath: "/"},
 		BrokerConfig{host: "localhost", port: "8080"},
 		new(tls.Config))
@@ -57,5 +57,16 @@ func TestHealthchecks(t *testing.T) {
 		t.Errorf("Response code was %v; want 200", res.StatusCode)
 	}
 
+	res, err = http.Get("http://localhost:8888/metrics")
+	assert.NoError(t, err)
+	res.Body.Close()
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+
+	// The admin endpoints are served apart
+	res, err = http.Get("http://localhost:8888/log")
+	assert.NoError(t, err)
+	res.Body.Close()
+	assert.Equal(t, http.StatusNotFound, res.StatusCode)
+
 	ts.Close()
 }
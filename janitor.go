@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+)
+
+var staleUploadsAborted = prometheus.NewCounter(prometheus.CounterOpts{
+	Name: "s3proxy_stale_multipart_uploads_aborted_total",
+	Help: "Number of incomplete multipart uploads aborted by the janitor.",
+})
+
+func init() {
+	prometheus.MustRegister(staleUploadsAborted)
+}
+
+// uploadJanitor aborts multipart uploads that were started but neither
+// completed nor aborted, their parts would otherwise use storage forever.
+type uploadJanitor struct {
+	config S3Config
+	client *s3.Client
+}
+
+// newUploadJanitor creates a janitor for the bucket of the S3 backend
+func newUploadJanitor(config S3Config) *uploadJanitor {
+	return &uploadJanitor{
+		config: config,
+		client: newS3Client(config, &http.Client{Transport: transportConfigS3(config)}),
+	}
+}
+
+// Run cleans up the bucket every interval until ctx is done, it should be
+// run as a go routine
+func (j *uploadJanitor) Run(ctx context.Context) {
+	ticker := time.NewTicker(j.config.janitorInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if _, err := j.abortStaleUploads(ctx, time.Now()); err != nil {
+			log.Errorf("failed to clean up stale multipart uploads: %v", err)
+		}
+	}
+}
+
+// abortStaleUploads aborts the uploads initiated before the configured age
+// and returns how many it aborted
+func (j *uploadJanitor) abortStaleUploads(ctx context.Context, now time.Time) (int, error) {
+	cutoff := now.Add(-j.config.staleUploadAge)
+	aborted := 0
+
+	input := &s3.ListMultipartUploadsInput{Bucket: aws.String(j.config.bucket)}
+	for {
+		listCtx, cancel := s3Context(ctx, j.config)
+		result, err := j.client.ListMultipartUploads(listCtx, input)
+		cancel()
+		if err != nil {
+			return aborted, err
+		}
+
+		for _, upload := range result.Uploads {
+			if upload.Initiated == nil || !upload.Initiated.Before(cutoff) {
+				continue
+			}
+
+			abortCtx, cancel := s3Context(ctx, j.config)
+			_, err := j.client.AbortMultipartUpload(abortCtx, &s3.AbortMultipartUploadInput{
+				Bucket:   aws.String(j.config.bucket),
+				Key:      upload.Key,
+				UploadId: upload.UploadId,
+			})
+			cancel()
+			if err != nil {
+				log.Errorf("failed to abort multipart upload %s of %s: %v", aws.ToString(upload.UploadId), aws.ToString(upload.Key), err)
+				continue
+			}
+
+			log.Infof("aborted multipart upload %s of %s initiated at %v", aws.ToString(upload.UploadId), aws.ToString(upload.Key), upload.Initiated)
+			staleUploadsAborted.Inc()
+			aborted++
+		}
+
+		if !aws.ToBool(result.IsTruncated) {
+			return aborted, nil
+		}
+		input.KeyMarker = result.NextKeyMarker
+		input.UploadIdMarker = result.NextUploadIdMarker
+	}
+}
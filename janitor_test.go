@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAbortStaleUploads(t *testing.T) {
+	now := time.Date(2021, 6, 10, 12, 0, 0, 0, time.UTC)
+	var aborted []string
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodDelete {
+			aborted = append(aborted, r.URL.Query().Get("uploadId"))
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		if r.URL.Query().Get("key-marker") == "" {
+			fmt.Fprintf(w, `<ListMultipartUploadsResult><IsTruncated>true</IsTruncated><NextKeyMarker>user/a</NextKeyMarker><NextUploadIdMarker>old</NextUploadIdMarker>
+<Upload><Key>user/a</Key><UploadId>old</UploadId><Initiated>%s</Initiated></Upload></ListMultipartUploadsResult>`, now.Add(-8*24*time.Hour).Format(time.RFC3339))
+			return
+		}
+		fmt.Fprintf(w, `<ListMultipartUploadsResult><IsTruncated>false</IsTruncated>
+<Upload><Key>user/b</Key><UploadId>new</UploadId><Initiated>%s</Initiated></Upload></ListMultipartUploadsResult>`, now.Add(-time.Hour).Format(time.RFC3339))
+	}))
+	defer backend.Close()
+
+	s3conf := testS3Config(backend.URL)
+	s3conf.retryMaxAttempts = 1
+	s3conf.staleUploadAge = 7 * 24 * time.Hour
+	j := newUploadJanitor(s3conf)
+
+	n, err := j.abortStaleUploads(context.Background(), now)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, n)
+	assert.Equal(t, []string{"old"}, aborted)
+}
+
+func TestAbortStaleUploads_backendError(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusForbidden)
+	}))
+	defer backend.Close()
+
+	s3conf := testS3Config(backend.URL)
+	s3conf.retryMaxAttempts = 1
+	s3conf.staleUploadAge = time.Hour
+	j := newUploadJanitor(s3conf)
+
+	_, err := j.abortStaleUploads(context.Background(), time.Now())
+	assert.Error(t, err)
+}
+
+func TestUploadJanitor_Run(t *testing.T) {
+	listed := make(chan struct{}, 10)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		listed <- struct{}{}
+		fmt.Fprint(w, "<ListMultipartUploadsResult><IsTruncated>false</IsTruncated></ListMultipartUploadsResult>")
+	}))
+	defer backend.Close()
+
+	s3conf := testS3Config(backend.URL)
+	s3conf.retryMaxAttempts = 1
+	s3conf.janitorInterval = 10 * time.Millisecond
+	s3conf.staleUploadAge = time.Hour
+	j := newUploadJanitor(s3conf)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		j.Run(ctx)
+		close(done)
+	}()
+	<-listed
+	cancel()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Error("the janitor should stop when its context is done")
+	}
+}
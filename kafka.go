@@ -0,0 +1,212 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/tls"
+	"fmt"
+	"strings"
+
+	"github.com/IBM/sarama"
+	"github.com/google/uuid"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"github.com/xdg-go/scram"
+)
+
+// Partition keys of the Kafka messages, events with the same key end up in
+// the same partition and keep their order
+const (
+	kafkaKeyUser     = "user"
+	kafkaKeyFilepath = "filepath"
+	kafkaKeyNone     = "none"
+)
+
+// kafkaConfig stores the settings of the Kafka messenger
+type kafkaConfig struct {
+	brokers      []string
+	topic        string
+	partitionKey string
+	// SASL mechanism used with broker.user and broker.password, empty
+	// disables SASL
+	sasl    string
+	version sarama.KafkaVersion
+}
+
+func init() {
+	registerMessenger("kafka", messengerType{
+		required: []string{"broker.kafka.brokers", "broker.kafka.topic"},
+		create: func(c BrokerConfig, tlsConfig *tls.Config) (Messenger, error) {
+			return NewKafkaMessenger(c, tlsConfig)
+		},
+		check: checkKafka,
+	})
+}
+
+// readKafkaConfig reads the broker.kafka section of the configuration
+func readKafkaConfig() (kafkaConfig, error) {
+	k := kafkaConfig{
+		brokers:      viper.GetStringSlice("broker.kafka.brokers"),
+		topic:        viper.GetString("broker.kafka.topic"),
+		partitionKey: kafkaKeyUser,
+		sasl:         strings.ToLower(viper.GetString("broker.kafka.sasl")),
+		version:      sarama.V2_1_0_0,
+	}
+
+	if viper.IsSet("broker.kafka.partitionKey") {
+		k.partitionKey = strings.ToLower(viper.GetString("broker.kafka.partitionKey"))
+	}
+	switch k.partitionKey {
+	case kafkaKeyUser, kafkaKeyFilepath, kafkaKeyNone:
+	default:
+		return k, fmt.Errorf("broker.kafka.partitionKey %q is not one of user, filepath or none", k.partitionKey)
+	}
+
+	switch k.sasl {
+	case "", "plain", "scram-sha-256", "scram-sha-512":
+	default:
+		return k, fmt.Errorf("broker.kafka.sasl %q is not one of plain, scram-sha-256 or scram-sha-512", k.sasl)
+	}
+
+	if viper.IsSet("broker.kafka.version") {
+		version, err := sarama.ParseKafkaVersion(viper.GetString("broker.kafka.version"))
+		if err != nil {
+			return k, fmt.Errorf("broker.kafka.version: %v", err)
+		}
+		// The idempotent producer needs Kafka 0.11 or later
+		if !version.IsAtLeast(sarama.V0_11_0_0) {
+			return k, fmt.Errorf("broker.kafka.version %s is older than 0.11.0", version)
+		}
+		k.version = version
+	}
+
+	return k, nil
+}
+
+// newSaramaConfig sets up an idempotent producer that waits for all
+// in-sync replicas to acknowledge each event
+func newSaramaConfig(c BrokerConfig, tlsConfig *tls.Config) *sarama.Config {
+	config := sarama.NewConfig()
+	config.ClientID = "s3inbox"
+	config.Version = c.kafka.version
+
+	config.Producer.Idempotent = true
+	config.Producer.RequiredAcks = sarama.WaitForAll
+	config.Producer.Return.Successes = true
+	// Idempotence requires a single request in flight per connection
+	config.Net.MaxOpenRequests = 1
+
+	if c.ssl {
+		config.Net.TLS.Enable = true
+		config.Net.TLS.Config = tlsConfig
+	}
+
+	if c.kafka.sasl != "" {
+		config.Net.SASL.Enable = true
+		config.Net.SASL.User = c.user
+		config.Net.SASL.Password = c.password
+		switch c.kafka.sasl {
+		case "plain":
+			config.Net.SASL.Mechanism = sarama.SASLTypePlaintext
+		case "scram-sha-256":
+			config.Net.SASL.Mechanism = sarama.SASLTypeSCRAMSHA256
+			config.Net.SASL.SCRAMClientGeneratorFunc = func() sarama.SCRAMClient {
+				return &scramClient{hash: scram.HashGeneratorFcn(sha256.New)}
+			}
+		case "scram-sha-512":
+			config.Net.SASL.Mechanism = sarama.SASLTypeSCRAMSHA512
+			config.Net.SASL.SCRAMClientGeneratorFunc = func() sarama.SCRAMClient {
+				return &scramClient{hash: scram.HashGeneratorFcn(sha512.New)}
+			}
+		}
+	}
+
+	return config
+}
+
+// scramClient does the SCRAM authentication for sarama
+type scramClient struct {
+	*scram.ClientConversation
+	hash scram.HashGeneratorFcn
+}
+
+// Begin starts the SCRAM conversation
+func (s *scramClient) Begin(user, password, authzID string) error {
+	client, err := s.hash.NewClient(user, password, authzID)
+	if err != nil {
+		return err
+	}
+	s.ClientConversation = client.NewConversation()
+	return nil
+}
+
+// KafkaMessenger is a Messenger that sends messages to a Kafka topic
+type KafkaMessenger struct {
+	producer     sarama.SyncProducer
+	topic        string
+	partitionKey string
+	format       eventFormat
+}
+
+// NewKafkaMessenger creates a new messenger that publishes to a Kafka topic
+func NewKafkaMessenger(c BrokerConfig, tlsConfig *tls.Config) (*KafkaMessenger, error) {
+	producer, err := sarama.NewSyncProducer(c.kafka.brokers, newSaramaConfig(c, tlsConfig))
+	if err != nil {
+		return nil, fmt.Errorf("kafka producer: %v", err)
+	}
+
+	return &KafkaMessenger{producer, c.kafka.topic, c.kafka.partitionKey, c.format}, nil
+}
+
+// checkKafka connects to the Kafka brokers and verifies that the topic
+// exists
+func checkKafka(c BrokerConfig, tlsConfig *tls.Config) error {
+	client, err := sarama.NewClient(c.kafka.brokers, newSaramaConfig(c, tlsConfig))
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	_, err = client.Partitions(c.kafka.topic)
+	return err
+}
+
+// SendMessage sends the event to Kafka and waits for it to be acknowledged
+func (m *KafkaMessenger) SendMessage(message Event) error {
+	body, err := m.format.encode(message)
+	if err != nil {
+		return err
+	}
+
+	corrID, _ := uuid.NewRandom()
+
+	msg := &sarama.ProducerMessage{
+		Topic: m.topic,
+		Value: sarama.ByteEncoder(body),
+		Headers: []sarama.RecordHeader{
+			{Key: []byte("content-type"), Value: []byte(m.format.contentType())},
+			{Key: []byte("correlation-id"), Value: []byte(corrID.String())},
+			{Key: []byte("message-id"), Value: []byte(messageID(message))},
+		},
+	}
+	if message.RequestID != "" {
+		msg.Headers = append(msg.Headers, sarama.RecordHeader{Key: []byte("x-request-id"), Value: []byte(message.RequestID)})
+	}
+	if encoding := m.format.contentEncoding(""); encoding != "" {
+		msg.Headers = append(msg.Headers, sarama.RecordHeader{Key: []byte("content-encoding"), Value: []byte(encoding)})
+	}
+
+	switch m.partitionKey {
+	case kafkaKeyUser:
+		msg.Key = sarama.StringEncoder(message.Username)
+	case kafkaKeyFilepath:
+		msg.Key = sarama.StringEncoder(message.Filepath)
+	}
+
+	partition, offset, err := m.producer.SendMessage(msg)
+	if err != nil {
+		return err
+	}
+	log.Debugf("event sent to %s partition %d at offset %d", m.topic, partition, offset)
+	return nil
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/IBM/sarama"
+	"github.com/IBM/sarama/mocks"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestKafkaMessenger_SendMessage(t *testing.T) {
+	producer := mocks.NewSyncProducer(t, nil)
+	defer producer.Close()
+	m := &KafkaMessenger{producer, "inbox", kafkaKeyUser, eventFormat{}}
+
+	event := Event{Operation: "upload", Username: "user", Filepath: "user/file.c4gh", Filesize: 10, RequestID: "abc"}
+	producer.ExpectSendMessageWithMessageCheckerFunctionAndSucceed(func(msg *sarama.ProducerMessage) error {
+		assert.Equal(t, "inbox", msg.Topic)
+		key, _ := msg.Key.Encode()
+		assert.Equal(t, "user", string(key))
+
+		value, _ := msg.Value.Encode()
+		var sent Event
+		assert.NoError(t, json.Unmarshal(value, &sent))
+		assert.Equal(t, "user/file.c4gh", sent.Filepath)
+
+		headers := map[string]string{}
+		for _, h := range msg.Headers {
+			headers[string(h.Key)] = string(h.Value)
+		}
+		assert.Equal(t, "abc", headers["x-request-id"])
+		assert.NotEmpty(t, headers["correlation-id"])
+		return nil
+	})
+	assert.NoError(t, m.SendMessage(event))
+
+	m.partitionKey = kafkaKeyNone
+	producer.ExpectSendMessageWithMessageCheckerFunctionAndSucceed(func(msg *sarama.ProducerMessage) error {
+		assert.Nil(t, msg.Key)
+		return nil
+	})
+	assert.NoError(t, m.SendMessage(event))
+
+	// Events that are not acknowledged are errors
+	producer.ExpectSendMessageAndFail(errors.New("not enough replicas"))
+	assert.Error(t, m.SendMessage(event))
+}
+
+func TestNewSaramaConfig(t *testing.T) {
+	c := BrokerConfig{user: "user", password: "pass", kafka: kafkaConfig{version: sarama.V2_1_0_0}}
+
+	config := newSaramaConfig(c, nil)
+	assert.NoError(t, config.Validate())
+	assert.True(t, config.Producer.Idempotent)
+	assert.Equal(t, sarama.WaitForAll, config.Producer.RequiredAcks)
+	assert.False(t, config.Net.TLS.Enable)
+	assert.False(t, config.Net.SASL.Enable)
+
+	c.ssl = true
+	c.kafka.sasl = "scram-sha-512"
+	config = newSaramaConfig(c, nil)
+	assert.NoError(t, config.Validate())
+	assert.True(t, config.Net.TLS.Enable)
+	assert.True(t, config.Net.SASL.Enable)
+	assert.Equal(t, sarama.SASLMechanism(sarama.SASLTypeSCRAMSHA512), config.Net.SASL.Mechanism)
+	assert.Equal(t, "user", config.Net.SASL.User)
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// ListenAddress describes one address the proxy accepts connections on
+type ListenAddress struct {
+	network string
+	address string
+	tls     bool
+	// mode is the file mode of unix sockets
+	mode os.FileMode
+}
+
+func (l ListenAddress) String() string {
+	if l.network == "unix" {
+		return "unix://" + l.address
+	}
+	if l.tls {
+		return "https://" + l.address
+	}
+	return "http://" + l.address
+}
+
+// parseListenAddress parses a listen address on the form [scheme://]host:port
+// where scheme is either http or https, or a unix socket on the form
+// unix:///path/to/socket. Addresses without a scheme use TLS when useTLS is
+// set, i.e. when the server has a certificate configured.
+func parseListenAddress(s string, useTLS bool) (ListenAddress, error) {
+	l := ListenAddress{network: "tcp", address: s, tls: useTLS}
+
+	if strings.Contains(s, "://") {
+		parts := strings.SplitN(s, "://", 2)
+		switch parts[0] {
+		case "http":
+			l.tls = false
+		case "https":
+			l.tls = true
+		case "unix":
+			// TLS is left to whatever is in front of the socket
+			if parts[1] == "" {
+				return l, fmt.Errorf("no socket path in listen address %s", s)
+			}
+			return ListenAddress{network: "unix", address: parts[1], mode: 0660}, nil
+		default:
+			return l, fmt.Errorf("unsupported scheme %q in listen address %s", parts[0], s)
+		}
+		l.address = parts[1]
+	}
+
+	if _, _, err := net.SplitHostPort(l.address); err != nil {
+		return l, fmt.Errorf("bad listen address %s: %v", s, err)
+	}
+
+	return l, nil
+}
+
+// serve starts a server for each of the listen addresses and blocks until
+// one of them fails. The TLS config is used for the addresses that use TLS.
+func serve(addresses []ListenAddress, handler http.Handler, tlsConfig *tls.Config) error {
+	errs := make(chan error, len(addresses))
+
+	for _, a := range addresses {
+		if a.network == "unix" {
+			// Remove any socket left behind by a previous run
+			if fi, err := os.Lstat(a.address); err == nil && fi.Mode()&os.ModeSocket != 0 {
+				if err := os.Remove(a.address); err != nil {
+					return fmt.Errorf("failed to remove old socket %s: %v", a.address, err)
+				}
+			}
+		}
+
+		var l net.Listener
+		var err error
+		if a.network == "unix" {
+			l, err = listenUnix(a.address, a.mode)
+		} else {
+			l, err = net.Listen(a.network, a.address)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to listen on %s: %v", a, err)
+		}
+
+		log.Infof("Listening on %s", a)
+		srv := &http.Server{Handler: handler, TLSConfig: tlsConfig}
+		go func(a ListenAddress, l net.Listener) {
+			if a.tls {
+				errs <- srv.ServeTLS(l, "", "")
+			} else {
+				errs <- srv.Serve(l)
+			}
+		}(a, l)
+	}
+
+	return <-errs
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseListenAddress(t *testing.T) {
+	l, err := parseListenAddress(":8000", true)
+	assert.NoError(t, err)
+	assert.Equal(t, ListenAddress{network: "tcp", address: ":8000", tls: true}, l)
+
+	l, err = parseListenAddress(":8000", false)
+	assert.NoError(t, err)
+	assert.False(t, l.tls)
+
+	l, err = parseListenAddress("http://127.0.0.1:8080", true)
+	assert.NoError(t, err)
+	assert.Equal(t, ListenAddress{network: "tcp", address: "127.0.0.1:8080"}, l)
+
+	l, err = parseListenAddress("https://0.0.0.0:8443", false)
+	assert.NoError(t, err)
+	assert.Equal(t, ListenAddress{network: "tcp", address: "0.0.0.0:8443", tls: true}, l)
+
+	l, err = parseListenAddress("unix:///tmp/proxy.sock", true)
+	assert.NoError(t, err)
+	assert.Equal(t, ListenAddress{network: "unix", address: "/tmp/proxy.sock", mode: 0660}, l)
+	assert.Equal(t, "unix:///tmp/proxy.sock", l.String())
+
+	_, err = parseListenAddress("unix://", false)
+	assert.Error(t, err)
+
+	_, err = parseListenAddress("ftp://:21", false)
+	assert.Error(t, err)
+
+	_, err = parseListenAddress("localhost", false)
+	assert.Error(t, err)
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"github.com/streadway/amqp"
+)
+
+var livenessMessages = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "s3proxy_liveness_messages_total",
+	Help: "Number of liveness messages published to the broker, by whether they were confirmed or failed.",
+}, []string{"result"})
+
+func init() {
+	prometheus.MustRegister(livenessMessages)
+}
+
+// livenessConfig stores how the liveness messages are published, which tell
+// the pipeline that the inbox can reach it when there are no uploads
+type livenessConfig struct {
+	// how often a message is published, 0 publishes none
+	interval   time.Duration
+	routingKey string
+}
+
+// readLivenessConfig reads the broker.liveness section of the configuration
+func readLivenessConfig(messengerType string) (livenessConfig, error) {
+	l := livenessConfig{routingKey: "inbox.liveness"}
+
+	if viper.IsSet("broker.liveness.interval") {
+		l.interval = viper.GetDuration("broker.liveness.interval")
+		if l.interval < 0 {
+			return l, errors.New("broker.liveness.interval can not be negative")
+		}
+	}
+	if viper.IsSet("broker.liveness.routingKey") {
+		l.routingKey = viper.GetString("broker.liveness.routingKey")
+		if l.routingKey == "" {
+			return l, errors.New("broker.liveness.routingKey can not be empty")
+		}
+	}
+	if l.interval > 0 && messengerType != "amqp" {
+		return l, errors.New("broker.liveness needs broker.type amqp")
+	}
+
+	return l, nil
+}
+
+// livenessSender is a messenger that can publish liveness messages
+type livenessSender interface {
+	sendLiveness(routingKey string, body []byte) error
+}
+
+// livenessMessage is the body of the liveness messages
+type livenessMessage struct {
+	Operation string `json:"operation"`
+	Instance  string `json:"instance"`
+	Timestamp string `json:"timestamp"`
+}
+
+// runLiveness publishes a liveness message every interval until the context
+// is cancelled
+func runLiveness(ctx context.Context, sender livenessSender, c livenessConfig) {
+	instance, _ := os.Hostname()
+	ticker := time.NewTicker(c.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		body, _ := json.Marshal(livenessMessage{
+			Operation: "heartbeat",
+			Instance:  instance,
+			Timestamp: time.Now().UTC().Format(time.RFC3339),
+		})
+		if err := sender.sendLiveness(c.routingKey, body); err != nil {
+			livenessMessages.WithLabelValues("failed").Inc()
+			log.Warnf("liveness message not published: %v", err)
+			continue
+		}
+		livenessMessages.WithLabelValues("confirmed").Inc()
+	}
+}
+
+// sendLiveness publishes a liveness message with the routing key and waits
+// for the broker to confirm it. Liveness messages are not queued while the
+// broker can't be reached, missing ones are what tells about it.
+func (m *AMQPMessenger) sendLiveness(routingKey string, body []byte) error {
+	event := &amqpEvent{
+		routingKey: routingKey,
+		publishing: amqp.Publishing{
+			ContentType:   "application/json",
+			DeliveryMode:  amqp.Transient,
+			CorrelationId: uuid.New().String(),
+			Body:          body,
+		},
+		done: make(chan error, 1),
+	}
+	m.sign(&event.publishing)
+
+	m.lock.Lock()
+	err := errBrokerClosed
+	if m.session != nil {
+		err = m.publish(m.session, event)
+	}
+	m.lock.Unlock()
+	if err != nil {
+		return err
+	}
+	return <-event.done
+}
+
+// sendLiveness publishes the liveness message on the first channel
+func (p *AMQPPool) sendLiveness(routingKey string, body []byte) error {
+	return p.channels[0].sendLiveness(routingKey, body)
+}
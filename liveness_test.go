@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAMQPMessenger_sendLiveness(t *testing.T) {
+	m, sessions := newTestAMQPMessenger()
+	m.routingKey = "files.inbox"
+
+	// Nothing is queued while the broker is down
+	assert.ErrorIs(t, m.sendLiveness("inbox.liveness", []byte("{}")), errBrokerClosed)
+
+	go m.supervise()
+	session, channel := newFakeSession()
+	sessions <- session
+	assert.Eventually(t, func() bool {
+		return m.sendLiveness("inbox.liveness", []byte(`{"operation":"heartbeat"}`)) == nil
+	}, time.Second, time.Millisecond)
+	assert.NoError(t, m.SendMessage(Event{Operation: "upload", Username: "user", Filepath: "user/a.c4gh"}))
+	assert.Equal(t, []string{"inbox.liveness", "files.inbox"}, channel.keys)
+	assert.Equal(t, `{"operation":"heartbeat"}`, channel.body(0))
+}
+
+// livenessRecorder keeps the liveness messages
+type livenessRecorder struct {
+	lock   sync.Mutex
+	keys   []string
+	bodies [][]byte
+}
+
+func (r *livenessRecorder) sendLiveness(routingKey string, body []byte) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.keys = append(r.keys, routingKey)
+	r.bodies = append(r.bodies, body)
+	return nil
+}
+
+func TestRunLiveness(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	recorder := &livenessRecorder{}
+	go runLiveness(ctx, recorder, livenessConfig{interval: time.Millisecond, routingKey: "inbox.liveness"})
+	assert.Eventually(t, func() bool {
+		recorder.lock.Lock()
+		defer recorder.lock.Unlock()
+		return len(recorder.bodies) >= 2
+	}, time.Second, time.Millisecond)
+
+	recorder.lock.Lock()
+	defer recorder.lock.Unlock()
+	assert.Equal(t, "inbox.liveness", recorder.keys[0])
+	var message livenessMessage
+	assert.NoError(t, json.Unmarshal(recorder.bodies[0], &message))
+	assert.Equal(t, "heartbeat", message.Operation)
+	_, err := time.Parse(time.RFC3339, message.Timestamp)
+	assert.NoError(t, err)
+}
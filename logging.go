@@ -0,0 +1,218 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// logFormatters are the formats of the log by name
+var logFormatters = map[string]func() log.Formatter{
+	"text": func() log.Formatter { return &log.TextFormatter{} },
+	"json": func() log.Formatter { return &log.JSONFormatter{} },
+}
+
+// currentLogFormat is the name of the format the log is written in
+var currentLogFormat = struct {
+	sync.Mutex
+	name string
+}{name: "text"}
+
+// logFile is the file the log is written to, when it goes to a file. It is
+// opened again on SIGHUP, so it can be rotated.
+var logFile = &reopeningFile{}
+
+// configureLogging sets up the log from the log section of the
+// configuration: the level, the format, text or json, and the output,
+// stderr, stdout, syslog or the path of a file.
+func configureLogging() error {
+	if viper.IsSet("log.level") {
+		stringLevel := viper.GetString("log.level")
+		intLevel, err := log.ParseLevel(stringLevel)
+		if err != nil {
+			log.Infof("Log level '%s' not supported, setting to 'trace'", stringLevel)
+			intLevel = log.TraceLevel
+		}
+		log.SetLevel(intLevel)
+		log.Infof("Setting log level to '%s'", stringLevel)
+	}
+
+	format := "text"
+	if viper.IsSet("log.format") {
+		format = strings.ToLower(viper.GetString("log.format"))
+	}
+	if err := setLogFormat(format); err != nil {
+		return fmt.Errorf("log.format: %v", err)
+	}
+
+	// Hooks are only used to send the log to syslog
+	log.StandardLogger().ReplaceHooks(make(log.LevelHooks))
+	switch output := viper.GetString("log.output"); output {
+	case "", "stderr":
+		log.SetOutput(os.Stderr)
+	case "stdout":
+		log.SetOutput(os.Stdout)
+	case "syslog":
+		tag := "s3inbox"
+		if viper.IsSet("log.syslogTag") {
+			tag = viper.GetString("log.syslogTag")
+		}
+		hook, err := newSyslogHook(viper.GetString("log.syslogAddress"), tag)
+		if err != nil {
+			return fmt.Errorf("log.output: %v", err)
+		}
+		log.AddHook(hook)
+		log.SetOutput(io.Discard)
+	default:
+		if err := logFile.open(output); err != nil {
+			return fmt.Errorf("log.output: %v", err)
+		}
+		log.SetOutput(logFile)
+	}
+	return nil
+}
+
+// setLogFormat changes the format of the log to the named one
+func setLogFormat(name string) error {
+	formatter, ok := logFormatters[name]
+	if !ok {
+		return fmt.Errorf("unknown log format %q, use text or json", name)
+	}
+	currentLogFormat.Lock()
+	defer currentLogFormat.Unlock()
+	log.SetFormatter(formatter())
+	currentLogFormat.name = name
+	return nil
+}
+
+// reopeningFile is a file that can be opened again under the same name,
+// after it was moved away by log rotation
+type reopeningFile struct {
+	lock sync.Mutex
+	path string
+	file *os.File
+}
+
+// open opens the file at path for appending, closing the one open before
+func (f *reopeningFile) open(path string) error {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600) // #nosec this path comes from our configuration
+	if err != nil {
+		return err
+	}
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.file != nil {
+		f.file.Close()
+	}
+	f.path = path
+	f.file = file
+	return nil
+}
+
+// reopen opens the file again, if there is one
+func (f *reopeningFile) reopen() error {
+	f.lock.Lock()
+	path := f.path
+	f.lock.Unlock()
+	if path == "" {
+		return nil
+	}
+	return f.open(path)
+}
+
+func (f *reopeningFile) Write(p []byte) (int, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.file == nil {
+		return os.Stderr.Write(p)
+	}
+	return f.file.Write(p)
+}
+
+// watchLogFile opens the log file again when the process receives SIGHUP,
+// as logrotate sends after moving it. It should be run as a go routine, and
+// returns when ctx is done.
+func watchLogFile(ctx context.Context) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+		}
+		if err := logFile.reopen(); err != nil {
+			log.Errorf("failed to reopen the log file: %v", err)
+		}
+	}
+}
+
+// logSettings are the settings of the log that can be changed at runtime
+type logSettings struct {
+	Level  string `json:"level"`
+	Format string `json:"format"`
+}
+
+func currentLogSettings() logSettings {
+	currentLogFormat.Lock()
+	defer currentLogFormat.Unlock()
+	return logSettings{Level: log.GetLevel().String(), Format: currentLogFormat.name}
+}
+
+// logHandler serves the level and format of the log, which are changed by
+// a PUT with the level and format parameters, like /log?level=debug
+func logHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+		case http.MethodPut, http.MethodPost:
+			if err := changeLogSettings(r.FormValue("level"), r.FormValue("format")); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(currentLogSettings()); err != nil {
+			log.Errorf("writing log settings response: %v", err)
+		}
+	})
+}
+
+// changeLogSettings sets the level and format of the log, those that are
+// empty are left as they are
+func changeLogSettings(level, format string) error {
+	var newLevel log.Level
+	if level != "" {
+		var err error
+		if newLevel, err = log.ParseLevel(level); err != nil {
+			return err
+		}
+	}
+	if format != "" {
+		if err := setLogFormat(strings.ToLower(format)); err != nil {
+			return err
+		}
+		log.Infof("log format changed to %s", format)
+	}
+	if level != "" {
+		log.SetLevel(newLevel)
+		log.Infof("log level changed to %s", newLevel)
+	}
+	return nil
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+// resetLogging puts the log back the way the other tests expect it
+func resetLogging(t *testing.T) {
+	t.Cleanup(func() {
+		viper.Reset()
+		log.SetOutput(os.Stderr)
+		log.SetLevel(log.InfoLevel)
+		assert.NoError(t, setLogFormat("text"))
+		logFile = &reopeningFile{}
+	})
+}
+
+func TestConfigureLogging(t *testing.T) {
+	resetLogging(t)
+	path := filepath.Join(t.TempDir(), "s3inbox.log")
+
+	viper.Reset()
+	viper.Set("log.level", "debug")
+	viper.Set("log.format", "JSON")
+	viper.Set("log.output", path)
+	assert.NoError(t, configureLogging())
+	assert.Equal(t, log.DebugLevel, log.GetLevel())
+	log.WithField("user", "someone").Info("logged to the file")
+
+	content, err := ioutil.ReadFile(path)
+	assert.NoError(t, err)
+	lines := strings.Split(strings.TrimSpace(string(content)), "\n")
+	var entry map[string]interface{}
+	assert.NoError(t, json.Unmarshal([]byte(lines[len(lines)-1]), &entry))
+	assert.Equal(t, "logged to the file", entry["msg"])
+	assert.Equal(t, "someone", entry["user"])
+
+	// The file is written again after it is rotated
+	assert.NoError(t, os.Rename(path, path+".1"))
+	assert.NoError(t, logFile.reopen())
+	log.Info("after rotation")
+	content, err = ioutil.ReadFile(path)
+	assert.NoError(t, err)
+	assert.Contains(t, string(content), "after rotation")
+
+	viper.Set("log.format", "xml")
+	assert.Error(t, configureLogging())
+
+	viper.Set("log.format", "text")
+	viper.Set("log.output", "syslog")
+	viper.Set("log.syslogAddress", "localhost:514")
+	assert.Error(t, configureLogging(), "the syslog address needs a scheme")
+}
+
+func TestLogHandler(t *testing.T) {
+	resetLogging(t)
+	handler := logHandler()
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/log", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `{"level": "info", "format": "text"}`, w.Body.String())
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodPut, "/log?level=debug&format=json", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `{"level": "debug", "format": "json"}`, w.Body.String())
+	assert.Equal(t, log.DebugLevel, log.GetLevel())
+	assert.IsType(t, &log.JSONFormatter{}, log.StandardLogger().Formatter)
+
+	// Nothing changes when a setting is wrong
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodPut, "/log?level=loud&format=text", nil))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Equal(t, log.DebugLevel, log.GetLevel())
+	assert.Equal(t, "json", currentLogSettings().Format)
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodDelete, "/log", nil))
+	assert.Equal(t, http.StatusMethodNotAllowed, w.Code)
+}
@@ -1,63 +1,232 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
+	"fmt"
 	"net/http"
+	"os"
 
 	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
 )
 
 func main() {
+	if err := runCommand(os.Args[1:]); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// newServeCommand creates the serve command
+func newServeCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "serve",
+		Short: "run the proxy",
+		Args:  cobra.NoArgs,
+	}
+	configFlags := addConfigFlags(cmd.Flags())
+	cmd.RunE = func(*cobra.Command, []string) error {
+		configFlags.apply()
+		return runServe()
+	}
+	return cmd
+}
+
+// runServe is the serve command, it runs the proxy
+func runServe() error {
 	config, err := NewConfig()
 	if err != nil {
-		log.Fatal(err)
+		return err
+	}
+	log.Infof("starting %s", currentVersion())
+	// Stops the background tasks when the proxy stops
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go watchLogFile(ctx)
+	// The errors of the log are reported from here on
+	reporter, err := newErrorReporter(config.Reporting)
+	if err != nil {
+		return err
+	}
+	if reporter != nil {
+		log.AddHook(reporter)
+		// It runs until the proxy exits, to send the report of log.Fatal
+		go reporter.Run(context.Background())
+		log.RegisterExitHandler(func() { reporter.flush(config.Reporting.timeout) })
+		defer reporter.flush(config.Reporting.timeout)
+	}
+	if loadedRemote != nil {
+		log.Infof("configuration merged with %s", loadedRemote)
+		go loadedRemote.watch(ctx)
 	}
+	if config.Server.fips {
+		log.Info("running with FIPS-approved cryptography only")
+	}
+	logFeatures(config.Features)
 	tlsBroker, err := TLSConfigBroker(config)
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
 	tlsProxy, err := TLSConfigProxy(config)
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
 
-	err = checkS3Bucket(config.S3)
-	if err != nil {
-		log.Fatal(err)
+	if err = startupCheck(config, tlsBroker); err != nil {
+		return fmt.Errorf("startup check failed: %v", err)
 	}
 
-	messenger := NewAMQPMessenger(config.Broker, tlsBroker)
-	log.Debug("messenger acquired ", messenger)
+	// Files are cheap to look at, AWS secrets are only read again if asked
+	var files, remote []rotatingSecret
+	for _, s := range config.rotatingSecrets() {
+		if _, ok := s.(*secretFile); ok {
+			files = append(files, s)
+		} else {
+			remote = append(remote, s)
+		}
+	}
+	if len(files) > 0 {
+		go watchSecrets(ctx, config.Server.secretReloadInterval, files)
+	}
+	if len(remote) > 0 && config.Secrets.refreshInterval > 0 {
+		go watchSecrets(ctx, config.Secrets.refreshInterval, remote)
+	}
 
-	var pubkeys map[string][]byte
-	auth := NewValidateFromToken(pubkeys)
-	auth.pubkeys = make(map[string][]byte)
-	// Load keys for JWT verification
-	if config.Server.jwtpubkeyurl != "" {
-		if err := auth.getjwtpubkey(config.Server.jwtpubkeyurl); err != nil {
-			log.Panicf("Error while getting key %s: %v", config.Server.jwtpubkeyurl, err)
+	if config.S3.janitorInterval > 0 {
+		for _, backend := range append([]S3Config{config.S3}, config.backendList()...) {
+			go newUploadJanitor(backend).Run(ctx)
 		}
 	}
-	if config.Server.jwtpubkeypath != "" {
-		if err := auth.getjwtkey(config.Server.jwtpubkeypath); err != nil {
-			log.Panicf("Error while getting key %s: %v", config.Server.jwtpubkeypath, err)
+
+	base, err := NewMessenger(config.Broker, tlsBroker)
+	if err != nil {
+		return err
+	}
+	log.Debug("messenger acquired ", base)
+	messenger, err := wrapMessenger(base, config.Broker)
+	if err != nil {
+		return err
+	}
+	if outbox, ok := base.(*OutboxMessenger); ok {
+		go outbox.Relay(ctx)
+	}
+	if sender, ok := base.(livenessSender); ok && config.Broker.liveness.interval > 0 {
+		go runLiveness(ctx, sender, config.Broker.liveness)
+	}
+	if config.Broker.spool.dir != "" {
+		spool, err := NewSpoolingMessenger(messenger, config.Broker.spool)
+		if err != nil {
+			return err
 		}
+		go spool.Replay(ctx)
+		messenger = spool
+	}
+
+	// Load keys for JWT verification
+	auth, err := loadJWTKeys(config.Server)
+	if err != nil {
+		return err
+	}
+	audit, err := newAuditLog(config.Audit)
+	if err != nil {
+		return err
 	}
 	proxy := NewProxy(config.S3, auth, messenger, tlsProxy)
+	proxy.audit = audit
+	proxy.schemaVersion = config.Broker.schemaVersion
+	proxy.c4ghKey = config.Server.c4ghKey
+	proxy.clientContext = config.Server.clientContext
+	if err := configureProxy(proxy, config, tlsProxy); err != nil {
+		return err
+	}
 
 	log.Debug("got the proxy ", proxy)
+	live := &liveProxy{}
+	live.proxy.Store(proxy)
+	if loadedRemote != nil {
+		loadedRemote.reload = func() error {
+			reloaded, err := reloadProxy(proxy, tlsProxy)
+			if err != nil {
+				return err
+			}
+			live.proxy.Store(reloaded)
+			return nil
+		}
+	}
 
-	http.Handle("/", proxy)
+	capture, err := newDebugCapture(config.Debug)
+	if err != nil {
+		return err
+	}
+	// The proxy has a mux of its own, net/http/pprof adds the profiles to
+	// the default one
+	mux := http.NewServeMux()
+	mux.Handle("/", reporter.recoverPanics(capture.wrap(live)))
+	if config.Debug.pprofListen != "" {
+		go servePprof(config.Debug.pprofListen)
+	}
 
-	hc := NewHealthCheck(8001, config.S3, config.Broker, tlsProxy)
+	hc := NewHealthCheck(config.Server.healthListen, config.S3, config.Broker, tlsProxy)
+	if config.S3.monitorInterval > 0 {
+		monitor := newBackendMonitor(config.S3)
+		go monitor.Run(ctx)
+		hc.backendCheck = monitor.Check
+	}
 	go hc.RunHealthChecks()
+	if config.Server.adminListen != "" {
+		admin := &adminServer{audit: audit, capture: capture}
+		if spool, ok := messenger.(*SpoolingMessenger); ok {
+			admin.spool = spool
+		}
+		go admin.serve(config.Server.adminListen)
+	}
 
-	if config.Server.cert != "" && config.Server.key != "" {
-		if e := http.ListenAndServeTLS(":8000", config.Server.cert, config.Server.key, nil); e != nil {
-			panic(e)
+	var tlsServer *tls.Config
+	if len(config.Server.acme.domains) > 0 {
+		m := newACMEManager(config.Server.acme)
+		if config.Server.acme.httpAddress != "" {
+			go func() {
+				if e := http.ListenAndServe(config.Server.acme.httpAddress, m.HTTPHandler(nil)); e != nil {
+					panic(e)
+				}
+			}()
 		}
-	} else {
-		if e := http.ListenAndServe(":8000", nil); e != nil {
-			panic(e)
+		tlsServer = m.TLSConfig()
+	} else if config.Server.cert != "" && config.Server.key != "" {
+		certs, err := NewCertReloader(config.Server.cert, config.Server.key)
+		if err != nil {
+			return err
 		}
+		go certs.Watch(ctx, config.Server.certReloadInterval)
+		tlsServer = &tls.Config{GetCertificate: certs.GetCertificate}
 	}
+
+	if tlsServer != nil {
+		config.Server.tls.apply(tlsServer)
+		if config.Server.clientCAs != nil {
+			// Clients without a certificate are still let in
+			tlsServer.ClientCAs = config.Server.clientCAs
+			tlsServer.ClientAuth = tls.VerifyClientCertIfGiven
+		}
+	}
+
+	return serve(config.Server.listen, mux, tlsServer)
+}
+
+// configureProxy sets the proxy up with the settings of the configuration
+// that can change while it runs
+func configureProxy(proxy *Proxy, config *Config, tlsProxy *tls.Config) error {
+	proxy.trustedProxies = config.Server.trustedProxies
+	proxy.maxUploadSize = config.Server.maxUploadSize
+	proxy.forwardHeaders = config.Server.forwardHeaders
+	proxy.returnHeaders = config.Server.returnHeaders
+	proxy.allowedContentTypes = config.Server.contentTypes
+	proxy.downloads = config.Features.enabled("downloads")
+	proxy.deletes = config.Features.enabled("deletes")
+	proxy.renameWindow = config.Server.renameWindow
+	proxy.resumeUploads = config.Features.enabled("resumeUploads")
+	proxy.detectDuplicates = config.Features.enabled("detectDuplicates")
+	proxy.strictCrypt4gh = config.Features.enabled("strictCrypt4gh")
+	// The overrides start from the settings above
+	return setupOverrides(proxy, config, tlsProxy)
 }
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+var eventsDeduplicated = prometheus.NewCounter(prometheus.CounterOpts{
+	Name: "s3proxy_events_deduplicated_total",
+	Help: "Number of events not sent because an event with the same message id was sent recently.",
+})
+
+func init() {
+	prometheus.MustRegister(eventsDeduplicated)
+}
+
+// messageID is the id an event is sent with. It is derived from the user,
+// the file and its checksums, so the same upload event sent again, after a
+// retry, from the spool or the outbox, or by the next backfill, has the same
+// id and consumers can tell it is a duplicate. Events without checksums,
+// such as removes, are told apart by their timestamp instead.
+func messageID(message Event) string {
+	h := sha256.New()
+	for _, part := range []string{message.Operation, message.Username, message.Filepath, message.VersionID, message.OldPath} {
+		fmt.Fprintf(h, "%s\x00", part)
+	}
+	if len(message.Checksum) > 0 {
+		fmt.Fprintf(h, "%v\x00", message.Checksum)
+	} else {
+		fmt.Fprintf(h, "%s\x00", message.Timestamp)
+	}
+	return fmt.Sprintf("%x", h.Sum(nil))[:32]
+}
+
+// dedupConfig stores the settings of the record of sent message ids
+type dedupConfig struct {
+	// file the sent message ids are kept in, empty disables the record
+	file string
+	// how long a sent message id is kept
+	window time.Duration
+}
+
+// readDedupConfig reads the broker.dedup section of the configuration
+func readDedupConfig() (dedupConfig, error) {
+	d := dedupConfig{
+		file:   viper.GetString("broker.dedup.file"),
+		window: 24 * time.Hour,
+	}
+
+	if viper.IsSet("broker.dedup.window") {
+		d.window = viper.GetDuration("broker.dedup.window")
+		if d.window <= 0 {
+			return d, fmt.Errorf("broker.dedup.window must be positive")
+		}
+	}
+
+	return d, nil
+}
+
+// DedupingMessenger is a Messenger that keeps the message ids of the events
+// it sent in a file, and doesn't send an event again while its id is there.
+// The record survives restarts, so events that are sent again after one are
+// not published twice.
+type DedupingMessenger struct {
+	lock   sync.Mutex
+	next   Messenger
+	path   string
+	file   *os.File
+	window time.Duration
+	// sent are the times the recent message ids were sent
+	sent map[string]time.Time
+	// compacted is when the file last had the expired ids removed
+	compacted time.Time
+	// now returns the current time, it is replaced in the tests
+	now func() time.Time
+}
+
+// NewDedupingMessenger wraps the messenger with the record of sent message
+// ids, the ids sent before a restart are read back from the file
+func NewDedupingMessenger(next Messenger, c dedupConfig) (*DedupingMessenger, error) {
+	m := &DedupingMessenger{next: next, path: c.file, window: c.window, sent: make(map[string]time.Time), now: time.Now}
+
+	file, err := os.Open(c.file)
+	switch {
+	case os.IsNotExist(err):
+	case err != nil:
+		return nil, fmt.Errorf("broker.dedup.file: %v", err)
+	default:
+		m.load(file)
+		file.Close()
+	}
+	if len(m.sent) > 0 {
+		log.Infof("%d recently sent message ids in %s", len(m.sent), c.file)
+	}
+
+	if err := m.compact(); err != nil {
+		return nil, fmt.Errorf("broker.dedup.file: %v", err)
+	}
+	return m, nil
+}
+
+// load reads the message ids that haven't expired from the file, lines that
+// can't be read, like one cut short by a crash, are skipped
+func (m *DedupingMessenger) load(file *os.File) {
+	expired := m.now().Add(-m.window)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		id, sent, found := strings.Cut(scanner.Text(), " ")
+		seconds, err := strconv.ParseInt(sent, 10, 64)
+		if !found || err != nil {
+			continue
+		}
+		if at := time.Unix(seconds, 0); at.After(expired) {
+			m.sent[id] = at
+		}
+	}
+}
+
+// compact drops the expired message ids and writes the rest to a new file,
+// that is appended to from then on. It is called with the lock held.
+func (m *DedupingMessenger) compact() error {
+	now := m.now()
+	var b strings.Builder
+	for id, at := range m.sent {
+		if !at.After(now.Add(-m.window)) {
+			delete(m.sent, id)
+			continue
+		}
+		fmt.Fprintf(&b, "%s %d\n", id, at.Unix())
+	}
+
+	// The file is written under another name and renamed, so the ids are
+	// never lost halfway
+	temp, err := ioutil.TempFile(filepath.Dir(m.path), ".dedup-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(temp.Name())
+	if _, err := temp.WriteString(b.String()); err != nil {
+		temp.Close()
+		return err
+	}
+	if err := temp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(temp.Name(), m.path); err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(m.path, os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	if m.file != nil {
+		m.file.Close()
+	}
+	m.file = file
+	m.compacted = now
+	return nil
+}
+
+// SendMessage sends the event unless one with the same message id was sent
+// within the window
+func (m *DedupingMessenger) SendMessage(message Event) error {
+	id := messageID(message)
+
+	m.lock.Lock()
+	at, seen := m.sent[id]
+	m.lock.Unlock()
+	if seen && m.now().Sub(at) < m.window {
+		eventsDeduplicated.Inc()
+		log.WithField("request_id", message.RequestID).Infof("event %s was already sent at %s, not sending it again", id, at)
+		return nil
+	}
+
+	if err := m.next.SendMessage(message); err != nil {
+		return err
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.record(id)
+	return nil
+}
+
+// record adds a sent message id to the file, it is called with the lock
+// held. The event is sent already, so failing to record it is only logged.
+func (m *DedupingMessenger) record(id string) {
+	now := m.now()
+	m.sent[id] = now
+	if now.Sub(m.compacted) >= m.window {
+		if err := m.compact(); err != nil {
+			log.Errorf("compacting the sent message ids in %s: %v", m.path, err)
+		}
+		return
+	}
+	if _, err := fmt.Fprintf(m.file, "%s %d\n", id, now.Unix()); err != nil {
+		log.Errorf("recording the sent message id %s in %s: %v", id, m.path, err)
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMessageID(t *testing.T) {
+	upload := Event{Operation: "upload", Username: "user", Filepath: "user/a.c4gh", Checksum: []interface{}{Checksum{Type: "sha256", Value: "abc"}}, Timestamp: "2024-01-01T00:00:00Z"}
+	id := messageID(upload)
+	assert.Len(t, id, 32)
+
+	again := upload
+	again.Timestamp = "2024-01-02T00:00:00Z"
+	again.RequestID = "other"
+	assert.Equal(t, id, messageID(again), "the same upload has the same id")
+
+	changed := upload
+	changed.Checksum = []interface{}{Checksum{Type: "sha256", Value: "def"}}
+	assert.NotEqual(t, id, messageID(changed), "other content has another id")
+
+	moved := upload
+	moved.Filepath = "user/b.c4gh"
+	assert.NotEqual(t, id, messageID(moved))
+
+	// Without checksums the timestamp tells the events apart
+	remove := Event{Operation: "remove", Username: "user", Filepath: "user/a.c4gh", Timestamp: "2024-01-01T00:00:00Z"}
+	later := remove
+	later.Timestamp = "2024-01-01T00:00:01Z"
+	assert.NotEqual(t, messageID(remove), messageID(later))
+	assert.NotEqual(t, id, messageID(remove))
+}
+
+func TestDedupingMessenger(t *testing.T) {
+	config := dedupConfig{file: filepath.Join(t.TempDir(), "sent-ids"), window: time.Hour}
+	next := &recordingMessenger{}
+	m, err := NewDedupingMessenger(next, config)
+	assert.NoError(t, err)
+
+	deduplicated := testutil.ToFloat64(eventsDeduplicated)
+	event := Event{Operation: "upload", Username: "user", Filepath: "user/a.c4gh", Checksum: []interface{}{Checksum{Type: "sha256", Value: "abc"}}}
+	assert.NoError(t, m.SendMessage(event))
+	assert.NoError(t, m.SendMessage(event))
+	assert.Len(t, next.events, 1, "the event is sent once")
+	assert.Equal(t, deduplicated+1, testutil.ToFloat64(eventsDeduplicated))
+
+	// Events that could not be sent are not recorded
+	failed := Event{Operation: "upload", Username: "user", Filepath: "user/b.c4gh"}
+	next.err = errors.New("broker down")
+	assert.Error(t, m.SendMessage(failed))
+	next.err = nil
+	assert.NoError(t, m.SendMessage(failed))
+	assert.Len(t, next.events, 2)
+
+	// The record survives restarts
+	m, err = NewDedupingMessenger(next, config)
+	assert.NoError(t, err)
+	assert.Len(t, m.sent, 2)
+	assert.NoError(t, m.SendMessage(event))
+	assert.Len(t, next.events, 2)
+
+	// Once the window is over the event is sent again, and the expired ids
+	// are dropped from the file
+	now := time.Now().Add(2 * time.Hour)
+	m.now = func() time.Time { return now }
+	assert.NoError(t, m.SendMessage(event))
+	assert.Len(t, next.events, 3)
+	content, err := ioutil.ReadFile(config.file)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, strings.Count(string(content), "\n"))
+	assert.True(t, strings.HasPrefix(string(content), messageID(event)+" "))
+}
+
+func TestDedupingMessenger_damagedFile(t *testing.T) {
+	config := dedupConfig{file: filepath.Join(t.TempDir(), "sent-ids"), window: time.Hour}
+	event := Event{Operation: "upload", Username: "user", Filepath: "user/a.c4gh"}
+	content := "garbage\n" + messageID(event) + " " + strings.Repeat("9", 3) + "\n" + messageID(event) + " 1"
+	assert.NoError(t, ioutil.WriteFile(config.file, []byte(content), 0600))
+
+	m, err := NewDedupingMessenger(&recordingMessenger{}, config)
+	assert.NoError(t, err)
+	assert.Empty(t, m.sent, "unreadable and expired ids are skipped")
+}
@@ -1,11 +1,18 @@
 package main
 
 import (
+	"context"
+	"crypto/ed25519"
 	"crypto/tls"
-	"encoding/json"
+	"errors"
 	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
 
 	"github.com/google/uuid"
+	"github.com/prometheus/client_golang/prometheus"
 	log "github.com/sirupsen/logrus"
 	"github.com/streadway/amqp"
 )
@@ -23,111 +30,648 @@ type Event struct {
 	Filepath  string        `json:"filepath"`
 	Filesize  int64         `json:"filesize"`
 	Checksum  []interface{} `json:"encrypted_checksums"`
+	ClientIP  string        `json:"client_ip,omitempty"`
+	// VersionID is the version of the uploaded object in versioned buckets
+	VersionID string `json:"version_id,omitempty"`
+	// Duplicate tells that the uploaded content was already stored and
+	// the upload was skipped
+	Duplicate bool `json:"duplicate,omitempty"`
+	// DecryptedChecksums are the checksums of the content of the uploaded
+	// Crypt4GH file, when the proxy has the key to decrypt it
+	DecryptedChecksums []interface{} `json:"decrypted_checksums,omitempty"`
+	// OldPath is where a renamed file was before
+	OldPath string `json:"oldpath,omitempty"`
+	// SchemaVersion is only in events of the versioned schema
+	SchemaVersion int `json:"schema_version,omitempty"`
+	// Timestamp is when the proxy completed the operation, in RFC 3339
+	Timestamp string `json:"timestamp,omitempty"`
+	// UserAgent and ClientIdentity, the subject of the client certificate,
+	// are only sent when the full client context is configured
+	UserAgent      string `json:"user_agent,omitempty"`
+	ClientIdentity string `json:"client_identity,omitempty"`
+	// RequestID is the id of the request that caused the event, it is sent
+	// in the message headers rather than the body
+	RequestID string `json:"-"`
+	// RoutingKey replaces the routing key of the broker for the event, for
+	// the files of an override that sets one
+	RoutingKey string `json:"-"`
 }
 
+// The schemas events can be sent in. The legacy schema is what consumers
+// written before the schema was versioned expect.
+const (
+	legacySchema    = 1
+	versionedSchema = 2
+)
+
 // Messenger is an interface for sending messages for different file events
 type Messenger interface {
 	SendMessage(message Event) error
 }
 
-// AMQPMessenger is a Messenger that sends messages to a local AMQP broker
+func init() {
+	registerMessenger("amqp", messengerType{
+		// broker.user and broker.password are checked with the auth mechanism
+		required: []string{"broker.host", "broker.port", "broker.exchange", "broker.routingkey"},
+		create: func(c BrokerConfig, tlsConfig *tls.Config) (Messenger, error) {
+			if c.channels > 1 {
+				return NewAMQPPool(c, tlsConfig), nil
+			}
+			return NewAMQPMessenger(c, tlsConfig), nil
+		},
+		check: checkBroker,
+	})
+}
+
+// Backoff between attempts to connect to the broker, it doubles after each
+// failed attempt up to the maximum
+const (
+	amqpMinBackoff = time.Second
+	amqpMaxBackoff = time.Minute
+)
+
+// maxQueuedEvents bounds the events kept while the broker can't be reached,
+// and the events waiting for confirms. Events beyond it are errors.
+const maxQueuedEvents = 10000
+
+// Events the broker doesn't confirm in time, or rejects, are published again
+// until they have been tried amqpMaxAttempts times
+const (
+	amqpConfirmTimeout = 30 * time.Second
+	amqpMaxAttempts    = 5
+)
+
+var (
+	brokerConnected = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "s3proxy_broker_connected",
+		Help: "Number of channels to the AMQP broker to publish events on, 0 when it can't be reached.",
+	})
+	eventsPublished = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "s3proxy_events_published_total",
+		Help: "Number of AMQP messages published, including the ones published again.",
+	})
+	eventsConfirmed = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "s3proxy_events_confirmed_total",
+		Help: "Number of AMQP messages confirmed by the broker.",
+	})
+	eventsNacked = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "s3proxy_events_nacked_total",
+		Help: "Number of AMQP messages rejected by the broker.",
+	})
+	eventsRetried = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "s3proxy_events_retried_total",
+		Help: "Number of AMQP messages published again after they were rejected or not confirmed in time.",
+	})
+	eventsFailed = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "s3proxy_events_failed_total",
+		Help: "Number of AMQP messages given up on after the last attempt.",
+	})
+	eventConfirmSeconds = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "s3proxy_event_confirm_seconds",
+		Help:    "Time from publishing an AMQP message until the broker confirms it.",
+		Buckets: prometheus.ExponentialBuckets(0.001, 4, 8),
+	})
+)
+
+func init() {
+	prometheus.MustRegister(brokerConnected, eventsPublished, eventsConfirmed, eventsNacked, eventsRetried, eventsFailed, eventConfirmSeconds)
+}
+
+// amqpPublisher is the part of a channel the messenger publishes with
+type amqpPublisher interface {
+	Publish(exchange, key string, mandatory, immediate bool, msg amqp.Publishing) error
+}
+
+// amqpConnection is the part of a connection the messenger looks after
+type amqpConnection interface {
+	IsClosed() bool
+	Close() error
+}
+
+// amqpSession is a connection to the broker with a channel in confirm mode
+type amqpSession struct {
+	connection amqpConnection
+	channel    amqpPublisher
+	confirms   chan amqp.Confirmation
+	// closed gets the error when the channel or connection goes down
+	closed chan *amqp.Error
+	// delivery tag the next event published on the channel gets, and the
+	// published events waiting for their confirms by delivery tag
+	nextTag uint64
+	pending map[uint64]*amqpEvent
+}
+
+// amqpEvent is an event on its way to the broker
+type amqpEvent struct {
+	publishing amqp.Publishing
+	// routing key of the message, if not the one of the events
+	routingKey string
+	attempts   int
+	// when the event was last published
+	published time.Time
+	// done gets the outcome of the first delivery attempt that is waited for
+	done chan error
+}
+
+// finish tells the sender of the event how it went, if it still waits
+func (e *amqpEvent) finish(err error) {
+	select {
+	case e.done <- err:
+	default:
+	}
+}
+
+// AMQPMessenger is a Messenger that sends messages to a local AMQP broker.
+// The connection is looked after in the background, it is opened again with
+// backoff when it is lost and events sent in the meantime are queued until
+// it is back. Events are tracked until the broker confirms them, and the
+// ones it rejects or doesn't confirm in time are published again.
 type AMQPMessenger struct {
-	connection *amqp.Connection
-	channel    *amqp.Channel
+	lock    sync.Mutex
+	session *amqpSession
+	// events waiting for the connection, in the order they were sent
+	queued     []*amqpEvent
 	exchange   string
 	routingKey string
+	// delivery mode of the messages, amqp.Persistent or amqp.Transient
+	deliveryMode uint8
+	// confirmTimeout is how long to wait for a confirm before publishing
+	// an event again
+	confirmTimeout time.Duration
+	// events are published in batches of up to batchSize, waiting at most
+	// batchInterval for a batch to fill up
+	batchLock     sync.Mutex
+	batch         *amqpBatch
+	batchSize     int
+	batchInterval time.Duration
+	// key of the HMAC-SHA256 signatures of the messages, or of the JWS
+	// signatures, they are unsigned without either
+	signingKey []byte
+	jwsKey     ed25519.PrivateKey
+	format     eventFormat
+	// connect opens a session, reopen opens a new channel on the connection
+	// of a session whose channel was closed and sleep waits between
+	// attempts, they are replaced in the tests
+	connect func() (*amqpSession, error)
+	reopen  func(lost *amqpSession) (*amqpSession, error)
+	sleep   func(time.Duration)
 }
 
 // NewAMQPMessenger creates a new messenger that can communicate with a backend
-// amqp server.
+// amqp server. It connects in the background, so it can be created while
+// the broker is down.
 func NewAMQPMessenger(c BrokerConfig, tlsConfig *tls.Config) *AMQPMessenger {
-	brokerURI := buildMqURI(c.host, c.port, c.user, c.password, c.vhost, c.ssl)
+	return newAMQPMessenger(c, func() (*amqpSession, error) { return connectAMQP(c, tlsConfig) })
+}
 
-	var connection *amqp.Connection
-	var channel *amqp.Channel
-	var err error
+// newAMQPMessenger creates a messenger that opens its sessions with connect
+func newAMQPMessenger(c BrokerConfig, connect func() (*amqpSession, error)) *AMQPMessenger {
+	m := &AMQPMessenger{
+		exchange:       c.exchange,
+		routingKey:     c.routingKey,
+		deliveryMode:   amqp.Transient,
+		confirmTimeout: amqpConfirmTimeout,
+		batchSize:      c.batchSize,
+		batchInterval:  c.batchInterval,
+		jwsKey:         c.jwsKey,
+		format:         c.format,
+		connect:        connect,
+		sleep:          time.Sleep,
+		reopen: func(lost *amqpSession) (*amqpSession, error) {
+			return openAMQPChannel(lost.connection.(*amqp.Connection), c)
+		},
+	}
+	if c.persistent {
+		m.deliveryMode = amqp.Persistent
+	}
+	if c.signingMode == hmacSigning {
+		m.signingKey = []byte(c.signingKey)
+	}
+	go m.supervise()
+	return m
+}
 
-	log.Debugf("connecting to broker with <%s>", brokerURI)
-	if c.ssl {
-		connection, err = amqp.DialTLS(brokerURI, tlsConfig)
-	} else {
-		connection, err = amqp.Dial(brokerURI)
+// connectAMQP opens a connection and a channel on it
+func connectAMQP(c BrokerConfig, tlsConfig *tls.Config) (*amqpSession, error) {
+	connection, err := dialBroker(c, tlsConfig)
+	if err != nil {
+		return nil, err
 	}
+
+	session, err := openAMQPChannel(connection, c)
 	if err != nil {
-		log.Panicf("brokerErrMsg 1: %s", err)
+		connection.Close()
+		return nil, err
 	}
+	return session, nil
+}
 
-	channel, err = connection.Channel()
+// openAMQPChannel opens a channel in confirm mode and sets up the exchange,
+// the channel is all that has to be opened again when the broker closes it
+// but keeps the connection
+func openAMQPChannel(connection *amqp.Connection, c BrokerConfig) (*amqpSession, error) {
+	channel, err := connection.Channel()
 	if err != nil {
-		log.Panicf("brokerErrMsg 2: %s", err)
+		return nil, err
 	}
 
 	log.Debug("enabling publishing confirms.")
 	if err = channel.Confirm(false); err != nil {
-		log.Fatalf("channel could not be put into confirm mode: %s", err)
+		channel.Close()
+		return nil, fmt.Errorf("channel could not be put into confirm mode: %s", err)
 	}
 
-	if err = channel.ExchangeDeclarePassive(
-		c.exchange, // name
-		"topic",    // type
-		true,       // durable
-		false,      // auto-deleted
-		false,      // internal
-		false,      // noWait
-		nil,        // arguments
-	); err != nil {
-		log.Fatalf("exchange declare: %s", err)
+	if err = declareTopology(channel, c.exchange, c.topology); err != nil {
+		channel.Close()
+		return nil, err
+	}
+
+	return newAMQPSession(
+		connection,
+		channel,
+		// The channel stalls when confirms can't be delivered, so there is
+		// room for all the events that may wait for them
+		channel.NotifyPublish(make(chan amqp.Confirmation, 2*maxQueuedEvents)),
+		channel.NotifyClose(make(chan *amqp.Error, 1)),
+	), nil
+}
+
+// newAMQPSession sets up the tracking of the events published on a channel
+func newAMQPSession(connection amqpConnection, channel amqpPublisher, confirms chan amqp.Confirmation, closed chan *amqp.Error) *amqpSession {
+	return &amqpSession{
+		connection: connection,
+		channel:    channel,
+		confirms:   confirms,
+		closed:     closed,
+		// Delivery tags start at 1 on each channel
+		nextTag: 1,
+		pending: make(map[uint64]*amqpEvent),
+	}
+}
+
+// supervise keeps a session open, it connects with backoff and sends the
+// queued events each time the connection is back. A channel the broker
+// closes is opened again on the same connection when it is still up, dead
+// connections are found with the heartbeats.
+func (m *AMQPMessenger) supervise() {
+	backoff := amqpMinBackoff
+	var lost *amqpSession
+	for {
+		session, err := m.open(lost)
+		lost = nil
+		if err != nil {
+			log.Errorf("can not connect to broker, retrying in %s: %v", backoff, err)
+			m.sleep(backoff)
+			if backoff *= 2; backoff > amqpMaxBackoff {
+				backoff = amqpMaxBackoff
+			}
+			continue
+		}
+		backoff = amqpMinBackoff
+		log.Info("connected to broker")
+		brokerConnected.Inc()
+
+		m.lock.Lock()
+		m.session = session
+		m.sendQueued()
+		m.lock.Unlock()
+
+		tracked := make(chan struct{})
+		go func() {
+			m.trackConfirms(session)
+			close(tracked)
+		}()
+
+		err = <-session.closed
+		if session.connection != nil && !session.connection.IsClosed() {
+			log.Errorf("channel to broker closed: %v", err)
+			lost = session
+		} else {
+			log.Errorf("connection to broker lost: %v", err)
+		}
+		brokerConnected.Dec()
+		<-tracked
+
+		m.lock.Lock()
+		m.session = nil
+		m.requeuePending(session)
+		m.lock.Unlock()
+	}
+}
+
+// open opens a new channel on the connection of a session whose channel was
+// closed, or connects again if there is no such session or it fails
+func (m *AMQPMessenger) open(lost *amqpSession) (*amqpSession, error) {
+	if lost != nil {
+		session, err := m.reopen(lost)
+		if err == nil {
+			return session, nil
+		}
+		log.Warnf("can not open a new channel, connecting again: %v", err)
+		lost.connection.Close()
+	}
+	return m.connect()
+}
+
+// trackConfirms handles the confirms of a session, and publishes again the
+// events that are not confirmed in time, until the session is closed
+func (m *AMQPMessenger) trackConfirms(session *amqpSession) {
+	ticker := time.NewTicker(m.confirmTimeout / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case confirmed, ok := <-session.confirms:
+			if !ok {
+				return
+			}
+			m.lock.Lock()
+			m.confirm(session, confirmed)
+			m.sendQueued()
+			m.lock.Unlock()
+		case <-ticker.C:
+			m.lock.Lock()
+			m.retryUnconfirmed(session)
+			m.sendQueued()
+			m.lock.Unlock()
+		}
+	}
+}
+
+// confirm finishes a confirmed event and retries a rejected one, it is
+// called with the lock held
+func (m *AMQPMessenger) confirm(session *amqpSession, confirmed amqp.Confirmation) {
+	event, ok := session.pending[confirmed.DeliveryTag]
+	if !ok {
+		// Confirms of events that were already published again
+		return
+	}
+	delete(session.pending, confirmed.DeliveryTag)
+
+	if confirmed.Ack {
+		log.Debugf("confirmed delivery with delivery tag: %d", confirmed.DeliveryTag)
+		eventsConfirmed.Inc()
+		eventConfirmSeconds.Observe(time.Since(event.published).Seconds())
+		event.finish(nil)
+		return
+	}
+	eventsNacked.Inc()
+	m.retry(session, event, fmt.Errorf("failed delivery of delivery tag: %d", confirmed.DeliveryTag))
+}
+
+// retryUnconfirmed publishes again the events that have waited too long for
+// their confirms, it is called with the lock held
+func (m *AMQPMessenger) retryUnconfirmed(session *amqpSession) {
+	for tag, event := range session.pending {
+		if time.Since(event.published) < m.confirmTimeout {
+			continue
+		}
+		delete(session.pending, tag)
+		m.retry(session, event, fmt.Errorf("no confirm for delivery tag %d in %s", tag, m.confirmTimeout))
+	}
+}
+
+// retry publishes an event again unless it has been tried too many times,
+// it is called with the lock held
+func (m *AMQPMessenger) retry(session *amqpSession, event *amqpEvent, cause error) {
+	if event.attempts >= amqpMaxAttempts {
+		log.Errorf("event %s not delivered after %d attempts: %v", event.publishing.CorrelationId, event.attempts, cause)
+		eventsFailed.Inc()
+		event.finish(cause)
+		return
+	}
+	log.Warnf("publishing event %s again: %v", event.publishing.CorrelationId, cause)
+	eventsRetried.Inc()
+	if err := m.publish(session, event); err != nil {
+		if errors.Is(err, errBrokerClosed) {
+			// It is sent when the connection is back
+			m.queued = append(m.queued, event)
+			event.finish(nil)
+			return
+		}
+		event.finish(err)
+	}
+}
+
+// requeuePending puts the events of a closed session that were never
+// confirmed first in the queue, in the order they were published. It is
+// called with the lock held.
+func (m *AMQPMessenger) requeuePending(session *amqpSession) {
+	tags := make([]uint64, 0, len(session.pending))
+	for tag := range session.pending {
+		tags = append(tags, tag)
+	}
+	sort.Slice(tags, func(i, j int) bool { return tags[i] < tags[j] })
+
+	requeued := make([]*amqpEvent, 0, len(tags)+len(m.queued))
+	for _, tag := range tags {
+		event := session.pending[tag]
+		event.finish(nil)
+		requeued = append(requeued, event)
+	}
+	if len(requeued) > 0 {
+		log.Warnf("%d events were not confirmed before the connection was lost, they are sent again", len(requeued))
+	}
+	m.queued = append(requeued, m.queued...)
+	session.pending = map[uint64]*amqpEvent{}
+}
+
+// sendQueued sends the queued events if there is a connection and room for
+// them to wait for their confirms, it is called with the lock held
+func (m *AMQPMessenger) sendQueued() {
+	if m.session == nil || len(m.queued) == 0 {
+		return
+	}
+	log.Infof("sending %d queued events", len(m.queued))
+	for len(m.queued) > 0 && len(m.session.pending) < maxQueuedEvents {
+		if err := m.publish(m.session, m.queued[0]); err != nil {
+			log.Errorf("sending queued event: %v", err)
+			if errors.Is(err, errBrokerClosed) {
+				return
+			}
+			m.queued[0].finish(err)
+		}
+		m.queued = m.queued[1:]
+	}
+}
+
+// queue keeps an event until the connection is back, it is called with the
+// lock held
+func (m *AMQPMessenger) queue(event *amqpEvent) error {
+	if len(m.queued) >= maxQueuedEvents {
+		return fmt.Errorf("broker unavailable and %d events already queued", len(m.queued))
+	}
+	m.queued = append(m.queued, event)
+	log.Warnf("event queued until the broker can take it")
+	return nil
+}
+
+// flush waits until the queued events are published and the broker has
+// confirmed all events, or the context is done
+func (m *AMQPMessenger) flush(ctx context.Context) error {
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		m.lock.Lock()
+		waiting := len(m.queued)
+		if m.session != nil {
+			waiting += len(m.session.pending)
+		}
+		m.lock.Unlock()
+		if waiting == 0 {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("%d events not confirmed by the broker: %v", waiting, ctx.Err())
+		case <-ticker.C:
+		}
+	}
+}
+
+// dialBroker opens a connection to the broker
+func dialBroker(c BrokerConfig, tlsConfig *tls.Config) (*amqp.Connection, error) {
+	// The password may have been rotated since the last connection
+	brokerURI := buildMqURI(c.host, c.port, c.user, c.currentPassword(), c.vhost, c.ssl)
+
+	dial, err := proxyDialer(c)
+	if err != nil {
+		return nil, err
+	}
+
+	log.Debugf("connecting to broker with <%s>", brokerURI)
+	config := amqp.Config{
+		Heartbeat: c.heartbeat,
+		Locale:    "en_US",
+		Dial:      dial,
 	}
+	if c.ssl {
+		config.TLSClientConfig = tlsConfig
+	}
+	if c.authMechanism == "external" {
+		config.SASL = []amqp.Authentication{externalAuth{}}
+	}
+	return amqp.DialConfig(brokerURI, config)
+}
+
+// externalAuth is the SASL EXTERNAL mechanism, the broker takes the user
+// from the client certificate
+type externalAuth struct{}
+
+// Mechanism returns "EXTERNAL"
+func (externalAuth) Mechanism() string {
+	return "EXTERNAL"
+}
+
+// Response is empty, the identity comes from the TLS connection
+func (externalAuth) Response() string {
+	return ""
+}
 
-	return &AMQPMessenger{connection, channel, c.exchange, c.routingKey}
+// brokerHTTPClient is the client of the messengers with HTTP APIs, it uses
+// the TLS and proxy settings of the broker
+func brokerHTTPClient(c BrokerConfig, tlsConfig *tls.Config) *http.Client {
+	return &http.Client{Transport: &http.Transport{
+		TLSClientConfig: tlsConfig,
+		Proxy:           httpProxyFunc(c.proxy, c.proxyFromEnvironment),
+	}}
 }
 
-// SendMessage sends message to RabbitMQ if the upload is finished
+// SendMessage sends message to RabbitMQ if the upload is finished and waits
+// for the broker to confirm it. Events are queued while the broker can't be
+// reached, and count as sent once they are queued.
 func (m *AMQPMessenger) SendMessage(message Event) error {
-	// Set channel
-	if e := m.channel.Confirm(false); e != nil {
-		log.Fatalf("channel could not be put into confirm mode: %s", e)
+	// Batches are published with the routing key of the broker
+	if m.batchSize > 1 && message.RoutingKey == "" {
+		return m.sendBatched(message)
 	}
 
-	// Shouldn't this be setup once and for all?
-	confirms := m.channel.NotifyPublish(make(chan amqp.Confirmation, 100))
-	defer confirmOne(confirms)
+	body, err := m.format.encode(message)
+	if err != nil {
+		return err
+	}
 
-	body, e := json.Marshal(message)
-	if e != nil {
-		log.Fatalf("%s", e)
+	// The request id ties the message to the request it came from
+	corrID := message.RequestID
+	if corrID == "" {
+		corrID = uuid.New().String()
 	}
 
-	corrID, _ := uuid.NewRandom()
+	headers := amqp.Table{}
+	if message.RequestID != "" {
+		headers["x-request-id"] = message.RequestID
+	}
 
-	err := m.channel.Publish(
-		m.exchange,
-		m.routingKey,
-		false, // mandatory
-		false, // immediate
-		amqp.Publishing{
-			Headers:         amqp.Table{},
-			ContentEncoding: "UTF-8",
-			ContentType:     "application/json",
-			DeliveryMode:    amqp.Transient, // 1=non-persistent, 2=persistent
-			CorrelationId:   corrID.String(),
+	event := &amqpEvent{
+		publishing: amqp.Publishing{
+			Headers:         headers,
+			ContentEncoding: m.format.contentEncoding("UTF-8"),
+			ContentType:     m.format.contentType(),
+			DeliveryMode:    m.deliveryMode, // 1=non-persistent, 2=persistent
+			CorrelationId:   corrID,
+			MessageId:       messageID(message),
 			Priority:        0, // 0-9
-			Body:            []byte(body),
-			// a bunch of application/implementation-specific fields
+			Body:            body,
 		},
-	)
-	return err
+		routingKey: message.RoutingKey,
+		done:       make(chan error, 1),
+	}
+	m.sign(&event.publishing)
+
+	published, err := m.enqueue(event)
+	if err != nil || !published {
+		return err
+	}
+	return <-event.done
+}
+
+// enqueue publishes the event, or queues it until it can be published. It
+// tells if the event was published, and the confirm is to be waited for.
+func (m *AMQPMessenger) enqueue(event *amqpEvent) (bool, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	// Events keep their order, so nothing is sent before the queue is empty
+	if m.session == nil || len(m.queued) > 0 || len(m.session.pending) >= maxQueuedEvents {
+		return false, m.queue(event)
+	}
+	err := m.publish(m.session, event)
+	if errors.Is(err, errBrokerClosed) {
+		return false, m.queue(event)
+	}
+	return err == nil, err
 }
 
-// // One would typically keep a channel of publishings, a sequence number, and a
-// // set of unacknowledged sequence numbers and loop until the publishing channel
-// // is closed.
-func confirmOne(confirms <-chan amqp.Confirmation) error {
-	confirmed := <-confirms
-	if !confirmed.Ack {
-		return fmt.Errorf("failed delivery of delivery tag: %d", confirmed.DeliveryTag)
+// errBrokerClosed tells that the session went down before an event could be
+// published
+var errBrokerClosed = errors.New("broker connection closed")
+
+// publish sends an event on the session and tracks it until the broker
+// confirms it, it is called with the lock held
+func (m *AMQPMessenger) publish(session *amqpSession, event *amqpEvent) error {
+	routingKey := m.routingKey
+	if event.routingKey != "" {
+		routingKey = event.routingKey
 	}
-	log.Printf("confirmed delivery with delivery tag: %d", confirmed.DeliveryTag)
+	if err := session.channel.Publish(
+		m.exchange,
+		routingKey,
+		false, // mandatory
+		false, // immediate
+		event.publishing,
+	); err != nil {
+		if err == amqp.ErrClosed {
+			return errBrokerClosed
+		}
+		return err
+	}
+
+	eventsPublished.Inc()
+
+	// The delivery tag only counts publishings that reached the channel
+	session.pending[session.nextTag] = event
+	session.nextTag++
+	event.attempts++
+	event.published = time.Now()
 	return nil
 }
 
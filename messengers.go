@@ -0,0 +1,74 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"sort"
+)
+
+// messengerType is a way of sending events, selected with broker.type
+type messengerType struct {
+	// required are the configuration settings the messenger can't do without
+	required []string
+	// create sets up the messenger from the configuration
+	create func(c BrokerConfig, tlsConfig *tls.Config) (Messenger, error)
+	// check verifies at startup that events can be sent, it may be nil
+	check func(c BrokerConfig, tlsConfig *tls.Config) error
+}
+
+// messengerTypes are the registered messengers by name
+var messengerTypes = map[string]messengerType{}
+
+// registerMessenger makes a messenger available to the configuration, it is
+// meant to be called from the init function of the implementation
+func registerMessenger(name string, t messengerType) {
+	if _, ok := messengerTypes[name]; ok {
+		panic("messenger " + name + " registered twice")
+	}
+	messengerTypes[name] = t
+}
+
+// getMessengerType returns the registered messenger with the name
+func getMessengerType(name string) (messengerType, error) {
+	t, ok := messengerTypes[name]
+	if !ok {
+		names := make([]string, 0, len(messengerTypes))
+		for n := range messengerTypes {
+			names = append(names, n)
+		}
+		sort.Strings(names)
+		return messengerType{}, fmt.Errorf("unknown messenger %q, known are %v", name, names)
+	}
+	return t, nil
+}
+
+// wrapMessenger adds the record of sent message ids and the retries the
+// configuration asks for to the messenger. The outbox keeps the record for
+// the events it relays, as that is where they may be sent twice.
+func wrapMessenger(messenger Messenger, c BrokerConfig) (Messenger, error) {
+	if c.dedup.file != "" {
+		target := &messenger
+		if outbox, ok := messenger.(*OutboxMessenger); ok {
+			target = &outbox.relay
+		}
+		dedup, err := NewDedupingMessenger(*target, c.dedup)
+		if err != nil {
+			return nil, err
+		}
+		*target = dedup
+	}
+	// The fan-out retries each destination on its own
+	if c.retry.attempts > 1 && c.messengerType != "fanout" {
+		messenger = NewRetryingMessenger(messenger, c.retry)
+	}
+	return messenger, nil
+}
+
+// NewMessenger creates the messenger selected in the configuration
+func NewMessenger(c BrokerConfig, tlsConfig *tls.Config) (Messenger, error) {
+	t, err := getMessengerType(c.messengerType)
+	if err != nil {
+		return nil, err
+	}
+	return t.create(c, tlsConfig)
+}
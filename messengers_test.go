@@ -0,0 +1,37 @@
+package main
+
+import (
+	"crypto/tls"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGetMessengerType(t *testing.T) {
+	amqp, err := getMessengerType("amqp")
+	assert.NoError(t, err)
+	assert.Contains(t, amqp.required, "broker.host")
+	assert.NotNil(t, amqp.check)
+
+	_, err = getMessengerType("carrier-pigeon")
+	assert.Error(t, err)
+}
+
+func TestRegisterMessenger(t *testing.T) {
+	defer delete(messengerTypes, "test")
+
+	messenger := NewMockMessenger()
+	registerMessenger("test", messengerType{
+		create: func(c BrokerConfig, tlsConfig *tls.Config) (Messenger, error) {
+			return messenger, nil
+		},
+	})
+	m, err := NewMessenger(BrokerConfig{messengerType: "test"}, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, messenger, m)
+
+	assert.Panics(t, func() { registerMessenger("test", messengerType{}) })
+
+	_, err = NewMessenger(BrokerConfig{messengerType: "unknown"}, nil)
+	assert.Error(t, err)
+}
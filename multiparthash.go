@@ -0,0 +1,209 @@
+package main
+
+import (
+	"crypto/md5" // #nosec only used to verify the ETags of multipart uploads
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxTrackedUploads bounds the number of multipart uploads hashed at the same
+// time, uploads started when it is reached are not tracked
+const maxTrackedUploads = 10000
+
+// trackedUploadTimeout is how long an upload without new parts is kept
+const trackedUploadTimeout = 24 * time.Hour
+
+// multipartHashes computes the checksums of multipart uploads from the
+// parts passing through the proxy. This only works when the parts are sent
+// one after the other in order, uploads with parts sent in parallel or out of
+// order are not tracked and have to be checksummed some other way.
+type multipartHashes struct {
+	lock    sync.Mutex
+	uploads map[string]*multipartHash
+}
+
+// multipartHash is the checksum of the parts of an upload received so far
+type multipartHash struct {
+	// the part expected next, and the hash state after the previous parts
+	next  int
+	state [][]byte
+	size  int64
+	// MD5 sums of the parts, from their ETags, which make up the ETag of
+	// the completed upload
+	partSums [][]byte
+	// a part is being received
+	busy    bool
+	broken  bool
+	updated time.Time
+}
+
+// partHash hashes the body of one part as it is forwarded
+type partHash struct {
+	uploadID string
+	part     int
+	hash     *contentHash
+	body     io.ReadCloser
+	size     int64
+	done     bool
+}
+
+func newMultipartHashes() *multipartHashes {
+	return &multipartHashes{uploads: make(map[string]*multipartHash)}
+}
+
+// uploadsPart tells if the request uploads a part of a multipart upload
+func uploadsPart(r *http.Request) bool {
+	query := r.URL.Query()
+	return r.Method == http.MethodPut && query.Get("uploadId") != "" && query.Get("partNumber") != "" &&
+		r.Header.Get("X-Amz-Copy-Source") == ""
+}
+
+// track starts hashing the body of an uploaded part if it is the next one of
+// its upload, it returns nil when the part is not hashed
+func (m *multipartHashes) track(r *http.Request) *partHash {
+	uploadID := r.URL.Query().Get("uploadId")
+	part, err := strconv.Atoi(r.URL.Query().Get("partNumber"))
+	if err != nil {
+		return nil
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	upload, ok := m.uploads[uploadID]
+	if !ok {
+		if part != 1 || !m.makeRoom() {
+			return nil
+		}
+		state, _ := newContentHash().state()
+		upload = &multipartHash{next: 1, state: state}
+		m.uploads[uploadID] = upload
+	}
+	upload.updated = time.Now()
+	if upload.broken {
+		return nil
+	}
+	if upload.busy || part != upload.next {
+		// Parts in parallel, out of order or sent again can't be hashed
+		// in one go
+		upload.broken = true
+		return nil
+	}
+
+	h, err := resumeContentHash(upload.state)
+	if err != nil {
+		upload.broken = true
+		return nil
+	}
+	upload.busy = true
+
+	ph := &partHash{uploadID: uploadID, part: part, hash: h, body: r.Body}
+	r.Body = ph
+	return ph
+}
+
+// makeRoom drops uploads that have been idle for too long when there are too
+// many, it tells if there is room for another one
+func (m *multipartHashes) makeRoom() bool {
+	if len(m.uploads) < maxTrackedUploads {
+		return true
+	}
+	for id, upload := range m.uploads {
+		if time.Since(upload.updated) > trackedUploadTimeout {
+			delete(m.uploads, id)
+		}
+	}
+	return len(m.uploads) < maxTrackedUploads
+}
+
+func (ph *partHash) Read(b []byte) (int, error) {
+	n, err := ph.body.Read(b)
+	ph.hash.Write(b[:n])
+	ph.size += int64(n)
+	if err == io.EOF {
+		ph.done = true
+	}
+	return n, err
+}
+
+func (ph *partHash) Close() error {
+	return ph.body.Close()
+}
+
+// partDone adds the hashed part to its upload if the backend stored it
+func (m *multipartHashes) partDone(ph *partHash, response *http.Response) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	upload, ok := m.uploads[ph.uploadID]
+	if !ok {
+		return
+	}
+	upload.busy = false
+	if response == nil || response.StatusCode != http.StatusOK || !ph.done {
+		// The part is sent again on failures, so the hash stays as it was
+		return
+	}
+
+	sum, err := hex.DecodeString(strings.Trim(response.Header.Get("ETag"), "\""))
+	if err != nil || len(sum) != md5.Size {
+		// Without MD5 ETags the completed upload can't be verified
+		upload.broken = true
+		return
+	}
+	state, err := ph.hash.state()
+	if err != nil {
+		upload.broken = true
+		return
+	}
+	upload.state = state
+	upload.size += ph.size
+	upload.partSums = append(upload.partSums, sum)
+	upload.next++
+}
+
+// complete returns the checksum of a completed upload with the given ETag,
+// if all of its parts were hashed, and stops tracking it
+func (m *multipartHashes) complete(uploadID, etag string) (objectInfo, bool) {
+	m.lock.Lock()
+	upload, ok := m.uploads[uploadID]
+	delete(m.uploads, uploadID)
+	m.lock.Unlock()
+
+	if !ok || upload.broken || upload.busy || len(upload.partSums) == 0 {
+		return objectInfo{}, false
+	}
+	// The upload may have been completed with only some of the parts
+	if strings.Trim(etag, "\"") != multipartETag(upload.partSums) {
+		return objectInfo{}, false
+	}
+
+	h, err := resumeContentHash(upload.state)
+	if err != nil {
+		return objectInfo{}, false
+	}
+	return h.info(upload.size), true
+}
+
+// abort stops tracking an upload
+func (m *multipartHashes) abort(uploadID string) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	delete(m.uploads, uploadID)
+}
+
+// multipartETag returns the ETag S3 gives a multipart upload of parts with
+// the given MD5 sums
+func multipartETag(partSums [][]byte) string {
+	h := md5.New() // #nosec this is how S3 computes the ETag
+	for _, sum := range partSums {
+		h.Write(sum)
+	}
+	return fmt.Sprintf("%x-%d", h.Sum(nil), len(partSums))
+}
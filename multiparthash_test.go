@@ -0,0 +1,88 @@
+package main
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// sendPart passes a part through the hashes as if the backend stored it
+func sendPart(m *multipartHashes, uploadID string, part int, data string) {
+	r, _ := http.NewRequest("PUT", fmt.Sprintf("/bucket/user/file?partNumber=%d&uploadId=%s", part, uploadID), strings.NewReader(data))
+	ph := m.track(r)
+	if ph == nil {
+		return
+	}
+	_, _ = io.Copy(io.Discard, r.Body)
+	response := &http.Response{StatusCode: http.StatusOK, Header: http.Header{}}
+	response.Header.Set("ETag", fmt.Sprintf("\"%x\"", md5.Sum([]byte(data))))
+	m.partDone(ph, response)
+}
+
+func partsETag(data ...string) string {
+	var sums [][]byte
+	for _, d := range data {
+		sum := md5.Sum([]byte(d))
+		sums = append(sums, sum[:])
+	}
+	return multipartETag(sums)
+}
+
+func TestMultipartHashes(t *testing.T) {
+	m := newMultipartHashes()
+
+	sendPart(m, "1", 1, "abc")
+	sendPart(m, "1", 2, "def")
+	info, ok := m.complete("1", "\""+partsETag("abc", "def")+"\"")
+	assert.True(t, ok)
+	assert.Equal(t, objectInfo{checksum: fmt.Sprintf("%x", sha256.Sum256([]byte("abcdef"))), md5: fmt.Sprintf("%x", md5.Sum([]byte("abcdef"))), size: 6}, info)
+	assert.Empty(t, m.uploads)
+
+	// Completing with other parts than the hashed ones gives nothing
+	sendPart(m, "2", 1, "abc")
+	sendPart(m, "2", 2, "def")
+	_, ok = m.complete("2", partsETag("abc"))
+	assert.False(t, ok)
+
+	// Parts out of order can't be hashed
+	sendPart(m, "3", 1, "abc")
+	sendPart(m, "3", 3, "ghi")
+	sendPart(m, "3", 2, "def")
+	_, ok = m.complete("3", partsETag("abc", "def", "ghi"))
+	assert.False(t, ok)
+
+	// Uploads not started with the first part are not tracked
+	sendPart(m, "4", 2, "def")
+	assert.Empty(t, m.uploads)
+
+	sendPart(m, "5", 1, "abc")
+	m.abort("5")
+	assert.Empty(t, m.uploads)
+}
+
+func TestMultipartHashes_failedPart(t *testing.T) {
+	m := newMultipartHashes()
+
+	// A part the backend did not store is sent again
+	r, _ := http.NewRequest("PUT", "/bucket/user/file?partNumber=1&uploadId=1", strings.NewReader("xyz"))
+	ph := m.track(r)
+	_, _ = io.Copy(io.Discard, r.Body)
+	m.partDone(ph, &http.Response{StatusCode: http.StatusInternalServerError})
+
+	sendPart(m, "1", 1, "abc")
+	info, ok := m.complete("1", partsETag("abc"))
+	assert.True(t, ok)
+	assert.Equal(t, fmt.Sprintf("%x", sha256.Sum256([]byte("abc"))), info.checksum)
+
+	// Parts sent at the same time can't be hashed in order
+	r1, _ := http.NewRequest("PUT", "/bucket/user/file?partNumber=1&uploadId=2", strings.NewReader("abc"))
+	assert.NotNil(t, m.track(r1))
+	r2, _ := http.NewRequest("PUT", "/bucket/user/file?partNumber=1&uploadId=2", strings.NewReader("abc"))
+	assert.Nil(t, m.track(r2))
+}
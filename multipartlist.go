@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// listsUploads tells if the request is a ListMultipartUploads of the user's
+// "bucket", i.e. GET /username?uploads
+func listsUploads(r *http.Request) bool {
+	if r.Method != http.MethodGet {
+		return false
+	}
+	if _, ok := r.URL.Query()["uploads"]; !ok {
+		return false
+	}
+	return !strings.Contains(strings.Trim(r.URL.Path, "/"), "/")
+}
+
+// listsParts tells if the request is a ListParts of an upload of an object,
+// i.e. GET /username/key?uploadId=id
+func listsParts(r *http.Request) bool {
+	if r.Method != http.MethodGet || r.URL.Query().Get("uploadId") == "" {
+		return false
+	}
+	segments := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/"), "/", 2)
+	return len(segments) == 2 && segments[1] != "" && !strings.HasSuffix(r.URL.Path, "/")
+}
+
+// requestUser returns the user of the request, i.e. the first segment of the
+// path
+func requestUser(r *http.Request) string {
+	return strings.SplitN(strings.TrimPrefix(r.URL.Path, "/"), "/", 2)[0]
+}
+
+// scopeUploadListing restricts a ListMultipartUploads to the uploads below
+// the user's prefix in the backend bucket
+func scopeUploadListing(r *http.Request, bucket, username string) {
+	query := r.URL.Query()
+	query.Set("prefix", username+"/"+query.Get("prefix"))
+	if marker := query.Get("key-marker"); marker != "" {
+		query.Set("key-marker", username+"/"+marker)
+	}
+	r.URL.Path = "/" + bucket + "/"
+	r.URL.RawQuery = query.Encode()
+}
+
+// unscopedElements are the elements of upload listings that hold keys
+var unscopedElements = map[string]bool{"Key": true, "Prefix": true, "KeyMarker": true, "NextKeyMarker": true}
+
+// unscopeUploadListing rewrites a ListMultipartUploads or ListParts result
+// from the backend so that it looks like a listing of the user's own bucket,
+// which is what the client asked for. Clients use the keys in it to resume
+// or abort uploads, so they must not include the user's prefix.
+func unscopeUploadListing(body []byte, bucket, username string) ([]byte, error) {
+	decoder := xml.NewDecoder(bytes.NewReader(body))
+	var out bytes.Buffer
+	encoder := xml.NewEncoder(&out)
+
+	element := ""
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		switch t := token.(type) {
+		case xml.StartElement:
+			element = t.Name.Local
+			// The namespace is kept in the xmlns attribute, the encoder
+			// would add it once more
+			t.Name.Space = ""
+			token = t
+		case xml.EndElement:
+			element = ""
+			t.Name.Space = ""
+			token = t
+		case xml.CharData:
+			switch {
+			case element == "Bucket" && string(t) == bucket:
+				token = xml.CharData(username)
+			case unscopedElements[element]:
+				token = xml.CharData(bytes.TrimPrefix(t, []byte(username+"/")))
+			}
+		}
+		if err := encoder.EncodeToken(token); err != nil {
+			return nil, err
+		}
+	}
+	if err := encoder.Flush(); err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestListsUploads(t *testing.T) {
+	for path, expected := range map[string]bool{
+		"/username?uploads":              true,
+		"/username/?uploads&prefix=dir/": true,
+		"/username/file?uploads":         false,
+		"/username/?delimiter=/":         false,
+	} {
+		r, _ := http.NewRequest("GET", path, nil)
+		assert.Equal(t, expected, listsUploads(r), path)
+	}
+
+	r, _ := http.NewRequest("POST", "/username/file?uploads", nil)
+	assert.False(t, listsUploads(r))
+}
+
+func TestListsParts(t *testing.T) {
+	for path, expected := range map[string]bool{
+		"/username/file?uploadId=1": true,
+		"/username/?uploadId=1":     false,
+		"/username/file":            false,
+	} {
+		r, _ := http.NewRequest("GET", path, nil)
+		assert.Equal(t, expected, listsParts(r), path)
+	}
+
+	r, _ := http.NewRequest("DELETE", "/username/file?uploadId=1", nil)
+	assert.False(t, listsParts(r))
+}
+
+func TestScopeUploadListing(t *testing.T) {
+	r, _ := http.NewRequest("GET", "/username?uploads&prefix=dir/&key-marker=dir/a", nil)
+	scopeUploadListing(r, "bucket", "username")
+	assert.Equal(t, "/bucket/", r.URL.Path)
+	assert.Equal(t, "username/dir/", r.URL.Query().Get("prefix"))
+	assert.Equal(t, "username/dir/a", r.URL.Query().Get("key-marker"))
+
+	r, _ = http.NewRequest("GET", "/username?uploads", nil)
+	scopeUploadListing(r, "bucket", "username")
+	assert.Equal(t, "username/", r.URL.Query().Get("prefix"))
+	assert.Equal(t, "", r.URL.Query().Get("key-marker"))
+}
+
+func TestUnscopeUploadListing(t *testing.T) {
+	body := "<ListMultipartUploadsResult><Bucket>bucket</Bucket><KeyMarker></KeyMarker><Prefix>username/</Prefix>" +
+		"<NextKeyMarker>username/b</NextKeyMarker><Upload><Key>username/b</Key><UploadId>1</UploadId></Upload></ListMultipartUploadsResult>"
+	expected := "<ListMultipartUploadsResult><Bucket>username</Bucket><KeyMarker></KeyMarker><Prefix></Prefix>" +
+		"<NextKeyMarker>b</NextKeyMarker><Upload><Key>b</Key><UploadId>1</UploadId></Upload></ListMultipartUploadsResult>"
+	unscoped, err := unscopeUploadListing([]byte(body), "bucket", "username")
+	assert.NoError(t, err)
+	assert.Equal(t, expected, string(unscoped))
+
+	// Escaped keys, the namespace and elements with other names are kept
+	body = `<?xml version="1.0" encoding="UTF-8"?>
+<ListPartsResult xmlns="http://s3.amazonaws.com/doc/2006-03-01/"><Bucket>bucket</Bucket><Key>username/a&amp;b</Key>` +
+		`<Initiator><ID>username/x</ID></Initiator></ListPartsResult>`
+	expected = `<?xml version="1.0" encoding="UTF-8"?>
+<ListPartsResult xmlns="http://s3.amazonaws.com/doc/2006-03-01/"><Bucket>username</Bucket><Key>a&amp;b</Key>` +
+		`<Initiator><ID>username/x</ID></Initiator></ListPartsResult>`
+	unscoped, err = unscopeUploadListing([]byte(body), "bucket", "username")
+	assert.NoError(t, err)
+	assert.Equal(t, expected, string(unscoped))
+
+	_, err = unscopeUploadListing([]byte("<ListPartsResult><Key>"), "bucket", "username")
+	assert.Error(t, err)
+}
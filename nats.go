@@ -0,0 +1,188 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// natsConfig stores the settings of the NATS JetStream messenger
+type natsConfig struct {
+	urls    []string
+	subject string
+	// stream the subject must belong to, empty accepts any stream
+	stream string
+	// credentials file with the user JWT and NKey seed, used instead of
+	// broker.user and broker.password when set
+	credentials string
+	// how long to wait for the stream to acknowledge an event
+	timeout time.Duration
+}
+
+func init() {
+	registerMessenger("nats", messengerType{
+		required: []string{"broker.nats.urls", "broker.nats.subject"},
+		create: func(c BrokerConfig, tlsConfig *tls.Config) (Messenger, error) {
+			return NewNATSMessenger(c, tlsConfig)
+		},
+		check: checkNATS,
+	})
+}
+
+// readNATSConfig reads the broker.nats section of the configuration
+func readNATSConfig() (natsConfig, error) {
+	n := natsConfig{
+		urls:        viper.GetStringSlice("broker.nats.urls"),
+		subject:     viper.GetString("broker.nats.subject"),
+		stream:      viper.GetString("broker.nats.stream"),
+		credentials: viper.GetString("broker.nats.credentials"),
+		timeout:     5 * time.Second,
+	}
+
+	if viper.IsSet("broker.nats.timeout") {
+		n.timeout = viper.GetDuration("broker.nats.timeout")
+		if n.timeout <= 0 {
+			return n, fmt.Errorf("broker.nats.timeout must be positive")
+		}
+	}
+
+	return n, nil
+}
+
+// natsOptions sets up the connection with the credentials and TLS settings
+// of the broker configuration
+func natsOptions(c BrokerConfig, tlsConfig *tls.Config) []nats.Option {
+	options := []nats.Option{
+		nats.Name("s3inbox"),
+		// Keep trying to reconnect, events wait for the acknowledgement
+		nats.MaxReconnects(-1),
+		nats.DisconnectErrHandler(func(_ *nats.Conn, err error) {
+			if err != nil {
+				log.Errorf("disconnected from NATS: %v", err)
+			}
+		}),
+		nats.ReconnectHandler(func(nc *nats.Conn) {
+			log.Infof("reconnected to NATS at %s", nc.ConnectedUrl())
+		}),
+	}
+
+	switch {
+	case c.nats.credentials != "":
+		options = append(options, nats.UserCredentials(c.nats.credentials))
+	case c.user != "":
+		options = append(options, nats.UserInfo(c.user, c.password))
+	}
+	if c.ssl {
+		options = append(options, nats.Secure(tlsConfig))
+	}
+
+	return options
+}
+
+// natsPublisher is the part of JetStream the messenger uses
+type natsPublisher interface {
+	PublishMsg(ctx context.Context, msg *nats.Msg, opts ...jetstream.PublishOpt) (*jetstream.PubAck, error)
+}
+
+// NATSMessenger is a Messenger that publishes events to a NATS JetStream
+// stream. Each event is acknowledged by the stream before SendMessage
+// returns, and carries a message id the stream uses to drop duplicates of
+// events that are sent again.
+type NATSMessenger struct {
+	connection *nats.Conn
+	jetStream  natsPublisher
+	subject    string
+	stream     string
+	timeout    time.Duration
+	format     eventFormat
+}
+
+// NewNATSMessenger connects to NATS and creates a messenger that publishes
+// to the configured subject
+func NewNATSMessenger(c BrokerConfig, tlsConfig *tls.Config) (*NATSMessenger, error) {
+	nc, js, err := connectNATS(c, tlsConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	return &NATSMessenger{nc, js, c.nats.subject, c.nats.stream, c.nats.timeout, c.format}, nil
+}
+
+// connectNATS opens a connection to NATS with JetStream on top
+func connectNATS(c BrokerConfig, tlsConfig *tls.Config) (*nats.Conn, jetstream.JetStream, error) {
+	nc, err := nats.Connect(strings.Join(c.nats.urls, ","), natsOptions(c, tlsConfig)...)
+	if err != nil {
+		return nil, nil, fmt.Errorf("nats connect: %v", err)
+	}
+	js, err := jetstream.New(nc)
+	if err != nil {
+		nc.Close()
+		return nil, nil, fmt.Errorf("nats jetstream: %v", err)
+	}
+	return nc, js, nil
+}
+
+// checkNATS connects to NATS and verifies that a stream takes the events
+func checkNATS(c BrokerConfig, tlsConfig *tls.Config) error {
+	nc, js, err := connectNATS(c, tlsConfig)
+	if err != nil {
+		return err
+	}
+	defer nc.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), c.nats.timeout)
+	defer cancel()
+	stream, err := js.StreamNameBySubject(ctx, c.nats.subject)
+	if err != nil {
+		return fmt.Errorf("no stream for subject %s: %v", c.nats.subject, err)
+	}
+	if c.nats.stream != "" && stream != c.nats.stream {
+		return fmt.Errorf("subject %s belongs to stream %s, not %s", c.nats.subject, stream, c.nats.stream)
+	}
+	return nil
+}
+
+// SendMessage publishes the event and waits for the stream to store it
+func (m *NATSMessenger) SendMessage(message Event) error {
+	body, err := m.format.encode(message)
+	if err != nil {
+		return err
+	}
+
+	corrID, _ := uuid.NewRandom()
+
+	msg := nats.NewMsg(m.subject)
+	msg.Data = body
+	msg.Header.Set("Content-Type", m.format.contentType())
+	if encoding := m.format.contentEncoding(""); encoding != "" {
+		msg.Header.Set("Content-Encoding", encoding)
+	}
+	msg.Header.Set("Correlation-Id", corrID.String())
+	if message.RequestID != "" {
+		msg.Header.Set("X-Request-Id", message.RequestID)
+	}
+
+	// The stream drops messages with an id it has seen within its
+	// duplicate window
+	options := []jetstream.PublishOpt{jetstream.WithMsgID(messageID(message))}
+	if m.stream != "" {
+		options = append(options, jetstream.WithExpectStream(m.stream))
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), m.timeout)
+	defer cancel()
+	ack, err := m.jetStream.PublishMsg(ctx, msg, options...)
+	if err != nil {
+		return err
+	}
+	log.Debugf("event stored in %s at sequence %d", ack.Stream, ack.Sequence)
+	return nil
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeJetStream records the published messages and acknowledges them
+type fakeJetStream struct {
+	messages []*nats.Msg
+	options  []jetstream.PublishOpt
+	err      error
+}
+
+func (f *fakeJetStream) PublishMsg(_ context.Context, msg *nats.Msg, opts ...jetstream.PublishOpt) (*jetstream.PubAck, error) {
+	if f.err != nil {
+		return nil, f.err
+	}
+	f.messages = append(f.messages, msg)
+	f.options = opts
+	return &jetstream.PubAck{Stream: "INBOX", Sequence: uint64(len(f.messages))}, nil
+}
+
+func TestNATSMessenger_SendMessage(t *testing.T) {
+	js := &fakeJetStream{}
+	m := &NATSMessenger{jetStream: js, subject: "inbox.events", timeout: time.Second}
+
+	event := Event{Operation: "upload", Username: "user", Filepath: "user/file.c4gh", Filesize: 10, RequestID: "abc"}
+	assert.NoError(t, m.SendMessage(event))
+	if assert.Len(t, js.messages, 1) {
+		msg := js.messages[0]
+		assert.Equal(t, "inbox.events", msg.Subject)
+		assert.Equal(t, "abc", msg.Header.Get("X-Request-Id"))
+		assert.NotEmpty(t, msg.Header.Get("Correlation-Id"))
+
+		var sent Event
+		assert.NoError(t, json.Unmarshal(msg.Data, &sent))
+		assert.Equal(t, "user/file.c4gh", sent.Filepath)
+	}
+	assert.Len(t, js.options, 1, "events carry a message id")
+
+	m.stream = "INBOX"
+	assert.NoError(t, m.SendMessage(event))
+	assert.Len(t, js.options, 2, "events are only stored in the expected stream")
+
+	// Events that are not acknowledged are errors
+	js.err = errors.New("nats: no response from stream")
+	assert.Error(t, m.SendMessage(event))
+}
+
+func TestNATSOptions(t *testing.T) {
+	c := BrokerConfig{user: "user", password: "pass"}
+	options := natsOptions(c, nil)
+
+	o := nats.GetDefaultOptions()
+	for _, option := range options {
+		assert.NoError(t, option(&o))
+	}
+	assert.Equal(t, "user", o.User)
+	assert.Equal(t, "pass", o.Password)
+	assert.False(t, o.Secure)
+	assert.Equal(t, -1, o.MaxReconnect)
+
+	c.ssl = true
+	o = nats.GetDefaultOptions()
+	for _, option := range natsOptions(c, nil) {
+		assert.NoError(t, option(&o))
+	}
+	assert.True(t, o.Secure)
+}
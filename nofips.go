@@ -0,0 +1,9 @@
+//go:build !boringcrypto
+
+package main
+
+// fipsAvailable tells if the program uses the FIPS-validated BoringCrypto
+// module, which needs a build with GOEXPERIMENT=boringcrypto
+func fipsAvailable() bool {
+	return false
+}
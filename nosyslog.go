@@ -0,0 +1,14 @@
+//go:build windows
+
+package main
+
+import (
+	"errors"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// newSyslogHook fails, there is no syslog on Windows
+func newSyslogHook(address, tag string) (log.Hook, error) {
+	return nil, errors.New("syslog is not available on windows")
+}
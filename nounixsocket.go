@@ -0,0 +1,24 @@
+//go:build windows
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+)
+
+// listenUnix listens on the unix socket at the path with the mode. There is
+// no umask on Windows, the socket gets its mode once it is created.
+func listenUnix(path string, mode os.FileMode) (net.Listener, error) {
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := os.Chmod(path, mode); err != nil {
+		l.Close()
+		return nil, fmt.Errorf("failed to set permissions on %s: %v", path, err)
+	}
+	return l, nil
+}
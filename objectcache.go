@@ -0,0 +1,99 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// objectInfo is what the proxy needs to know about an uploaded object to
+// announce it
+type objectInfo struct {
+	checksum string
+	// hex encoded md5 checksum of the content, if it is known
+	md5  string
+	size int64
+	// checksums of the decrypted content of a Crypt4GH file, if they are
+	// known
+	decrypted *objectInfo
+}
+
+// objectCacheKey identifies one version of an object, the ETag changes
+// whenever the content does so stale entries are never hit
+type objectCacheKey struct {
+	bucket string
+	key    string
+	etag   string
+}
+
+type objectCacheEntry struct {
+	info    objectInfo
+	expires time.Time
+}
+
+// objectInfoCache keeps the results of recent object lookups, so retried
+// uploads and completions of the same object don't go to the backend again.
+// A nil cache caches nothing.
+type objectInfoCache struct {
+	lock       sync.Mutex
+	ttl        time.Duration
+	maxEntries int
+	entries    map[objectCacheKey]objectCacheEntry
+}
+
+// newObjectInfoCache returns a cache keeping entries for ttl, or nil if
+// caching is disabled
+func newObjectInfoCache(ttl time.Duration, maxEntries int) *objectInfoCache {
+	if ttl <= 0 || maxEntries <= 0 {
+		return nil
+	}
+	return &objectInfoCache{
+		ttl:        ttl,
+		maxEntries: maxEntries,
+		entries:    make(map[objectCacheKey]objectCacheEntry),
+	}
+}
+
+func (c *objectInfoCache) get(key objectCacheKey) (objectInfo, bool) {
+	if c == nil || key.etag == "" {
+		return objectInfo{}, false
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	entry, ok := c.entries[key]
+	if !ok {
+		return objectInfo{}, false
+	}
+	if time.Now().After(entry.expires) {
+		delete(c.entries, key)
+		return objectInfo{}, false
+	}
+	return entry.info, true
+}
+
+func (c *objectInfoCache) add(key objectCacheKey, info objectInfo) {
+	if c == nil || key.etag == "" {
+		return
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	now := time.Now()
+	if len(c.entries) >= c.maxEntries {
+		// Make room by dropping what has expired, and if that is not enough
+		// the entry closest to expiry
+		var oldest objectCacheKey
+		var oldestExpiry time.Time
+		for k, e := range c.entries {
+			if now.After(e.expires) {
+				delete(c.entries, k)
+			} else if oldestExpiry.IsZero() || e.expires.Before(oldestExpiry) {
+				oldest, oldestExpiry = k, e.expires
+			}
+		}
+		if len(c.entries) >= c.maxEntries {
+			delete(c.entries, oldest)
+		}
+	}
+	c.entries[key] = objectCacheEntry{info: info, expires: now.Add(c.ttl)}
+}
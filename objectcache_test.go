@@ -0,0 +1,55 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestObjectInfoCache(t *testing.T) {
+	c := newObjectInfoCache(time.Minute, 2)
+	key := objectCacheKey{bucket: "bucket", key: "user/file", etag: "abc"}
+
+	_, ok := c.get(key)
+	assert.False(t, ok)
+
+	c.add(key, objectInfo{checksum: "sum", size: 5})
+	info, ok := c.get(key)
+	assert.True(t, ok)
+	assert.Equal(t, objectInfo{checksum: "sum", size: 5}, info)
+
+	// A new version of the object is not cached
+	_, ok = c.get(objectCacheKey{bucket: "bucket", key: "user/file", etag: "def"})
+	assert.False(t, ok)
+
+	// Without an ETag nothing is cached
+	c.add(objectCacheKey{bucket: "bucket", key: "user/other"}, objectInfo{})
+	_, ok = c.get(objectCacheKey{bucket: "bucket", key: "user/other"})
+	assert.False(t, ok)
+
+	// The cache does not grow beyond its size
+	c.add(objectCacheKey{bucket: "bucket", key: "user/a", etag: "1"}, objectInfo{})
+	c.add(objectCacheKey{bucket: "bucket", key: "user/b", etag: "2"}, objectInfo{})
+	assert.Len(t, c.entries, 2)
+	_, ok = c.get(key)
+	assert.False(t, ok, "oldest entry should be evicted")
+}
+
+func TestObjectInfoCacheExpiry(t *testing.T) {
+	c := newObjectInfoCache(time.Millisecond, 10)
+	key := objectCacheKey{bucket: "bucket", key: "user/file", etag: "abc"}
+	c.add(key, objectInfo{checksum: "sum"})
+	time.Sleep(5 * time.Millisecond)
+	_, ok := c.get(key)
+	assert.False(t, ok)
+}
+
+func TestObjectInfoCacheDisabled(t *testing.T) {
+	c := newObjectInfoCache(0, 10)
+	assert.Nil(t, c)
+	key := objectCacheKey{bucket: "bucket", key: "user/file", etag: "abc"}
+	c.add(key, objectInfo{checksum: "sum"})
+	_, ok := c.get(key)
+	assert.False(t, ok)
+}
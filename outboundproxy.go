@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bufio"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/net/http/httpproxy"
+)
+
+// proxyConfig returns the outbound proxy settings. The HTTP_PROXY,
+// HTTPS_PROXY and NO_PROXY environment variables are only used when
+// fromEnvironment is set, so a proxy meant for other programs is not picked
+// up by accident. An explicitly configured proxy takes precedence over
+// HTTP_PROXY and HTTPS_PROXY.
+func proxyConfig(proxy string, fromEnvironment bool) *httpproxy.Config {
+	c := &httpproxy.Config{}
+	if fromEnvironment {
+		c = httpproxy.FromEnvironment()
+	}
+	if proxy != "" {
+		c.HTTPProxy = proxy
+		c.HTTPSProxy = proxy
+	}
+	return c
+}
+
+// httpProxyFunc returns a function suitable as the Proxy of an http.Transport
+func httpProxyFunc(proxy string, fromEnvironment bool) func(*http.Request) (*url.URL, error) {
+	proxyFunc := proxyConfig(proxy, fromEnvironment).ProxyFunc()
+	return func(r *http.Request) (*url.URL, error) {
+		return proxyFunc(r.URL)
+	}
+}
+
+// proxyDialer returns a dial function that tunnels connections to the broker
+// through the outbound proxy, or nil if the broker should be reached
+// directly.
+func proxyDialer(c BrokerConfig) (func(network, addr string) (net.Conn, error), error) {
+	// The broker is matched against the proxy settings as if it was a web
+	// server, so amqps uses HTTPS_PROXY and amqp uses HTTP_PROXY
+	target := &url.URL{Scheme: "http", Host: net.JoinHostPort(c.host, c.port)}
+	if c.ssl {
+		target.Scheme = "https"
+	}
+
+	proxyURL, err := proxyConfig(c.proxy, c.proxyFromEnvironment).ProxyFunc()(target)
+	if err != nil {
+		return nil, err
+	}
+	if proxyURL == nil {
+		return nil, nil
+	}
+
+	log.Debugf("connecting to broker through proxy %s", proxyURL.Host)
+	return func(network, addr string) (net.Conn, error) {
+		return dialThroughProxy(proxyURL, addr, 30*time.Second)
+	}, nil
+}
+
+// dialThroughProxy opens a tunnel to addr through an HTTP proxy using the
+// CONNECT method.
+func dialThroughProxy(proxyURL *url.URL, addr string, timeout time.Duration) (net.Conn, error) {
+	conn, err := net.DialTimeout("tcp", proxyURL.Host, timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+	if proxyURL.User != nil {
+		password, _ := proxyURL.User.Password()
+		auth := base64.StdEncoding.EncodeToString([]byte(proxyURL.User.Username() + ":" + password))
+		req.Header.Set("Proxy-Authorization", "Basic "+auth)
+	}
+
+	_ = conn.SetDeadline(time.Now().Add(timeout))
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(conn), req)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, fmt.Errorf("proxy %s refused connection to %s: %s", proxyURL.Host, addr, resp.Status)
+	}
+	_ = conn.SetDeadline(time.Time{})
+
+	return conn, nil
+}
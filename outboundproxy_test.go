@@ -0,0 +1,99 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// startConnectProxy starts a minimal proxy that accepts one CONNECT request
+// and then echoes everything sent through the tunnel.
+func startConnectProxy(t *testing.T, status int) (net.Listener, chan *http.Request) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	requests := make(chan *http.Request, 1)
+
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		req, err := http.ReadRequest(bufio.NewReader(conn))
+		if err != nil {
+			return
+		}
+		requests <- req
+		resp := &http.Response{StatusCode: status, ProtoMajor: 1, ProtoMinor: 1}
+		_ = resp.Write(conn)
+		if status == http.StatusOK {
+			_, _ = io.Copy(conn, conn)
+		}
+	}()
+
+	return l, requests
+}
+
+func TestDialThroughProxy(t *testing.T) {
+	l, requests := startConnectProxy(t, http.StatusOK)
+	defer l.Close()
+
+	proxyURL, _ := url.Parse("http://user:secret@" + l.Addr().String())
+	conn, err := dialThroughProxy(proxyURL, "mq.example.org:5671", time.Second)
+	assert.NoError(t, err)
+	defer conn.Close()
+
+	req := <-requests
+	assert.Equal(t, http.MethodConnect, req.Method)
+	assert.Equal(t, "mq.example.org:5671", req.Host)
+	assert.Equal(t, "Basic dXNlcjpzZWNyZXQ=", req.Header.Get("Proxy-Authorization"))
+
+	_, err = conn.Write([]byte("ping"))
+	assert.NoError(t, err)
+	buf := make([]byte, 4)
+	_, err = io.ReadFull(conn, buf)
+	assert.NoError(t, err)
+	assert.Equal(t, "ping", string(buf))
+}
+
+func TestDialThroughProxyRefused(t *testing.T) {
+	l, _ := startConnectProxy(t, http.StatusForbidden)
+	defer l.Close()
+
+	proxyURL, _ := url.Parse("http://" + l.Addr().String())
+	_, err := dialThroughProxy(proxyURL, "mq.example.org:5671", time.Second)
+	assert.Error(t, err)
+}
+
+func TestProxyDialer(t *testing.T) {
+	dial, err := proxyDialer(BrokerConfig{host: "mq.example.org", port: "5671", ssl: true})
+	assert.NoError(t, err)
+	assert.Nil(t, dial)
+
+	dial, err = proxyDialer(BrokerConfig{host: "mq.example.org", port: "5671", ssl: true, proxy: "http://proxy.example.org:3128"})
+	assert.NoError(t, err)
+	assert.NotNil(t, dial)
+}
+
+func TestHTTPProxyFunc(t *testing.T) {
+	r, _ := http.NewRequest("GET", "https://s3.example.org/bucket", nil)
+	proxyURL, err := httpProxyFunc("http://proxy.example.org:3128", false)(r)
+	assert.NoError(t, err)
+	assert.Equal(t, "proxy.example.org:3128", proxyURL.Host)
+
+	// The environment is only used when asked to
+	t.Setenv("HTTPS_PROXY", "http://envproxy.example.org:3128")
+	proxyURL, err = httpProxyFunc("", false)(r)
+	assert.NoError(t, err)
+	assert.Nil(t, proxyURL)
+
+	proxyURL, err = httpProxyFunc("", true)(r)
+	assert.NoError(t, err)
+	assert.Equal(t, "envproxy.example.org:3128", proxyURL.Host)
+}
@@ -0,0 +1,297 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"strings"
+	"time"
+
+	// Registers the postgres driver with database/sql
+	_ "github.com/lib/pq"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// outboxTableName is what the outbox table may be called, it ends up in the
+// SQL statements as is
+var outboxTableName = regexp.MustCompile(`^[a-z_][a-z0-9_]*(\.[a-z_][a-z0-9_]*)?$`)
+
+// outboxConfig stores the settings of the outbox messenger
+type outboxConfig struct {
+	// connection string of the PostgreSQL database
+	dsn   string
+	table string
+	// messenger type the events are relayed with
+	relay string
+	// how often the outbox is looked at, and how many events are relayed
+	// in one transaction
+	interval  time.Duration
+	batchSize int
+	// how long to wait for the database
+	timeout time.Duration
+}
+
+func init() {
+	registerMessenger("outbox", messengerType{
+		required: []string{"broker.outbox.relay"},
+		create: func(c BrokerConfig, tlsConfig *tls.Config) (Messenger, error) {
+			return NewOutboxMessenger(c, tlsConfig)
+		},
+		check: checkOutbox,
+	})
+}
+
+// readOutboxConfig reads the broker.outbox section of the configuration. The
+// connection string is taken from broker.outbox.dsnFile if it is set, so the
+// database password can be kept out of the configuration.
+func readOutboxConfig() (outboxConfig, error) {
+	o := outboxConfig{
+		dsn:       viper.GetString("broker.outbox.dsn"),
+		table:     "outbox",
+		relay:     viper.GetString("broker.outbox.relay"),
+		interval:  time.Second,
+		batchSize: 100,
+		timeout:   10 * time.Second,
+	}
+
+	if viper.IsSet("broker.outbox.dsnFile") {
+		dsn, err := ioutil.ReadFile(viper.GetString("broker.outbox.dsnFile")) // #nosec this file comes from our configuration
+		if err != nil {
+			return o, fmt.Errorf("broker.outbox.dsnFile: %v", err)
+		}
+		o.dsn = strings.TrimSpace(string(dsn))
+	}
+	if o.dsn == "" {
+		return o, fmt.Errorf("either broker.outbox.dsn or broker.outbox.dsnFile is needed")
+	}
+
+	if o.relay == "outbox" {
+		return o, fmt.Errorf("broker.outbox.relay can not be the outbox itself")
+	}
+
+	if viper.IsSet("broker.outbox.table") {
+		o.table = viper.GetString("broker.outbox.table")
+		if !outboxTableName.MatchString(o.table) {
+			return o, fmt.Errorf("broker.outbox.table %q is not a valid table name", o.table)
+		}
+	}
+	if viper.IsSet("broker.outbox.interval") {
+		o.interval = viper.GetDuration("broker.outbox.interval")
+		if o.interval <= 0 {
+			return o, fmt.Errorf("broker.outbox.interval must be positive")
+		}
+	}
+	if viper.IsSet("broker.outbox.batchSize") {
+		o.batchSize = viper.GetInt("broker.outbox.batchSize")
+		if o.batchSize <= 0 {
+			return o, fmt.Errorf("broker.outbox.batchSize must be positive")
+		}
+	}
+	if viper.IsSet("broker.outbox.timeout") {
+		o.timeout = viper.GetDuration("broker.outbox.timeout")
+		if o.timeout <= 0 {
+			return o, fmt.Errorf("broker.outbox.timeout must be positive")
+		}
+	}
+
+	return o, nil
+}
+
+// outboxStore keeps the events until they are relayed
+type outboxStore interface {
+	// add stores an event
+	add(ctx context.Context, event []byte) error
+	// relay hands at most limit of the oldest events to send, in order, and
+	// removes those sent. It stops at the first event that can't be sent and
+	// returns how many were.
+	relay(ctx context.Context, limit int, send func(event []byte) error) (int, error)
+}
+
+// OutboxMessenger is a Messenger that stores the events in a PostgreSQL
+// table before the upload is acknowledged, and relays them onward with
+// another messenger in the background. Events are not lost when the proxy or
+// the broker goes down, but may be sent twice if the proxy stops between
+// sending an event and removing it from the outbox.
+type OutboxMessenger struct {
+	store     outboxStore
+	relay     Messenger
+	interval  time.Duration
+	batchSize int
+	timeout   time.Duration
+}
+
+// NewOutboxMessenger connects to the database, creates the outbox table if
+// needed and sets up the messenger the events are relayed with. The relay
+// starts with Relay.
+func NewOutboxMessenger(c BrokerConfig, tlsConfig *tls.Config) (*OutboxMessenger, error) {
+	relayConfig := c
+	relayConfig.messengerType = c.outbox.relay
+	relay, err := NewMessenger(relayConfig, tlsConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	db, err := sql.Open("postgres", c.outbox.dsn)
+	if err != nil {
+		return nil, fmt.Errorf("outbox database: %v", err)
+	}
+	store := &pgOutbox{db: db, table: c.outbox.table}
+
+	ctx, cancel := context.WithTimeout(context.Background(), c.outbox.timeout)
+	defer cancel()
+	if err := store.createTable(ctx); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("outbox table %s: %v", c.outbox.table, err)
+	}
+
+	return &OutboxMessenger{store, relay, c.outbox.interval, c.outbox.batchSize, c.outbox.timeout}, nil
+}
+
+// checkOutbox verifies that the database can be reached and that events can
+// be relayed
+func checkOutbox(c BrokerConfig, tlsConfig *tls.Config) error {
+	db, err := sql.Open("postgres", c.outbox.dsn)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), c.outbox.timeout)
+	defer cancel()
+	if err := db.PingContext(ctx); err != nil {
+		return fmt.Errorf("outbox database: %v", err)
+	}
+
+	relay, err := getMessengerType(c.outbox.relay)
+	if err != nil || relay.check == nil {
+		return err
+	}
+	relayConfig := c
+	relayConfig.messengerType = c.outbox.relay
+	return relay.check(relayConfig, tlsConfig)
+}
+
+// SendMessage stores the event in the outbox
+func (m *OutboxMessenger) SendMessage(message Event) error {
+	body, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), m.timeout)
+	defer cancel()
+	return m.store.add(ctx, body)
+}
+
+// Relay sends the stored events onward until the context is cancelled
+func (m *OutboxMessenger) Relay(ctx context.Context) {
+	ticker := time.NewTicker(m.interval)
+	defer ticker.Stop()
+	for {
+		m.relayPending(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// relayPending sends the events in the outbox in batches, until it is empty
+// or an event can't be sent
+func (m *OutboxMessenger) relayPending(ctx context.Context) {
+	for ctx.Err() == nil {
+		sent, err := m.store.relay(ctx, m.batchSize, func(event []byte) error {
+			var message Event
+			if err := json.Unmarshal(event, &message); err != nil {
+				return err
+			}
+			return m.relay.SendMessage(message)
+		})
+		if sent > 0 {
+			log.Debugf("relayed %d events from the outbox", sent)
+		}
+		if err != nil {
+			log.Errorf("relaying events from the outbox: %v", err)
+			return
+		}
+		if sent < m.batchSize {
+			return
+		}
+	}
+}
+
+// pgOutbox is an outbox in a PostgreSQL table
+type pgOutbox struct {
+	db    *sql.DB
+	table string
+}
+
+// createTable creates the outbox table if it doesn't exist
+func (o *pgOutbox) createTable(ctx context.Context) error {
+	_, err := o.db.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS `+o.table+` (
+	id bigserial PRIMARY KEY,
+	created timestamptz NOT NULL DEFAULT now(),
+	event jsonb NOT NULL
+)`) // #nosec the table name is checked by readOutboxConfig
+	return err
+}
+
+func (o *pgOutbox) add(ctx context.Context, event []byte) error {
+	_, err := o.db.ExecContext(ctx, `INSERT INTO `+o.table+` (event) VALUES ($1)`, string(event)) // #nosec the table name is checked by readOutboxConfig
+	return err
+}
+
+func (o *pgOutbox) relay(ctx context.Context, limit int, send func(event []byte) error) (int, error) {
+	tx, err := o.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	// Rolling back after the commit does nothing
+	defer tx.Rollback()
+
+	// Locked rows are skipped, so several proxies can share the outbox
+	rows, err := tx.QueryContext(ctx, `SELECT id, event FROM `+o.table+` ORDER BY id LIMIT $1 FOR UPDATE SKIP LOCKED`, limit) // #nosec the table name is checked by readOutboxConfig
+	if err != nil {
+		return 0, err
+	}
+	type pending struct {
+		id    int64
+		event []byte
+	}
+	var events []pending
+	for rows.Next() {
+		var p pending
+		if err := rows.Scan(&p.id, &p.event); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		events = append(events, p)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	sent := 0
+	var sendErr error
+	for _, p := range events {
+		if sendErr = send(p.event); sendErr != nil {
+			break
+		}
+		if _, err := tx.ExecContext(ctx, `DELETE FROM `+o.table+` WHERE id = $1`, p.id); err != nil { // #nosec the table name is checked by readOutboxConfig
+			return 0, err
+		}
+		sent++
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	return sent, sendErr
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// memoryOutbox is an outbox kept in memory
+type memoryOutbox struct {
+	lock   sync.Mutex
+	events [][]byte
+}
+
+func (o *memoryOutbox) add(_ context.Context, event []byte) error {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	o.events = append(o.events, event)
+	return nil
+}
+
+func (o *memoryOutbox) relay(_ context.Context, limit int, send func(event []byte) error) (int, error) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	sent := 0
+	for sent < limit && len(o.events) > 0 {
+		if err := send(o.events[0]); err != nil {
+			return sent, err
+		}
+		o.events = o.events[1:]
+		sent++
+	}
+	return sent, nil
+}
+
+// recordingMessenger records the events sent with it
+type recordingMessenger struct {
+	events []Event
+	err    error
+}
+
+func (m *recordingMessenger) SendMessage(message Event) error {
+	if m.err != nil {
+		return m.err
+	}
+	m.events = append(m.events, message)
+	return nil
+}
+
+func TestOutboxMessenger(t *testing.T) {
+	store := &memoryOutbox{}
+	relay := &recordingMessenger{}
+	m := &OutboxMessenger{store: store, relay: relay, interval: time.Second, batchSize: 2, timeout: time.Second}
+
+	for _, file := range []string{"user/a.c4gh", "user/b.c4gh", "user/c.c4gh"} {
+		assert.NoError(t, m.SendMessage(Event{Operation: "upload", Username: "user", Filepath: file}))
+	}
+	assert.Empty(t, relay.events, "events wait in the outbox")
+	if assert.Len(t, store.events, 3) {
+		var stored Event
+		assert.NoError(t, json.Unmarshal(store.events[0], &stored))
+		assert.Equal(t, "user/a.c4gh", stored.Filepath)
+	}
+
+	// Events stay in the outbox while they can't be relayed
+	relay.err = errors.New("broker down")
+	m.relayPending(context.Background())
+	assert.Len(t, store.events, 3)
+
+	// and are relayed in order, over several batches, once they can
+	relay.err = nil
+	m.relayPending(context.Background())
+	assert.Empty(t, store.events)
+	if assert.Len(t, relay.events, 3) {
+		assert.Equal(t, "user/a.c4gh", relay.events[0].Filepath)
+		assert.Equal(t, "user/c.c4gh", relay.events[2].Filepath)
+	}
+}
+
+func TestOutboxMessenger_Relay(t *testing.T) {
+	store := &memoryOutbox{}
+	m := &OutboxMessenger{store: store, relay: &recordingMessenger{}, interval: time.Millisecond, batchSize: 10, timeout: time.Second}
+	assert.NoError(t, m.SendMessage(Event{Operation: "upload", Username: "user", Filepath: "user/a.c4gh"}))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		m.Relay(ctx)
+		close(done)
+	}()
+	assert.Eventually(t, func() bool {
+		store.lock.Lock()
+		defer store.lock.Unlock()
+		return len(store.events) == 0
+	}, time.Second, time.Millisecond)
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Error("the relay did not stop")
+	}
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/spf13/viper"
+)
+
+// Some settings can be overridden for the files below a prefix of the
+// inboxes, like the folder of a project:
+//
+//	overrides:
+//	  - prefix: "project-a/"
+//	    maxUploadSize: 107374182400
+//	    operations: ["upload", "download"]
+//	    routingKey: "files.project-a"
+//	    backend: "archive"
+//	    bucket: "project-a"
+//
+// The prefix is matched against the path of the file in the user's inbox,
+// the longest prefix that matches applies. Listings are not of a file, they
+// are always of the bucket of the aws section.
+
+// overrideOperations are the operations an override can allow
+var overrideOperations = []string{"upload", "download", "delete"}
+
+// overrideConfig stores the settings of the files below a prefix
+type overrideConfig struct {
+	prefix string
+	// largest accepted request body, nil for that of the server section
+	maxUploadSize *int64
+	// the allowed operations, nil for those of the features section
+	operations []string
+	// routing key of the events, empty for that of the broker
+	routingKey string
+	// backend and bucket the files are stored in, empty for those of the
+	// aws section
+	backend string
+	bucket  string
+}
+
+// readOverrides reads the overrides section, the backends they name must be
+// among the backends
+func readOverrides(c *Config) ([]overrideConfig, error) {
+	items, ok := viper.Get("overrides").([]interface{})
+	if !ok && viper.IsSet("overrides") {
+		return nil, fmt.Errorf("overrides must be a list")
+	}
+	var overrides []overrideConfig
+	prefixes := map[string]bool{}
+	for i, item := range items {
+		section, ok := settingsSection(item)
+		if !ok {
+			return nil, fmt.Errorf("overrides[%d] is not a section", i)
+		}
+		// The settings are read like those of the configuration
+		settings := viper.New()
+		for key, value := range section {
+			settings.Set(key, value)
+		}
+
+		o := overrideConfig{
+			prefix:     settings.GetString("prefix"),
+			routingKey: settings.GetString("routingKey"),
+			backend:    settings.GetString("backend"),
+			bucket:     settings.GetString("bucket"),
+		}
+		if o.prefix == "" || strings.HasPrefix(o.prefix, "/") {
+			return nil, fmt.Errorf("overrides[%d].prefix must be a path in the inboxes, like project-a/", i)
+		}
+		if prefixes[o.prefix] {
+			return nil, fmt.Errorf("overrides[%d]: prefix %s is overridden twice", i, o.prefix)
+		}
+		prefixes[o.prefix] = true
+
+		if settings.IsSet("maxUploadSize") {
+			size := settings.GetInt64("maxUploadSize")
+			if size < 0 {
+				return nil, fmt.Errorf("overrides[%d].maxUploadSize can not be negative", i)
+			}
+			o.maxUploadSize = &size
+		}
+		if settings.IsSet("operations") {
+			o.operations = []string{}
+			for _, operation := range settings.GetStringSlice("operations") {
+				operation = strings.ToLower(operation)
+				if !contains(overrideOperations, operation) {
+					return nil, fmt.Errorf("overrides[%d].operations: %q is not one of %s", i, operation, strings.Join(overrideOperations, ", "))
+				}
+				o.operations = append(o.operations, operation)
+			}
+		}
+		if _, err := c.backend(o.backend); err != nil {
+			return nil, fmt.Errorf("overrides[%d].backend: %v", i, err)
+		}
+		overrides = append(overrides, o)
+	}
+	return overrides, nil
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// pathOverride is the proxy of the files below a prefix of the inboxes
+type pathOverride struct {
+	prefix string
+	proxy  *Proxy
+}
+
+// addOverride sets up the proxy of the files of the override, which is
+// this proxy with the overridden settings. The backend is that of the
+// override, with the TLS configuration of it.
+func (p *Proxy) addOverride(o overrideConfig, backend S3Config, tlsConfig *tls.Config) {
+	override := *p
+	override.overrides = nil
+	if o.bucket != "" {
+		backend.bucket = o.bucket
+	}
+	if o.backend != "" {
+		override.client = newBackendClient(backend, tlsConfig)
+	}
+	override.s3 = backend
+	if o.maxUploadSize != nil {
+		override.maxUploadSize = *o.maxUploadSize
+	}
+	if o.operations != nil {
+		override.uploads = contains(o.operations, "upload")
+		override.downloads = contains(o.operations, "download")
+		override.deletes = contains(o.operations, "delete")
+	}
+	if o.routingKey != "" {
+		override.routingKey = o.routingKey
+	}
+
+	p.overrides = append(p.overrides, pathOverride{o.prefix, &override})
+	sort.SliceStable(p.overrides, func(i, j int) bool { return len(p.overrides[i].prefix) > len(p.overrides[j].prefix) })
+}
+
+// setupOverrides adds the proxies of the overrides of the configuration, it
+// is called once the proxy is set up
+func setupOverrides(p *Proxy, c *Config, tlsProxy *tls.Config) error {
+	for _, o := range c.Overrides {
+		backend, err := c.backend(o.backend)
+		if err != nil {
+			return err
+		}
+		tlsConfig := tlsProxy
+		if o.backend != "" {
+			if tlsConfig, err = tlsConfigBackend(backend); err != nil {
+				return err
+			}
+		}
+		p.addOverride(o, backend, tlsConfig)
+	}
+	return nil
+}
+
+// overrideFor returns the proxy of the override of the file of the request,
+// nil if none applies to it
+func (p *Proxy) overrideFor(r *http.Request) *Proxy {
+	segments := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/"), "/", 2)
+	if len(segments) < 2 {
+		return nil
+	}
+	for _, o := range p.overrides {
+		if strings.HasPrefix(segments[1], o.prefix) {
+			return o.proxy
+		}
+	}
+	return nil
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestServeHTTP_overrides(t *testing.T) {
+	var paths []string
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		paths = append(paths, r.URL.Path)
+		w.Header().Set("ETag", "\"etag\"")
+	}))
+	defer backend.Close()
+
+	s3conf := testS3Config(backend.URL)
+	messenger := NewMockMessenger()
+	proxy := NewProxy(s3conf, NewAlwaysAllow(), messenger, new(tls.Config))
+	size := int64(10)
+	proxy.addOverride(overrideConfig{prefix: "project-a/", maxUploadSize: &size, routingKey: "files.project-a", bucket: "project-a"}, s3conf, nil)
+	proxy.addOverride(overrideConfig{prefix: "project-a/archived/", operations: []string{"download"}}, s3conf, nil)
+
+	// Files below the prefix go to its bucket, with its routing key
+	r, _ := http.NewRequest("PUT", "/username/project-a/file", strings.NewReader("small"))
+	w := httptest.NewRecorder()
+	proxy.ServeHTTP(w, r)
+	assert.Equal(t, 200, w.Result().StatusCode)
+	assert.Equal(t, []string{"/project-a/username/project-a/file"}, paths)
+	if assert.NotNil(t, messenger.lastEvent) {
+		assert.Equal(t, "files.project-a", messenger.lastEvent.RoutingKey)
+		assert.Equal(t, "username/project-a/file", messenger.lastEvent.Filepath)
+	}
+	messenger.CheckAndRestore()
+
+	r, _ = http.NewRequest("PUT", "/username/project-a/file", strings.NewReader("more than ten bytes"))
+	w = httptest.NewRecorder()
+	proxy.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, w.Result().StatusCode)
+
+	// The longest prefix applies
+	r, _ = http.NewRequest("PUT", "/username/project-a/archived/file", strings.NewReader("small"))
+	w = httptest.NewRecorder()
+	proxy.ServeHTTP(w, r)
+	assert.Equal(t, 403, w.Result().StatusCode)
+	assert.False(t, messenger.CheckAndRestore())
+
+	// The rest of the inbox is as configured
+	paths = nil
+	r, _ = http.NewRequest("PUT", "/username/other/file", strings.NewReader("more than ten bytes"))
+	w = httptest.NewRecorder()
+	proxy.ServeHTTP(w, r)
+	assert.Equal(t, 200, w.Result().StatusCode)
+	assert.Equal(t, []string{"/buckbuck/username/other/file"}, paths)
+	if assert.NotNil(t, messenger.lastEvent) {
+		assert.Equal(t, "", messenger.lastEvent.RoutingKey)
+	}
+}
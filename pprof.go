@@ -0,0 +1,35 @@
+package main
+
+import (
+	"net/http"
+	"net/http/pprof"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// With debug.pprof the CPU, heap and other profiles of net/http/pprof are
+// served on debug.pprofListen, an address apart from those of the proxy and
+// the health checks that should only be reachable from inside, like
+//
+//	go tool pprof http://localhost:6060/debug/pprof/profile?seconds=30
+//	go tool pprof http://localhost:6060/debug/pprof/heap
+
+// pprofHandler serves the profiles below /debug/pprof/
+func pprofHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	return mux
+}
+
+// servePprof serves the profiles on the address, it should be run as a go
+// routine. The proxy goes on without them if they can't be served.
+func servePprof(address string) {
+	log.Warnf("serving profiles on %s, which should not be reachable from outside", address)
+	if err := http.ListenAndServe(address, pprofHandler()); err != nil {
+		log.Errorf("failed to serve profiles: %v", err)
+	}
+}
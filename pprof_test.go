@@ -0,0 +1,37 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPprofHandler(t *testing.T) {
+	handler := pprofHandler()
+	for _, path := range []string{"/debug/pprof/", "/debug/pprof/heap", "/debug/pprof/cmdline"} {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		assert.Equal(t, 200, w.Code, path)
+	}
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/username/file", nil))
+	assert.Equal(t, 404, w.Code)
+}
+
+func (suite *TestSuite) TestConfigPprof() {
+	viper.Set("debug.pprofListen", "localhost:7070")
+	config, err := NewConfig()
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), "", config.Debug.pprofListen, "profiles are only served with debug.pprof")
+
+	viper.Set("debug.pprof", true)
+	config, err = NewConfig()
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), "localhost:7070", config.Debug.pprofListen)
+
+	viper.Set("debug.pprofListen", ":6060")
+	_, err = NewConfig()
+	assert.Error(suite.T(), err, "all the interfaces are not internal")
+}
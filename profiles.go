@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/spf13/viper"
+)
+
+// A configuration file can describe several deployments in its profiles
+// section, like
+//
+//	profiles:
+//	  staging:
+//	    aws:
+//	      bucket: "inbox-staging"
+//	  prod:
+//	    extends: staging
+//	    aws:
+//	      bucket: "inbox"
+//
+// The profile chosen with --profile, PROXY_PROFILE or profile in the file is
+// merged over the rest of the file, after the profiles it extends. The
+// environment and the flags still win over the profiles.
+
+// applyProfile merges the active profile into the configuration read from
+// the file
+func applyProfile() error {
+	if viper.GetString("profile") == "" {
+		return nil
+	}
+	settings, err := fileSettings()
+	if err != nil {
+		return err
+	}
+	return readSettings(settings)
+}
+
+// fileSettings returns the settings of the configuration file with the
+// active profile merged in, none without a file
+func fileSettings() (map[string]interface{}, error) {
+	name := viper.GetString("profile")
+	file := readConfigFile()
+	if file == nil {
+		if name != "" {
+			return nil, fmt.Errorf("profile %s needs a configuration file with profiles", name)
+		}
+		return map[string]interface{}{}, nil
+	}
+	settings := file.AllSettings()
+	if name == "" {
+		return settings, nil
+	}
+	chain, err := profileChain(file, name)
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range chain {
+		profile := file.GetStringMap("profiles." + p)
+		delete(profile, "extends")
+		mergeSettings(settings, profile)
+	}
+	return settings, nil
+}
+
+// readSettings makes the settings those of the configuration file, under
+// the environment and the flags
+func readSettings(settings map[string]interface{}) error {
+	// JSON is YAML, which the configuration is read as
+	content, err := json.Marshal(settings)
+	if err != nil {
+		return err
+	}
+	viper.SetConfigType("yaml")
+	return viper.ReadConfig(bytes.NewReader(content))
+}
+
+// readConfigFile reads the configuration file on its own, without the
+// environment and the flags, it returns nil if there is none
+func readConfigFile() *viper.Viper {
+	used := viper.ConfigFileUsed()
+	if used == "" {
+		return nil
+	}
+	file := viper.New()
+	file.SetConfigFile(used)
+	file.SetConfigType("yaml")
+	if err := file.ReadInConfig(); err != nil {
+		return nil
+	}
+	if err := decryptSopsFile(file); err != nil {
+		return nil
+	}
+	return file
+}
+
+// profileChain returns the named profile and the ones it extends, the one
+// extended by all the others first
+func profileChain(file *viper.Viper, name string) ([]string, error) {
+	var chain []string
+	seen := map[string]bool{}
+	for name != "" {
+		name = strings.ToLower(name)
+		if seen[name] {
+			return nil, fmt.Errorf("profile %s extends itself", name)
+		}
+		if !file.IsSet("profiles." + name) {
+			return nil, fmt.Errorf("no profile named %s in %s", name, file.ConfigFileUsed())
+		}
+		seen[name] = true
+		chain = append([]string{name}, chain...)
+		name = file.GetString("profiles." + name + ".extends")
+	}
+	return chain, nil
+}
+
+// mergeSettings merges src into dst, sections are merged and other values
+// replaced
+func mergeSettings(dst, src map[string]interface{}) {
+	for key, value := range src {
+		key = strings.ToLower(key)
+		srcSection, srcOK := settingsSection(value)
+		dstSection, dstOK := settingsSection(dst[key])
+		if srcOK && dstOK {
+			mergeSettings(dstSection, srcSection)
+			dst[key] = dstSection
+			continue
+		}
+		if srcOK {
+			// Converted all the way down, for the JSON encoding
+			section := map[string]interface{}{}
+			mergeSettings(section, srcSection)
+			value = section
+		}
+		dst[key] = value
+	}
+}
+
+// settingsSection returns the value as a section of settings, if it is one
+func settingsSection(value interface{}) (map[string]interface{}, bool) {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		return v, true
+	case map[interface{}]interface{}:
+		section := make(map[string]interface{}, len(v))
+		for key, value := range v {
+			section[strings.ToLower(fmt.Sprint(key))] = value
+		}
+		return section, true
+	}
+	return nil, false
+}
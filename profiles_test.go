@@ -0,0 +1,79 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"time"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+const profilesConfig = `
+aws:
+  bucket: "devbucket"
+  timeout: 10
+  region: "us-east-1"
+log:
+  level: "info"
+profiles:
+  staging:
+    aws:
+      bucket: "stagingbucket"
+      timeout: "30s"
+  prod:
+    extends: staging
+    aws:
+      region: "eu-north-1"
+  loop:
+    extends: loop
+`
+
+func (suite *TestSuite) TestConfigProfiles() {
+	file := filepath.Join(suite.T().TempDir(), "config.yaml")
+	assert.NoError(suite.T(), ioutil.WriteFile(file, []byte(profilesConfig), 0600))
+	// The file is what the test is about
+	viper.Reset()
+	for key, value := range map[string]string{
+		"broker.host":          "testhost",
+		"broker.port":          "123",
+		"broker.user":          "testuser",
+		"broker.password":      "testpassword",
+		"broker.routingkey":    "routingtest",
+		"broker.exchange":      "testexchange",
+		"broker.vhost":         "testvhost",
+		"aws.url":              "testurl",
+		"aws.accesskey":        "testaccess",
+		"aws.secretkey":        "testsecret",
+		"server.jwtpubkeypath": "testpath",
+		"server.confFile":      file,
+	} {
+		viper.Set(key, value)
+	}
+
+	config, err := NewConfig()
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), "devbucket", config.S3.bucket, "without a profile the file is used as it is")
+
+	viper.Set("profile", "prod")
+	config, err = NewConfig()
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), "stagingbucket", config.S3.bucket, "settings come from the extended profile")
+	assert.Equal(suite.T(), 30*time.Second, config.S3.timeout, "a profile may change the type of a value")
+	assert.Equal(suite.T(), "eu-north-1", config.S3.region)
+	assert.Equal(suite.T(), "info", viper.GetString("log.level"), "settings without a profile are kept")
+
+	// The flags still win over the profile
+	viper.Set("aws.region", "us-west-2")
+	config, err = NewConfig()
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), "us-west-2", config.S3.region)
+
+	viper.Set("profile", "missing")
+	_, err = NewConfig()
+	assert.Error(suite.T(), err)
+
+	viper.Set("profile", "loop")
+	_, err = NewConfig()
+	assert.Error(suite.T(), err)
+}
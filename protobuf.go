@@ -0,0 +1,107 @@
+package main
+
+import (
+	"encoding/binary"
+)
+
+// protobufSchema is the Protobuf schema of the events, with the fields of
+// the JSON events in the same order. Event comes first, so it is message 0
+// for the schema registry.
+const protobufSchema = `syntax = "proto3";
+
+package s3inbox;
+
+message Event {
+  string operation = 1;
+  string user = 2;
+  string filepath = 3;
+  int64 filesize = 4;
+  repeated Checksum encrypted_checksums = 5;
+  string client_ip = 6;
+  string version_id = 7;
+  bool duplicate = 8;
+  repeated Checksum decrypted_checksums = 9;
+  string oldpath = 10;
+  int32 schema_version = 11;
+  string timestamp = 12;
+  string user_agent = 13;
+  string client_identity = 14;
+  map<string, string> fields = 15;
+}
+
+message Checksum {
+  string type = 1;
+  string value = 2;
+}
+`
+
+// Protobuf wire types
+const (
+	protobufVarint = 0
+	protobufBytes  = 2
+)
+
+// protobufEvent returns the Protobuf encoding of an event with the static
+// fields, fields with the default value are left out
+func protobufEvent(message Event, fields map[string]string) []byte {
+	var b []byte
+	b = protobufString(b, 1, message.Operation)
+	b = protobufString(b, 2, message.Username)
+	b = protobufString(b, 3, message.Filepath)
+	b = protobufUint(b, 4, uint64(message.Filesize))
+	b = protobufChecksums(b, 5, checksumsOf(message.Checksum))
+	b = protobufString(b, 6, message.ClientIP)
+	b = protobufString(b, 7, message.VersionID)
+	if message.Duplicate {
+		b = protobufUint(b, 8, 1)
+	}
+	b = protobufChecksums(b, 9, checksumsOf(message.DecryptedChecksums))
+	b = protobufString(b, 10, message.OldPath)
+	b = protobufUint(b, 11, uint64(message.SchemaVersion))
+	b = protobufString(b, 12, message.Timestamp)
+	b = protobufString(b, 13, message.UserAgent)
+	b = protobufString(b, 14, message.ClientIdentity)
+	return protobufMap(b, 15, fields)
+}
+
+func protobufTag(b []byte, field, wireType int) []byte {
+	return binary.AppendUvarint(b, uint64(field<<3|wireType))
+}
+
+// protobufUint appends a varint field
+func protobufUint(b []byte, field int, v uint64) []byte {
+	if v == 0 {
+		return b
+	}
+	return binary.AppendUvarint(protobufTag(b, field, protobufVarint), v)
+}
+
+// protobufLength appends a length delimited field, strings and messages
+func protobufLength(b []byte, field int, v []byte) []byte {
+	b = binary.AppendUvarint(protobufTag(b, field, protobufBytes), uint64(len(v)))
+	return append(b, v...)
+}
+
+func protobufString(b []byte, field int, s string) []byte {
+	if s == "" {
+		return b
+	}
+	return protobufLength(b, field, []byte(s))
+}
+
+// protobufMap appends a map of strings, which is a repeated message of the
+// keys and values
+func protobufMap(b []byte, field int, fields map[string]string) []byte {
+	for _, name := range sortedNames(fields) {
+		b = protobufLength(b, field, protobufString(protobufString(nil, 1, name), 2, fields[name]))
+	}
+	return b
+}
+
+// protobufChecksums appends a repeated Checksum field
+func protobufChecksums(b []byte, field int, checksums []Checksum) []byte {
+	for _, checksum := range checksums {
+		b = protobufLength(b, field, protobufString(protobufString(nil, 1, checksum.Type), 2, checksum.Value))
+	}
+	return b
+}
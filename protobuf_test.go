@@ -0,0 +1,25 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestProtobufEvent(t *testing.T) {
+	event := Event{Operation: "upload", Username: "u", Filepath: "u/f", Filesize: 5, Checksum: []interface{}{Checksum{Type: "sha256", Value: "ab"}}}
+	expected := []byte{0x0a, 0x06}
+	expected = append(expected, "upload"...)
+	expected = append(expected, 0x12, 0x01, 'u', 0x1a, 0x03, 'u', '/', 'f', 0x20, 0x05)
+	expected = append(expected, 0x2a, 0x0c, 0x0a, 0x06)
+	expected = append(expected, "sha256"...)
+	expected = append(expected, 0x12, 0x02, 'a', 'b')
+	assert.Equal(t, expected, protobufEvent(event, nil))
+
+	// Fields with default values are left out
+	assert.Empty(t, protobufEvent(Event{}, nil))
+	assert.Equal(t, []byte{0x40, 0x01, 0x58, 0x02}, protobufEvent(Event{Duplicate: true, SchemaVersion: 2}, nil))
+
+	// Map entries are messages of the key and value
+	assert.Equal(t, []byte{0x7a, 0x0a, 0x0a, 0x04, 's', 'i', 't', 'e', 0x12, 0x02, 's', 'e'}, protobufEvent(Event{}, map[string]string{"site": "se"}))
+}
@@ -2,22 +2,30 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"crypto/sha256"
 	"crypto/tls"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"mime"
+	"net"
 	"net/http"
+	"net/url"
 	"regexp"
 	"strconv"
 	"strings"
 	"time"
 
-	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/awserr"
-	"github.com/aws/aws-sdk-go/aws/credentials"
-	"github.com/aws/aws-sdk-go/aws/session"
-	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	v4 "github.com/aws/aws-sdk-go-v2/aws/signer/v4"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/smithy-go"
 	"github.com/minio/minio-go/v6/pkg/s3signer"
 	log "github.com/sirupsen/logrus"
 )
@@ -28,6 +36,52 @@ type Proxy struct {
 	auth      Authenticator
 	messenger Messenger
 	client    *http.Client
+	// load balancers allowed to set X-Forwarded-For
+	trustedProxies []*net.IPNet
+	// largest accepted request body, 0 means no limit
+	maxUploadSize int64
+	// headers passed on to the backend and back to the client, nil means all
+	forwardHeaders []string
+	returnHeaders  []string
+	// media types accepted for uploads, nil means all
+	allowedContentTypes []string
+	// allow users to upload files, true unless an override disallows it
+	uploads bool
+	// allow users to download their own objects
+	downloads bool
+	// allow users to delete their own objects
+	deletes bool
+	// how long the event of a copy waits for the source to be deleted, so
+	// the two can be sent as a rename, 0 sends them as they are
+	renameWindow time.Duration
+	copies       *copyTracker
+	// answer new multipart uploads of a key with the one in progress
+	resumeUploads bool
+	// skip uploads of content that is already stored at the key
+	detectDuplicates bool
+	// reject uploads of files that are not Crypt4GH encrypted
+	strictCrypt4gh bool
+	// results of recent lookups of uploaded objects
+	objectCache *objectInfoCache
+	// checksums of multipart uploads computed from their parts
+	multipartHashes *multipartHashes
+	// key for signing with SigV4A
+	sigV4AKeys *sigV4AKeyCache
+	// schema of the sent events
+	schemaVersion int
+	// Crypt4GH key for the checksums of the decrypted content, nil if they
+	// are not computed
+	c4ghKey *[32]byte
+	// what is told about the client in the events
+	clientContext string
+	// routing key of the events, empty for the one of the broker
+	routingKey string
+	// the proxies of the files below the prefixes of the overrides, the
+	// longest prefix first
+	overrides []pathOverride
+	// records the changes of the files and the denied requests, nil if
+	// there is no audit log
+	audit *auditLog
 }
 
 // S3RequestType is the type of request that we are currently proxying to the
@@ -44,88 +98,273 @@ const (
 	Delete
 	AbortMultipart
 	Policy
+	BucketInfo
 	Other
 )
 
 // NewProxy creates a new S3Proxy. This implements the ServerHTTP interface.
 func NewProxy(s3conf S3Config, auth Authenticator, messenger Messenger, tls *tls.Config) *Proxy {
-	tr := &http.Transport{TLSClientConfig: tls}
-	client := &http.Client{Transport: tr}
+	return &Proxy{s3: s3conf, auth: auth, messenger: messenger, client: newBackendClient(s3conf, tls),
+		uploads:         true,
+		objectCache:     newObjectInfoCache(s3conf.lookupCacheTTL, s3conf.lookupCacheSize),
+		multipartHashes: newMultipartHashes(),
+		sigV4AKeys:      &sigV4AKeyCache{},
+		copies:          newCopyTracker()}
+}
 
-	return &Proxy{s3conf, auth, messenger, client}
+// newBackendClient creates the client of the requests to the backend
+func newBackendClient(s3conf S3Config, tls *tls.Config) *http.Client {
+	// Clients that send Expect: 100-continue get the answer of the backend,
+	// the body is only read from them once the backend wants it
+	tr := &http.Transport{TLSClientConfig: tls, Proxy: httpProxyFunc(s3conf.proxy, s3conf.proxyFromEnvironment),
+		ExpectContinueTimeout: s3conf.expectContinueTimeout,
+		MaxIdleConnsPerHost:   s3conf.maxIdleConnsPerHost,
+		IdleConnTimeout:       s3conf.idleConnTimeout,
+		DialContext:           (&net.Dialer{KeepAlive: s3conf.keepAlive}).DialContext}
+	return &http.Client{Transport: tr}
 }
 
 func (p *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	r = withRequestID(withClientIP(r, p.trustedProxies))
+	w.Header().Set("X-Amz-Request-Id", requestID(r))
+	w.Header().Set("X-Correlation-Id", requestID(r))
+
+	if err := validatePath(r); err != nil {
+		requestLog(r).Infof("rejected request with bad path: %v", err)
+		p.badRequest(w, r)
+		return
+	}
+
+	if override := p.overrideFor(r); override != nil {
+		override.serve(w, r)
+		return
+	}
+	p.serve(w, r)
+}
+
+// serve answers the request, which has a request id and a valid path
+func (p *Proxy) serve(w http.ResponseWriter, r *http.Request) {
 	switch t := p.detectRequestType(r); t {
-	case MakeBucket, RemoveBucket, Delete, Policy, Get:
+	case MakeBucket, RemoveBucket, Policy, Get:
 		// Not allowed
-		log.Debug("not allowed known")
+		requestLog(r).Debug("not allowed known")
 		p.notAllowedResponse(w, r)
+	case Delete:
+		if !p.deletes {
+			requestLog(r).Debug("deletes not enabled")
+			p.notAllowedResponse(w, r)
+			return
+		}
+		p.allowedResponse(w, r)
 	case Put, List, Other, AbortMultipart:
-		// Allowed
+		if !p.uploads && (r.Method == http.MethodPut || r.Method == http.MethodPost) {
+			requestLog(r).Debug("uploads not allowed")
+			p.notAllowedResponse(w, r)
+			return
+		}
 		p.allowedResponse(w, r)
+	case BucketInfo:
+		// Answered by the proxy
+		p.bucketInfoResponse(w, r)
 	default:
-		log.Debugf("Unexpected request (%v) not allowed", r)
+		requestLog(r).Debugf("Unexpected request (%v) not allowed", r)
 		p.notAllowedResponse(w, r)
 	}
 }
 
 func (p *Proxy) internalServerError(w http.ResponseWriter, r *http.Request) {
-	log.Debug("internal server error")
-	log.Debugf("Internal server error for request (%v)", r)
+	requestLog(r).Debug("internal server error")
+	requestLog(r).Debugf("Internal server error for request (%v)", r)
 	w.WriteHeader(500)
 }
 
+// s3Error writes an error response in the format S3 clients expect
+func (p *Proxy) s3Error(w http.ResponseWriter, r *http.Request, status int, code, message string) {
+	requestLog(r).Debugf("s3 error %s: %s", code, message)
+	if status < 500 {
+		p.audit.denied(r, status, message)
+	}
+	body, _ := xml.Marshal(struct {
+		XMLName   xml.Name `xml:"Error"`
+		Code      string
+		Message   string
+		Resource  string
+		RequestID string `xml:"RequestId"`
+	}{Code: code, Message: message, Resource: r.URL.Path, RequestID: requestID(r)})
+
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	_, _ = w.Write([]byte(xml.Header))
+	_, _ = w.Write(body)
+}
+
+func (p *Proxy) badRequest(w http.ResponseWriter, r *http.Request) {
+	requestLog(r).Debug("bad request")
+	p.audit.denied(r, 400, "bad request")
+	w.WriteHeader(400)
+}
+
 func (p *Proxy) notAllowedResponse(w http.ResponseWriter, r *http.Request) {
-	log.Debug("not allowed response")
+	requestLog(r).Debug("not allowed response")
+	p.audit.denied(r, 403, "not allowed")
 	w.WriteHeader(403)
 }
 
 func (p *Proxy) notAuthorized(w http.ResponseWriter, r *http.Request) {
-	log.Debug("not authorized")
+	requestLog(r).Debug("not authorized")
+	p.audit.denied(r, 401, "not authenticated")
 	w.WriteHeader(401) // Actually correct!
 }
 
+func (p *Proxy) entityTooLarge(w http.ResponseWriter, r *http.Request) {
+	requestLog(r).Debugf("request body of %d bytes too large", r.ContentLength)
+	p.audit.denied(r, 413, "request body too large")
+	w.WriteHeader(413)
+}
+
+// All checks in allowedResponse up to forwarding the request are done without
+// touching the request body. Rejecting a request before the body is read
+// means that clients sending Expect: 100-continue never get the go-ahead to
+// send it, and the connection is closed on others instead of the proxy
+// receiving the whole upload first.
 func (p *Proxy) allowedResponse(w http.ResponseWriter, r *http.Request) {
 	if err := p.auth.Authenticate(r); err != nil {
-		log.Debugf("Request not authenticated (%v)", err)
+		requestLog(r).Debugf("Request not authenticated (%v)", err)
 		p.notAuthorized(w, r)
 		return
 	}
 
-	log.Debug("prepend")
+	if p.maxUploadSize > 0 {
+		if r.ContentLength > p.maxUploadSize {
+			p.entityTooLarge(w, r)
+			return
+		}
+		// Enforce the limit for bodies of unknown size as well
+		r.Body = http.MaxBytesReader(w, r.Body, p.maxUploadSize)
+	}
+
+	if !p.contentTypeAllowed(r) {
+		p.s3Error(w, r, 400, "InvalidArgument", fmt.Sprintf("Content-Type %q is not accepted", r.Header.Get("Content-Type")))
+		return
+	}
+
+	if !copySourceAllowed(r) {
+		p.s3Error(w, r, 403, "AccessDenied", "Only your own files can be copied")
+		return
+	}
+
+	if p.resumeUploads && initiatesMultipart(r) && p.resumeUpload(w, r) {
+		return
+	}
+
+	// Listings of multipart uploads are rewritten to look like the user's
+	// own bucket
+	uploadListing := listsUploads(r) || listsParts(r)
+	username := requestUser(r)
+
+	requestLog(r).Debug("prepend")
 	p.prependBucketToHostPath(r)
 
-	log.Debug("Forwarding to backend")
+	if p.detectDuplicates {
+		if etag, ok := p.duplicateOf(r); ok {
+			p.duplicateResponse(w, r, etag)
+			return
+		}
+	}
+
+	// The start of the body is read, so this is the first check that makes
+	// clients send it
+	if p.strictCrypt4gh && !startsCrypt4GH(r) {
+		p.s3Error(w, r, 400, "InvalidArgument", "Only Crypt4GH encrypted files are accepted")
+		return
+	}
+
+	if p.splitsUpload(r) {
+		p.splitUpload(w, r)
+		return
+	}
+
+	var part *partHash
+	if uploadsPart(r) {
+		part = p.multipartHashes.track(r)
+	} else if body := hashBody(r, p.c4ghKey); body != nil {
+		// The decryption ends with the body even if it is never sent
+		defer body.Close()
+	}
+
+	requestLog(r).Debug("Forwarding to backend")
 	s3response, err := p.forwardToBackend(r)
+	if part != nil {
+		p.multipartHashes.partDone(part, s3response)
+	}
+	if r.Method == http.MethodDelete && err == nil && s3response.StatusCode == http.StatusNoContent {
+		p.multipartHashes.abort(r.URL.Query().Get("uploadId"))
+	}
 
 	if err != nil {
-		log.Debug("internal server error")
-		log.Debug(err)
+		requestLog(r).Debug("internal server error")
+		requestLog(r).Debug(err)
 		p.internalServerError(w, r)
 		return
 	}
 
 	// Send message to upstream
 	if p.uploadFinishedSuccessfully(r, s3response) {
-		log.Debug("create message")
-		message, _ := p.CreateMessageFromRequest(r)
-		if err = p.messenger.SendMessage(message); err != nil {
-			log.Debug("error when sending message")
-			log.Debug(err)
+		requestLog(r).Debug("create message")
+		message, err := p.CreateMessageFromRequest(r, s3response.Header)
+		if err != nil {
+			requestLog(r).Errorf("no message sent for upload: %v", err)
+		} else if source, ok := p.renameSource(r); ok {
+			p.copies.hold(source, message, p.renameWindow, p.sendEvent)
+		} else {
+			p.sendEvent(message)
 		}
 	}
+	if p.isObjectDelete(r) && s3response.StatusCode == http.StatusNoContent {
+		message := p.removeEvent(r)
+		if copied, ok := p.copies.take(message.Filepath); ok && message.VersionID == "" {
+			message = p.renameEvent(r, copied, message.Filepath)
+		}
+		p.sendEvent(message)
+	}
+
+	if uploadListing && s3response.StatusCode == http.StatusOK {
+		body, err := ioutil.ReadAll(s3response.Body)
+		_ = s3response.Body.Close()
+		if err != nil {
+			requestLog(r).Debugf("failed to read upload listing: %v", err)
+			p.internalServerError(w, r)
+			return
+		}
+		if body, err = unscopeUploadListing(body, p.s3.bucket, username); err != nil {
+			requestLog(r).Debugf("failed to rewrite upload listing: %v", err)
+			p.internalServerError(w, r)
+			return
+		}
+		s3response.Header.Set("Content-Length", strconv.Itoa(len(body)))
+		s3response.Body = ioutil.NopCloser(bytes.NewReader(body))
+	}
 
 	// Redirect answer
-	log.Debug("redirect answer")
+	requestLog(r).Debug("redirect answer")
+	removeHopHeaders(s3response.Header)
+	if p.returnHeaders != nil {
+		filterHeaders(s3response.Header, requiredResponseHeaders, p.returnHeaders)
+	}
 	for header, values := range s3response.Header {
+		if header == "X-Amz-Request-Id" {
+			// Clients get the id of the proxy request instead
+			requestLog(r).Debugf("backend request id: %v", values)
+			continue
+		}
 		for _, value := range values {
 			w.Header().Add(header, value)
 		}
 	}
+	w.WriteHeader(s3response.StatusCode)
 	_, err = io.Copy(w, s3response.Body)
 	if err != nil {
-		log.Fatalln("redirect error")
+		requestLog(r).Fatalln("redirect error")
 	}
 
 	// Read any remaining data in the connection and
@@ -134,6 +373,69 @@ func (p *Proxy) allowedResponse(w http.ResponseWriter, r *http.Request) {
 	_ = s3response.Body.Close()
 }
 
+// contentTypeAllowed checks the content type of requests that create objects,
+// i.e. single uploads and initiated multipart uploads, against the allowed
+// media types. A missing content type counts as application/octet-stream.
+func (p *Proxy) contentTypeAllowed(r *http.Request) bool {
+	if p.allowedContentTypes == nil {
+		return true
+	}
+	if !createsObject(r) {
+		return true
+	}
+
+	mediaType := "application/octet-stream"
+	if ct := r.Header.Get("Content-Type"); ct != "" {
+		var err error
+		if mediaType, _, err = mime.ParseMediaType(ct); err != nil {
+			return false
+		}
+	}
+	for _, allowed := range p.allowedContentTypes {
+		if strings.EqualFold(allowed, mediaType) {
+			return true
+		}
+	}
+	return false
+}
+
+// createsObject tells if the request creates an object, i.e. is a single
+// upload or initiates a multipart upload
+func createsObject(r *http.Request) bool {
+	return (r.Method == http.MethodPut && !strings.Contains(r.URL.RawQuery, "partNumber")) ||
+		(r.Method == http.MethodPost && strings.Contains(r.URL.RawQuery, "uploads"))
+}
+
+// isDownload tells if the request reads an object, when downloads are
+// enabled. Range and conditional headers are passed on to the backend, so
+// interrupted downloads can be resumed.
+func (p *Proxy) isDownload(r *http.Request) bool {
+	if !p.downloads || r.Method != http.MethodGet {
+		return false
+	}
+
+	// An object key below the user's prefix is needed
+	segments := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/"), "/", 2)
+	if len(segments) < 2 || segments[1] == "" || strings.HasSuffix(r.URL.Path, "/") {
+		return false
+	}
+
+	// Anything but the parameters of GetObject makes it some other request
+	for param := range r.URL.Query() {
+		if param != "versionId" && param != "partNumber" && !strings.HasPrefix(param, "response-") {
+			return false
+		}
+	}
+	return true
+}
+
+// isObjectDelete tells if the request deletes an object, when deletes are
+// enabled
+func (p *Proxy) isObjectDelete(r *http.Request) bool {
+	return p.deletes && r.Method == http.MethodDelete &&
+		!strings.HasSuffix(r.URL.String(), "/") && !strings.Contains(r.URL.String(), "uploadId")
+}
+
 func (p *Proxy) uploadFinishedSuccessfully(req *http.Request, response *http.Response) bool {
 	if response.StatusCode != 200 {
 		return false
@@ -148,13 +450,26 @@ func (p *Proxy) uploadFinishedSuccessfully(req *http.Request, response *http.Res
 
 func (p *Proxy) forwardToBackend(r *http.Request) (*http.Response, error) {
 
-	p.resignHeader(r, p.s3.accessKey, p.s3.secretKey, p.s3.url)
+	backendURL, path := p.backendAddress(r.URL.Path)
+	if path != r.URL.Path {
+		// The path of the original request is kept for creating the
+		// message afterwards
+		u := *r.URL
+		u.Path = path
+		r = r.WithContext(r.Context())
+		r.URL = &u
+	}
+
+	accessKey, secretKey := p.s3.keys()
+	if _, err := p.resignHeader(r, accessKey, secretKey, backendURL); err != nil {
+		return nil, err
+	}
 
 	// Redirect request
-	nr, err := http.NewRequest(r.Method, p.s3.url+r.URL.String(), r.Body)
+	nr, err := http.NewRequest(r.Method, backendURL+r.URL.String(), r.Body)
 	if err != nil {
-		log.Debug("error when redirecting the request")
-		log.Debug(err)
+		requestLog(r).Debug("error when redirecting the request")
+		requestLog(r).Debug(err)
 		return nil, err
 	}
 	nr.Header = r.Header
@@ -163,19 +478,79 @@ func (p *Proxy) forwardToBackend(r *http.Request) (*http.Response, error) {
 	return p.client.Do(nr)
 }
 
+// backendAddress returns the URL of the backend and the path to request
+// there for a path in the bucket. With virtual-hosted style addressing, which
+// transfer acceleration always uses, the bucket is part of the host name
+// instead of the path.
+func (p *Proxy) backendAddress(path string) (string, string) {
+	backendURL := p.s3.url
+	if p.s3.accelerateEndpoint != "" {
+		backendURL = p.s3.accelerateEndpoint
+	} else if p.s3.virtualHosted {
+		u, err := url.Parse(p.s3.url)
+		if err != nil {
+			return p.s3.url, path
+		}
+		u.Host = p.s3.bucket + "." + u.Host
+		backendURL = u.String()
+	} else {
+		return backendURL, path
+	}
+
+	path = strings.TrimPrefix(path, "/"+p.s3.bucket)
+	if path == "" {
+		path = "/"
+	}
+	return backendURL, path
+}
+
+// validatePath checks that the path of the request, after decoding, can only
+// refer to objects below the user's own prefix. The path is normalized so
+// that the backend gets exactly the path that was checked.
+func validatePath(r *http.Request) error {
+	path := r.URL.Path
+	if !strings.HasPrefix(path, "/") {
+		return fmt.Errorf("path %q is not absolute", path)
+	}
+	if strings.ContainsAny(path, "\\\x00") {
+		return fmt.Errorf("path %q contains forbidden characters", path)
+	}
+	if strings.Contains(strings.ToLower(r.URL.RawPath), "%2f") {
+		return fmt.Errorf("path %q contains encoded slashes", r.URL.RawPath)
+	}
+
+	segments := strings.Split(path[1:], "/")
+	for i, segment := range segments {
+		switch segment {
+		case ".", "..":
+			return fmt.Errorf("path %q contains relative segments", path)
+		case "":
+			// Only the trailing slash of e.g. bucket requests may be empty
+			if i != len(segments)-1 || i == 0 {
+				return fmt.Errorf("path %q contains empty segments", path)
+			}
+		}
+	}
+
+	r.URL.RawPath = ""
+	return nil
+}
+
 // Add bucket to host path
 func (p *Proxy) prependBucketToHostPath(r *http.Request) {
 	bucket := p.s3.bucket
 
 	// Extract username for request's url path
-	re := regexp.MustCompile("/([^/]+)/")
-	username := re.FindStringSubmatch(r.URL.Path)[1]
+	username := requestUser(r)
 
-	log.Debugf("incoming path: %s", r.URL.Path)
-	log.Debugf("incoming raw: %s", r.URL.RawQuery)
+	requestLog(r).Debugf("incoming path: %s", r.URL.Path)
+	requestLog(r).Debugf("incoming raw: %s", r.URL.RawQuery)
 
 	// Restructure request to query the users folder instead of the general bucket
-	if r.Method == http.MethodGet && strings.Contains(r.URL.String(), "?delimiter") {
+	if listsUploads(r) {
+		scopeUploadListing(r, bucket, username)
+		requestLog(r).Debug("new Raw Query: ", r.URL.RawQuery)
+	} else if r.Method == http.MethodGet && strings.Contains(r.URL.String(), "?delimiter") {
 		r.URL.Path = "/" + bucket + "/"
 		if strings.Contains(r.URL.RawQuery, "&prefix") {
 			params := strings.Split(r.URL.RawQuery, "&prefix=")
@@ -183,36 +558,99 @@ func (p *Proxy) prependBucketToHostPath(r *http.Request) {
 		} else {
 			r.URL.RawQuery = r.URL.RawQuery + "&prefix=" + username + "%2F"
 		}
-		log.Debug("new Raw Query: ", r.URL.RawQuery)
-	} else if r.Method == http.MethodGet && strings.Contains(r.URL.String(), "?location") {
-		r.URL.Path = "/" + bucket + "/"
-		log.Debug("new Path: ", r.URL.Path)
+		requestLog(r).Debug("new Raw Query: ", r.URL.RawQuery)
 	} else if r.Method == http.MethodPost || r.Method == http.MethodPut {
 		r.URL.Path = "/" + bucket + r.URL.Path
-		log.Debug("new Path: ", r.URL.Path)
+		scopeCopySource(r, bucket)
+		requestLog(r).Debug("new Path: ", r.URL.Path)
+	} else if p.isDownload(r) || listsParts(r) || p.isObjectDelete(r) {
+		r.URL.Path = "/" + bucket + r.URL.Path
+		requestLog(r).Debug("new Path: ", r.URL.Path)
 	}
-	log.Infof("User: %v, Request type %v, Path: %v", username, r.Method, r.URL.Path)
+	requestLog(r).Infof("User: %v, Client: %v, Request type %v, Path: %v", username, requestClientIP(r), r.Method, r.URL.Path)
 }
 
 // Function for signing the headers of the s3 requests
 // Used for for creating a signature for with the default
 // credentials of the s3 service and the user's signature (authentication)
-func (p *Proxy) resignHeader(r *http.Request, accessKey string, secretKey string, backendURL string) *http.Request {
-	log.Debugf("Generating resigning header for %s", backendURL)
-	r.Header.Del("X-Amz-Security-Token")
-	r.Header.Del("X-Forwarded-Port")
-	r.Header.Del("X-Forwarded-Proto")
-	r.Header.Del("X-Forwarded-Host")
-	r.Header.Del("X-Forwarded-For")
-	r.Header.Del("X-Original-Uri")
-	r.Header.Del("X-Real-Ip")
-	r.Header.Del("X-Request-Id")
-	r.Header.Del("X-Scheme")
+func (p *Proxy) resignHeader(r *http.Request, accessKey string, secretKey string, backendURL string) (*http.Request, error) {
+	requestLog(r).Debugf("Generating resigning header for %s", backendURL)
+	removeHopHeaders(r.Header)
+	for _, h := range frontendHeaders {
+		r.Header.Del(h)
+	}
+	if p.forwardHeaders != nil {
+		filterHeaders(r.Header, requiredRequestHeaders, p.forwardHeaders)
+	}
+	if id := requestID(r); id != "" {
+		r.Header.Set("X-Request-Id", id)
+	}
+	if createsObject(r) {
+		p.setObjectHeaders(r)
+	}
+	if p.s3.requesterPays {
+		r.Header.Set("X-Amz-Request-Payer", "requester")
+	}
+	for _, h := range p.s3.profile.unsupportedHeaders {
+		r.Header.Del(h)
+	}
 	if strings.Contains(backendURL, "//") {
 		host := strings.SplitN(backendURL, "//", 2)
 		r.Host = host[1]
 	}
-	return s3signer.SignV4(*r, accessKey, secretKey, "", p.s3.region)
+	if p.s3.signatureVersion == "v4a" {
+		key, err := p.sigV4AKeys.get(accessKey, secretKey)
+		if err != nil {
+			return nil, fmt.Errorf("failed to derive SigV4A key: %v", err)
+		}
+		signed, err := signV4A(r, accessKey, key, p.s3.regionSet)
+		if err != nil {
+			// The client's signature must not reach the backend
+			r.Header.Del("Authorization")
+			return nil, fmt.Errorf("failed to sign request: %v", err)
+		}
+		return signed, nil
+	}
+	if p.s3.fips {
+		return signV4(r, accessKey, secretKey, p.s3.region)
+	}
+	return s3signer.SignV4(*r, accessKey, secretKey, "", p.s3.region), nil
+}
+
+// signV4 signs the request with the signer of the AWS SDK, which hashes with
+// crypto/sha256 rather than the assembly implementation s3signer uses
+func signV4(r *http.Request, accessKey, secretKey, region string) (*http.Request, error) {
+	payloadHash := r.Header.Get("X-Amz-Content-Sha256")
+	if payloadHash == "" {
+		payloadHash = "UNSIGNED-PAYLOAD"
+		r.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	}
+	credentials := aws.Credentials{AccessKeyID: accessKey, SecretAccessKey: secretKey}
+	err := v4.NewSigner(func(o *v4.SignerOptions) {
+		// S3 paths are not escaped twice
+		o.DisableURIPathEscaping = true
+	}).SignHTTP(r.Context(), credentials, r, payloadHash, "s3", region, time.Now())
+	if err != nil {
+		r.Header.Del("Authorization")
+		return nil, fmt.Errorf("failed to sign request: %v", err)
+	}
+	return r, nil
+}
+
+// setObjectHeaders sets the configured storage class and object lock settings
+// on a request that creates an object. They take precedence over what the
+// client asked for, so users can't shorten the retention.
+func (p *Proxy) setObjectHeaders(r *http.Request) {
+	if p.s3.storageClass != "" {
+		r.Header.Set("X-Amz-Storage-Class", p.s3.storageClass)
+	}
+	if p.s3.objectLockMode != "" {
+		r.Header.Set("X-Amz-Object-Lock-Mode", p.s3.objectLockMode)
+		r.Header.Set("X-Amz-Object-Lock-Retain-Until-Date", time.Now().UTC().Add(p.s3.objectLockRetention).Format(time.RFC3339))
+	}
+	if p.s3.objectLockLegalHold {
+		r.Header.Set("X-Amz-Object-Lock-Legal-Hold", "ON")
+	}
 }
 
 // Not necessarily a function on the struct since it does not use any of the
@@ -220,138 +658,354 @@ func (p *Proxy) resignHeader(r *http.Request, accessKey string, secretKey string
 func (p *Proxy) detectRequestType(r *http.Request) S3RequestType {
 	switch r.Method {
 	case http.MethodGet:
-		if strings.HasSuffix(r.URL.String(), "/") {
-			log.Debug("detect Get")
+		if _, ok := bucketInfoResource(r); ok {
+			requestLog(r).Debug("detect BucketInfo")
+			return BucketInfo
+		} else if strings.HasSuffix(r.URL.String(), "/") {
+			requestLog(r).Debug("detect Get")
 			return Get
 		} else if strings.Contains(r.URL.String(), "?acl") {
-			log.Debug("detect Policy")
+			requestLog(r).Debug("detect Policy")
 			return Policy
 		} else {
-			log.Debug("detect List")
+			requestLog(r).Debug("detect List")
 			return List
 		}
 	case http.MethodDelete:
 		if strings.HasSuffix(r.URL.String(), "/") {
-			log.Debug("detect RemoveBucket")
+			requestLog(r).Debug("detect RemoveBucket")
 			return RemoveBucket
 		} else if strings.Contains(r.URL.String(), "uploadId") {
-			log.Debug("detect AbortMultipart")
+			requestLog(r).Debug("detect AbortMultipart")
 			return AbortMultipart
 		} else {
 			// Do we allow deletion of files?
-			log.Debug("detect Delete")
+			requestLog(r).Debug("detect Delete")
 			return Delete
 		}
 	case http.MethodPut:
 		if strings.HasSuffix(r.URL.String(), "/") {
-			log.Debug("detect MakeBucket")
+			requestLog(r).Debug("detect MakeBucket")
 			return MakeBucket
 		} else if strings.Contains(r.URL.String(), "?policy") {
-			log.Debug("detect Policy")
+			requestLog(r).Debug("detect Policy")
 			return Policy
 		} else {
 			// Should decide if we will handle copy here or through authentication
-			log.Debug("detect Put")
+			requestLog(r).Debug("detect Put")
 			return Put
 		}
 	default:
-		log.Debug("detect Other")
+		requestLog(r).Debug("detect Other")
 		return Other
 	}
 }
 
 // CreateMessageFromRequest is a function that can take a http request and
-// figure out the correct message to send from it.
-func (p *Proxy) CreateMessageFromRequest(r *http.Request) (Event, error) {
+// figure out the correct message to send from it. The backend header is the
+// header of the backend's response to the upload, it may be nil.
+func (p *Proxy) CreateMessageFromRequest(r *http.Request, backendHeader http.Header) (Event, error) {
+	var info objectInfo
+	var err error
+
+	// Versioned buckets tell which version the upload created
+	etag := backendHeader.Get("ETag")
+	versionID := backendHeader.Get("X-Amz-Version-Id")
+
+	if r.Method == http.MethodPost && strings.Contains(r.URL.String(), "uploadId") {
+		// The ETag of a multipart upload is not a checksum of the content
+		info, err = p.multipartChecksum(r.Context(), r.URL.Path, r.URL.Query().Get("uploadId"), versionID)
+	} else if body, ok := uploadedBody(r); ok {
+		info = body
+	} else {
+		info.checksum, info.size, err = p.requestInfo(r.Context(), r.URL.Path, etag)
+	}
+	if err != nil {
+		requestLog(r).Debugf("could not get checksum information: %s", err)
+		return Event{}, err
+	}
+
+	return p.uploadEvent(r, info, versionID), nil
+}
+
+// uploadEvent creates the event for an upload with the given checksums and
+// size. The sha256 checksum comes first, consumers of the legacy schema only
+// look at that one.
+func (p *Proxy) uploadEvent(r *http.Request, info objectInfo, versionID string) Event {
+	// Case for simple upload
+	event := p.fileEvent(r, "upload")
+	p.setUpload(&event, info, versionID)
+	requestLog(r).Info("user ", event.Username, " uploaded file ", event.Filepath, " with checksum ", info.checksum, " at ", time.Now())
+	return event
+}
+
+// setUpload fills in the size and checksums of an uploaded file
+func (p *Proxy) setUpload(event *Event, info objectInfo, versionID string) {
+	event.Filesize = info.size
+	event.VersionID = versionID
+	event.Checksum = []interface{}{}
+	if info.checksum != "" {
+		event.Checksum = append(event.Checksum, Checksum{Type: "sha256", Value: info.checksum})
+	}
+	if info.md5 != "" {
+		event.Checksum = append(event.Checksum, Checksum{Type: "md5", Value: info.md5})
+	}
+	if info.decrypted != nil {
+		event.DecryptedChecksums = []interface{}{
+			Checksum{Type: "sha256", Value: info.decrypted.checksum},
+			Checksum{Type: "md5", Value: info.decrypted.md5},
+		}
+	}
+	p.setSchema(event)
+}
+
+// removeEvent creates the event for a deleted object
+func (p *Proxy) removeEvent(r *http.Request) Event {
+	event := p.fileEvent(r, "remove")
+	event.VersionID = r.URL.Query().Get("versionId")
+	p.setSchema(&event)
+	requestLog(r).Info("user ", event.Username, " removed file ", event.Filepath, " at ", time.Now())
+	return event
+}
+
+// fileEvent creates an event of the operation on the file of the request,
+// whose path includes the bucket
+func (p *Proxy) fileEvent(r *http.Request, operation string) Event {
 	// Extract username for request's url path
 	re := regexp.MustCompile("/[^/]+/([^/]+)/")
 	username := re.FindStringSubmatch(r.URL.Path)[1]
 
-	event := Event{}
-	checksum := Checksum{}
-	var err error
+	event := Event{
+		Operation: operation,
+		Username:  username,
+		Filepath:  strings.Replace(r.URL.Path, "/"+p.s3.bucket+"/", "", 1),
+		RequestID: requestID(r),
+	}
+	p.setClientContext(r, &event)
+	return event
+}
 
-	checksum.Value, event.Filesize, err = p.requestInfo(r.URL.Path)
-	if err != nil {
-		log.Fatalf("could not get checksum information: %s", err)
+// setSchema sets the time the operation completed, and the version of the
+// configured event schema beyond the legacy one
+func (p *Proxy) setSchema(event *Event) {
+	event.Timestamp = time.Now().UTC().Format(time.RFC3339)
+	if p.schemaVersion >= versionedSchema {
+		event.SchemaVersion = p.schemaVersion
 	}
+}
 
-	// Case for simple upload
-	event.Operation = "upload"
-	event.Filepath = strings.Replace(r.URL.Path, "/"+p.s3.bucket+"/", "", 1)
-	event.Username = username
-	checksum.Type = "sha256"
-	event.Checksum = []interface{}{checksum}
-	log.Info("user ", event.Username, " uploaded file ", event.Filepath, " with checksum ", checksum.Value, " at ", time.Now())
-	return event, nil
+// errObjectNotFound tells that no object with the exact key exists
+var errObjectNotFound = errors.New("object not found")
+
+// ObjectLookupError is returned when an uploaded object can not be looked up
+// in the S3 backend
+type ObjectLookupError struct {
+	Key string
+	Err error
+}
+
+func (e *ObjectLookupError) Error() string {
+	return fmt.Sprintf("lookup of %s failed: %v", e.Key, e.Err)
+}
+
+func (e *ObjectLookupError) Unwrap() error {
+	return e.Err
 }
 
 // RequestInfo is a function that makes a request to the S3 and collects
-// the etag and size information for the uploaded document
-func (p *Proxy) requestInfo(fullPath string) (string, int64, error) {
+// the etag and size information for the uploaded document. Nothing is
+// requested when the object with the given etag was looked up recently.
+func (p *Proxy) requestInfo(ctx context.Context, fullPath, etag string) (string, int64, error) {
 	filePath := strings.Replace(fullPath, "/"+p.s3.bucket+"/", "", 1)
-	s, err := p.newSession()
-	if err != nil {
-		return "", 0, err
-	}
-	svc := s3.New(s)
-	input := &s3.ListObjectsV2Input{
-		Bucket:  aws.String(p.s3.bucket),
-		MaxKeys: aws.Int64(1),
-		Prefix:  aws.String(filePath),
+	if info, ok := p.objectCache.get(p.objectCacheKey(filePath, etag)); ok {
+		log.Debugf("using cached info for %s", filePath)
+		return info.checksum, info.size, nil
 	}
+	ctx, cancel := s3Context(ctx, p.s3)
+	defer cancel()
 
-	result, err := svc.ListObjectsV2(input)
+	object, err := p.findObject(ctx, filePath)
 	if err != nil {
-		if aerr, ok := err.(awserr.Error); ok {
-			switch aerr.Code() {
-			case s3.ErrCodeNoSuchBucket:
-				log.Debug("bucket not found when listing objects")
-				log.Debug(s3.ErrCodeNoSuchBucket, aerr.Error())
-			default:
-				log.Debug("caught error when listing objects")
-				log.Debug(aerr.Error())
-			}
+		var noBucket *types.NoSuchBucket
+		var apiErr smithy.APIError
+		if errors.As(err, &noBucket) {
+			log.Debug("bucket not found when listing objects")
+			log.Debug(noBucket.Error())
+		} else if errors.As(err, &apiErr) {
+			log.Debug("caught error when listing objects")
+			log.Debug(apiErr.Error())
 		} else {
 			log.Debug("error when listing objects")
 			log.Debug(err)
 		}
-		return "", 0, err
+		return "", 0, &ObjectLookupError{Key: filePath, Err: err}
+	}
+	if object == nil {
+		return "", 0, &ObjectLookupError{Key: filePath, Err: errObjectNotFound}
 	}
-	fmt.Println(strings.ReplaceAll(*result.Contents[0].ETag, "\"", ""))
-	return fmt.Sprintf("%x", sha256.Sum256([]byte(strings.ReplaceAll(*result.Contents[0].ETag, "\"", "")))), *result.Contents[0].Size, nil
 
+	etag = strings.ReplaceAll(aws.ToString(object.ETag), "\"", "")
+	log.Debugf("etag of %s: %s", filePath, etag)
+	info := objectInfo{checksum: fmt.Sprintf("%x", sha256.Sum256([]byte(etag))), size: aws.ToInt64(object.Size)}
+	p.objectCache.add(p.objectCacheKey(filePath, etag), info)
+	return info.checksum, info.size, nil
 }
 
-func (p *Proxy) newSession() (*session.Session, error) {
-	var mySession *session.Session
-	var err error
-	if p.s3.cacert != "" {
-		cert, _ := ioutil.ReadFile(p.s3.cacert)
-		cacert := bytes.NewReader(cert)
-		mySession, err = session.NewSessionWithOptions(session.Options{
-			CustomCABundle: cacert,
-			Config: aws.Config{
-				Region:           aws.String(p.s3.region),
-				Endpoint:         aws.String(p.s3.url),
-				DisableSSL:       aws.Bool(strings.HasPrefix(p.s3.url, "http:")),
-				S3ForcePathStyle: aws.Bool(true),
-				Credentials:      credentials.NewStaticCredentials(p.s3.accessKey, p.s3.secretKey, ""),
-			}})
+// findObject lists the objects with the key as prefix and returns the one
+// with exactly that key, or nil if there is none. Other objects can share
+// the prefix, e.g. file.c4gh and file.c4gh.bak.
+func (p *Proxy) findObject(ctx context.Context, key string) (*types.Object, error) {
+	client := p.newS3ReadClient()
+
+	paginator := s3.NewListObjectsV2Paginator(client, &s3.ListObjectsV2Input{
+		Bucket: aws.String(p.s3.bucket),
+		Prefix: aws.String(key),
+	})
+	for paginator.HasMorePages() {
+		result, err := paginator.NextPage(ctx)
 		if err != nil {
 			return nil, err
 		}
-	} else {
-		mySession, err = session.NewSession(&aws.Config{
-			Region:           aws.String(p.s3.region),
-			Endpoint:         aws.String(p.s3.url),
-			DisableSSL:       aws.Bool(strings.HasPrefix(p.s3.url, "http:")),
-			S3ForcePathStyle: aws.Bool(true),
-			Credentials:      credentials.NewStaticCredentials(p.s3.accessKey, p.s3.secretKey, ""),
-		})
-		if err != nil {
-			return nil, err
+		for i := range result.Contents {
+			if aws.ToString(result.Contents[i].Key) == key {
+				return &result.Contents[i], nil
+			}
+		}
+	}
+	return nil, nil
+}
+
+// storedObject is what HeadObject tells about an object
+type storedObject struct {
+	etag string
+	size int64
+	// hex encoded sha256 checksum of the full content, if the backend has
+	// one. Checksums of multipart uploads are often composite, those are
+	// not used.
+	checksum string
+}
+
+// headObject looks up an object, with its checksum if the backend stores
+// one. The latest version is looked up unless a version id is given.
+func (p *Proxy) headObject(ctx context.Context, filePath, versionID string) (storedObject, error) {
+	ctx, cancel := s3Context(ctx, p.s3)
+	defer cancel()
+	input := &s3.HeadObjectInput{
+		Bucket:       aws.String(p.s3.bucket),
+		Key:          aws.String(filePath),
+		ChecksumMode: types.ChecksumModeEnabled,
+	}
+	if versionID != "" {
+		input.VersionId = aws.String(versionID)
+	}
+
+	result, err := p.newS3ReadClient().HeadObject(ctx, input)
+	if err != nil {
+		var notFound *types.NotFound
+		if errors.As(err, &notFound) {
+			err = errObjectNotFound
+		}
+		return storedObject{}, &ObjectLookupError{Key: filePath, Err: err}
+	}
+
+	object := storedObject{etag: strings.Trim(aws.ToString(result.ETag), "\""), size: aws.ToInt64(result.ContentLength)}
+	// Composite checksums end with the number of parts
+	if value := aws.ToString(result.ChecksumSHA256); value != "" && !strings.Contains(value, "-") {
+		if sum, err := base64.StdEncoding.DecodeString(value); err == nil && len(sum) == sha256.Size {
+			object.checksum = hex.EncodeToString(sum)
+		}
+	}
+	return object, nil
+}
+
+// multipartChecksum returns the checksums and size of a completed multipart
+// upload. The checksums are the ones computed from the parts passing
+// through the proxy or the full object sha256 checksum stored by the
+// backend. If neither is available the object is read back when that is
+// enabled, and otherwise the checksums are left empty.
+func (p *Proxy) multipartChecksum(ctx context.Context, fullPath, uploadID, versionID string) (objectInfo, error) {
+	filePath := strings.Replace(fullPath, "/"+p.s3.bucket+"/", "", 1)
+
+	object, err := p.headObject(ctx, filePath, versionID)
+	if err != nil {
+		p.multipartHashes.abort(uploadID)
+		return objectInfo{}, err
+	}
+
+	key := p.objectCacheKey(filePath, object.etag)
+	if info, ok := p.objectCache.get(key); ok {
+		log.Debugf("using cached checksum for %s", filePath)
+		p.multipartHashes.abort(uploadID)
+		return info, nil
+	}
+
+	info, ok := p.multipartHashes.complete(uploadID, object.etag)
+	switch {
+	case ok && info.size == object.size:
+		log.Debugf("checksum of %s computed from its parts", filePath)
+	case object.checksum != "":
+		info = objectInfo{checksum: object.checksum, size: object.size}
+	case p.s3.readBackChecksums:
+		if info, err = p.objectChecksum(ctx, filePath, versionID); err != nil {
+			return objectInfo{}, err
 		}
+	default:
+		log.Infof("no checksum available for %s, the parts were not sent in order", filePath)
+		return objectInfo{size: object.size}, nil
 	}
-	return mySession, nil
+
+	p.objectCache.add(key, info)
+	return info, nil
+}
+
+// objectChecksum streams the stored object from the S3 backend and computes
+// the checksums and the size of the full content. The latest version
+// is read unless a version id is given.
+func (p *Proxy) objectChecksum(ctx context.Context, filePath, versionID string) (objectInfo, error) {
+	ctx, cancel := s3Context(ctx, p.s3)
+	defer cancel()
+	input := &s3.GetObjectInput{
+		Bucket: aws.String(p.s3.bucket),
+		Key:    aws.String(filePath),
+	}
+	if versionID != "" {
+		input.VersionId = aws.String(versionID)
+	}
+
+	result, err := p.newS3ReadClient().GetObject(ctx, input)
+	if err != nil {
+		log.Debug("error when reading back object")
+		log.Debug(err)
+		var noKey *types.NoSuchKey
+		if errors.As(err, &noKey) {
+			err = errObjectNotFound
+		}
+		return objectInfo{}, &ObjectLookupError{Key: filePath, Err: err}
+	}
+	defer result.Body.Close()
+
+	hash := newDecryptingHash(p.c4ghKey)
+	defer hash.close()
+	size, err := io.Copy(hash, result.Body)
+	if err != nil {
+		return objectInfo{}, &ObjectLookupError{Key: filePath, Err: err}
+	}
+	return hash.info(size), nil
+}
+
+// objectCacheKey returns the cache key of an object in the backend bucket
+func (p *Proxy) objectCacheKey(filePath, etag string) objectCacheKey {
+	return objectCacheKey{bucket: p.s3.bucket, key: filePath, etag: strings.Trim(etag, "\"")}
+}
+
+// newS3Client creates a client for the S3 backend, it uses the same http
+// client as the proxied requests so it shares CAs and client certificates.
+func (p *Proxy) newS3Client() *s3.Client {
+	return newS3Client(p.s3, p.client)
+}
+
+// newS3ReadClient creates a client for the lookups that only read from the
+// backend, with the read keys if there are any
+func (p *Proxy) newS3ReadClient() *s3.Client {
+	return newS3Client(p.s3.readOnly(), p.client)
 }
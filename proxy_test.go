@@ -1,15 +1,28 @@
 package main
 
 import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/md5"
+	"crypto/sha256"
 	"crypto/tls"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"math/big"
 	"net"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/minio/minio-go/v6/pkg/s3signer"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -19,6 +32,18 @@ type FakeServer struct {
 	pinged bool
 }
 
+// testS3Config is the configuration of the fake backend at the url, the
+// tests set the other fields they need on it
+func testS3Config(url string) S3Config {
+	return S3Config{
+		url:       url,
+		accessKey: "someAccess",
+		secretKey: "someSecret",
+		bucket:    "buckbuck",
+		region:    "us-east-1",
+	}
+}
+
 func startFakeServer(port string) *FakeServer {
 	l, err := net.Listen("tcp", "127.0.0.1:"+port)
 	if err != nil {
@@ -27,7 +52,7 @@ func startFakeServer(port string) *FakeServer {
 	f := FakeServer{}
 	foo := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		f.pinged = true
-		fmt.Fprintf(w, f.resp)
+		fmt.Fprint(w, f.resp)
 	})
 	ts := httptest.NewUnstartedServer(foo)
 	ts.Listener.Close()
@@ -83,14 +108,8 @@ func TestServeHTTP_disallowed(t *testing.T) {
 	f := startFakeServer("9023")
 	defer f.Close()
 
-	s3conf := S3Config{
-		url:       "http://localhost:9023",
-		accessKey: "someAccess",
-		secretKey: "someSecret",
-		bucket:    "buckbuck",
-		region:    "us-east-1",
-		cacert:    "./dev_utils/certs/ca.crt",
-	}
+	s3conf := testS3Config("http://localhost:9023")
+	s3conf.cacert = "./dev_utils/certs/ca.crt"
 	messenger := NewMockMessenger()
 	proxy := NewProxy(s3conf, &AlwaysDeny{}, messenger, new(tls.Config))
 
@@ -160,14 +179,8 @@ func TestServeHTTP_disallowed(t *testing.T) {
 }
 
 func TestServeHTTP_S3Unresponsive(t *testing.T) {
-	s3conf := S3Config{
-		url:       "http://localhost:40211",
-		accessKey: "someAccess",
-		secretKey: "someSecret",
-		bucket:    "buckbuck",
-		region:    "us-east-1",
-		cacert:    "./dev_utils/certs/ca.crt",
-	}
+	s3conf := testS3Config("http://localhost:40211")
+	s3conf.cacert = "./dev_utils/certs/ca.crt"
 	messenger := NewMockMessenger()
 	proxy := NewProxy(s3conf, &AlwaysAllow{}, messenger, new(tls.Config))
 
@@ -188,14 +201,8 @@ func TestServeHTTP_allowed(t *testing.T) {
 	defer f.Close()
 
 	// Start proxy
-	s3conf := S3Config{
-		url:       "http://localhost:9024",
-		accessKey: "someAccess",
-		secretKey: "someSecret",
-		bucket:    "buckbuck",
-		region:    "us-east-1",
-		cacert:    "./dev_utils/certs/ca.crt",
-	}
+	s3conf := testS3Config("http://localhost:9024")
+	s3conf.cacert = "./dev_utils/certs/ca.crt"
 	messenger := NewMockMessenger()
 	proxy := NewProxy(s3conf, NewAlwaysAllow(), messenger, new(tls.Config))
 	//proxy := NewProxy(s3conf, NewValidateFromFile("./dev_utils/users.csv"), NewMockMessenger(), s, new(tls.Config))
@@ -205,6 +212,7 @@ func TestServeHTTP_allowed(t *testing.T) {
 	w := httptest.NewRecorder()
 	proxy.ServeHTTP(w, r)
 	assert.Equal(t, 200, w.Result().StatusCode)
+	assert.Len(t, w.Result().Header["X-Amz-Request-Id"], 1)
 	assert.Equal(t, true, f.PingedAndRestore())
 	assert.Equal(t, false, f.PingedAndRestore()) // Testing the pinged interface
 	assert.Equal(t, false, messenger.CheckAndRestore())
@@ -212,7 +220,7 @@ func TestServeHTTP_allowed(t *testing.T) {
 	// Put file works
 	w = httptest.NewRecorder()
 	r.Method = "PUT"
-	f.resp = "<ListBucketResult xmlns=\"http://s3.amazonaws.com/doc/2006-03-01/\"><Name>test</Name><Prefix>/elexirid/file.txt</Prefix><KeyCount>1</KeyCount><MaxKeys>2</MaxKeys><Delimiter></Delimiter><IsTruncated>false</IsTruncated><Contents><Key>/elexirid/file.txt</Key><LastModified>2020-03-10T13:20:15.000Z</LastModified><ETag>&#34;0a44282bd39178db9680f24813c41aec-1&#34;</ETag><Size>5</Size><Owner><ID></ID><DisplayName></DisplayName></Owner><StorageClass>STANDARD</StorageClass></Contents></ListBucketResult>"
+	f.resp = "<ListBucketResult xmlns=\"http://s3.amazonaws.com/doc/2006-03-01/\"><Name>test</Name><Prefix>username/file</Prefix><KeyCount>1</KeyCount><MaxKeys>2</MaxKeys><Delimiter></Delimiter><IsTruncated>false</IsTruncated><Contents><Key>username/file</Key><LastModified>2020-03-10T13:20:15.000Z</LastModified><ETag>&#34;0a44282bd39178db9680f24813c41aec-1&#34;</ETag><Size>5</Size><Owner><ID></ID><DisplayName></DisplayName></Owner><StorageClass>STANDARD</StorageClass></Contents></ListBucketResult>"
 	proxy.ServeHTTP(w, r)
 	assert.Equal(t, 200, w.Result().StatusCode)
 	assert.Equal(t, true, f.PingedAndRestore())
@@ -293,18 +301,12 @@ func TestMessageFormatting(t *testing.T) {
 	r.Header.Set("content-length", "1234")
 	r.Header.Set("x-amz-content-sha256", "checksum")
 
-	s3conf := S3Config{
-		url:       "http://localhost:9023",
-		accessKey: "someAccess",
-		secretKey: "someSecret",
-		bucket:    "buckbuck",
-		region:    "us-east-1",
-		cacert:    "./dev_utils/certs/ca.crt",
-	}
+	s3conf := testS3Config("http://localhost:9023")
+	s3conf.cacert = "./dev_utils/certs/ca.crt"
 	messenger := NewMockMessenger()
 	proxy := NewProxy(s3conf, &AlwaysDeny{}, messenger, new(tls.Config))
-	f.resp = "<ListBucketResult xmlns=\"http://s3.amazonaws.com/doc/2006-03-01/\"><Name>test</Name><Prefix>/user/new_file.txt</Prefix><KeyCount>1</KeyCount><MaxKeys>2</MaxKeys><Delimiter></Delimiter><IsTruncated>false</IsTruncated><Contents><Key>/user/new_file.txt</Key><LastModified>2020-03-10T13:20:15.000Z</LastModified><ETag>&#34;0a44282bd39178db9680f24813c41aec-1&#34;</ETag><Size>1234</Size><Owner><ID></ID><DisplayName></DisplayName></Owner><StorageClass>STANDARD</StorageClass></Contents></ListBucketResult>"
-	msg, err := proxy.CreateMessageFromRequest(r)
+	f.resp = "<ListBucketResult xmlns=\"http://s3.amazonaws.com/doc/2006-03-01/\"><Name>test</Name><Prefix>/user/new_file.txt</Prefix><KeyCount>1</KeyCount><MaxKeys>2</MaxKeys><Delimiter></Delimiter><IsTruncated>false</IsTruncated><Contents><Key>user/new_file.txt</Key><LastModified>2020-03-10T13:20:15.000Z</LastModified><ETag>&#34;0a44282bd39178db9680f24813c41aec-1&#34;</ETag><Size>1234</Size><Owner><ID></ID><DisplayName></DisplayName></Owner><StorageClass>STANDARD</StorageClass></Contents></ListBucketResult>"
+	msg, err := proxy.CreateMessageFromRequest(r, nil)
 	assert.Nil(t, err)
 	assert.IsType(t, Event{}, msg)
 
@@ -318,10 +320,791 @@ func TestMessageFormatting(t *testing.T) {
 	assert.Equal(t, "sha256", checksum.Type)
 	assert.Equal(t, "5b233b981dc12e7ccf4c242b99c042b7842b73b956ad662e4fe0f8354151538b", checksum.Value)
 
+	// Test multipart upload completion, without checksum from the parts or
+	// the backend it is computed from the content when that is enabled
+	r.URL, _ = url.Parse("/buckbuck/user/new_file.txt?uploadId=5")
+	f.resp = "some file content"
+	proxy.s3.readBackChecksums = true
+	msg, err = proxy.CreateMessageFromRequest(r, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(17), msg.Filesize)
+	assert.Equal(t, "user/new_file.txt", msg.Filepath)
+	c, _ = json.Marshal(msg.Checksum[0])
+	_ = json.Unmarshal(c, &checksum)
+	assert.Equal(t, "sha256", checksum.Type)
+	assert.Equal(t, fmt.Sprintf("%x", sha256.Sum256([]byte("some file content"))), checksum.Value)
+
 	// Test single shot upload
 	r.Method = "PUT"
-	msg, err = proxy.CreateMessageFromRequest(r)
+	r.URL, _ = url.Parse("/buckbuck/user/new_file.txt")
+	f.resp = "<ListBucketResult xmlns=\"http://s3.amazonaws.com/doc/2006-03-01/\"><Name>test</Name><Prefix>/user/new_file.txt</Prefix><KeyCount>1</KeyCount><MaxKeys>2</MaxKeys><Delimiter></Delimiter><IsTruncated>false</IsTruncated><Contents><Key>user/new_file.txt</Key><LastModified>2020-03-10T13:20:15.000Z</LastModified><ETag>&#34;0a44282bd39178db9680f24813c41aec-1&#34;</ETag><Size>1234</Size><Owner><ID></ID><DisplayName></DisplayName></Owner><StorageClass>STANDARD</StorageClass></Contents></ListBucketResult>"
+	msg, err = proxy.CreateMessageFromRequest(r, nil)
 	assert.Nil(t, err)
 	assert.IsType(t, Event{}, msg)
 	assert.Equal(t, "upload", msg.Operation)
 }
+
+// readRecorder records whether anything read from it
+type readRecorder struct {
+	read bool
+}
+
+func (b *readRecorder) Read(p []byte) (int, error) {
+	b.read = true
+	return 0, io.EOF
+}
+
+func TestServeHTTP_earlyRejection(t *testing.T) {
+	f := startFakeServer("9025")
+	defer f.Close()
+
+	s3conf := testS3Config("http://localhost:9025")
+	messenger := NewMockMessenger()
+
+	// Bad credentials are rejected without reading the body
+	proxy := NewProxy(s3conf, &AlwaysDeny{}, messenger, new(tls.Config))
+	body := &readRecorder{}
+	r, _ := http.NewRequest("PUT", "/username/file", body)
+	r.ContentLength = 1 << 32
+	r.Header.Set("Expect", "100-continue")
+	w := httptest.NewRecorder()
+	proxy.ServeHTTP(w, r)
+	assert.Equal(t, 401, w.Result().StatusCode)
+	assert.False(t, body.read)
+	assert.False(t, f.PingedAndRestore())
+
+	// Too large uploads are rejected without reading the body
+	proxy = NewProxy(s3conf, NewAlwaysAllow(), messenger, new(tls.Config))
+	proxy.maxUploadSize = 1024
+	body = &readRecorder{}
+	r, _ = http.NewRequest("PUT", "/username/file", body)
+	r.ContentLength = 1025
+	w = httptest.NewRecorder()
+	proxy.ServeHTTP(w, r)
+	assert.Equal(t, 413, w.Result().StatusCode)
+	assert.False(t, body.read)
+	assert.False(t, f.PingedAndRestore())
+	assert.False(t, messenger.CheckAndRestore())
+
+	// Uploads within the limit are forwarded
+	r, _ = http.NewRequest("PUT", "/username/file?partNumber=1", strings.NewReader("data"))
+	w = httptest.NewRecorder()
+	proxy.ServeHTTP(w, r)
+	assert.Equal(t, 200, w.Result().StatusCode)
+	assert.True(t, f.PingedAndRestore())
+}
+
+func TestValidatePath(t *testing.T) {
+	for _, path := range []string{"/user/", "/user/file", "/user/dir/file.c4gh", "/user", "/user/file%20name"} {
+		r, _ := http.NewRequest("PUT", path, nil)
+		assert.NoError(t, validatePath(r), path)
+	}
+
+	for _, path := range []string{
+		"/",
+		"//file",
+		"/user//file",
+		"/user/../other/file",
+		"/user/%2E%2E/other/file",
+		"/user/./file",
+		"/user%2F..%2Fother/file",
+		"/user/dir%2ffile",
+		"/user/..\\other",
+	} {
+		r, _ := http.NewRequest("PUT", path, nil)
+		assert.Error(t, validatePath(r), path)
+	}
+}
+
+func TestServeHTTP_badPath(t *testing.T) {
+	f := startFakeServer("9026")
+	defer f.Close()
+
+	s3conf := testS3Config("http://localhost:9026")
+	messenger := NewMockMessenger()
+	proxy := NewProxy(s3conf, NewAlwaysAllow(), messenger, new(tls.Config))
+
+	r, _ := http.NewRequest("PUT", "/username/../other/file", nil)
+	w := httptest.NewRecorder()
+	proxy.ServeHTTP(w, r)
+	assert.Equal(t, 400, w.Result().StatusCode)
+	assert.False(t, f.PingedAndRestore())
+	assert.False(t, messenger.CheckAndRestore())
+}
+
+func TestServeHTTP_contentType(t *testing.T) {
+	f := startFakeServer("9027")
+	defer f.Close()
+
+	s3conf := testS3Config("http://localhost:9027")
+	messenger := NewMockMessenger()
+	proxy := NewProxy(s3conf, NewAlwaysAllow(), messenger, new(tls.Config))
+	proxy.allowedContentTypes = []string{"application/octet-stream"}
+
+	// Spreadsheets are rejected with an S3 error
+	r, _ := http.NewRequest("PUT", "/username/file.xlsx", strings.NewReader("data"))
+	r.Header.Set("Content-Type", "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet")
+	w := httptest.NewRecorder()
+	proxy.ServeHTTP(w, r)
+	assert.Equal(t, 400, w.Result().StatusCode)
+	assert.Contains(t, w.Body.String(), "<Code>InvalidArgument</Code>")
+	assert.Contains(t, w.Body.String(), "<Resource>/username/file.xlsx</Resource>")
+	assert.False(t, f.PingedAndRestore())
+
+	// So are initiated multipart uploads
+	r, _ = http.NewRequest("POST", "/username/file.pdf?uploads", nil)
+	r.Header.Set("Content-Type", "application/pdf")
+	w = httptest.NewRecorder()
+	proxy.ServeHTTP(w, r)
+	assert.Equal(t, 400, w.Result().StatusCode)
+	assert.False(t, f.PingedAndRestore())
+
+	// Allowed types, with parameters, and missing types are accepted
+	for _, contentType := range []string{"application/octet-stream", "Application/Octet-Stream; charset=binary", ""} {
+		r, _ = http.NewRequest("PUT", "/username/file.c4gh", strings.NewReader("data"))
+		r.Header.Set("Content-Type", contentType)
+		w = httptest.NewRecorder()
+		proxy.ServeHTTP(w, r)
+		assert.Equal(t, 200, w.Result().StatusCode, contentType)
+		assert.True(t, f.PingedAndRestore())
+	}
+}
+
+func TestServeHTTP_rangeDownload(t *testing.T) {
+	var path, byteRange string
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path, byteRange = r.URL.Path, r.Header.Get("Range")
+		http.ServeContent(w, r, "file", time.Time{}, strings.NewReader("0123456789"))
+	}))
+	defer backend.Close()
+
+	s3conf := testS3Config(backend.URL)
+	messenger := NewMockMessenger()
+	proxy := NewProxy(s3conf, NewAlwaysAllow(), messenger, new(tls.Config))
+
+	// Without downloads the object path is passed on as is
+	r, _ := http.NewRequest("GET", "/username/file", nil)
+	w := httptest.NewRecorder()
+	proxy.ServeHTTP(w, r)
+	assert.Equal(t, "/username/file", path)
+
+	proxy.downloads = true
+
+	r, _ = http.NewRequest("GET", "/username/file", nil)
+	r.Header.Set("Range", "bytes=2-5")
+	w = httptest.NewRecorder()
+	proxy.ServeHTTP(w, r)
+	assert.Equal(t, "/buckbuck/username/file", path)
+	assert.Equal(t, "bytes=2-5", byteRange)
+	assert.Equal(t, 206, w.Result().StatusCode)
+	assert.Equal(t, "bytes 2-5/10", w.Result().Header.Get("Content-Range"))
+	assert.Equal(t, "2345", w.Body.String())
+	assert.False(t, messenger.CheckAndRestore())
+
+	// Unsatisfiable ranges are passed back to the client
+	r, _ = http.NewRequest("GET", "/username/file", nil)
+	r.Header.Set("Range", "bytes=20-")
+	w = httptest.NewRecorder()
+	proxy.ServeHTTP(w, r)
+	assert.Equal(t, 416, w.Result().StatusCode)
+
+	// Listings are not downloads
+	r, _ = http.NewRequest("GET", "/username/dir?list-type=2", nil)
+	assert.False(t, proxy.isDownload(r))
+}
+
+func TestServeHTTP_uploadChecksums(t *testing.T) {
+	var received string
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		received = string(body)
+		w.Header().Set("ETag", "\"etag\"")
+	}))
+	defer backend.Close()
+
+	s3conf := testS3Config(backend.URL)
+	messenger := NewMockMessenger()
+	proxy := NewProxy(s3conf, NewAlwaysAllow(), messenger, new(tls.Config))
+
+	// The checksums come from the body on its way to the backend, nothing
+	// is looked up afterwards
+	r, _ := http.NewRequest("PUT", "/username/file", strings.NewReader("some file content"))
+	w := httptest.NewRecorder()
+	proxy.ServeHTTP(w, r)
+	assert.Equal(t, 200, w.Result().StatusCode)
+	assert.Equal(t, "some file content", received)
+	if assert.NotNil(t, messenger.lastEvent) {
+		assert.Equal(t, int64(17), messenger.lastEvent.Filesize)
+		assert.Equal(t, []interface{}{
+			Checksum{Type: "sha256", Value: fmt.Sprintf("%x", sha256.Sum256([]byte("some file content")))},
+			Checksum{Type: "md5", Value: fmt.Sprintf("%x", md5.Sum([]byte("some file content")))},
+		}, messenger.lastEvent.Checksum)
+	}
+}
+
+func TestServeHTTP_delete(t *testing.T) {
+	var method, path string
+	status := http.StatusNoContent
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		method, path = r.Method, r.URL.Path
+		w.WriteHeader(status)
+	}))
+	defer backend.Close()
+
+	s3conf := testS3Config(backend.URL)
+	messenger := NewMockMessenger()
+	proxy := NewProxy(s3conf, NewAlwaysAllow(), messenger, new(tls.Config))
+	proxy.deletes = true
+
+	r, _ := http.NewRequest("DELETE", "/username/dir/file", nil)
+	w := httptest.NewRecorder()
+	proxy.ServeHTTP(w, r)
+	assert.Equal(t, 204, w.Result().StatusCode)
+	assert.Equal(t, "DELETE", method)
+	assert.Equal(t, "/buckbuck/username/dir/file", path)
+	assert.NotNil(t, messenger.lastEvent)
+	assert.Equal(t, "remove", messenger.lastEvent.Operation)
+	assert.Equal(t, "username", messenger.lastEvent.Username)
+	assert.Equal(t, "username/dir/file", messenger.lastEvent.Filepath)
+	messenger.CheckAndRestore()
+
+	// Failed deletes send no event
+	status = http.StatusForbidden
+	r, _ = http.NewRequest("DELETE", "/username/file", nil)
+	w = httptest.NewRecorder()
+	proxy.ServeHTTP(w, r)
+	assert.Equal(t, 403, w.Result().StatusCode)
+	assert.False(t, messenger.CheckAndRestore())
+
+	// Buckets still can't be removed
+	method = ""
+	r, _ = http.NewRequest("DELETE", "/username/", nil)
+	w = httptest.NewRecorder()
+	proxy.ServeHTTP(w, r)
+	assert.Equal(t, 403, w.Result().StatusCode)
+	assert.Equal(t, "", method)
+}
+
+func TestRequestInfo(t *testing.T) {
+	page := func(next string, keys ...string) string {
+		body := "<ListBucketResult xmlns=\"http://s3.amazonaws.com/doc/2006-03-01/\"><Name>buckbuck</Name>"
+		if next != "" {
+			body += "<IsTruncated>true</IsTruncated><NextContinuationToken>" + next + "</NextContinuationToken>"
+		}
+		for _, key := range keys {
+			body += "<Contents><Key>" + key + "</Key><ETag>&#34;etag-" + key + "&#34;</ETag><Size>42</Size></Contents>"
+		}
+		return body + "</ListBucketResult>"
+	}
+	var pages map[string]string
+	requests := 0
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		fmt.Fprint(w, pages[r.URL.Query().Get("continuation-token")])
+	}))
+	defer backend.Close()
+
+	s3conf := testS3Config(backend.URL)
+	s3conf.lookupCacheTTL = time.Minute
+	s3conf.lookupCacheSize = 10
+	proxy := NewProxy(s3conf, NewAlwaysAllow(), NewMockMessenger(), new(tls.Config))
+
+	// The exact key is found on a later page
+	pages = map[string]string{
+		"":      page("token", "user/file.c4gh.bak"),
+		"token": page("", "user/file.c4gh"),
+	}
+	checksum, size, err := proxy.requestInfo(context.Background(), "/buckbuck/user/file.c4gh", "")
+	assert.NoError(t, err)
+	assert.Equal(t, fmt.Sprintf("%x", sha256.Sum256([]byte("etag-user/file.c4gh"))), checksum)
+	assert.Equal(t, int64(42), size)
+
+	// Looking up the same version again is served from the cache
+	requests = 0
+	cached, _, err := proxy.requestInfo(context.Background(), "/buckbuck/user/file.c4gh", "\"etag-user/file.c4gh\"")
+	assert.NoError(t, err)
+	assert.Equal(t, checksum, cached)
+	assert.Equal(t, 0, requests)
+	_, _, err = proxy.requestInfo(context.Background(), "/buckbuck/user/file.c4gh", "\"new-etag\"")
+	assert.NoError(t, err)
+	assert.Equal(t, 2, requests)
+
+	// Objects only sharing the prefix do not count
+	pages = map[string]string{"": page("", "user/file.c4gh.bak")}
+	_, _, err = proxy.requestInfo(context.Background(), "/buckbuck/user/file.c4gh", "")
+	var lookupErr *ObjectLookupError
+	if assert.True(t, errors.As(err, &lookupErr)) {
+		assert.Equal(t, "user/file.c4gh", lookupErr.Key)
+	}
+	assert.True(t, errors.Is(err, errObjectNotFound))
+
+	// Neither do empty listings
+	pages = map[string]string{"": page("")}
+	_, _, err = proxy.requestInfo(context.Background(), "/buckbuck/user/file.c4gh", "")
+	assert.True(t, errors.Is(err, errObjectNotFound))
+}
+
+func TestResignHeader_storageClass(t *testing.T) {
+	s3conf := testS3Config("http://localhost:9000")
+	s3conf.storageClass = "STANDARD_IA"
+	proxy := NewProxy(s3conf, NewAlwaysAllow(), NewMockMessenger(), new(tls.Config))
+
+	// Single uploads and initiated multipart uploads get the storage class
+	for _, target := range []string{"PUT /buckbuck/user/file", "POST /buckbuck/user/file?uploads"} {
+		parts := strings.SplitN(target, " ", 2)
+		r, _ := http.NewRequest(parts[0], parts[1], nil)
+		r.Header.Set("X-Amz-Storage-Class", "GLACIER")
+		signed, _ := proxy.resignHeader(r, s3conf.accessKey, s3conf.secretKey, s3conf.url)
+		assert.Equal(t, "STANDARD_IA", signed.Header.Get("X-Amz-Storage-Class"), target)
+		assert.Contains(t, signed.Header.Get("Authorization"), "x-amz-storage-class", target)
+	}
+
+	// Parts don't
+	r, _ := http.NewRequest("PUT", "/buckbuck/user/file?partNumber=1&uploadId=1", nil)
+	signed, _ := proxy.resignHeader(r, s3conf.accessKey, s3conf.secretKey, s3conf.url)
+	assert.Empty(t, signed.Header.Get("X-Amz-Storage-Class"))
+}
+
+func TestResignHeader_objectLock(t *testing.T) {
+	s3conf := testS3Config("http://localhost:9000")
+	s3conf.objectLockMode = "COMPLIANCE"
+	s3conf.objectLockRetention = 24 * time.Hour
+	proxy := NewProxy(s3conf, NewAlwaysAllow(), NewMockMessenger(), new(tls.Config))
+
+	// The configured retention replaces the one of the client
+	r, _ := http.NewRequest("PUT", "/buckbuck/user/file", nil)
+	r.Header.Set("X-Amz-Object-Lock-Mode", "GOVERNANCE")
+	r.Header.Set("X-Amz-Object-Lock-Retain-Until-Date", "2000-01-01T00:00:00Z")
+	signed, _ := proxy.resignHeader(r, s3conf.accessKey, s3conf.secretKey, s3conf.url)
+	assert.Equal(t, "COMPLIANCE", signed.Header.Get("X-Amz-Object-Lock-Mode"))
+	until, err := time.Parse(time.RFC3339, signed.Header.Get("X-Amz-Object-Lock-Retain-Until-Date"))
+	assert.NoError(t, err)
+	assert.WithinDuration(t, time.Now().Add(24*time.Hour), until, time.Minute)
+	assert.Empty(t, signed.Header.Get("X-Amz-Object-Lock-Legal-Hold"))
+
+	// Without configured defaults the headers of the client are passed on
+	proxy.s3.objectLockMode = ""
+	proxy.s3.objectLockLegalHold = false
+	r, _ = http.NewRequest("PUT", "/buckbuck/user/file", nil)
+	r.Header.Set("X-Amz-Object-Lock-Legal-Hold", "ON")
+	signed, _ = proxy.resignHeader(r, s3conf.accessKey, s3conf.secretKey, s3conf.url)
+	assert.Equal(t, "ON", signed.Header.Get("X-Amz-Object-Lock-Legal-Hold"))
+	assert.Empty(t, signed.Header.Get("X-Amz-Object-Lock-Mode"))
+}
+
+func TestRequesterPays(t *testing.T) {
+	var payer string
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		payer = r.Header.Get("X-Amz-Request-Payer")
+		fmt.Fprint(w, "<ListBucketResult><Contents><Key>user/file</Key><ETag>etag</ETag><Size>1</Size></Contents></ListBucketResult>")
+	}))
+	defer backend.Close()
+
+	s3conf := testS3Config(backend.URL)
+	s3conf.requesterPays = true
+	proxy := NewProxy(s3conf, NewAlwaysAllow(), NewMockMessenger(), new(tls.Config))
+
+	// Proxied requests
+	r, _ := http.NewRequest("GET", "/username/file", nil)
+	w := httptest.NewRecorder()
+	proxy.ServeHTTP(w, r)
+	assert.Equal(t, "requester", payer)
+
+	// and the lookups of the proxy itself
+	payer = ""
+	_, _, err := proxy.requestInfo(context.Background(), "/buckbuck/user/file", "")
+	assert.NoError(t, err)
+	assert.Equal(t, "requester", payer)
+}
+
+func TestMessageFormatting_versioned(t *testing.T) {
+	var versionID string
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		versionID = r.URL.Query().Get("versionId")
+		fmt.Fprint(w, "some file content")
+	}))
+	defer backend.Close()
+
+	s3conf := testS3Config(backend.URL)
+	proxy := NewProxy(s3conf, NewAlwaysAllow(), NewMockMessenger(), new(tls.Config))
+
+	// The completed multipart upload is read back in the uploaded version
+	r, _ := http.NewRequest("POST", "/buckbuck/user/new_file.txt?uploadId=5", nil)
+	header := http.Header{}
+	header.Set("X-Amz-Version-Id", "3HL4kqtJlcpXroDTDmJ")
+	msg, err := proxy.CreateMessageFromRequest(r, header)
+	assert.NoError(t, err)
+	assert.Equal(t, "3HL4kqtJlcpXroDTDmJ", msg.VersionID)
+	assert.Equal(t, "3HL4kqtJlcpXroDTDmJ", versionID)
+
+	body, _ := json.Marshal(msg)
+	assert.Contains(t, string(body), `"version_id":"3HL4kqtJlcpXroDTDmJ"`)
+
+	// Unversioned uploads have no version in the message
+	msg, err = proxy.CreateMessageFromRequest(r, nil)
+	assert.NoError(t, err)
+	body, _ = json.Marshal(msg)
+	assert.NotContains(t, string(body), "version_id")
+}
+
+func TestMessageFormatting_schemaVersion(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "some file content")
+	}))
+	defer backend.Close()
+
+	s3conf := testS3Config(backend.URL)
+	proxy := NewProxy(s3conf, NewAlwaysAllow(), NewMockMessenger(), new(tls.Config))
+	r, _ := http.NewRequest("POST", "/buckbuck/user/new_file.txt?uploadId=5", nil)
+
+	// The legacy schema has no version, but all events have the time
+	msg, err := proxy.CreateMessageFromRequest(r, nil)
+	assert.NoError(t, err)
+	body, _ := json.Marshal(msg)
+	assert.NotContains(t, string(body), "schema_version")
+	_, err = time.Parse(time.RFC3339, msg.Timestamp)
+	assert.NoError(t, err)
+
+	proxy.schemaVersion = versionedSchema
+	msg, err = proxy.CreateMessageFromRequest(r, nil)
+	assert.NoError(t, err)
+	body, _ = json.Marshal(msg)
+	assert.Contains(t, string(body), `"schema_version":2`)
+	_, err = time.Parse(time.RFC3339, msg.Timestamp)
+	assert.NoError(t, err)
+}
+
+func TestResignHeader_sigV4A(t *testing.T) {
+	s3conf := testS3Config("https://mrap.accesspoint.s3-global.amazonaws.com")
+	s3conf.signatureVersion = "v4a"
+	s3conf.regionSet = "eu-north-1,eu-west-1"
+	proxy := NewProxy(s3conf, NewAlwaysAllow(), NewMockMessenger(), new(tls.Config))
+
+	r, _ := http.NewRequest("PUT", "/buckbuck/user/file", nil)
+	signed, err := proxy.resignHeader(r, s3conf.accessKey, s3conf.secretKey, s3conf.url)
+	assert.NoError(t, err)
+	assert.Equal(t, "mrap.accesspoint.s3-global.amazonaws.com", signed.Host)
+	assert.Equal(t, "eu-north-1,eu-west-1", signed.Header.Get("X-Amz-Region-Set"))
+	assert.True(t, strings.HasPrefix(signed.Header.Get("Authorization"), "AWS4-ECDSA-P256-SHA256 Credential=someAccess/"))
+
+	// The derived key is kept for the next requests
+	key := proxy.sigV4AKeys.key
+	assert.NotNil(t, key)
+	r, _ = http.NewRequest("PUT", "/buckbuck/user/file", nil)
+	_, err = proxy.resignHeader(r, s3conf.accessKey, s3conf.secretKey, s3conf.url)
+	assert.NoError(t, err)
+	assert.Same(t, key, proxy.sigV4AKeys.key)
+}
+
+func TestResignHeader_fips(t *testing.T) {
+	s3conf := testS3Config("http://localhost:1")
+	s3conf.fips = true
+	proxy := NewProxy(s3conf, NewAlwaysAllow(), NewMockMessenger(), new(tls.Config))
+
+	// Both signers give the same signature when signing in the same second
+	for i := 0; i < 3; i++ {
+		r, _ := http.NewRequest("GET", "/buckbuck/user/some%20file?partNumber=1&uploadId=a", nil)
+		r.Header.Set("X-Amz-Content-Sha256", "UNSIGNED-PAYLOAD")
+		signed, err := proxy.resignHeader(r, s3conf.accessKey, s3conf.secretKey, s3conf.url)
+		assert.NoError(t, err)
+
+		r, _ = http.NewRequest("GET", "/buckbuck/user/some%20file?partNumber=1&uploadId=a", nil)
+		r.Header.Set("X-Amz-Content-Sha256", "UNSIGNED-PAYLOAD")
+		r.Host = "localhost:1"
+		reference := s3signer.SignV4(*r, s3conf.accessKey, s3conf.secretKey, "", s3conf.region)
+		if signed.Header.Get("X-Amz-Date") != reference.Header.Get("X-Amz-Date") {
+			continue
+		}
+		assert.Equal(t, reference.Header.Get("Authorization"), signed.Header.Get("Authorization"))
+		return
+	}
+	t.Error("could not sign within the same second")
+}
+
+func TestServeHTTP_sigV4AFailure(t *testing.T) {
+	f := startFakeServer("9027")
+	defer f.Close()
+
+	s3conf := testS3Config("http://localhost:9027")
+	s3conf.signatureVersion = "v4a"
+	s3conf.regionSet = "*"
+	proxy := NewProxy(s3conf, NewAlwaysAllow(), NewMockMessenger(), new(tls.Config))
+
+	// A key that can't sign
+	proxy.sigV4AKeys.accessKey, proxy.sigV4AKeys.secretKey = s3conf.accessKey, s3conf.secretKey
+	proxy.sigV4AKeys.key = &ecdsa.PrivateKey{PublicKey: ecdsa.PublicKey{Curve: elliptic.P256(), X: big.NewInt(1), Y: big.NewInt(1)}, D: big.NewInt(1)}
+
+	// Requests that can't be signed are not sent with the client's signature
+	r, _ := http.NewRequest("PUT", "/username/file", strings.NewReader("data"))
+	r.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential=username/20200101/us-east-1/s3/aws4_request")
+	w := httptest.NewRecorder()
+	proxy.ServeHTTP(w, r)
+	assert.Equal(t, 500, w.Code)
+	assert.False(t, f.PingedAndRestore())
+}
+
+func TestServeHTTP_accelerate(t *testing.T) {
+	var host, path string
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host, path = r.Host, r.URL.Path
+	}))
+	defer backend.Close()
+
+	s3conf := testS3Config("http://localhost:1")
+	s3conf.accelerateEndpoint = backend.URL
+	proxy := NewProxy(s3conf, NewAlwaysAllow(), NewMockMessenger(), new(tls.Config))
+
+	r, _ := http.NewRequest("PUT", "/username/file", nil)
+	w := httptest.NewRecorder()
+	proxy.ServeHTTP(w, r)
+	assert.Equal(t, 200, w.Result().StatusCode)
+	assert.Equal(t, strings.TrimPrefix(backend.URL, "http://"), host)
+	assert.Equal(t, "/username/file", path)
+}
+
+func TestServeHTTP_listMultipartUploads(t *testing.T) {
+	var path, prefix string
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path, prefix = r.URL.Path, r.URL.Query().Get("prefix")
+		fmt.Fprint(w, "<ListMultipartUploadsResult><Bucket>buckbuck</Bucket><Prefix>username/</Prefix><Upload><Key>username/file</Key><UploadId>1</UploadId></Upload></ListMultipartUploadsResult>")
+	}))
+	defer backend.Close()
+
+	s3conf := testS3Config(backend.URL)
+	proxy := NewProxy(s3conf, NewAlwaysAllow(), NewMockMessenger(), new(tls.Config))
+
+	r, _ := http.NewRequest("GET", "/username?uploads", nil)
+	w := httptest.NewRecorder()
+	proxy.ServeHTTP(w, r)
+	assert.Equal(t, 200, w.Code)
+	assert.Equal(t, "/buckbuck/", path)
+	assert.Equal(t, "username/", prefix)
+	body := w.Body.String()
+	assert.Equal(t, "<ListMultipartUploadsResult><Bucket>username</Bucket><Prefix></Prefix><Upload><Key>file</Key><UploadId>1</UploadId></Upload></ListMultipartUploadsResult>", body)
+	assert.Equal(t, strconv.Itoa(len(body)), w.Header().Get("Content-Length"))
+
+	// Parts of an upload are listed from the user's prefix
+	r, _ = http.NewRequest("GET", "/username/file?uploadId=1", nil)
+	w = httptest.NewRecorder()
+	proxy.ServeHTTP(w, r)
+	assert.Equal(t, 200, w.Code)
+	assert.Equal(t, "/buckbuck/username/file", path)
+}
+
+func TestServeHTTP_virtualHosted(t *testing.T) {
+	var host, path, listHost string
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPut {
+			host, path = r.Host, r.URL.Path
+		} else {
+			// the lookup after the upload
+			listHost = r.Host
+		}
+	}))
+	defer backend.Close()
+	backendAddr := strings.TrimPrefix(backend.URL, "http://")
+
+	s3conf := testS3Config("http://s3.example.org")
+	s3conf.virtualHosted = true
+	proxy := NewProxy(s3conf, NewAlwaysAllow(), NewMockMessenger(), new(tls.Config))
+	// Connect to the test backend whatever the host name is
+	proxy.client.Transport = &http.Transport{DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+		return net.Dial(network, backendAddr)
+	}}
+
+	r, _ := http.NewRequest("PUT", "/username/file", nil)
+	w := httptest.NewRecorder()
+	proxy.ServeHTTP(w, r)
+	assert.Equal(t, 200, w.Code)
+	assert.Equal(t, "buckbuck.s3.example.org", host)
+	assert.Equal(t, "/username/file", path)
+	assert.Equal(t, "buckbuck.s3.example.org", listHost)
+
+	backendURL, path := proxy.backendAddress("/buckbuck/")
+	assert.Equal(t, "http://buckbuck.s3.example.org", backendURL)
+	assert.Equal(t, "/", path)
+
+	proxy.s3.virtualHosted = false
+	backendURL, path = proxy.backendAddress("/buckbuck/username/file")
+	assert.Equal(t, "http://s3.example.org", backendURL)
+	assert.Equal(t, "/buckbuck/username/file", path)
+}
+
+// contentRecorder is a readRecorder with content
+type contentRecorder struct {
+	io.Reader
+	read bool
+}
+
+func (r *contentRecorder) Read(p []byte) (int, error) {
+	r.read = true
+	return r.Reader.Read(p)
+}
+
+func TestServeHTTP_expectContinue(t *testing.T) {
+	reject := true
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if reject {
+			// Reject without reading the body
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		_, _ = io.Copy(io.Discard, r.Body)
+	}))
+	defer backend.Close()
+
+	s3conf := testS3Config(backend.URL)
+	s3conf.expectContinueTimeout = 5 * time.Second
+	proxy := httptest.NewServer(NewProxy(s3conf, NewAlwaysAllow(), NewMockMessenger(), new(tls.Config)))
+	defer proxy.Close()
+	client := &http.Client{Transport: &http.Transport{ExpectContinueTimeout: 5 * time.Second}}
+
+	body := &contentRecorder{Reader: strings.NewReader("some file content")}
+	r, _ := http.NewRequest("PUT", proxy.URL+"/username/file", body)
+	r.ContentLength = 17
+	r.Header.Set("Expect", "100-continue")
+	res, err := client.Do(r)
+	assert.NoError(t, err)
+	res.Body.Close()
+	assert.Equal(t, http.StatusForbidden, res.StatusCode)
+	assert.False(t, body.read, "body should not be sent when the backend rejects it")
+
+	reject = false
+	body = &contentRecorder{Reader: strings.NewReader("some file content")}
+	r, _ = http.NewRequest("PUT", proxy.URL+"/username/file", body)
+	r.ContentLength = 17
+	r.Header.Set("Expect", "100-continue")
+	res, err = client.Do(r)
+	assert.NoError(t, err)
+	res.Body.Close()
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.True(t, body.read)
+}
+
+func TestNewProxy_connections(t *testing.T) {
+	s3conf := S3Config{
+		url:                 "http://localhost:1",
+		maxIdleConnsPerHost: 16,
+		idleConnTimeout:     time.Minute,
+	}
+	proxy := NewProxy(s3conf, NewAlwaysAllow(), NewMockMessenger(), new(tls.Config))
+	tr := proxy.client.Transport.(*http.Transport)
+	assert.Equal(t, 16, tr.MaxIdleConnsPerHost)
+	assert.Equal(t, time.Minute, tr.IdleConnTimeout)
+	assert.NotNil(t, tr.DialContext)
+}
+
+func TestServeHTTP_backendStatus(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/xml")
+		w.WriteHeader(http.StatusForbidden)
+		fmt.Fprint(w, `<?xml version="1.0" encoding="UTF-8"?><Error><Code>AccessDenied</Code><Message>Access Denied</Message></Error>`)
+	}))
+	defer backend.Close()
+
+	s3conf := testS3Config(backend.URL)
+	messenger := NewMockMessenger()
+	proxy := NewProxy(s3conf, NewAlwaysAllow(), messenger, new(tls.Config))
+
+	// Errors of the backend reach the client with their status code
+	r, _ := http.NewRequest("PUT", "/username/file", strings.NewReader("data"))
+	w := httptest.NewRecorder()
+	proxy.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusForbidden, w.Result().StatusCode)
+	assert.Contains(t, w.Body.String(), "AccessDenied")
+	assert.False(t, messenger.CheckAndRestore())
+}
+
+func TestServeHTTP_multipartChecksum(t *testing.T) {
+	parts := map[string][]byte{}
+	var methods []string
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		methods = append(methods, r.Method)
+		switch {
+		case r.Method == http.MethodPut:
+			body, _ := io.ReadAll(r.Body)
+			parts[r.URL.Query().Get("partNumber")] = body
+			w.Header().Set("ETag", fmt.Sprintf("\"%x\"", md5.Sum(body)))
+		case r.Method == http.MethodPost:
+			fmt.Fprint(w, "<CompleteMultipartUploadResult><Key>user/file</Key></CompleteMultipartUploadResult>")
+		case r.Method == http.MethodHead:
+			sum1, sum2 := md5.Sum(parts["1"]), md5.Sum(parts["2"])
+			w.Header().Set("ETag", "\""+multipartETag([][]byte{sum1[:], sum2[:]})+"\"")
+			w.Header().Set("Content-Length", strconv.Itoa(len(parts["1"])+len(parts["2"])))
+		}
+	}))
+	defer backend.Close()
+
+	s3conf := testS3Config(backend.URL)
+	messenger := NewMockMessenger()
+	proxy := NewProxy(s3conf, NewAlwaysAllow(), messenger, new(tls.Config))
+
+	for part, data := range []string{"first part ", "second part"} {
+		r, _ := http.NewRequest("PUT", fmt.Sprintf("/user/file?partNumber=%d&uploadId=7", part+1), strings.NewReader(data))
+		w := httptest.NewRecorder()
+		proxy.ServeHTTP(w, r)
+		assert.Equal(t, 200, w.Code)
+	}
+
+	r, _ := http.NewRequest("POST", "/user/file?uploadId=7", strings.NewReader("<CompleteMultipartUpload/>"))
+	w := httptest.NewRecorder()
+	proxy.ServeHTTP(w, r)
+	assert.Equal(t, 200, w.Code)
+
+	// The checksum comes from the parts, the object is not read back
+	assert.NotContains(t, methods, "GET")
+	if assert.NotNil(t, messenger.lastEvent) {
+		assert.Equal(t, int64(22), messenger.lastEvent.Filesize)
+		assert.Equal(t, Checksum{Type: "sha256", Value: fmt.Sprintf("%x", sha256.Sum256([]byte("first part second part")))}, messenger.lastEvent.Checksum[0])
+	}
+}
+
+func TestHeadObject_checksum(t *testing.T) {
+	checksum := sha256.Sum256([]byte("content"))
+	var checksumMode, value string
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		checksumMode = r.Header.Get("X-Amz-Checksum-Mode")
+		w.Header().Set("ETag", "\"abc\"")
+		w.Header().Set("Content-Length", "7")
+		w.Header().Set("X-Amz-Checksum-Sha256", value)
+	}))
+	defer backend.Close()
+
+	s3conf := testS3Config(backend.URL)
+	proxy := NewProxy(s3conf, NewAlwaysAllow(), NewMockMessenger(), new(tls.Config))
+
+	value = base64.StdEncoding.EncodeToString(checksum[:])
+	object, err := proxy.headObject(context.Background(), "user/file", "")
+	assert.NoError(t, err)
+	assert.Equal(t, "ENABLED", checksumMode)
+	assert.Equal(t, storedObject{etag: "abc", size: 7, checksum: fmt.Sprintf("%x", checksum)}, object)
+
+	// Composite checksums of multipart uploads are not used
+	value += "-2"
+	object, err = proxy.headObject(context.Background(), "user/file", "")
+	assert.NoError(t, err)
+	assert.Empty(t, object.checksum)
+}
+
+func TestHeadObject_readKeys(t *testing.T) {
+	var credential string
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		credential = r.Header.Get("Authorization")
+		w.Header().Set("ETag", "\"abc\"")
+	}))
+	defer backend.Close()
+
+	s3conf := testS3Config(backend.URL)
+	proxy := NewProxy(s3conf, NewAlwaysAllow(), NewMockMessenger(), new(tls.Config))
+	_, err := proxy.headObject(context.Background(), "user/file", "")
+	assert.NoError(t, err)
+	assert.Contains(t, credential, "Credential=someAccess/")
+
+	// Lookups use the read keys when there are some
+	s3conf.readAccessKey = "readAccess"
+	s3conf.readSecretKey = "readSecret"
+	proxy = NewProxy(s3conf, NewAlwaysAllow(), NewMockMessenger(), new(tls.Config))
+	_, err = proxy.headObject(context.Background(), "user/file", "")
+	assert.NoError(t, err)
+	assert.Contains(t, credential, "Credential=readAccess/")
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/jwt"
+)
+
+// pubsubScope is the OAuth scope needed to publish to Pub/Sub
+const pubsubScope = "https://www.googleapis.com/auth/pubsub"
+
+// pubsubConfig stores the settings of the Google Pub/Sub messenger
+type pubsubConfig struct {
+	project string
+	topic   string
+	// service account key file
+	credentials string
+	// user, filepath or none, like the Kafka partition key. Subscriptions
+	// need message ordering enabled for it to have an effect.
+	orderingKey string
+	endpoint    string
+	// how long to wait for an event to be accepted
+	timeout time.Duration
+}
+
+func init() {
+	registerMessenger("pubsub", messengerType{
+		required: []string{"broker.pubsub.project", "broker.pubsub.topic", "broker.pubsub.credentials"},
+		create: func(c BrokerConfig, tlsConfig *tls.Config) (Messenger, error) {
+			return NewPubSubMessenger(c, tlsConfig)
+		},
+		check: checkPubSub,
+	})
+}
+
+// readPubSubConfig reads the broker.pubsub section of the configuration
+func readPubSubConfig() (pubsubConfig, error) {
+	p := pubsubConfig{
+		project:     viper.GetString("broker.pubsub.project"),
+		topic:       viper.GetString("broker.pubsub.topic"),
+		credentials: viper.GetString("broker.pubsub.credentials"),
+		orderingKey: kafkaKeyUser,
+		endpoint:    "https://pubsub.googleapis.com",
+		timeout:     10 * time.Second,
+	}
+
+	if viper.IsSet("broker.pubsub.orderingKey") {
+		p.orderingKey = strings.ToLower(viper.GetString("broker.pubsub.orderingKey"))
+	}
+	switch p.orderingKey {
+	case kafkaKeyUser, kafkaKeyFilepath, kafkaKeyNone:
+	default:
+		return p, fmt.Errorf("broker.pubsub.orderingKey %q is not one of user, filepath or none", p.orderingKey)
+	}
+
+	// Ordering keys are only kept in order by regional endpoints like
+	// https://europe-north1-pubsub.googleapis.com
+	if viper.IsSet("broker.pubsub.endpoint") {
+		p.endpoint = strings.TrimSuffix(viper.GetString("broker.pubsub.endpoint"), "/")
+	}
+	if viper.IsSet("broker.pubsub.timeout") {
+		p.timeout = viper.GetDuration("broker.pubsub.timeout")
+		if p.timeout <= 0 {
+			return p, fmt.Errorf("broker.pubsub.timeout must be positive")
+		}
+	}
+
+	return p, nil
+}
+
+// PubSubMessenger is a Messenger that publishes events to a Google Pub/Sub
+// topic through its REST API
+type PubSubMessenger struct {
+	client      *http.Client
+	topicURL    string
+	orderingKey string
+	timeout     time.Duration
+	format      eventFormat
+}
+
+// pubsubMessage is a message in a publish request
+type pubsubMessage struct {
+	Data        []byte            `json:"data"`
+	Attributes  map[string]string `json:"attributes,omitempty"`
+	OrderingKey string            `json:"orderingKey,omitempty"`
+}
+
+// NewPubSubMessenger creates a new messenger that publishes to a Pub/Sub
+// topic with the service account credentials
+func NewPubSubMessenger(c BrokerConfig, tlsConfig *tls.Config) (*PubSubMessenger, error) {
+	client, err := newPubSubClient(c, tlsConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	return &PubSubMessenger{client, pubsubTopicURL(c.pubsub), c.pubsub.orderingKey, c.pubsub.timeout, c.format}, nil
+}
+
+// serviceAccountKey is the part of a service account key file needed to
+// get access tokens
+type serviceAccountKey struct {
+	Type         string `json:"type"`
+	ClientEmail  string `json:"client_email"`
+	PrivateKeyID string `json:"private_key_id"`
+	PrivateKey   string `json:"private_key"`
+	TokenURI     string `json:"token_uri"`
+}
+
+// newPubSubClient creates an HTTP client that authenticates as the
+// configured service account
+func newPubSubClient(c BrokerConfig, tlsConfig *tls.Config) (*http.Client, error) {
+	data, err := ioutil.ReadFile(c.pubsub.credentials) // #nosec this file comes from our configuration
+	if err != nil {
+		return nil, fmt.Errorf("broker.pubsub.credentials: %v", err)
+	}
+	var key serviceAccountKey
+	if err := json.Unmarshal(data, &key); err != nil {
+		return nil, fmt.Errorf("broker.pubsub.credentials: %v", err)
+	}
+	if key.Type != "service_account" || key.ClientEmail == "" || key.PrivateKey == "" {
+		return nil, fmt.Errorf("broker.pubsub.credentials is not a service account key")
+	}
+
+	config := &jwt.Config{
+		Email:        key.ClientEmail,
+		PrivateKey:   []byte(key.PrivateKey),
+		PrivateKeyID: key.PrivateKeyID,
+		Scopes:       []string{pubsubScope},
+		TokenURL:     key.TokenURI,
+	}
+	if config.TokenURL == "" {
+		config.TokenURL = "https://oauth2.googleapis.com/token"
+	}
+
+	// The tokens are fetched with the same TLS and proxy settings
+	ctx := context.WithValue(context.Background(), oauth2.HTTPClient, brokerHTTPClient(c, tlsConfig))
+	return config.Client(ctx), nil
+}
+
+// pubsubTopicURL returns the REST resource of the topic
+func pubsubTopicURL(p pubsubConfig) string {
+	return fmt.Sprintf("%s/v1/projects/%s/topics/%s", p.endpoint, p.project, p.topic)
+}
+
+// checkPubSub verifies that the topic exists and can be reached
+func checkPubSub(c BrokerConfig, tlsConfig *tls.Config) error {
+	client, err := newPubSubClient(c, tlsConfig)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), c.pubsub.timeout)
+	defer cancel()
+	r, err := http.NewRequestWithContext(ctx, http.MethodGet, pubsubTopicURL(c.pubsub), nil)
+	if err != nil {
+		return err
+	}
+	response, err := client.Do(r)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return fmt.Errorf("pubsub topic %s: %s", c.pubsub.topic, response.Status)
+	}
+	return nil
+}
+
+// SendMessage publishes the event and waits for Pub/Sub to store it
+func (m *PubSubMessenger) SendMessage(message Event) error {
+	body, err := m.format.encode(message)
+	if err != nil {
+		return err
+	}
+
+	corrID, _ := uuid.NewRandom()
+
+	msg := pubsubMessage{Data: body, Attributes: eventAttributes(message, corrID.String(), m.format)}
+	switch m.orderingKey {
+	case kafkaKeyUser:
+		msg.OrderingKey = message.Username
+	case kafkaKeyFilepath:
+		msg.OrderingKey = message.Filepath
+	}
+
+	request, err := json.Marshal(map[string][]pubsubMessage{"messages": {msg}})
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), m.timeout)
+	defer cancel()
+	r, err := http.NewRequestWithContext(ctx, http.MethodPost, m.topicURL+":publish", bytes.NewReader(request))
+	if err != nil {
+		return err
+	}
+	r.Header.Set("Content-Type", "application/json")
+
+	response, err := m.client.Do(r)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	responseBody, _ := io.ReadAll(io.LimitReader(response.Body, 64*1024))
+	if response.StatusCode != http.StatusOK {
+		return fmt.Errorf("pubsub publish: %s: %s", response.Status, strings.TrimSpace(string(responseBody)))
+	}
+	var published struct {
+		MessageIds []string `json:"messageIds"`
+	}
+	if err := json.Unmarshal(responseBody, &published); err != nil || len(published.MessageIds) != 1 {
+		return fmt.Errorf("pubsub publish: unexpected response %q", responseBody)
+	}
+	log.Debugf("event published to %s as %s", m.topicURL, published.MessageIds[0])
+	return nil
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPubSubMessenger_SendMessage(t *testing.T) {
+	var published []pubsubMessage
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/projects/archive/topics/inbox:publish" {
+			http.Error(w, `{"error": {"status": "NOT_FOUND"}}`, http.StatusNotFound)
+			return
+		}
+		var request struct {
+			Messages []pubsubMessage `json:"messages"`
+		}
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&request))
+		published = append(published, request.Messages...)
+		_, _ = w.Write([]byte(`{"messageIds": ["1"]}`))
+	}))
+	defer ts.Close()
+
+	config := pubsubConfig{endpoint: ts.URL, project: "archive", topic: "inbox"}
+	m := &PubSubMessenger{client: ts.Client(), topicURL: pubsubTopicURL(config), orderingKey: kafkaKeyUser, timeout: time.Second}
+
+	event := Event{Operation: "upload", Username: "user", Filepath: "user/file.c4gh", Filesize: 10, RequestID: "abc"}
+	assert.NoError(t, m.SendMessage(event))
+	if assert.Len(t, published, 1) {
+		msg := published[0]
+		assert.Equal(t, "user", msg.OrderingKey)
+		assert.Equal(t, "abc", msg.Attributes["x-request-id"])
+		assert.NotEmpty(t, msg.Attributes["correlation-id"])
+
+		var sent Event
+		assert.NoError(t, json.Unmarshal(msg.Data, &sent))
+		assert.Equal(t, "user/file.c4gh", sent.Filepath)
+	}
+
+	m.orderingKey = kafkaKeyNone
+	assert.NoError(t, m.SendMessage(event))
+	if assert.Len(t, published, 2) {
+		assert.Empty(t, published[1].OrderingKey)
+	}
+
+	// Events the topic doesn't take are errors
+	m.topicURL = pubsubTopicURL(pubsubConfig{endpoint: ts.URL, project: "archive", topic: "missing"})
+	assert.Error(t, m.SendMessage(event))
+}
@@ -0,0 +1,429 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"reflect"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	consul "github.com/hashicorp/consul/api"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"go.etcd.io/etcd/api/v3/v3rpc/rpctypes"
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"go.uber.org/zap"
+	"google.golang.org/grpc/metadata"
+)
+
+// The configuration can also be kept in Consul or etcd, so the replicas of
+// the proxy at all the sites share it. The key holds a YAML document like
+// the configuration file, which is merged over the file, like
+//
+//	remote:
+//	  provider: "consul"
+//	  endpoint: "https://consul.example.org:8500"
+//	  key: "s3inbox/config"
+//
+// The environment and the flags still win over it. With remote.watchInterval
+// the key is read again that often. Changes of the log level and format, the
+// features, the overrides and backends, the headers and the limits of the
+// requests are applied right away, to the requests that come after, and the
+// others when the proxy is restarted.
+
+// liveSettings are the settings and sections a change of the remote
+// configuration applies to while the proxy runs, those after the log
+// settings by setting up the proxy again
+var liveSettings = []string{
+	"log.level", "log.format",
+	"features", "overrides", "backends",
+	"server.maxUploadSize", "server.allowedContentTypes", "server.forwardHeaders", "server.returnHeaders",
+	"server.renameWindow", "server.trustedProxies",
+	// the deprecated settings of the features
+	"server.downloads", "server.deletes", "server.resumeUploads", "server.detectDuplicates",
+}
+
+// liveSetting returns the setting or section of liveSettings the key is in,
+// empty if it is not applied while the proxy runs
+func liveSetting(key string) string {
+	for _, setting := range liveSettings {
+		if strings.EqualFold(key, setting) || strings.HasPrefix(strings.ToLower(key), strings.ToLower(setting)+".") {
+			return setting
+		}
+	}
+	return ""
+}
+
+// remoteConfig is the configuration document kept in Consul or etcd
+type remoteConfig struct {
+	provider string
+	endpoint string
+	key      string
+	// ACL token of Consul, or token of the user of etcd
+	token string
+	// user of etcd, authenticated with the password when the token is not set
+	user     string
+	password string
+	// how often the key is read again, zero only reads it at startup
+	watchInterval time.Duration
+	client        *http.Client
+
+	// the document last read and its settings
+	content  []byte
+	settings *viper.Viper
+	// the settings of the file with those of the document merged in, to
+	// tell the ones given in the environment or with flags apart
+	merged map[string]interface{}
+	// sets the proxy up again with the live settings, nil until the proxy
+	// runs
+	reload func() error
+}
+
+// loadedRemote is the remote configuration merged into the settings, nil
+// without one
+var loadedRemote *remoteConfig
+
+// applyRemoteConfig reads the configuration document of the remote section
+// and merges it over the configuration file
+func applyRemoteConfig() error {
+	loadedRemote = nil
+	if !viper.IsSet("remote.provider") {
+		return nil
+	}
+	remote, err := readRemoteConfig()
+	if err != nil {
+		return err
+	}
+	content, err := remote.fetch(context.Background())
+	if err != nil {
+		return err
+	}
+	if remote.settings, err = parseRemoteSettings(content); err != nil {
+		return fmt.Errorf("remote configuration %s: %v", remote.key, err)
+	}
+	remote.content = content
+
+	settings, err := fileSettings()
+	if err != nil {
+		return err
+	}
+	mergeSettings(settings, remote.settings.AllSettings())
+	if err := readSettings(settings); err != nil {
+		return fmt.Errorf("remote configuration %s: %v", remote.key, err)
+	}
+
+	remote.merged = settings
+	loadedRemote = remote
+	return nil
+}
+
+// readRemoteConfig reads the remote section of the configuration
+func readRemoteConfig() (*remoteConfig, error) {
+	r := &remoteConfig{
+		provider: strings.ToLower(viper.GetString("remote.provider")),
+		endpoint: strings.TrimSuffix(viper.GetString("remote.endpoint"), "/"),
+		key:      viper.GetString("remote.key"),
+		user:     viper.GetString("remote.user"),
+	}
+	if r.provider != "consul" && r.provider != "etcd" {
+		return nil, fmt.Errorf("remote.provider %q is not consul or etcd", r.provider)
+	}
+	if u, err := url.Parse(r.endpoint); err != nil || u.Scheme == "" || u.Host == "" {
+		return nil, fmt.Errorf("remote.endpoint %q is not a valid URL", r.endpoint)
+	}
+	if r.key == "" {
+		return nil, fmt.Errorf("remote.key not set")
+	}
+
+	secrets, err := readSecretsConfig()
+	if err != nil {
+		return nil, err
+	}
+	if r.token, _, err = readSecret("remote.token", secrets); err != nil {
+		return nil, err
+	}
+	if r.password, _, err = readSecret("remote.password", secrets); err != nil {
+		return nil, err
+	}
+	if r.user != "" && r.provider != "etcd" {
+		return nil, fmt.Errorf("remote.user is only used with etcd, Consul takes remote.token")
+	}
+
+	if viper.IsSet("remote.watchInterval") {
+		r.watchInterval = viper.GetDuration("remote.watchInterval")
+		if r.watchInterval < 0 {
+			return nil, fmt.Errorf("remote.watchInterval can not be negative")
+		}
+	}
+	timeout := 10 * time.Second
+	if viper.IsSet("remote.timeout") {
+		timeout = viper.GetDuration("remote.timeout")
+		if timeout <= 0 {
+			return nil, fmt.Errorf("remote.timeout must be positive")
+		}
+	}
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+	if viper.IsSet("remote.cacert") {
+		cacert, err := ioutil.ReadFile(viper.GetString("remote.cacert")) // #nosec this file comes from our configuration
+		if err != nil {
+			return nil, fmt.Errorf("remote.cacert: %v", err)
+		}
+		tlsConfig.RootCAs, _ = x509.SystemCertPool()
+		if tlsConfig.RootCAs == nil {
+			tlsConfig.RootCAs = x509.NewCertPool()
+		}
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(cacert) {
+			return nil, fmt.Errorf("remote.cacert: no certificates in %s", viper.GetString("remote.cacert"))
+		}
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+	r.client = &http.Client{Timeout: timeout, Transport: transport}
+	return r, nil
+}
+
+// parseRemoteSettings reads the settings of a configuration document
+func parseRemoteSettings(content []byte) (*viper.Viper, error) {
+	settings := viper.New()
+	settings.SetConfigType("yaml")
+	if err := settings.ReadConfig(bytes.NewReader(content)); err != nil {
+		return nil, err
+	}
+	return settings, nil
+}
+
+func (r *remoteConfig) String() string {
+	return r.provider + " key " + r.key
+}
+
+// fetch reads the configuration document
+func (r *remoteConfig) fetch(ctx context.Context) ([]byte, error) {
+	var content []byte
+	var err error
+	if r.provider == "consul" {
+		content, err = r.fetchConsul(ctx)
+	} else {
+		content, err = r.fetchEtcd(ctx)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the remote configuration from %s: %v", r, err)
+	}
+	return content, nil
+}
+
+// fetchConsul reads the key from the KV store of Consul
+func (r *remoteConfig) fetchConsul(ctx context.Context) ([]byte, error) {
+	client, err := consul.NewClient(&consul.Config{Address: r.endpoint, Token: r.token, HttpClient: r.client})
+	if err != nil {
+		return nil, err
+	}
+	pair, _, err := client.KV().Get(strings.TrimPrefix(r.key, "/"), (&consul.QueryOptions{}).WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	if pair == nil {
+		return nil, fmt.Errorf("no such key")
+	}
+	return pair.Value, nil
+}
+
+// fetchEtcd reads the key from etcd v3
+func (r *remoteConfig) fetchEtcd(ctx context.Context) ([]byte, error) {
+	config := clientv3.Config{
+		Endpoints:   []string{r.endpoint},
+		DialTimeout: r.client.Timeout,
+		Context:     ctx,
+		Username:    r.user,
+		Password:    r.password,
+		Logger:      zap.NewNop(),
+	}
+	if strings.HasPrefix(r.endpoint, "https://") {
+		config.TLS = r.client.Transport.(*http.Transport).TLSClientConfig
+	}
+	client, err := clientv3.New(config)
+	if err != nil {
+		return nil, err
+	}
+	defer client.Close()
+
+	ctx, cancel := context.WithTimeout(ctx, r.client.Timeout)
+	defer cancel()
+	if r.token != "" {
+		ctx = metadata.AppendToOutgoingContext(ctx, rpctypes.TokenFieldNameGRPC, r.token)
+	}
+	found, err := client.Get(ctx, r.key)
+	if err != nil {
+		return nil, err
+	}
+	if len(found.Kvs) == 0 {
+		return nil, fmt.Errorf("no such key")
+	}
+	return found.Kvs[0].Value, nil
+}
+
+// watch reads the configuration document every watchInterval until the
+// context is done, and applies the changes it can
+func (r *remoteConfig) watch(ctx context.Context) {
+	if r.watchInterval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(r.watchInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		content, err := r.fetch(ctx)
+		if err != nil {
+			log.Warn(err)
+			continue
+		}
+		if bytes.Equal(content, r.content) {
+			continue
+		}
+		settings, err := parseRemoteSettings(content)
+		if err != nil {
+			log.Warnf("remote configuration %s not applied: %v", r.key, err)
+			continue
+		}
+		r.apply(settings)
+		r.content = content
+	}
+}
+
+// apply changes the live settings to those of the new document, and tells
+// which other settings changed
+func (r *remoteConfig) apply(settings *viper.Viper) {
+	var level, format string
+	var live, restart []string
+	for _, key := range changedSettings(r.settings, settings) {
+		switch {
+		case r.local(key):
+		case key == "log.level":
+			level = settings.GetString(key)
+		case key == "log.format":
+			format = settings.GetString(key)
+		case liveSetting(key) != "":
+			live = append(live, key)
+		default:
+			restart = append(restart, key)
+		}
+	}
+	if len(live) > 0 {
+		if err := r.reloadSettings(settings); err != nil {
+			log.Warnf("remote configuration %s not applied: %v", r.key, err)
+			return
+		}
+		log.Infof("remote configuration %s changed %s", r.key, strings.Join(live, ", "))
+	}
+	if level != "" || format != "" {
+		if err := changeLogSettings(level, format); err != nil {
+			log.Warnf("remote configuration %s: %v", r.key, err)
+		}
+	}
+	if len(restart) > 0 {
+		log.Warnf("remote configuration %s changed %s, which apply when the proxy is restarted", r.key, strings.Join(restart, ", "))
+	}
+	r.settings = settings
+}
+
+// local tells if the setting is given in the environment or with a flag,
+// which wins over the document
+func (r *remoteConfig) local(key string) bool {
+	return !reflect.DeepEqual(viper.Get(key), settingValue(r.merged, key))
+}
+
+// reloadSettings merges the document over the configuration file again and
+// sets the proxy up with the settings, the settings stay as they were if
+// that fails
+func (r *remoteConfig) reloadSettings(settings *viper.Viper) error {
+	merged, err := fileSettings()
+	if err != nil {
+		return err
+	}
+	mergeSettings(merged, settings.AllSettings())
+	if err := readSettings(merged); err != nil {
+		return err
+	}
+	if r.reload != nil {
+		if err := r.reload(); err != nil {
+			_ = readSettings(r.merged)
+			return err
+		}
+	}
+	r.merged = merged
+	return nil
+}
+
+// changedSettings returns the settings that differ between the documents
+func changedSettings(old, new *viper.Viper) []string {
+	keys := map[string]bool{}
+	for _, key := range append(old.AllKeys(), new.AllKeys()...) {
+		keys[key] = true
+	}
+	var changed []string
+	for key := range keys {
+		if !reflect.DeepEqual(old.Get(key), new.Get(key)) {
+			changed = append(changed, key)
+		}
+	}
+	sort.Strings(changed)
+	return changed
+}
+
+// remoteSource tells if the setting comes from the remote configuration
+func remoteSource(key string) (string, bool) {
+	if loadedRemote == nil || !loadedRemote.settings.IsSet(key) {
+		return "", false
+	}
+	return "remote " + loadedRemote.provider, true
+}
+
+// settingValue returns the value of the setting in the settings, nil if it
+// is not there
+func settingValue(settings map[string]interface{}, key string) interface{} {
+	parts := strings.Split(key, ".")
+	for _, part := range parts[:len(parts)-1] {
+		section, ok := settingsSection(settings[part])
+		if !ok {
+			return nil
+		}
+		settings = section
+	}
+	return settings[parts[len(parts)-1]]
+}
+
+// liveProxy serves the requests with the proxy last set up, which changes
+// when the remote configuration does
+type liveProxy struct {
+	proxy atomic.Pointer[Proxy]
+}
+
+func (l *liveProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	l.proxy.Load().ServeHTTP(w, r)
+}
+
+// reloadProxy returns a proxy like the one given, with the live settings of
+// the configuration as it is now
+func reloadProxy(base *Proxy, tlsProxy *tls.Config) (*Proxy, error) {
+	config := &Config{}
+	if err := config.readConfig(); err != nil {
+		return nil, err
+	}
+	proxy := *base
+	proxy.overrides = nil
+	if err := configureProxy(&proxy, config, tlsProxy); err != nil {
+		return nil, err
+	}
+	return &proxy, nil
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"go.etcd.io/etcd/api/v3/etcdserverpb"
+	"go.etcd.io/etcd/api/v3/mvccpb"
+	"go.etcd.io/etcd/api/v3/v3rpc/rpctypes"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+// consulKV serves the document at the key like the KV store of Consul
+func consulKV(key, token string, document *string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Header.Get("X-Consul-Token") != token:
+			w.WriteHeader(http.StatusForbidden)
+		case r.URL.Path != "/v1/kv/"+key:
+			w.WriteHeader(http.StatusNotFound)
+		default:
+			w.Header().Set("Content-Type", "application/json")
+			_ = json.NewEncoder(w).Encode([]map[string]interface{}{{"Key": key, "Value": []byte(*document)}})
+		}
+	}))
+}
+
+// etcdKV serves the document at the key like etcd, to the user inbox with
+// the password secret
+type etcdKV struct {
+	etcdserverpb.UnimplementedKVServer
+	etcdserverpb.UnimplementedAuthServer
+	key      string
+	document string
+}
+
+func (e *etcdKV) Authenticate(ctx context.Context, r *etcdserverpb.AuthenticateRequest) (*etcdserverpb.AuthenticateResponse, error) {
+	if r.Name != "inbox" || r.Password != "secret" {
+		return nil, rpctypes.ErrGRPCAuthFailed
+	}
+	return &etcdserverpb.AuthenticateResponse{Header: &etcdserverpb.ResponseHeader{}, Token: "etcdtoken"}, nil
+}
+
+func (e *etcdKV) Range(ctx context.Context, r *etcdserverpb.RangeRequest) (*etcdserverpb.RangeResponse, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	if tokens := md.Get(rpctypes.TokenFieldNameGRPC); len(tokens) != 1 || tokens[0] != "etcdtoken" {
+		return nil, rpctypes.ErrGRPCPermissionDenied
+	}
+	response := &etcdserverpb.RangeResponse{Header: &etcdserverpb.ResponseHeader{}}
+	if string(r.Key) == e.key {
+		response.Kvs = []*mvccpb.KeyValue{{Key: r.Key, Value: []byte(e.document)}}
+		response.Count = 1
+	}
+	return response, nil
+}
+
+func (suite *TestSuite) TestConfigRemote() {
+	document := "aws:\n  region: \"eu-north-1\"\n"
+	consul := consulKV("s3inbox/config", "consultoken", &document)
+	defer consul.Close()
+
+	viper.Set("remote.provider", "consul")
+	viper.Set("remote.endpoint", consul.URL)
+	viper.Set("remote.key", "s3inbox/config")
+	viper.Set("remote.token", "consultoken")
+	config, err := NewConfig()
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), "eu-north-1", config.S3.region)
+	assert.Equal(suite.T(), "testbucket", config.S3.bucket, "settings of the flags win over the remote configuration")
+	source, ok := remoteSource("aws.region")
+	assert.True(suite.T(), ok)
+	assert.Equal(suite.T(), "remote consul", source)
+
+	viper.Set("remote.key", "s3inbox/other")
+	_, err = NewConfig()
+	assert.Error(suite.T(), err)
+
+	viper.Set("remote.provider", "zookeeper")
+	_, err = NewConfig()
+	assert.Error(suite.T(), err)
+}
+
+func TestRemoteConfig_etcd(t *testing.T) {
+	viper.Reset()
+	defer viper.Reset()
+	defer func() { loadedRemote = nil }()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	server := grpc.NewServer()
+	etcd := &etcdKV{key: "/s3inbox/config", document: "log:\n  level: \"debug\"\n"}
+	etcdserverpb.RegisterKVServer(server, etcd)
+	etcdserverpb.RegisterAuthServer(server, etcd)
+	go func() { _ = server.Serve(listener) }()
+	defer server.Stop()
+
+	viper.Set("remote.provider", "etcd")
+	viper.Set("remote.endpoint", "http://"+listener.Addr().String())
+	viper.Set("remote.key", "/s3inbox/config")
+	viper.Set("remote.user", "inbox")
+	viper.Set("remote.password", "secret")
+	viper.Set("remote.timeout", "2s")
+	assert.NoError(t, applyRemoteConfig())
+	assert.Equal(t, "debug", viper.GetString("log.level"))
+
+	// A token works as well as the user
+	viper.Set("remote.user", "")
+	viper.Set("remote.password", "")
+	viper.Set("remote.token", "etcdtoken")
+	assert.NoError(t, applyRemoteConfig())
+
+	viper.Set("remote.key", "/s3inbox/other")
+	assert.Error(t, applyRemoteConfig())
+
+	viper.Set("remote.key", "/s3inbox/config")
+	viper.Set("remote.token", "")
+	viper.Set("remote.user", "inbox")
+	viper.Set("remote.password", "wrong")
+	assert.Error(t, applyRemoteConfig())
+}
+
+func TestRemoteConfig_apply(t *testing.T) {
+	resetLogging(t)
+	viper.Reset()
+	defer func() { loadedRemote = nil }()
+	document := "log:\n  level: \"info\"\n  format: \"text\"\naws:\n  region: \"eu-north-1\"\n"
+	consul := consulKV("s3inbox/config", "", &document)
+	defer consul.Close()
+
+	viper.Set("remote.provider", "consul")
+	viper.Set("remote.endpoint", consul.URL)
+	viper.Set("remote.key", "s3inbox/config")
+	// Given with a flag, so it is not changed by the document
+	viper.Set("log.format", "json")
+	assert.NoError(t, applyRemoteConfig())
+	assert.False(t, loadedRemote.local("log.level"))
+	assert.True(t, loadedRemote.local("log.format"))
+
+	settings, err := parseRemoteSettings([]byte("log:\n  level: \"debug\"\n  format: \"json\"\naws:\n  region: \"eu-west-1\"\n"))
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"aws.region", "log.format", "log.level"}, changedSettings(loadedRemote.settings, settings))
+	loadedRemote.apply(settings)
+	assert.Equal(t, log.DebugLevel, log.GetLevel())
+	assert.Equal(t, "text", currentLogSettings().Format, "log.format is set with a flag")
+	assert.Equal(t, settings, loadedRemote.settings)
+
+	// The features and the other live settings set the proxy up again
+	reloaded := 0
+	loadedRemote.reload = func() error {
+		reloaded++
+		assert.True(t, viper.GetBool("features.deletes"))
+		return nil
+	}
+	settings, err = parseRemoteSettings([]byte("log:\n  level: \"debug\"\n  format: \"json\"\naws:\n  region: \"eu-west-1\"\nfeatures:\n  deletes: true\n"))
+	assert.NoError(t, err)
+	loadedRemote.apply(settings)
+	assert.Equal(t, 1, reloaded)
+	assert.Equal(t, settings, loadedRemote.settings)
+
+	// Nothing changes if the proxy can't be set up with them
+	loadedRemote.reload = func() error { return errors.New("overrides: no such backend") }
+	failed, err := parseRemoteSettings([]byte("features:\n  deletes: false\n"))
+	assert.NoError(t, err)
+	loadedRemote.apply(failed)
+	assert.True(t, viper.GetBool("features.deletes"))
+	assert.Equal(t, settings, loadedRemote.settings)
+}
+
+func TestLiveSetting(t *testing.T) {
+	assert.Equal(t, "features", liveSetting("features.deletes"))
+	assert.Equal(t, "server.maxUploadSize", liveSetting("server.maxuploadsize"))
+	assert.Equal(t, "overrides", liveSetting("overrides"))
+	assert.Equal(t, "", liveSetting("server.listen"))
+	assert.Equal(t, "", liveSetting("featuresx"))
+}
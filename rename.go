@@ -0,0 +1,127 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+// S3 has no rename, clients rename objects by copying them and deleting the
+// original. When renames are detected the upload event of a copy is held
+// back for a while, and if the source is deleted meanwhile a single rename
+// event is sent instead of the upload and remove events.
+
+// copySource returns the user's file that a CopyObject request copies from,
+// as user/key, and tells if the request is a copy
+func copySource(r *http.Request) (string, bool) {
+	source := r.Header.Get("X-Amz-Copy-Source")
+	if source == "" {
+		return "", false
+	}
+	source, _, _ = strings.Cut(strings.TrimPrefix(source, "/"), "?")
+	if unescaped, err := url.PathUnescape(source); err == nil {
+		source = unescaped
+	}
+	return source, true
+}
+
+// copySourceAllowed tells if the request copies from nothing or from one of
+// the user's own files, copies from elsewhere in the backend are refused
+func copySourceAllowed(r *http.Request) bool {
+	source, ok := copySource(r)
+	if !ok {
+		return true
+	}
+	username, key, found := strings.Cut(source, "/")
+	return found && key != "" && username == requestUser(r) &&
+		path.Clean("/"+source) == "/"+source
+}
+
+// scopeCopySource makes the copy source of a CopyObject refer to the file in
+// the backend bucket
+func scopeCopySource(r *http.Request, bucket string) {
+	if source := r.Header.Get("X-Amz-Copy-Source"); source != "" {
+		r.Header.Set("X-Amz-Copy-Source", "/"+bucket+"/"+strings.TrimPrefix(source, "/"))
+	}
+}
+
+// renameSource returns the file copied from by a request whose upload event
+// is held back as a possible rename
+func (p *Proxy) renameSource(r *http.Request) (string, bool) {
+	if !p.deletes || p.renameWindow <= 0 {
+		return "", false
+	}
+	source, ok := copySource(r)
+	if !ok {
+		return "", false
+	}
+	return strings.TrimPrefix(source, p.s3.bucket+"/"), true
+}
+
+// renameEvent turns the upload event of a copy into the rename event of the
+// deleted source
+func (p *Proxy) renameEvent(r *http.Request, copied Event, source string) Event {
+	event := copied
+	event.Operation = "rename"
+	event.OldPath = source
+	event.RequestID = requestID(r)
+	p.setSchema(&event)
+	requestLog(r).Info("user ", event.Username, " renamed file ", source, " to ", event.Filepath, " at ", time.Now())
+	return event
+}
+
+// heldCopy is the upload event of a copy waiting for its source to be
+// deleted
+type heldCopy struct {
+	event Event
+	timer *time.Timer
+}
+
+// copyTracker holds the upload events of copies by the file copied from
+type copyTracker struct {
+	lock   sync.Mutex
+	copies map[string]*heldCopy
+}
+
+func newCopyTracker() *copyTracker {
+	return &copyTracker{copies: make(map[string]*heldCopy)}
+}
+
+// hold keeps the upload event of a copy of the source, send gets it when the
+// source isn't deleted within the window. A copy of the same source that is
+// still held is sent right away.
+func (t *copyTracker) hold(source string, event Event, window time.Duration, send func(Event)) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if held, ok := t.copies[source]; ok && held.timer.Stop() {
+		go send(held.event)
+	}
+	held := &heldCopy{event: event}
+	held.timer = time.AfterFunc(window, func() {
+		t.lock.Lock()
+		if t.copies[source] == held {
+			delete(t.copies, source)
+		}
+		t.lock.Unlock()
+		send(event)
+	})
+	t.copies[source] = held
+}
+
+// take returns the held upload event of a copy of the source, which is no
+// longer sent on its own
+func (t *copyTracker) take(source string) (Event, bool) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	held, ok := t.copies[source]
+	if !ok || !held.timer.Stop() {
+		return Event{}, false
+	}
+	delete(t.copies, source)
+	return held.event, true
+}
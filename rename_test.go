@@ -0,0 +1,129 @@
+package main
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCopySourceAllowed(t *testing.T) {
+	for source, expected := range map[string]bool{
+		"":                             true,
+		"username/file":                true,
+		"/username/dir/file":           true,
+		"/username/my%20file":          true,
+		"username/file?versionId=abc":  true,
+		"otheruser/file":               false,
+		"username/":                    false,
+		"username":                     false,
+		"username/../otheruser/file":   false,
+		"username/%2E%2E/otheruser/fi": false,
+	} {
+		r, _ := http.NewRequest("PUT", "/username/copy", nil)
+		if source != "" {
+			r.Header.Set("X-Amz-Copy-Source", source)
+		}
+		assert.Equal(t, expected, copySourceAllowed(r), source)
+	}
+}
+
+func TestScopeCopySource(t *testing.T) {
+	r, _ := http.NewRequest("PUT", "/username/copy", nil)
+	r.Header.Set("X-Amz-Copy-Source", "/username/my%20file?versionId=abc")
+	scopeCopySource(r, "bucket")
+	assert.Equal(t, "/bucket/username/my%20file?versionId=abc", r.Header.Get("X-Amz-Copy-Source"))
+
+	r.Header.Del("X-Amz-Copy-Source")
+	scopeCopySource(r, "bucket")
+	assert.Equal(t, "", r.Header.Get("X-Amz-Copy-Source"))
+}
+
+func TestCopyTracker(t *testing.T) {
+	var lock sync.Mutex
+	var sent []Event
+	send := func(e Event) {
+		lock.Lock()
+		defer lock.Unlock()
+		sent = append(sent, e)
+	}
+
+	tracker := newCopyTracker()
+	tracker.hold("user/a", Event{Filepath: "user/b"}, time.Hour, send)
+	event, ok := tracker.take("user/a")
+	assert.True(t, ok)
+	assert.Equal(t, "user/b", event.Filepath)
+	_, ok = tracker.take("user/a")
+	assert.False(t, ok)
+
+	// A copy that isn't followed by a delete is sent as it is
+	tracker.hold("user/a", Event{Filepath: "user/c"}, time.Millisecond, send)
+	assert.Eventually(t, func() bool {
+		lock.Lock()
+		defer lock.Unlock()
+		return len(sent) == 1
+	}, time.Second, time.Millisecond)
+	assert.Equal(t, "user/c", sent[0].Filepath)
+	_, ok = tracker.take("user/a")
+	assert.False(t, ok)
+}
+
+func TestServeHTTP_rename(t *testing.T) {
+	var copySource string
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodPut:
+			copySource = r.Header.Get("X-Amz-Copy-Source")
+			w.WriteHeader(http.StatusOK)
+		case http.MethodDelete:
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			_, _ = w.Write([]byte("<ListBucketResult><Contents><Key>username/new</Key><ETag>&#34;abc&#34;</ETag><Size>5</Size></Contents></ListBucketResult>"))
+		}
+	}))
+	defer backend.Close()
+
+	s3conf := testS3Config(backend.URL)
+	messenger := NewMockMessenger()
+	proxy := NewProxy(s3conf, NewAlwaysAllow(), messenger, new(tls.Config))
+	proxy.deletes = true
+	proxy.renameWindow = time.Hour
+
+	r, _ := http.NewRequest("PUT", "/username/new", nil)
+	r.Header.Set("X-Amz-Copy-Source", "/username/old")
+	w := httptest.NewRecorder()
+	proxy.ServeHTTP(w, r)
+	assert.Equal(t, 200, w.Result().StatusCode)
+	assert.Equal(t, "/buckbuck/username/old", copySource)
+	assert.False(t, messenger.CheckAndRestore(), "the copy waits for a delete")
+
+	r, _ = http.NewRequest("DELETE", "/username/old", nil)
+	w = httptest.NewRecorder()
+	proxy.ServeHTTP(w, r)
+	assert.Equal(t, 204, w.Result().StatusCode)
+	if assert.NotNil(t, messenger.lastEvent) {
+		assert.Equal(t, "rename", messenger.lastEvent.Operation)
+		assert.Equal(t, "username/new", messenger.lastEvent.Filepath)
+		assert.Equal(t, "username/old", messenger.lastEvent.OldPath)
+	}
+	messenger.CheckAndRestore()
+
+	// Deleting it again is a plain remove
+	proxy.ServeHTTP(httptest.NewRecorder(), r)
+	if assert.NotNil(t, messenger.lastEvent) {
+		assert.Equal(t, "remove", messenger.lastEvent.Operation)
+	}
+
+	// Other users' files can't be copied
+	copySource = ""
+	r, _ = http.NewRequest("PUT", "/username/new", nil)
+	r.Header.Set("X-Amz-Copy-Source", "/otheruser/old")
+	w = httptest.NewRecorder()
+	proxy.ServeHTTP(w, r)
+	assert.Equal(t, 403, w.Result().StatusCode)
+	assert.Equal(t, "", copySource)
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"regexp"
+
+	"github.com/google/uuid"
+	log "github.com/sirupsen/logrus"
+)
+
+type requestIDKey struct{}
+
+// requestIDHeaders are where clients can pass the id of their request, so a
+// submission can be traced from the client through the pipeline
+var requestIDHeaders = []string{"X-Correlation-Id", "X-Request-Id"}
+
+// validRequestID is what ids taken from clients may look like, they end up
+// in logs and message headers
+var validRequestID = regexp.MustCompile(`^[A-Za-z0-9._:-]{1,128}$`)
+
+// withRequestID stores the id the client gave the request in the request
+// context, or generates a unique one if it gave none.
+func withRequestID(r *http.Request) *http.Request {
+	id := uuid.New().String()
+	for _, header := range requestIDHeaders {
+		if value := r.Header.Get(header); validRequestID.MatchString(value) {
+			id = value
+			break
+		}
+	}
+	return r.WithContext(context.WithValue(r.Context(), requestIDKey{}, id))
+}
+
+// requestID returns the id stored with withRequestID, or an empty string if
+// the request has none
+func requestID(r *http.Request) string {
+	id, _ := r.Context().Value(requestIDKey{}).(string)
+	return id
+}
+
+// requestLog returns a logger that tags all lines with the request id
+func requestLog(r *http.Request) *log.Entry {
+	return log.WithField("request_id", requestID(r))
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRequestID(t *testing.T) {
+	r, _ := http.NewRequest("GET", "/user/file", nil)
+	assert.Equal(t, "", requestID(r))
+
+	r1 := withRequestID(r)
+	r2 := withRequestID(r)
+	assert.Len(t, requestID(r1), 36)
+	assert.NotEqual(t, requestID(r1), requestID(r2))
+	assert.Equal(t, requestID(r1), requestLog(r1).Data["request_id"])
+}
+
+func TestRequestID_fromClient(t *testing.T) {
+	r, _ := http.NewRequest("GET", "/user/file", nil)
+	r.Header.Set("X-Request-Id", "portal-1234")
+	assert.Equal(t, "portal-1234", requestID(withRequestID(r)))
+
+	r.Header.Set("X-Correlation-Id", "submission.42")
+	assert.Equal(t, "submission.42", requestID(withRequestID(r)))
+
+	// Ids that don't look like ids are replaced
+	r.Header.Del("X-Request-Id")
+	r.Header.Set("X-Correlation-Id", "bad id\n")
+	assert.Len(t, requestID(withRequestID(r)), 36)
+}
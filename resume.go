@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"encoding/xml"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// initiateMultipartUploadResult is the response to CreateMultipartUpload
+type initiateMultipartUploadResult struct {
+	XMLName  xml.Name `xml:"http://s3.amazonaws.com/doc/2006-03-01/ InitiateMultipartUploadResult"`
+	Bucket   string   `xml:"Bucket"`
+	Key      string   `xml:"Key"`
+	UploadID string   `xml:"UploadId"`
+}
+
+// initiatesMultipart tells if the request is a CreateMultipartUpload
+func initiatesMultipart(r *http.Request) bool {
+	_, ok := r.URL.Query()["uploads"]
+	return r.Method == http.MethodPost && ok
+}
+
+// resumeUpload answers a CreateMultipartUpload with the latest multipart
+// upload of the same key that is still in progress, if there is one, so
+// interrupted transfers continue where they stopped. The parts uploaded so
+// far are listed in the X-Resumed-Parts header, clients can also get them
+// with ListParts. It tells if the request was answered.
+//
+// The resumed upload keeps the Content-Type it was started with. Settings
+// the backend can't be asked about before the upload is completed, like
+// metadata, tagging or object lock, can't be compared, so requests with
+// any of them always start a new upload.
+func (p *Proxy) resumeUpload(w http.ResponseWriter, r *http.Request) bool {
+	key := strings.TrimPrefix(r.URL.Path, "/")
+	_, objectKey, ok := strings.Cut(key, "/")
+	if !ok || objectKey == "" || hasUploadSettings(r.Header) {
+		return false
+	}
+
+	upload, err := p.inProgressUpload(r.Context(), key)
+	if err != nil {
+		requestLog(r).Errorf("failed to look for uploads to resume: %v", err)
+		return false
+	}
+	if upload == nil {
+		return false
+	}
+
+	parts, err := p.uploadedParts(r.Context(), key, aws.ToString(upload.UploadId))
+	if err != nil {
+		requestLog(r).Errorf("failed to list parts of upload %s: %v", aws.ToString(upload.UploadId), err)
+		return false
+	}
+
+	result := initiateMultipartUploadResult{
+		Bucket:   requestUser(r),
+		Key:      objectKey,
+		UploadID: aws.ToString(upload.UploadId),
+	}
+	body, err := xml.Marshal(result)
+	if err != nil {
+		requestLog(r).Errorf("failed to encode resumed upload: %v", err)
+		return false
+	}
+
+	requestLog(r).Infof("resuming upload %s of %s with %d parts", result.UploadID, key, len(parts))
+	w.Header().Set("Content-Type", "application/xml")
+	w.Header().Set("X-Resumed-Parts", strings.Join(parts, ","))
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write([]byte(xml.Header))
+	_, _ = w.Write(body)
+	return true
+}
+
+// uploadSettingHeaders are the prefixes of headers that set properties of
+// the object created by an upload
+var uploadSettingHeaders = []string{
+	"X-Amz-Meta-",
+	"X-Amz-Tagging",
+	"X-Amz-Object-Lock-",
+	"X-Amz-Server-Side-Encryption",
+	"X-Amz-Storage-Class",
+	"X-Amz-Website-Redirect-Location",
+	"X-Amz-Acl",
+	"X-Amz-Grant-",
+}
+
+// hasUploadSettings tells if the headers set properties of the uploaded
+// object beyond its content type
+func hasUploadSettings(header http.Header) bool {
+	for name := range header {
+		for _, prefix := range uploadSettingHeaders {
+			if strings.HasPrefix(http.CanonicalHeaderKey(name), prefix) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// inProgressUpload returns the most recently initiated multipart upload of
+// the key that is neither completed nor aborted, or nil
+func (p *Proxy) inProgressUpload(ctx context.Context, key string) (*types.MultipartUpload, error) {
+	ctx, cancel := s3Context(ctx, p.s3)
+	defer cancel()
+	client := p.newS3ReadClient()
+
+	var latest *types.MultipartUpload
+	input := &s3.ListMultipartUploadsInput{
+		Bucket: aws.String(p.s3.bucket),
+		Prefix: aws.String(key),
+	}
+	for {
+		result, err := client.ListMultipartUploads(ctx, input)
+		if err != nil {
+			return nil, err
+		}
+		for i, upload := range result.Uploads {
+			if aws.ToString(upload.Key) != key || upload.Initiated == nil {
+				continue
+			}
+			if latest == nil || upload.Initiated.After(*latest.Initiated) {
+				latest = &result.Uploads[i]
+			}
+		}
+		if !aws.ToBool(result.IsTruncated) {
+			return latest, nil
+		}
+		input.KeyMarker = result.NextKeyMarker
+		input.UploadIdMarker = result.NextUploadIdMarker
+	}
+}
+
+// uploadedParts returns the numbers of the parts uploaded so far
+func (p *Proxy) uploadedParts(ctx context.Context, key, uploadID string) ([]string, error) {
+	ctx, cancel := s3Context(ctx, p.s3)
+	defer cancel()
+
+	parts := []string{}
+	paginator := s3.NewListPartsPaginator(p.newS3ReadClient(), &s3.ListPartsInput{
+		Bucket:   aws.String(p.s3.bucket),
+		Key:      aws.String(key),
+		UploadId: aws.String(uploadID),
+	})
+	for paginator.HasMorePages() {
+		result, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for _, part := range result.Parts {
+			parts = append(parts, strconv.Itoa(int(aws.ToInt32(part.PartNumber))))
+		}
+	}
+	return parts, nil
+}
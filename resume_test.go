@@ -0,0 +1,70 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestResumeUpload(t *testing.T) {
+	initiated := false
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == http.MethodPost:
+			initiated = true
+			fmt.Fprint(w, "<InitiateMultipartUploadResult><UploadId>new</UploadId></InitiateMultipartUploadResult>")
+		case r.URL.Query().Get("uploadId") == "latest":
+			fmt.Fprint(w, "<ListPartsResult><IsTruncated>false</IsTruncated><Part><PartNumber>1</PartNumber></Part><Part><PartNumber>2</PartNumber></Part></ListPartsResult>")
+		case r.URL.Query().Get("prefix") == "username/file":
+			fmt.Fprint(w, `<ListMultipartUploadsResult><IsTruncated>false</IsTruncated>
+<Upload><Key>username/file</Key><UploadId>older</UploadId><Initiated>2021-06-01T10:00:00.000Z</Initiated></Upload>
+<Upload><Key>username/file</Key><UploadId>latest</UploadId><Initiated>2021-06-02T10:00:00.000Z</Initiated></Upload>
+<Upload><Key>username/file2</Key><UploadId>other</UploadId><Initiated>2021-06-03T10:00:00.000Z</Initiated></Upload>
+</ListMultipartUploadsResult>`)
+		default:
+			fmt.Fprint(w, "<ListMultipartUploadsResult><IsTruncated>false</IsTruncated></ListMultipartUploadsResult>")
+		}
+	}))
+	defer backend.Close()
+
+	s3conf := testS3Config(backend.URL)
+	proxy := NewProxy(s3conf, NewAlwaysAllow(), NewMockMessenger(), new(tls.Config))
+	proxy.resumeUploads = true
+
+	r, _ := http.NewRequest("POST", "/username/file?uploads", nil)
+	w := httptest.NewRecorder()
+	proxy.ServeHTTP(w, r)
+	assert.Equal(t, 200, w.Code)
+	assert.False(t, initiated, "upload in progress should be resumed")
+	assert.Contains(t, w.Body.String(), "<Bucket>username</Bucket><Key>file</Key><UploadId>latest</UploadId>")
+	assert.Equal(t, "1,2", w.Header().Get("X-Resumed-Parts"))
+
+	// Uploads with settings that can't be compared start a new upload
+	r, _ = http.NewRequest("POST", "/username/file?uploads", nil)
+	r.Header.Set("X-Amz-Meta-Origin", "sequencer")
+	w = httptest.NewRecorder()
+	proxy.ServeHTTP(w, r)
+	assert.Equal(t, 200, w.Code)
+	assert.True(t, initiated)
+	assert.Equal(t, "", w.Header().Get("X-Resumed-Parts"))
+
+	// and so do requests without an object key
+	initiated = false
+	r, _ = http.NewRequest("POST", "/username?uploads", nil)
+	w = httptest.NewRecorder()
+	assert.NotPanics(t, func() { proxy.ServeHTTP(w, r) })
+	assert.Equal(t, "", w.Header().Get("X-Resumed-Parts"))
+
+	// Without an upload in progress a new one is started
+	initiated = false
+	r, _ = http.NewRequest("POST", "/username/file3?uploads", nil)
+	w = httptest.NewRecorder()
+	proxy.ServeHTTP(w, r)
+	assert.Equal(t, 200, w.Code)
+	assert.True(t, initiated)
+	assert.Equal(t, "", w.Header().Get("X-Resumed-Parts"))
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+var eventsLost = prometheus.NewCounter(prometheus.CounterOpts{
+	Name: "s3proxy_events_lost_total",
+	Help: "Number of events that could not be sent, spooled or queued, and are lost.",
+})
+
+func init() {
+	prometheus.MustRegister(eventsLost)
+}
+
+// retryConfig stores how sending an event is retried
+type retryConfig struct {
+	// how many times sending is tried, 1 doesn't retry
+	attempts int
+	// wait before the first retry, it doubles for each one after it
+	backoff time.Duration
+}
+
+// readRetryConfig reads the broker.retry section of the configuration
+func readRetryConfig() (retryConfig, error) {
+	r := retryConfig{attempts: 1, backoff: time.Second}
+
+	if viper.IsSet("broker.retry.attempts") {
+		r.attempts = viper.GetInt("broker.retry.attempts")
+		if r.attempts < 1 {
+			return r, fmt.Errorf("broker.retry.attempts must be at least 1")
+		}
+	}
+	if viper.IsSet("broker.retry.backoff") {
+		r.backoff = viper.GetDuration("broker.retry.backoff")
+		if r.backoff <= 0 {
+			return r, fmt.Errorf("broker.retry.backoff must be positive")
+		}
+	}
+
+	return r, nil
+}
+
+// RetryingMessenger is a Messenger that tries sending an event again when
+// another messenger fails to, so a short broker hiccup doesn't lose the
+// event. The request waits while it retries.
+type RetryingMessenger struct {
+	next     Messenger
+	attempts int
+	backoff  time.Duration
+	// sleep waits between attempts, it is replaced in the tests
+	sleep func(time.Duration)
+}
+
+// NewRetryingMessenger wraps the messenger with retries
+func NewRetryingMessenger(next Messenger, c retryConfig) *RetryingMessenger {
+	return &RetryingMessenger{next: next, attempts: c.attempts, backoff: c.backoff, sleep: time.Sleep}
+}
+
+// SendMessage sends the event, trying again with backoff if it fails
+func (m *RetryingMessenger) SendMessage(message Event) error {
+	backoff := m.backoff
+	for attempt := 1; ; attempt++ {
+		err := m.next.SendMessage(message)
+		if err == nil || attempt >= m.attempts {
+			return err
+		}
+		log.WithField("request_id", message.RequestID).Warnf("sending event failed, retrying in %s: %v", backoff, err)
+		m.sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// sendEvent sends an event, one that can't be sent at all is lost and
+// logged as an error
+func (p *Proxy) sendEvent(event Event) {
+	if p.routingKey != "" {
+		event.RoutingKey = p.routingKey
+	}
+	p.audit.event(event)
+	if err := p.messenger.SendMessage(event); err != nil {
+		eventsLost.Inc()
+		log.WithField("request_id", event.RequestID).Errorf("event lost, error when sending message: %v", err)
+	}
+}
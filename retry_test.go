@@ -0,0 +1,61 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+// flakyMessenger fails the first sends
+type flakyMessenger struct {
+	recordingMessenger
+	failures int
+}
+
+func (m *flakyMessenger) SendMessage(message Event) error {
+	if m.failures > 0 {
+		m.failures--
+		return errors.New("broker hiccup")
+	}
+	return m.recordingMessenger.SendMessage(message)
+}
+
+func TestRetryingMessenger(t *testing.T) {
+	next := &flakyMessenger{failures: 2}
+	var waits []time.Duration
+	m := NewRetryingMessenger(next, retryConfig{attempts: 3, backoff: time.Second})
+	m.sleep = func(d time.Duration) { waits = append(waits, d) }
+
+	assert.NoError(t, m.SendMessage(Event{Operation: "upload", Username: "user", Filepath: "user/a.c4gh"}))
+	assert.Len(t, next.events, 1)
+	assert.Equal(t, []time.Duration{time.Second, 2 * time.Second}, waits, "the backoff doubles")
+
+	// The error of the last attempt is returned
+	next.failures = 3
+	assert.Error(t, m.SendMessage(Event{Operation: "upload", Username: "user", Filepath: "user/b.c4gh"}))
+	assert.Len(t, next.events, 1)
+}
+
+func TestServeHTTP_eventLost(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer backend.Close()
+
+	s3conf := testS3Config(backend.URL)
+	proxy := NewProxy(s3conf, NewAlwaysAllow(), &flakyMessenger{failures: 1}, new(tls.Config))
+	proxy.deletes = true
+
+	lost := testutil.ToFloat64(eventsLost)
+	r, _ := http.NewRequest("DELETE", "/username/file", nil)
+	w := httptest.NewRecorder()
+	proxy.ServeHTTP(w, r)
+	assert.Equal(t, 204, w.Result().StatusCode, "the request is done even if the event is lost")
+	assert.Equal(t, lost+1, testutil.ToFloat64(eventsLost))
+}
@@ -0,0 +1,293 @@
+package main
+
+import (
+	_ "embed"
+	"encoding/json"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"gopkg.in/yaml.v2"
+)
+
+// The JSON Schema of the configuration file is made from the example file,
+// which documents every setting: the settings, commented out or not, are
+// the properties, typed after their example values, and the comments
+// before them are their descriptions.
+
+//go:embed dev_utils/config.yaml
+var exampleConfig string
+
+// openSections are the sections whose settings are named by the operator,
+// the examples in them show what each of those is like
+var openSections = map[string]bool{
+	"backends":                 true,
+	"profiles":                 true,
+	"broker.exchangeArguments": true,
+	"broker.queueArguments":    true,
+	"broker.staticFields":      true,
+}
+
+// backendSettings are the settings of the aws section that the named
+// backends have of their own
+var backendSettings = []string{
+	"url", "bucket", "region", "readypath", "cacert", "clientCert", "clientKey",
+	"accessKey", "secretKey", "readAccessKey", "readSecretKey",
+}
+
+// schemaSetting is a line of the example file that holds a setting
+var schemaSetting = regexp.MustCompile(`^([A-Za-z0-9_-]+):(?:\s+(.*))?$`)
+
+// newSchemaCommand creates the schema command
+func newSchemaCommand() *cobra.Command {
+	return &cobra.Command{
+		Use:   "schema",
+		Short: "print the JSON Schema of the configuration file",
+		Args:  cobra.NoArgs,
+		RunE:  func(*cobra.Command, []string) error { return runSchema() },
+	}
+}
+
+// runSchema is the schema command, it prints the JSON Schema of the
+// configuration file
+func runSchema() error {
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(configSchema())
+}
+
+// configSchema returns the JSON Schema of the configuration file
+func configSchema() map[string]interface{} {
+	root := schemaObject("")
+	root["$schema"] = "https://json-schema.org/draft/2020-12/schema"
+	root["title"] = "s3inbox configuration"
+
+	// The path of the section of each indentation, the innermost last
+	type level struct {
+		indent int
+		path   []string
+	}
+	var levels []level
+	// sections that are lists of sections, like overrides
+	lists := map[string]bool{}
+	// The comment before settings describes those that follow it at the
+	// same indentation, as long as they are commented out or not like the
+	// first
+	var description []string
+	descriptionIndent := -1
+	descriptionCommented := false
+	afterSetting := false
+
+	for _, line := range strings.Split(exampleConfig, "\n") {
+		indent, text, commented, ok := exampleSetting(line)
+		if ok && strings.HasPrefix(text, "- ") {
+			// The first setting of a section in a list
+			text = strings.TrimPrefix(text, "- ")
+			indent += 2
+			for len(levels) > 0 && levels[len(levels)-1].indent >= indent {
+				levels = levels[:len(levels)-1]
+			}
+			if len(levels) > 0 {
+				lists[strings.Join(levels[len(levels)-1].path, ".")] = true
+			}
+		}
+		if !ok {
+			switch {
+			case strings.TrimSpace(line) == "":
+				description, descriptionIndent = nil, -1
+			case strings.HasPrefix(line, "#"):
+				// A new comment after settings describes the next ones
+				if afterSetting {
+					description, descriptionIndent = nil, -1
+				}
+				description = append(description, strings.TrimSpace(strings.TrimPrefix(line, "#")))
+			}
+			afterSetting = false
+			continue
+		}
+		match := schemaSetting.FindStringSubmatch(text)
+		if match == nil {
+			continue
+		}
+		afterSetting = true
+
+		for len(levels) > 0 && levels[len(levels)-1].indent >= indent {
+			levels = levels[:len(levels)-1]
+		}
+		var path []string
+		if len(levels) > 0 {
+			path = append(path, levels[len(levels)-1].path...)
+		}
+		path = append(path, match[1])
+
+		var property map[string]interface{}
+		if match[2] == "" {
+			property = schemaObject(strings.Join(path, "."))
+			levels = append(levels, level{indent, path})
+		} else {
+			property = schemaValue(match[2])
+		}
+		if descriptionIndent < 0 {
+			descriptionIndent, descriptionCommented = indent, commented
+		}
+		if indent == descriptionIndent && commented != descriptionCommented {
+			description = nil
+		}
+		if len(description) > 0 && indent == descriptionIndent {
+			property["description"] = strings.Join(description, " ")
+		}
+		addSchemaProperty(root, path, property)
+	}
+
+	for _, setting := range secretSettings {
+		path := strings.Split(setting, ".")
+		addSchemaProperty(root, path, map[string]interface{}{"type": "string"})
+		for _, variant := range []string{"File", "Secret"} {
+			variantPath := append(append([]string{}, path[:len(path)-1]...), path[len(path)-1]+variant)
+			addSchemaProperty(root, variantPath, map[string]interface{}{"type": "string"})
+		}
+	}
+
+	for list := range lists {
+		path := strings.Split(list, ".")
+		section := schemaProperties(root, path[:len(path)-1]...)
+		items := section[path[len(path)-1]].(map[string]interface{})
+		array := map[string]interface{}{"type": "array", "items": items}
+		if description, ok := items["description"]; ok {
+			array["description"] = description
+			delete(items, "description")
+		}
+		section[path[len(path)-1]] = array
+	}
+
+	// The named backends have some of the settings of the aws section
+	aws := schemaProperties(root, "aws")
+	backend := schemaObject("backends.*")
+	for _, name := range backendSettings {
+		for _, variant := range []string{"", "File", "Secret"} {
+			if property, ok := aws[name+variant]; ok {
+				backend["properties"].(map[string]interface{})[name+variant] = property
+			}
+		}
+	}
+	if backends, ok := schemaProperties(root)["backends"].(map[string]interface{}); ok {
+		backends["additionalProperties"] = backend
+		delete(backends, "properties")
+	}
+	// Profiles hold any of the settings, over the rest of the file
+	if profiles, ok := schemaProperties(root)["profiles"].(map[string]interface{}); ok {
+		profiles["additionalProperties"] = map[string]interface{}{
+			"type":       "object",
+			"properties": map[string]interface{}{"extends": map[string]interface{}{"type": "string"}},
+		}
+		delete(profiles, "properties")
+	}
+	return root
+}
+
+// exampleSetting returns the indentation and text of a line of the example
+// file that holds a setting, and if it is commented out. Comments describing
+// the settings start the line with "# ".
+func exampleSetting(line string) (int, string, bool, bool) {
+	trimmed := strings.TrimLeft(line, " ")
+	indent := len(line) - len(trimmed)
+	switch {
+	case trimmed == "":
+		return 0, "", false, false
+	case !strings.HasPrefix(trimmed, "#"):
+		return indent, trimmed, false, true
+	case indent == 0:
+		// Commented out sections, like #log:
+		text := strings.TrimPrefix(trimmed, "#")
+		if text == "" || strings.HasPrefix(text, " ") {
+			return 0, "", false, false
+		}
+		return 0, text, true, true
+	}
+	// Commented out settings, indented like they would be
+	text := strings.TrimPrefix(trimmed, "#")
+	setting := strings.TrimLeft(text, " ")
+	return len(text) - len(setting), setting, true, true
+}
+
+// schemaObject returns the schema of a section, the open ones take any
+// name for their settings
+func schemaObject(path string) map[string]interface{} {
+	if openSections[path] {
+		return map[string]interface{}{"type": "object", "properties": map[string]interface{}{}}
+	}
+	return map[string]interface{}{
+		"type":                 "object",
+		"properties":           map[string]interface{}{},
+		"additionalProperties": false,
+	}
+}
+
+// schemaValue returns the schema of a setting, typed after its example
+func schemaValue(example string) map[string]interface{} {
+	var value interface{}
+	if err := yaml.Unmarshal([]byte(example), &value); err != nil {
+		return map[string]interface{}{"type": "string"}
+	}
+	return map[string]interface{}{"type": schemaType(value)}
+}
+
+// schemaType returns the JSON Schema type of a value. Quoted values of other
+// types, like ssl: "true", can be given as either.
+func schemaType(value interface{}) interface{} {
+	switch v := value.(type) {
+	case bool:
+		return "boolean"
+	case int, int64, uint64:
+		return "integer"
+	case float64:
+		return "number"
+	case []interface{}:
+		return "array"
+	case map[interface{}]interface{}:
+		return "object"
+	case string:
+		var unquoted interface{}
+		if err := yaml.Unmarshal([]byte(v), &unquoted); err == nil {
+			switch unquoted.(type) {
+			case bool, int, int64, uint64, float64:
+				return []string{"string", schemaType(unquoted).(string)}
+			}
+		}
+	}
+	return "string"
+}
+
+// schemaProperties returns the properties of the section at the path
+func schemaProperties(schema map[string]interface{}, path ...string) map[string]interface{} {
+	properties, _ := schema["properties"].(map[string]interface{})
+	for _, name := range path {
+		section, _ := properties[name].(map[string]interface{})
+		properties, _ = section["properties"].(map[string]interface{})
+	}
+	return properties
+}
+
+// addSchemaProperty adds the property at the path, keeping the description
+// and properties of a setting that is already there
+func addSchemaProperty(root map[string]interface{}, path []string, property map[string]interface{}) {
+	properties := schemaProperties(root, path[:len(path)-1]...)
+	if properties == nil {
+		return
+	}
+	name := path[len(path)-1]
+	if existing, ok := properties[name].(map[string]interface{}); ok {
+		if _, section := existing["properties"]; section {
+			// A section mentioned again keeps its settings
+			if _, ok := existing["description"]; !ok && property["description"] != nil {
+				existing["description"] = property["description"]
+			}
+			return
+		}
+		if _, ok := property["description"]; !ok && existing["description"] != nil {
+			property["description"] = existing["description"]
+		}
+	}
+	properties[name] = property
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// schemaHas tells if the setting is a property of the schema
+func schemaHas(schema map[string]interface{}, setting string) bool {
+	path := strings.Split(setting, ".")
+	properties := schemaProperties(schema, path[:len(path)-1]...)
+	_, ok := properties[path[len(path)-1]]
+	return ok
+}
+
+func TestConfigSchema(t *testing.T) {
+	schema := configSchema()
+	assert.Equal(t, false, schema["additionalProperties"])
+
+	features := schemaProperties(schema, "features")
+	assert.Equal(t, map[string]interface{}{
+		"type":        "boolean",
+		"description": "Reject uploads that don't start like a Crypt4GH file, checked on single uploads and the first part of multipart uploads",
+	}, features["strictCrypt4gh"])
+	assert.Equal(t, []string{"string", "boolean"}, schemaProperties(schema, "broker")["ssl"].(map[string]interface{})["type"])
+	assert.Equal(t, "array", schemaProperties(schema, "server")["listen"].(map[string]interface{})["type"])
+	assert.True(t, schemaHas(schema, "secrets.ageKeySecret"))
+
+	backend := schemaProperties(schema)["backends"].(map[string]interface{})["additionalProperties"].(map[string]interface{})
+	assert.Contains(t, backend["properties"], "accessKeyFile")
+	assert.NotContains(t, backend["properties"], "timeout", "the named backends share the timeouts of the aws section")
+}
+
+// Settings read by the proxy must be in the example file, or the schema
+// rejects configurations using them
+func TestConfigSchema_allSettings(t *testing.T) {
+	schema := configSchema()
+	read := regexp.MustCompile(`viper\.(?:Get\w*|IsSet)\("([^"]+)"`)
+	files, err := filepath.Glob("*.go")
+	assert.NoError(t, err)
+	for _, file := range files {
+		if strings.HasSuffix(file, "_test.go") {
+			continue
+		}
+		content, err := ioutil.ReadFile(file)
+		assert.NoError(t, err)
+		for _, match := range read.FindAllStringSubmatch(string(content), -1) {
+			setting := strings.TrimSuffix(match[1], ".")
+			// These tell where the configuration file is
+			if setting == "server.confFile" || setting == "server.confPath" {
+				continue
+			}
+			assert.True(t, schemaHas(schema, setting), "%s, read in %s, is not in dev_utils/config.yaml", setting, file)
+		}
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// schemaRegistry registers the schema of the Avro or Protobuf events with a
+// Confluent compatible schema registry. The events then start with the id
+// of the schema, so consumers can look it up.
+type schemaRegistry struct {
+	url      string
+	subject  string
+	user     string
+	password string
+	client   *http.Client
+
+	lock sync.Mutex
+	// id of the schema, once it is registered
+	id         uint32
+	registered bool
+}
+
+// readSchemaRegistry reads the broker.schemaRegistry section, it returns
+// nil when there is no registry
+func readSchemaRegistry() (*schemaRegistry, error) {
+	if !viper.IsSet("broker.schemaRegistry.url") {
+		return nil, nil
+	}
+
+	r := &schemaRegistry{
+		url:      strings.TrimSuffix(viper.GetString("broker.schemaRegistry.url"), "/"),
+		subject:  "s3inbox-value",
+		user:     viper.GetString("broker.schemaRegistry.user"),
+		password: viper.GetString("broker.schemaRegistry.password"),
+		client:   &http.Client{Timeout: 10 * time.Second},
+	}
+	if !strings.HasPrefix(r.url, "http://") && !strings.HasPrefix(r.url, "https://") {
+		return nil, fmt.Errorf("broker.schemaRegistry.url: %q is not an http or https url", r.url)
+	}
+	if viper.IsSet("broker.schemaRegistry.subject") {
+		r.subject = viper.GetString("broker.schemaRegistry.subject")
+		if r.subject == "" {
+			return nil, fmt.Errorf("broker.schemaRegistry.subject can not be empty")
+		}
+	}
+	if viper.IsSet("broker.schemaRegistry.timeout") {
+		r.client.Timeout = viper.GetDuration("broker.schemaRegistry.timeout")
+		if r.client.Timeout <= 0 {
+			return nil, fmt.Errorf("broker.schemaRegistry.timeout must be positive")
+		}
+	}
+
+	return r, nil
+}
+
+// schemaID returns the id of the schema, it is registered under the subject
+// the first time. Registering a schema that is already there gives the id
+// it has.
+func (r *schemaRegistry) schemaID(schema, schemaType string) (uint32, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if r.registered {
+		return r.id, nil
+	}
+
+	request := map[string]string{"schema": schema}
+	if schemaType != "AVRO" {
+		request["schemaType"] = schemaType
+	}
+	body, err := json.Marshal(request)
+	if err != nil {
+		return 0, err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, r.url+"/subjects/"+url.PathEscape(r.subject)+"/versions", bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/vnd.schemaregistry.v1+json")
+	if r.user != "" {
+		req.SetBasicAuth(r.user, r.password)
+	}
+
+	response, err := r.client.Do(req)
+	if err != nil {
+		return 0, fmt.Errorf("schema registry: %v", err)
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		message, _ := ioutil.ReadAll(io.LimitReader(response.Body, 1024))
+		return 0, fmt.Errorf("schema registry: %s: %s", response.Status, strings.TrimSpace(string(message)))
+	}
+
+	var registered struct {
+		ID uint32 `json:"id"`
+	}
+	if err := json.NewDecoder(response.Body).Decode(&registered); err != nil {
+		return 0, fmt.Errorf("schema registry: %v", err)
+	}
+	log.Infof("event schema registered as %d under %s", registered.ID, r.subject)
+
+	r.id = registered.ID
+	r.registered = true
+	return r.id, nil
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSchemaRegistry(t *testing.T) {
+	requests := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		assert.Equal(t, "/subjects/inbox-value/versions", r.URL.Path)
+		user, password, _ := r.BasicAuth()
+		assert.Equal(t, "inbox", user)
+		assert.Equal(t, "secret", password)
+		var request map[string]string
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&request))
+		assert.Equal(t, protobufSchema, request["schema"])
+		assert.Equal(t, "PROTOBUF", request["schemaType"])
+		_, _ = w.Write([]byte(`{"id": 7}`))
+	}))
+	defer ts.Close()
+
+	registry := &schemaRegistry{url: ts.URL, subject: "inbox-value", user: "inbox", password: "secret", client: ts.Client()}
+	format := eventFormat{name: protobufFormat, registry: registry}
+	event := Event{Operation: "upload", Username: "u", Filepath: "u/f"}
+
+	// The events start with the schema id and the message indexes
+	body, err := format.encode(event)
+	assert.NoError(t, err)
+	assert.Equal(t, append([]byte{0, 0, 0, 0, 7, 0}, protobufEvent(event, nil)...), body)
+
+	_, err = format.encode(event)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, requests, "the schema is registered once")
+}
+
+func TestSchemaRegistry_error(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusConflict)
+		_, _ = w.Write([]byte(`{"error_code": 409, "message": "incompatible schema"}`))
+	}))
+	defer ts.Close()
+
+	registry := &schemaRegistry{url: ts.URL, subject: "inbox-value", client: ts.Client()}
+	_, err := eventFormat{name: avroFormat, registry: registry}.encode(Event{})
+	assert.ErrorContains(t, err, "incompatible schema")
+	assert.False(t, registry.registered, "it is tried again with the next event")
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// secretSettings are the settings that can be read from elsewhere instead,
+// named by the setting with File or Secret appended. A File, like a mounted
+// Kubernetes secret, is read again when it changes, so rotated secrets are
+// used without a restart. A Secret is the ARN of an AWS secret or parameter.
+var secretSettings = []string{"aws.accessKey", "aws.secretKey", "aws.readAccessKey", "aws.readSecretKey", "broker.password", "broker.signingKey", "secrets.ageKey", "remote.token", "remote.password", "reporting.dsn"}
+
+// secretSourceSet tells if the setting is one that is read from elsewhere,
+// and where is configured
+func secretSourceSet(setting string) bool {
+	for _, s := range secretSettings {
+		if strings.EqualFold(s, setting) {
+			return viper.IsSet(s+"File") || viper.IsSet(s+"Secret")
+		}
+	}
+	return false
+}
+
+// rotatingSecret is a secret read from outside the configuration, that may
+// change while the proxy runs
+type rotatingSecret interface {
+	// get returns the current secret
+	get() string
+	// reload reads the secret again, and tells if it changed
+	reload() (bool, error)
+	// String tells where the secret is from, for the logs
+	String() string
+}
+
+// readSecret reads the secret of the setting, from the file of its File
+// setting or the AWS secret of its Secret setting if there is one. Where it
+// is read from is returned for watching, it is nil when the secret is given
+// in the setting itself.
+func readSecret(setting string, secrets secretsConfig) (string, rotatingSecret, error) {
+	var sources []string
+	for _, name := range []string{setting, setting + "File", setting + "Secret"} {
+		if viper.IsSet(name) {
+			sources = append(sources, name)
+		}
+	}
+	if len(sources) > 1 {
+		return "", nil, fmt.Errorf("only one of %s can be set", strings.Join(sources, " and "))
+	}
+
+	var s rotatingSecret
+	switch {
+	case viper.IsSet(setting + "File"):
+		s = &secretFile{path: viper.GetString(setting + "File")}
+	case viper.IsSet(setting + "Secret"):
+		var err error
+		if s, err = newAWSSecret(viper.GetString(setting+"Secret"), secrets); err != nil {
+			return "", nil, fmt.Errorf("%sSecret: %v", setting, err)
+		}
+	default:
+		return viper.GetString(setting), nil, nil
+	}
+	if _, err := s.reload(); err != nil {
+		return "", nil, fmt.Errorf("%s: %v", sources[0], err)
+	}
+	return s.get(), s, nil
+}
+
+// secretFile is a secret kept in a file, that is read again when the file
+// changes
+type secretFile struct {
+	path    string
+	lock    sync.RWMutex
+	value   string
+	modTime time.Time
+}
+
+func (s *secretFile) String() string {
+	return s.path
+}
+
+// get returns the current secret
+func (s *secretFile) get() string {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.value
+}
+
+// reload reads the secret again if the file changed, and tells if it did.
+// The line ending editors and kubectl leave at the end is not part of it.
+func (s *secretFile) reload() (bool, error) {
+	info, err := os.Stat(s.path)
+	if err != nil {
+		return false, err
+	}
+	s.lock.RLock()
+	unchanged := info.ModTime().Equal(s.modTime)
+	s.lock.RUnlock()
+	if unchanged {
+		return false, nil
+	}
+
+	content, err := os.ReadFile(s.path)
+	if err != nil {
+		return false, err
+	}
+	value := strings.TrimRight(string(content), "\r\n")
+	// An empty file is most likely caught in the middle of an update
+	if value == "" {
+		return false, fmt.Errorf("%s is empty", s.path)
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	changed := value != s.value
+	s.value = value
+	s.modTime = info.ModTime()
+	return changed, nil
+}
+
+// keys returns the current access and secret key of the backend
+func (c S3Config) keys() (string, string) {
+	accessKey, secretKey := c.accessKey, c.secretKey
+	if c.accessKeySource != nil {
+		accessKey = c.accessKeySource.get()
+	}
+	if c.secretKeySource != nil {
+		secretKey = c.secretKeySource.get()
+	}
+	return accessKey, secretKey
+}
+
+// readOnly returns the configuration with the keys of the lookups that only
+// read from the backend, so the keys used for writing can be left out of
+// their permissions
+func (c S3Config) readOnly() S3Config {
+	if c.readAccessKey == "" {
+		return c
+	}
+	c.accessKey, c.secretKey = c.readAccessKey, c.readSecretKey
+	c.accessKeySource, c.secretKeySource = c.readAccessKeySource, c.readSecretKeySource
+	return c
+}
+
+// currentPassword returns the current password of the broker. The AMQP
+// messenger dials with it when it reconnects, Kafka and NATS keep the one
+// they connected with.
+func (c BrokerConfig) currentPassword() string {
+	if c.passwordSource != nil {
+		return c.passwordSource.get()
+	}
+	return c.password
+}
+
+// rotatingSecrets returns the secrets of the configuration that are read
+// from outside it
+func (c *Config) rotatingSecrets() []rotatingSecret {
+	var secrets []rotatingSecret
+	sources := []rotatingSecret{c.Broker.passwordSource}
+	for _, b := range append([]S3Config{c.S3}, c.backendList()...) {
+		sources = append(sources, b.accessKeySource, b.secretKeySource, b.readAccessKeySource, b.readSecretKeySource)
+	}
+	for _, s := range sources {
+		if s != nil {
+			secrets = append(secrets, s)
+		}
+	}
+	return secrets
+}
+
+// watchSecrets reads the secrets again every interval. It should be run as
+// a go routine, and returns when ctx is done.
+func watchSecrets(ctx context.Context, interval time.Duration, secrets []rotatingSecret) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		for _, s := range secrets {
+			// Keep using the old secret if the new one can't be read
+			changed, err := s.reload()
+			if err != nil {
+				log.Errorf("failed to reload secret %s: %v", s, err)
+				continue
+			}
+			if changed {
+				log.Infof("secret %s changed, using the new one", s)
+			}
+		}
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSecretFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "secret")
+	assert.NoError(t, os.WriteFile(path, []byte("first\n"), 0600))
+	s := &secretFile{path: path}
+	changed, err := s.reload()
+	assert.NoError(t, err)
+	assert.True(t, changed)
+	assert.Equal(t, "first", s.get())
+
+	changed, err = s.reload()
+	assert.NoError(t, err)
+	assert.False(t, changed, "the file is only read when it changes")
+
+	// A rotated secret is picked up
+	later := time.Now().Add(time.Minute)
+	assert.NoError(t, os.WriteFile(path, []byte("second"), 0600))
+	assert.NoError(t, os.Chtimes(path, later, later))
+	changed, err = s.reload()
+	assert.NoError(t, err)
+	assert.True(t, changed)
+	assert.Equal(t, "second", s.get())
+
+	// The old secret is kept while the file is empty
+	later = later.Add(time.Minute)
+	assert.NoError(t, os.WriteFile(path, nil, 0600))
+	assert.NoError(t, os.Chtimes(path, later, later))
+	_, err = s.reload()
+	assert.Error(t, err)
+	assert.Equal(t, "second", s.get())
+}
+
+func TestS3Credentials(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "secret-key")
+	assert.NoError(t, os.WriteFile(path, []byte("first"), 0600))
+	secretKey := &secretFile{path: path}
+	_, err := secretKey.reload()
+	assert.NoError(t, err)
+
+	provider := s3Credentials(S3Config{accessKey: "access", secretKeySource: secretKey})
+	credentials, err := provider.Retrieve(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, "access", credentials.AccessKeyID)
+	assert.Equal(t, "first", credentials.SecretAccessKey)
+
+	later := time.Now().Add(time.Minute)
+	assert.NoError(t, os.WriteFile(path, []byte("second"), 0600))
+	assert.NoError(t, os.Chtimes(path, later, later))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go watchSecrets(ctx, time.Millisecond, []rotatingSecret{secretKey})
+	assert.Eventually(t, func() bool {
+		credentials, err := provider.Retrieve(context.Background())
+		return err == nil && credentials.SecretAccessKey == "second"
+	}, time.Second, time.Millisecond)
+}
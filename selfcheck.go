@@ -0,0 +1,174 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+// startupCheck verifies that the S3 backend and the broker are usable, so
+// configuration problems stop the proxy at boot instead of failing the first
+// upload.
+func startupCheck(config *Config, tlsBroker *tls.Config) error {
+	for _, backend := range append([]S3Config{config.S3}, config.backendList()...) {
+		if err := checkS3Bucket(backend); err != nil {
+			return err
+		}
+		if err := checkS3Access(backend.readOnly()); err != nil {
+			return err
+		}
+	}
+	messenger, err := getMessengerType(config.Broker.messengerType)
+	if err != nil {
+		return err
+	}
+	if messenger.check == nil {
+		return nil
+	}
+	return messenger.check(config.Broker, tlsBroker)
+}
+
+// checkResult is the outcome of one of the checks of the check command
+type checkResult struct {
+	name string
+	err  error
+}
+
+// newCheckCommand creates the check command
+func newCheckCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "check",
+		Short: "check the configuration, TLS material, token keys, S3 backends and the broker, and exit",
+		Args:  cobra.NoArgs,
+	}
+	configFlags := addConfigFlags(cmd.Flags())
+	cmd.RunE = func(*cobra.Command, []string) error {
+		configFlags.apply()
+		return runCheck()
+	}
+	return cmd
+}
+
+// runCheck is the check command, it reads the configuration and checks the
+// TLS material, the keys of the tokens, the S3 backends and the broker
+// without serving. Every check is made and reported, and the command fails
+// if any of them did, to verify a deployment.
+func runCheck() error {
+	config, err := NewConfig()
+	if err != nil {
+		printCheckReport(os.Stdout, []checkResult{{"configuration", err}})
+		return fmt.Errorf("the configuration can not be read")
+	}
+	results := append([]checkResult{{"configuration", nil}}, runChecks(config)...)
+	printCheckReport(os.Stdout, results)
+
+	failed := 0
+	for _, r := range results {
+		if r.err != nil {
+			failed++
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d checks failed", failed, len(results))
+	}
+	log.Infof("the configuration works, bucket %s and the %s broker are usable", config.S3.bucket, config.Broker.messengerType)
+	return nil
+}
+
+// runChecks makes the checks of the check command, the connections are
+// only tried when the TLS material they need could be read
+func runChecks(config *Config) []checkResult {
+	var results []checkResult
+
+	tlsBroker, err := TLSConfigBroker(config)
+	results = append(results, checkResult{"broker TLS", err})
+	brokerTLS := err == nil
+
+	backends := map[string]S3Config{defaultBackend: config.S3}
+	for name, backend := range config.Backends {
+		backends[name] = backend
+	}
+	names := append([]string{defaultBackend}, config.backendNames()...)
+	for _, name := range names {
+		backend := backends[name]
+		if _, err := tlsConfigBackend(backend); err != nil {
+			results = append(results, checkResult{fmt.Sprintf("S3 backend %s TLS", name), err})
+			continue
+		}
+		err := checkS3Bucket(backend)
+		if err == nil {
+			err = checkS3Access(backend.readOnly())
+		}
+		results = append(results, checkResult{fmt.Sprintf("S3 backend %s, bucket %s", name, backend.bucket), err})
+	}
+
+	if config.Server.cert != "" && config.Server.key != "" {
+		_, err := NewCertReloader(config.Server.cert, config.Server.key)
+		results = append(results, checkResult{"server certificate", err})
+	}
+
+	auth, err := loadJWTKeys(config.Server)
+	if err == nil && len(auth.pubkeys) == 0 {
+		err = errors.New("no keys, every request would be rejected")
+	}
+	results = append(results, checkResult{"token keys", err})
+
+	if brokerTLS {
+		messenger, err := getMessengerType(config.Broker.messengerType)
+		if err == nil && messenger.check != nil {
+			err = messenger.check(config.Broker, tlsBroker)
+		}
+		results = append(results, checkResult{config.Broker.messengerType + " broker", err})
+	}
+
+	return results
+}
+
+// printCheckReport writes a line for each check, telling if it passed
+func printCheckReport(w io.Writer, results []checkResult) {
+	for _, r := range results {
+		if r.err != nil {
+			fmt.Fprintf(w, "FAIL  %s: %v\n", r.name, r.err)
+			continue
+		}
+		fmt.Fprintf(w, "ok    %s\n", r.name)
+	}
+}
+
+// checkS3Access lists the bucket, which needs both working credentials and
+// the permissions the proxy uses to look up uploaded files.
+func checkS3Access(config S3Config) error {
+	client := newS3Client(config, &http.Client{Transport: transportConfigS3(config)})
+	ctx, cancel := s3Context(context.Background(), config)
+	defer cancel()
+
+	_, err := client.ListObjectsV2(ctx, &s3.ListObjectsV2Input{
+		Bucket:  aws.String(config.bucket),
+		MaxKeys: aws.Int32(1),
+	})
+	if err != nil {
+		return errors.Errorf("can not list bucket %s at %s, check the S3 credentials and permissions: %v", config.bucket, config.url, err)
+	}
+	log.Debugf("bucket %s is accessible", config.bucket)
+	return nil
+}
+
+// checkBroker connects to the broker, which verifies that it can be reached
+// and accepts the credentials and vhost.
+func checkBroker(config BrokerConfig, tlsConfig *tls.Config) error {
+	connection, err := dialBroker(config, tlsConfig)
+	if err != nil {
+		return errors.Errorf("can not connect to broker at %s:%s: %v", config.host, config.port, err)
+	}
+	log.Debugf("broker %s:%s is reachable", config.host, config.port)
+	return connection.Close()
+}
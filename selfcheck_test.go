@@ -0,0 +1,83 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+func (suite *TestSuite) TestCheckS3Access() {
+	viper.Set("aws.url", ts.URL)
+	viper.Set("aws.bucket", "selfcheck")
+	config, err := NewConfig()
+	assert.NoError(suite.T(), err)
+
+	assert.Error(suite.T(), checkS3Access(config.S3), "missing bucket should fail")
+	assert.NoError(suite.T(), checkS3Bucket(config.S3))
+	assert.NoError(suite.T(), checkS3Access(config.S3))
+}
+
+func (suite *TestSuite) TestCheckBroker() {
+	viper.Set("broker.host", "127.0.0.1")
+	viper.Set("broker.port", 1)
+	config, err := NewConfig()
+	assert.NoError(suite.T(), err)
+
+	err = checkBroker(config.Broker, nil)
+	if assert.Error(suite.T(), err) {
+		assert.Contains(suite.T(), err.Error(), "127.0.0.1:1")
+	}
+}
+
+func (suite *TestSuite) TestStartupCheck() {
+	viper.Set("aws.url", ts.URL)
+	viper.Set("aws.bucket", "startupcheck")
+	viper.Set("broker.host", "127.0.0.1")
+	viper.Set("broker.port", 1)
+	config, err := NewConfig()
+	assert.NoError(suite.T(), err)
+
+	// The S3 checks pass, so it is the broker that fails
+	err = startupCheck(config, nil)
+	if assert.Error(suite.T(), err) {
+		assert.Contains(suite.T(), err.Error(), "broker")
+	}
+}
+
+func (suite *TestSuite) TestRunChecks() {
+	viper.Set("aws.url", ts.URL)
+	viper.Set("aws.bucket", "runchecks")
+	viper.Set("broker.host", "127.0.0.1")
+	viper.Set("broker.port", 1)
+	viper.Set("server.jwtpubkeypath", "dev_utils/keys")
+	config, err := NewConfig()
+	assert.NoError(suite.T(), err)
+
+	// Every check is made, the broker is the one that fails
+	results := runChecks(config)
+	failed := map[string]bool{}
+	for _, r := range results {
+		failed[r.name] = r.err != nil
+	}
+	assert.Equal(suite.T(), map[string]bool{
+		"broker TLS":                           false,
+		"S3 backend default, bucket runchecks": false,
+		"token keys":                           false,
+		"amqp broker":                          true,
+	}, failed)
+
+	var report strings.Builder
+	printCheckReport(&report, results)
+	assert.Contains(suite.T(), report.String(), "ok    token keys\n")
+	assert.Contains(suite.T(), report.String(), "FAIL  amqp broker: ")
+
+	viper.Set("server.jwtpubkeypath", "missing")
+	config, err = NewConfig()
+	assert.NoError(suite.T(), err)
+	for _, r := range runChecks(config) {
+		if r.name == "token keys" {
+			assert.Error(suite.T(), r.err)
+		}
+	}
+}
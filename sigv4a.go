@@ -0,0 +1,165 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"math/big"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/minio/minio-go/v6/pkg/s3utils"
+)
+
+// SigV4A is the asymmetric variant of SigV4 used for multi-region access
+// points, where one signature is valid in several regions. It signs the same
+// canonical request as SigV4 but with an ECDSA key derived from the secret key.
+const (
+	sigV4AAlgorithm  = "AWS4-ECDSA-P256-SHA256"
+	sigV4ADateFormat = "20060102T150405Z"
+)
+
+// sigV4AIgnoredHeaders are left out of the signature, the same as for SigV4
+var sigV4AIgnoredHeaders = map[string]bool{
+	"Authorization":  true,
+	"Content-Type":   true,
+	"Content-Length": true,
+	"User-Agent":     true,
+}
+
+// deriveSigV4AKey derives the signing key from the access key pair as
+// described by the SigV4A specification, using the NIST SP 800-108 KDF in
+// counter mode with HMAC-SHA256.
+func deriveSigV4AKey(accessKey, secretKey string) (*ecdsa.PrivateKey, error) {
+	curve := elliptic.P256()
+	nMinusTwo := new(big.Int).Sub(curve.Params().N, big.NewInt(2))
+
+	for counter := 1; counter <= 0xff; counter++ {
+		context := append([]byte(accessKey), byte(counter))
+
+		mac := hmac.New(sha256.New, []byte("AWS4A"+secretKey))
+		_ = binary.Write(mac, binary.BigEndian, int32(1))
+		mac.Write([]byte(sigV4AAlgorithm))
+		mac.Write([]byte{0x00})
+		mac.Write(context)
+		_ = binary.Write(mac, binary.BigEndian, int32(256))
+		candidate := new(big.Int).SetBytes(mac.Sum(nil))
+
+		if candidate.Cmp(nMinusTwo) < 0 {
+			key := new(ecdsa.PrivateKey)
+			key.Curve = curve
+			key.D = candidate.Add(candidate, big.NewInt(1))
+			key.X, key.Y = curve.ScalarBaseMult(key.D.Bytes())
+			return key, nil
+		}
+	}
+
+	return nil, errors.New("could not derive a SigV4A key from the credentials")
+}
+
+// sigV4AKeyCache keeps the key derived for an access key pair, so it is not
+// derived again for every request
+type sigV4AKeyCache struct {
+	lock      sync.Mutex
+	accessKey string
+	secretKey string
+	key       *ecdsa.PrivateKey
+}
+
+// get returns the key of the access key pair
+func (c *sigV4AKeyCache) get(accessKey, secretKey string) (*ecdsa.PrivateKey, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.key != nil && c.accessKey == accessKey && c.secretKey == secretKey {
+		return c.key, nil
+	}
+	key, err := deriveSigV4AKey(accessKey, secretKey)
+	if err != nil {
+		return nil, err
+	}
+	c.accessKey, c.secretKey, c.key = accessKey, secretKey, key
+	return key, nil
+}
+
+// signV4A signs the request with the key derived for the access key, for
+// the regions in the region set, "*" meaning all regions.
+func signV4A(r *http.Request, accessKey string, key *ecdsa.PrivateKey, regionSet string) (*http.Request, error) {
+	t := time.Now().UTC()
+	r.Header.Set("X-Amz-Date", t.Format(sigV4ADateFormat))
+	r.Header.Set("X-Amz-Region-Set", regionSet)
+
+	scope := t.Format("20060102") + "/s3/aws4_request"
+	signedHeaders, canonicalRequest := sigV4ACanonicalRequest(r)
+	digest := sha256.Sum256([]byte(sigV4AStringToSign(t, scope, canonicalRequest)))
+
+	signature, err := ecdsa.SignASN1(rand.Reader, key, digest[:])
+	if err != nil {
+		return nil, err
+	}
+
+	r.Header.Set("Authorization", sigV4AAlgorithm+" Credential="+accessKey+"/"+scope+
+		", SignedHeaders="+signedHeaders+", Signature="+hex.EncodeToString(signature))
+	return r, nil
+}
+
+func sigV4AStringToSign(t time.Time, scope, canonicalRequest string) string {
+	hash := sha256.Sum256([]byte(canonicalRequest))
+	return sigV4AAlgorithm + "\n" + t.Format(sigV4ADateFormat) + "\n" + scope + "\n" + hex.EncodeToString(hash[:])
+}
+
+// sigV4ACanonicalRequest returns the signed headers and the canonical request
+func sigV4ACanonicalRequest(r *http.Request) (string, string) {
+	headers := []string{"host"}
+	values := map[string][]string{}
+	for k, v := range r.Header {
+		if sigV4AIgnoredHeaders[http.CanonicalHeaderKey(k)] {
+			continue
+		}
+		headers = append(headers, strings.ToLower(k))
+		values[strings.ToLower(k)] = v
+	}
+	sort.Strings(headers)
+
+	host := r.Host
+	if host == "" {
+		host = r.URL.Host
+	}
+	values["host"] = []string{host}
+
+	var canonicalHeaders bytes.Buffer
+	for _, k := range headers {
+		trimmed := make([]string, len(values[k]))
+		for i, v := range values[k] {
+			trimmed[i] = strings.Join(strings.Fields(v), " ")
+		}
+		canonicalHeaders.WriteString(k + ":" + strings.Join(trimmed, ",") + "\n")
+	}
+
+	payloadHash := r.Header.Get("X-Amz-Content-Sha256")
+	if payloadHash == "" {
+		payloadHash = "UNSIGNED-PAYLOAD"
+	}
+
+	// The backend sorts and encodes the query the same way, the request
+	// itself is sent as it is
+	canonicalQuery := strings.Replace(r.URL.Query().Encode(), "+", "%20", -1)
+	signedHeaders := strings.Join(headers, ";")
+	return signedHeaders, strings.Join([]string{
+		r.Method,
+		s3utils.EncodePath(r.URL.Path),
+		canonicalQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/sha256"
+	"encoding/hex"
+	"math/big"
+	"net/http"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDeriveSigV4AKey(t *testing.T) {
+	// Test vector from the AWS SDK
+	key, err := deriveSigV4AKey("AKISORANDOMAASORANDOM", "q+jcrXGc+0zWN6uzclKVhvMmUsIfRPa4rlRandom")
+	assert.NoError(t, err)
+	x, _ := new(big.Int).SetString("15D242CEEBF8D8169FD6A8B5A746C41140414C3B07579038DA06AF89190FFFCB", 16)
+	y, _ := new(big.Int).SetString("515242CEDD82E94799482E4C0514B505AFCCF2C0C98D6A553BF539F424C5EC0", 16)
+	assert.Equal(t, 0, x.Cmp(key.X))
+	assert.Equal(t, 0, y.Cmp(key.Y))
+}
+
+func TestSignV4A(t *testing.T) {
+	r, _ := http.NewRequest("PUT", "http://mrap.accesspoint.s3-global.amazonaws.com/user/file?partNumber=1&uploadId=a+b", nil)
+	r.Header.Set("X-Amz-Content-Sha256", "UNSIGNED-PAYLOAD")
+	r.Header.Set("Content-Length", "5")
+
+	key, err := deriveSigV4AKey("AKISORANDOMAASORANDOM", "q+jcrXGc+0zWN6uzclKVhvMmUsIfRPa4rlRandom")
+	assert.NoError(t, err)
+	signed, err := signV4A(r, "AKISORANDOMAASORANDOM", key, "*")
+	assert.NoError(t, err)
+	assert.Equal(t, "*", signed.Header.Get("X-Amz-Region-Set"))
+	assert.Equal(t, "partNumber=1&uploadId=a+b", signed.URL.RawQuery, "the query is sent as it is")
+
+	auth := regexp.MustCompile(`^AWS4-ECDSA-P256-SHA256 Credential=AKISORANDOMAASORANDOM/(\d{8})/s3/aws4_request, SignedHeaders=([^,]+), Signature=([0-9a-f]+)$`).
+		FindStringSubmatch(signed.Header.Get("Authorization"))
+	if !assert.NotNil(t, auth) {
+		return
+	}
+	assert.Equal(t, "host;x-amz-content-sha256;x-amz-date;x-amz-region-set", auth[2])
+
+	// The signature verifies with the public key
+	date, _ := time.Parse(sigV4ADateFormat, signed.Header.Get("X-Amz-Date"))
+	_, canonicalRequest := sigV4ACanonicalRequest(signed)
+	digest := sha256.Sum256([]byte(sigV4AStringToSign(date, auth[1]+"/s3/aws4_request", canonicalRequest)))
+	assert.Contains(t, canonicalRequest, "\npartNumber=1&uploadId=a%20b\n")
+	signature, _ := hex.DecodeString(auth[3])
+	assert.True(t, ecdsa.VerifyASN1(&key.PublicKey, digest[:], signature))
+}
+
+func TestSigV4AKeyCache(t *testing.T) {
+	var cache sigV4AKeyCache
+	key, err := cache.get("access", "secret")
+	assert.NoError(t, err)
+	again, _ := cache.get("access", "secret")
+	assert.Same(t, key, again)
+
+	other, _ := cache.get("access", "other")
+	assert.NotEqual(t, 0, key.D.Cmp(other.D))
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+
+	"filippo.io/age"
+	"github.com/spf13/viper"
+)
+
+// Configuration files encrypted with sops (https://getsops.io) are
+// decrypted with the sops command when they are read, so the command must
+// be installed next to the proxy, or named with PROXY_SECRETS_SOPSCOMMAND.
+// sops finds the keys of the file itself, in KMS, with the
+// SOPS_AGE_KEY_FILE environment variable and so on, and is also handed the
+// age identities of secrets.ageKey or secrets.ageKeyKMS if they are not in
+// the encrypted file.
+
+// decryptSopsFile reads the configuration file again decrypted with sops,
+// if it was encrypted with sops
+func decryptSopsFile(v *viper.Viper) error {
+	// Every file sops encrypts has the MAC of its content
+	if !v.IsSet("sops.mac") {
+		return nil
+	}
+	command := viper.GetString("secrets.sopsCommand")
+	if command == "" {
+		command = "sops"
+	}
+	cmd := exec.Command(command, "--decrypt", "--input-type", "yaml", "--output-type", "yaml", v.ConfigFileUsed()) // #nosec the command is chosen by the operator
+	cmd.Env = os.Environ()
+	if key, err := readAgeKey(); err == nil && key != "" {
+		// Unless the identities are encrypted in the file too
+		if _, err := age.ParseIdentities(strings.NewReader(key)); err == nil {
+			cmd.Env = append(cmd.Env, "SOPS_AGE_KEY="+key)
+		}
+	}
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	decrypted, err := cmd.Output()
+	if err != nil {
+		return fmt.Errorf("%s is encrypted with sops, which failed to decrypt it: %v: %s", v.ConfigFileUsed(), err, bytes.TrimSpace(stderr.Bytes()))
+	}
+	return v.ReadConfig(bytes.NewReader(decrypted))
+}
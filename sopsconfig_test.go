@@ -0,0 +1,54 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+// sopsEncrypted is a configuration file as sops encrypts it
+const sopsEncrypted = `aws:
+    region: ENC[AES256_GCM,data:dGVzdA==,iv:aXY=,tag:dGFn,type:str]
+sops:
+    age:
+        - recipient: age1pxhfy0ql4j2mrjtnxs5d08yrx387zp888l4nct3aduh0g5yk0pgq6tcrrv
+    mac: ENC[AES256_GCM,data:bWFj,iv:aXY=,tag:dGFn,type:str]
+    version: 3.9.1
+`
+
+// fakeSops stands in for sops, it prints the decrypted file if it is given
+// the age identities
+const fakeSops = `#!/bin/sh
+case "$SOPS_AGE_KEY" in
+*AGE-SECRET-KEY-*) ;;
+*) echo "no identity could decrypt the data key" >&2; exit 128 ;;
+esac
+[ "$1 $2 $3 $4 $5" = "--decrypt --input-type yaml --output-type yaml" ] || exit 1
+echo "aws:"
+echo "    region: eu-north-1"
+`
+
+func (suite *TestSuite) TestConfigSopsFile() {
+	dir := suite.T().TempDir()
+	file := filepath.Join(dir, "config.yaml")
+	assert.NoError(suite.T(), ioutil.WriteFile(file, []byte(sopsEncrypted), 0600))
+	command := filepath.Join(dir, "sops")
+	assert.NoError(suite.T(), ioutil.WriteFile(command, []byte(fakeSops), 0700))
+	viper.Set("server.confFile", file)
+	viper.Set("secrets.sopsCommand", command)
+
+	_, err := NewConfig()
+	assert.ErrorContains(suite.T(), err, "no identity could decrypt the data key")
+
+	viper.Set("secrets.ageKey", ageFixtureKey)
+	config, err := NewConfig()
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), "eu-north-1", config.S3.region)
+	assert.False(suite.T(), viper.IsSet("sops"), "the metadata of sops is gone")
+
+	viper.Set("secrets.sopsCommand", filepath.Join(dir, "missing"))
+	_, err = NewConfig()
+	assert.Error(suite.T(), err)
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	v4 "github.com/aws/aws-sdk-go-v2/aws/signer/v4"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// maxUploadParts is the largest number of parts S3 takes in one upload
+const maxUploadParts = 10000
+
+// splitsUpload tells if the request is a single upload larger than the
+// backend accepts, which the proxy then uploads in parts. Bodies in the
+// aws-chunked encoding are left to the backend.
+func (p *Proxy) splitsUpload(r *http.Request) bool {
+	return p.s3.splitUploadSize > 0 &&
+		r.Method == http.MethodPut && createsObject(r) &&
+		r.Header.Get("X-Amz-Copy-Source") == "" &&
+		r.ContentLength > p.s3.splitUploadSize &&
+		!strings.HasPrefix(r.Header.Get("X-Amz-Content-Sha256"), "STREAMING-")
+}
+
+// splitUpload uploads the body of a single upload as a multipart upload, so
+// the client doesn't fail partway through a PUT the backend can't take. The
+// checksum is computed on the way, so the object is not read back.
+func (p *Proxy) splitUpload(w http.ResponseWriter, r *http.Request) {
+	key := strings.Replace(r.URL.Path, "/"+p.s3.bucket+"/", "", 1)
+	client := p.newS3Client()
+	requestLog(r).Infof("uploading %d bytes to %s in parts", r.ContentLength, key)
+
+	if r.ContentLength > maxUploadParts*p.s3.splitPartSize {
+		p.s3Error(w, r, http.StatusBadRequest, "EntityTooLarge", "Your proposed upload exceeds the maximum allowed size")
+		return
+	}
+
+	ctx, cancel := s3Context(r.Context(), p.s3)
+	upload, err := client.CreateMultipartUpload(ctx, p.splitUploadInput(r, key))
+	cancel()
+	if err != nil {
+		requestLog(r).Errorf("failed to start multipart upload of %s: %v", key, err)
+		p.s3Error(w, r, http.StatusInternalServerError, "InternalError", "could not start the upload")
+		return
+	}
+
+	// Each part is streamed from the body with its length known up front, so
+	// no part is held in memory. The payload hash can't be computed before
+	// sending a part that is read once, so parts are sent unsigned.
+	hash := newDecryptingHash(p.c4ghKey)
+	defer hash.close()
+	body := io.TeeReader(r.Body, hash)
+	var parts []types.CompletedPart
+	var size int64
+	for partNumber := int32(1); size < r.ContentLength; partNumber++ {
+		partSize := r.ContentLength - size
+		if partSize > p.s3.splitPartSize {
+			partSize = p.s3.splitPartSize
+		}
+		part, err := client.UploadPart(r.Context(), &s3.UploadPartInput{
+			Bucket:        aws.String(p.s3.bucket),
+			Key:           aws.String(key),
+			UploadId:      upload.UploadId,
+			PartNumber:    aws.Int32(partNumber),
+			Body:          io.LimitReader(body, partSize),
+			ContentLength: aws.Int64(partSize),
+		}, s3.WithAPIOptions(v4.SwapComputePayloadSHA256ForUnsignedPayloadMiddleware))
+		if err != nil {
+			p.abortSplitUpload(w, r, key, upload.UploadId, fmt.Errorf("part %d: %v", partNumber, err))
+			return
+		}
+		parts = append(parts, types.CompletedPart{ETag: part.ETag, PartNumber: aws.Int32(partNumber)})
+		size += partSize
+	}
+
+	// The client signed the hash of the body, which the backend can't check
+	// on the parts
+	info := hash.info(size)
+	if signed := r.Header.Get("X-Amz-Content-Sha256"); isPayloadHash(signed) && !strings.EqualFold(signed, info.checksum) {
+		p.cancelSplitUpload(r, key, upload.UploadId, fmt.Errorf("body hash %s does not match the signed %s", info.checksum, signed))
+		p.s3Error(w, r, http.StatusBadRequest, "XAmzContentSHA256Mismatch",
+			"The provided 'x-amz-content-sha256' header does not match what was computed.")
+		return
+	}
+
+	ctx, cancel = s3Context(r.Context(), p.s3)
+	complete, err := client.CompleteMultipartUpload(ctx, &s3.CompleteMultipartUploadInput{
+		Bucket:          aws.String(p.s3.bucket),
+		Key:             aws.String(key),
+		UploadId:        upload.UploadId,
+		MultipartUpload: &types.CompletedMultipartUpload{Parts: parts},
+	})
+	cancel()
+	if err != nil {
+		p.abortSplitUpload(w, r, key, upload.UploadId, err)
+		return
+	}
+
+	versionID := aws.ToString(complete.VersionId)
+	event := p.uploadEvent(r, info, versionID)
+	if err = p.messenger.SendMessage(event); err != nil {
+		requestLog(r).Debug("error when sending message")
+		requestLog(r).Debug(err)
+	}
+
+	w.Header().Set("ETag", aws.ToString(complete.ETag))
+	if versionID != "" {
+		w.Header().Set("X-Amz-Version-Id", versionID)
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// splitUploadInput starts the multipart upload with the settings of the
+// single upload
+func (p *Proxy) splitUploadInput(r *http.Request, key string) *s3.CreateMultipartUploadInput {
+	input := &s3.CreateMultipartUploadInput{
+		Bucket:   aws.String(p.s3.bucket),
+		Key:      aws.String(key),
+		Metadata: map[string]string{},
+	}
+	if ct := r.Header.Get("Content-Type"); ct != "" {
+		input.ContentType = aws.String(ct)
+	}
+	for name, values := range r.Header {
+		if meta := strings.TrimPrefix(strings.ToLower(name), "x-amz-meta-"); meta != strings.ToLower(name) {
+			input.Metadata[meta] = strings.Join(values, ",")
+		}
+	}
+
+	// The same settings as setObjectHeaders sets on proxied uploads
+	if p.s3.storageClass != "" {
+		input.StorageClass = types.StorageClass(p.s3.storageClass)
+	}
+	if p.s3.objectLockMode != "" {
+		input.ObjectLockMode = types.ObjectLockMode(p.s3.objectLockMode)
+		input.ObjectLockRetainUntilDate = aws.Time(time.Now().UTC().Add(p.s3.objectLockRetention))
+	}
+	if p.s3.objectLockLegalHold {
+		input.ObjectLockLegalHoldStatus = types.ObjectLockLegalHoldStatusOn
+	}
+	return input
+}
+
+// abortSplitUpload removes the parts uploaded so far and tells the client
+func (p *Proxy) abortSplitUpload(w http.ResponseWriter, r *http.Request, key string, uploadID *string, cause error) {
+	p.cancelSplitUpload(r, key, uploadID, cause)
+	p.s3Error(w, r, http.StatusInternalServerError, "InternalError", "the upload failed")
+}
+
+// cancelSplitUpload removes the parts uploaded so far
+func (p *Proxy) cancelSplitUpload(r *http.Request, key string, uploadID *string, cause error) {
+	requestLog(r).Errorf("failed to upload %s in parts: %v", key, cause)
+
+	// The client may be gone, abort anyway
+	ctx, cancel := s3Context(context.Background(), p.s3)
+	defer cancel()
+	if _, err := p.newS3Client().AbortMultipartUpload(ctx, &s3.AbortMultipartUploadInput{
+		Bucket:   aws.String(p.s3.bucket),
+		Key:      aws.String(key),
+		UploadId: uploadID,
+	}); err != nil {
+		requestLog(r).Errorf("failed to abort multipart upload %s: %v", aws.ToString(uploadID), err)
+	}
+}
+
+// isPayloadHash tells if the X-Amz-Content-Sha256 header holds the hash of
+// the payload rather than UNSIGNED-PAYLOAD or a streaming mode
+func isPayloadHash(value string) bool {
+	if len(value) != 2*sha256.Size {
+		return false
+	}
+	_, err := hex.DecodeString(value)
+	return err == nil
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSplitsUpload(t *testing.T) {
+	proxy := NewProxy(S3Config{splitUploadSize: 10}, NewAlwaysAllow(), NewMockMessenger(), new(tls.Config))
+
+	r, _ := http.NewRequest("PUT", "/buckbuck/username/file", strings.NewReader("more than ten bytes"))
+	assert.True(t, proxy.splitsUpload(r))
+
+	r, _ = http.NewRequest("PUT", "/buckbuck/username/file", strings.NewReader("ten bytes"))
+	assert.False(t, proxy.splitsUpload(r))
+
+	r, _ = http.NewRequest("PUT", "/buckbuck/username/file?partNumber=1&uploadId=1", strings.NewReader("more than ten bytes"))
+	assert.False(t, proxy.splitsUpload(r), "parts are uploaded as they are")
+
+	r, _ = http.NewRequest("PUT", "/buckbuck/username/file", strings.NewReader("more than ten bytes"))
+	r.Header.Set("X-Amz-Content-Sha256", "STREAMING-AWS4-HMAC-SHA256-PAYLOAD")
+	assert.False(t, proxy.splitsUpload(r), "chunked bodies are left to the backend")
+
+	proxy.s3.splitUploadSize = 0
+	r, _ = http.NewRequest("PUT", "/buckbuck/username/file", strings.NewReader("more than ten bytes"))
+	assert.False(t, proxy.splitsUpload(r))
+}
+
+func TestServeHTTP_splitUpload(t *testing.T) {
+	s3conf := S3Config{
+		url:              ts.URL,
+		accessKey:        "fakeaccess",
+		secretKey:        "testsecret",
+		bucket:           "splitbucket",
+		region:           "us-east-1",
+		retryMaxAttempts: 1,
+		splitUploadSize:  10,
+		splitPartSize:    10,
+	}
+	client := newS3Client(s3conf, http.DefaultClient)
+	_, err := client.CreateBucket(context.Background(), &s3.CreateBucketInput{Bucket: aws.String("splitbucket")})
+	assert.NoError(t, err)
+
+	messenger := NewMockMessenger()
+	proxy := NewProxy(s3conf, NewAlwaysAllow(), messenger, new(tls.Config))
+
+	content := "content in four parts of up to ten bytes"
+	r, _ := http.NewRequest("PUT", "/username/file", strings.NewReader(content))
+	r.Header.Set("Content-Type", "text/plain")
+	w := httptest.NewRecorder()
+	proxy.ServeHTTP(w, r)
+	assert.Equal(t, 200, w.Code)
+	assert.NotEmpty(t, w.Header().Get("ETag"))
+
+	object, err := client.GetObject(context.Background(), &s3.GetObjectInput{Bucket: aws.String("splitbucket"), Key: aws.String("username/file")})
+	if assert.NoError(t, err) {
+		stored, _ := ioutil.ReadAll(object.Body)
+		object.Body.Close()
+		assert.Equal(t, content, string(stored))
+		assert.True(t, strings.HasPrefix(aws.ToString(object.ContentType), "text/plain"))
+	}
+
+	if assert.NotNil(t, messenger.lastEvent) {
+		assert.Equal(t, "username/file", messenger.lastEvent.Filepath)
+		assert.Equal(t, int64(len(content)), messenger.lastEvent.Filesize)
+		assert.Equal(t, Checksum{Type: "sha256", Value: fmt.Sprintf("%x", sha256.Sum256([]byte(content)))}, messenger.lastEvent.Checksum[0])
+	}
+}
+
+func TestServeHTTP_splitUploadHashMismatch(t *testing.T) {
+	s3conf := S3Config{
+		url:              ts.URL,
+		accessKey:        "fakeaccess",
+		secretKey:        "testsecret",
+		bucket:           "splitbucket",
+		region:           "us-east-1",
+		retryMaxAttempts: 1,
+		splitUploadSize:  10,
+		splitPartSize:    10,
+	}
+	client := newS3Client(s3conf, http.DefaultClient)
+	_, _ = client.CreateBucket(context.Background(), &s3.CreateBucketInput{Bucket: aws.String("splitbucket")})
+
+	messenger := NewMockMessenger()
+	proxy := NewProxy(s3conf, NewAlwaysAllow(), messenger, new(tls.Config))
+
+	r, _ := http.NewRequest("PUT", "/username/tampered", strings.NewReader("content in four parts of up to ten bytes"))
+	r.Header.Set("X-Amz-Content-Sha256", fmt.Sprintf("%x", sha256.Sum256([]byte("some other content"))))
+	w := httptest.NewRecorder()
+	proxy.ServeHTTP(w, r)
+	assert.Equal(t, 400, w.Code)
+	assert.Contains(t, w.Body.String(), "XAmzContentSHA256Mismatch")
+	assert.Nil(t, messenger.lastEvent)
+
+	_, err := client.HeadObject(context.Background(), &s3.HeadObjectInput{Bucket: aws.String("splitbucket"), Key: aws.String("username/tampered")})
+	assert.Error(t, err, "the upload is aborted")
+
+	r, _ = http.NewRequest("PUT", "/username/huge", strings.NewReader(""))
+	r.ContentLength = maxUploadParts*10 + 1
+	w = httptest.NewRecorder()
+	proxy.ServeHTTP(w, r)
+	assert.Equal(t, 400, w.Code)
+	assert.Contains(t, w.Body.String(), "EntityTooLarge")
+}
@@ -0,0 +1,295 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+var (
+	eventsSpooled = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "s3proxy_events_spooled_total",
+		Help: "Number of events written to the local spool because they could not be sent.",
+	})
+	eventsInSpool = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "s3proxy_events_in_spool",
+		Help: "Number of events in the local spool waiting to be sent.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(eventsSpooled, eventsInSpool)
+}
+
+// spoolConfig stores the settings of the local event spool
+type spoolConfig struct {
+	// directory of the spool, empty disables spooling
+	dir string
+	// how much the spooled events may take up on disk, in bytes
+	maxSize int64
+	// how often sending the spooled events is tried
+	interval time.Duration
+}
+
+// readSpoolConfig reads the broker.spool section of the configuration
+func readSpoolConfig() (spoolConfig, error) {
+	s := spoolConfig{
+		dir:      viper.GetString("broker.spool.dir"),
+		maxSize:  100 * 1024 * 1024,
+		interval: 10 * time.Second,
+	}
+
+	if viper.IsSet("broker.spool.maxSize") {
+		s.maxSize = viper.GetInt64("broker.spool.maxSize")
+		if s.maxSize <= 0 {
+			return s, fmt.Errorf("broker.spool.maxSize must be positive")
+		}
+	}
+	if viper.IsSet("broker.spool.interval") {
+		s.interval = viper.GetDuration("broker.spool.interval")
+		if s.interval <= 0 {
+			return s, fmt.Errorf("broker.spool.interval must be positive")
+		}
+	}
+
+	return s, nil
+}
+
+// spooledEvent is an event as it is kept in the spool, with the request id
+// that is not part of the message body
+type spooledEvent struct {
+	Event      Event  `json:"event"`
+	RequestID  string `json:"request_id,omitempty"`
+	RoutingKey string `json:"routing_key,omitempty"`
+}
+
+// SpoolingMessenger is a Messenger that keeps the events another messenger
+// fails to send in files on local disk, and sends them in order once it
+// works again. Events sent while there are spooled events are spooled after
+// them, so the order is kept.
+type SpoolingMessenger struct {
+	lock     sync.Mutex
+	next     Messenger
+	dir      string
+	maxSize  int64
+	interval time.Duration
+	// number of the next spooled event, and the spooled events by number
+	// with their sizes
+	sequence uint64
+	spooled  map[uint64]int64
+	size     int64
+}
+
+// NewSpoolingMessenger wraps the messenger with the spool, the events
+// spooled before a restart are picked up again
+func NewSpoolingMessenger(next Messenger, c spoolConfig) (*SpoolingMessenger, error) {
+	if err := os.MkdirAll(c.dir, 0700); err != nil {
+		return nil, fmt.Errorf("broker.spool.dir: %v", err)
+	}
+	m := &SpoolingMessenger{next: next, dir: c.dir, maxSize: c.maxSize, interval: c.interval, sequence: 1, spooled: make(map[uint64]int64)}
+
+	files, err := ioutil.ReadDir(c.dir)
+	if err != nil {
+		return nil, fmt.Errorf("broker.spool.dir: %v", err)
+	}
+	for _, file := range files {
+		number, ok := spoolNumber(file.Name())
+		if !ok {
+			continue
+		}
+		m.spooled[number] = file.Size()
+		m.size += file.Size()
+		if number >= m.sequence {
+			m.sequence = number + 1
+		}
+	}
+	if len(m.spooled) > 0 {
+		log.Infof("%d events spooled in %s", len(m.spooled), c.dir)
+	}
+	eventsInSpool.Set(float64(len(m.spooled)))
+	return m, nil
+}
+
+// spoolName is the file name of a spooled event, the numbers are padded so
+// the files sort in order
+func spoolName(number uint64) string {
+	return fmt.Sprintf("%020d.json", number)
+}
+
+// spoolNumber returns the number of a spooled event from its file name
+func spoolNumber(name string) (uint64, bool) {
+	if !strings.HasSuffix(name, ".json") {
+		return 0, false
+	}
+	number, err := strconv.ParseUint(strings.TrimSuffix(name, ".json"), 10, 64)
+	return number, err == nil
+}
+
+// SendMessage sends the event, or spools it if that fails or other events
+// are waiting to be sent
+func (m *SpoolingMessenger) SendMessage(message Event) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if len(m.spooled) == 0 {
+		err := m.next.SendMessage(message)
+		if err == nil {
+			return nil
+		}
+		log.Warnf("sending event failed, spooling it: %v", err)
+	}
+	return m.spool(message)
+}
+
+// spool writes the event to the spool, it is called with the lock held
+func (m *SpoolingMessenger) spool(message Event) error {
+	body, err := json.Marshal(spooledEvent{message, message.RequestID, message.RoutingKey})
+	if err != nil {
+		return err
+	}
+	if m.size+int64(len(body)) > m.maxSize {
+		return fmt.Errorf("event spool %s is full with %d bytes", m.dir, m.size)
+	}
+
+	// The file is written under another name and renamed, so the spool
+	// never has half written events
+	name := filepath.Join(m.dir, spoolName(m.sequence))
+	temp, err := ioutil.TempFile(m.dir, ".spool-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(temp.Name())
+	if _, err := temp.Write(body); err != nil {
+		temp.Close()
+		return err
+	}
+	if err := temp.Sync(); err != nil {
+		temp.Close()
+		return err
+	}
+	if err := temp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(temp.Name(), name); err != nil {
+		return err
+	}
+
+	m.spooled[m.sequence] = int64(len(body))
+	m.size += int64(len(body))
+	m.sequence++
+	eventsSpooled.Inc()
+	eventsInSpool.Set(float64(len(m.spooled)))
+	return nil
+}
+
+// Replay sends the spooled events until the context is cancelled
+func (m *SpoolingMessenger) Replay(ctx context.Context) {
+	ticker := time.NewTicker(m.interval)
+	defer ticker.Stop()
+	for {
+		m.replay()
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// replay sends the spooled events in order, until one can't be sent
+func (m *SpoolingMessenger) replay() {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	sent := 0
+	for _, number := range m.numbers() {
+		name := filepath.Join(m.dir, spoolName(number))
+		spooled, err := m.read(number)
+		if err != nil && !isSpoolFormatError(err) {
+			log.Errorf("reading spooled event: %v", err)
+			return
+		}
+		if err != nil {
+			// Nothing would ever send it, so it is set aside
+			log.Errorf("spooled event %s can not be read, moving it aside: %v", name, err)
+			if err := os.Rename(name, name+".broken"); err != nil {
+				return
+			}
+		} else {
+			if err := m.next.SendMessage(spooled.Event); err != nil {
+				log.Warnf("sending spooled events failed, %d left: %v", len(m.spooled), err)
+				return
+			}
+			if err := os.Remove(name); err != nil {
+				log.Errorf("removing sent event from the spool: %v", err)
+				return
+			}
+		}
+		m.forget(number)
+		sent++
+	}
+	if sent > 0 {
+		log.Infof("sent %d spooled events", sent)
+	}
+}
+
+// numbers returns the numbers of the spooled events in order, it is called
+// with the lock held
+func (m *SpoolingMessenger) numbers() []uint64 {
+	numbers := make([]uint64, 0, len(m.spooled))
+	for number := range m.spooled {
+		numbers = append(numbers, number)
+	}
+	sort.Slice(numbers, func(i, j int) bool { return numbers[i] < numbers[j] })
+	return numbers
+}
+
+// spoolFormatError tells that a spooled event is not valid JSON
+type spoolFormatError struct {
+	err error
+}
+
+func (e spoolFormatError) Error() string {
+	return e.err.Error()
+}
+
+func isSpoolFormatError(err error) bool {
+	_, ok := err.(spoolFormatError)
+	return ok
+}
+
+// read reads a spooled event with its request id, it is called with the
+// lock held
+func (m *SpoolingMessenger) read(number uint64) (spooledEvent, error) {
+	var spooled spooledEvent
+	body, err := ioutil.ReadFile(filepath.Join(m.dir, spoolName(number))) // #nosec the spool is in our configured directory
+	if err != nil {
+		return spooled, err
+	}
+	if err := json.Unmarshal(body, &spooled); err != nil {
+		return spooled, spoolFormatError{err}
+	}
+	spooled.Event.RequestID = spooled.RequestID
+	spooled.Event.RoutingKey = spooled.RoutingKey
+	return spooled, nil
+}
+
+// forget drops a spooled event that was sent or set aside, it is called
+// with the lock held
+func (m *SpoolingMessenger) forget(number uint64) {
+	m.size -= m.spooled[number]
+	delete(m.spooled, number)
+	eventsInSpool.Set(float64(len(m.spooled)))
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSpoolingMessenger(t *testing.T) {
+	dir := t.TempDir()
+	relay := &recordingMessenger{}
+	config := spoolConfig{dir: dir, maxSize: 1024 * 1024, interval: time.Second}
+	m, err := NewSpoolingMessenger(relay, config)
+	assert.NoError(t, err)
+
+	assert.NoError(t, m.SendMessage(Event{Operation: "upload", Username: "user", Filepath: "user/a.c4gh"}))
+	assert.Len(t, relay.events, 1, "events are sent while it works")
+
+	spooled := testutil.ToFloat64(eventsSpooled)
+
+	// Events that can't be sent are spooled, and so are the ones after them
+	relay.err = errors.New("broker down")
+	assert.NoError(t, m.SendMessage(Event{Operation: "upload", Username: "user", Filepath: "user/b.c4gh", RequestID: "abc"}))
+	relay.err = nil
+	assert.NoError(t, m.SendMessage(Event{Operation: "upload", Username: "user", Filepath: "user/c.c4gh"}))
+	assert.Len(t, relay.events, 1)
+	files, _ := ioutil.ReadDir(dir)
+	assert.Len(t, files, 2)
+	assert.Equal(t, spooled+2, testutil.ToFloat64(eventsSpooled))
+	assert.Equal(t, float64(2), testutil.ToFloat64(eventsInSpool))
+
+	// The spool survives restarts
+	m, err = NewSpoolingMessenger(relay, config)
+	assert.NoError(t, err)
+	assert.Len(t, m.spooled, 2)
+
+	m.replay()
+	if assert.Len(t, relay.events, 3) {
+		assert.Equal(t, "user/b.c4gh", relay.events[1].Filepath)
+		assert.Equal(t, "abc", relay.events[1].RequestID)
+		assert.Equal(t, "user/c.c4gh", relay.events[2].Filepath)
+	}
+	files, _ = ioutil.ReadDir(dir)
+	assert.Empty(t, files)
+	assert.Equal(t, float64(0), testutil.ToFloat64(eventsInSpool))
+	assert.Equal(t, int64(0), m.size)
+}
+
+func TestSpoolingMessenger_full(t *testing.T) {
+	relay := &recordingMessenger{err: errors.New("broker down")}
+	m, err := NewSpoolingMessenger(relay, spoolConfig{dir: t.TempDir(), maxSize: 200, interval: time.Second})
+	assert.NoError(t, err)
+
+	assert.NoError(t, m.SendMessage(Event{Operation: "upload", Username: "user", Filepath: "user/a.c4gh"}))
+	assert.Error(t, m.SendMessage(Event{Operation: "upload", Username: "user", Filepath: "user/b.c4gh"}), "the spool is full")
+
+	// Events that can't be sent stay spooled
+	m.replay()
+	assert.Len(t, m.spooled, 1)
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+// The spool is looked at and replayed by hand on the admin endpoints, for
+// recovery after a broker outage:
+//
+//	GET /spool lists the spooled events
+//	POST /spool/replay sends the spooled events now
+//
+// Both take the user and the RFC 3339 times since and until as query
+// parameters, to pick the events. The replay command sends them while the
+// proxy is stopped, picking them with flags of the same names.
+
+// spoolFilter picks spooled events by user and time, zero values pick all
+type spoolFilter struct {
+	user  string
+	since time.Time
+	until time.Time
+}
+
+// parseSpoolFilter reads the filter from the query of the request
+func parseSpoolFilter(r *http.Request) (spoolFilter, error) {
+	query := r.URL.Query()
+	return newSpoolFilter(query.Get("user"), query.Get("since"), query.Get("until"))
+}
+
+// newSpoolFilter creates the filter of the user and the RFC 3339 times,
+// empty ones pick all
+func newSpoolFilter(user, since, until string) (spoolFilter, error) {
+	f := spoolFilter{user: user}
+	for name, value := range map[string]string{"since": since, "until": until} {
+		if value == "" {
+			continue
+		}
+		parsed, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			return f, fmt.Errorf("%s is not an RFC 3339 time: %v", name, err)
+		}
+		if name == "since" {
+			f.since = parsed
+		} else {
+			f.until = parsed
+		}
+	}
+	return f, nil
+}
+
+// matches tells if the filter picks the event, which is at the time of the
+// event or else the time it was spooled
+func (f spoolFilter) matches(event Event, spooled time.Time) bool {
+	if f.user != "" && event.Username != f.user {
+		return false
+	}
+	at := spooled
+	if t, err := time.Parse(time.RFC3339, event.Timestamp); err == nil {
+		at = t
+	}
+	return (f.since.IsZero() || !at.Before(f.since)) && (f.until.IsZero() || at.Before(f.until))
+}
+
+// spoolEntry is a spooled event as it is listed
+type spoolEntry struct {
+	Number    uint64    `json:"number"`
+	Spooled   time.Time `json:"spooled"`
+	RequestID string    `json:"request_id,omitempty"`
+	Event     Event     `json:"event"`
+}
+
+// each calls fn with the spooled events the filter picks in order, until
+// it returns false. Events that can't be read are skipped. It is called
+// with the lock held.
+func (m *SpoolingMessenger) each(f spoolFilter, fn func(spoolEntry) bool) {
+	for _, number := range m.numbers() {
+		info, err := os.Stat(filepath.Join(m.dir, spoolName(number)))
+		if err != nil {
+			log.Errorf("reading spooled event: %v", err)
+			continue
+		}
+		spooled, err := m.read(number)
+		if err != nil {
+			log.Errorf("reading spooled event: %v", err)
+			continue
+		}
+		if !f.matches(spooled.Event, info.ModTime()) {
+			continue
+		}
+		if !fn(spoolEntry{number, info.ModTime(), spooled.RequestID, spooled.Event}) {
+			return
+		}
+	}
+}
+
+// List returns the spooled events the filter picks
+func (m *SpoolingMessenger) List(f spoolFilter) []spoolEntry {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	entries := []spoolEntry{}
+	m.each(f, func(entry spoolEntry) bool {
+		entries = append(entries, entry)
+		return true
+	})
+	return entries
+}
+
+// ReplayMatching sends the spooled events the filter picks now, in order
+// but ahead of the others. It stops at the first event that can't be sent,
+// and returns how many were.
+func (m *SpoolingMessenger) ReplayMatching(f spoolFilter) (int, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	sent := 0
+	var err error
+	m.each(f, func(entry spoolEntry) bool {
+		if err = m.next.SendMessage(entry.Event); err != nil {
+			return false
+		}
+		if err = os.Remove(filepath.Join(m.dir, spoolName(entry.Number))); err != nil {
+			return false
+		}
+		m.forget(entry.Number)
+		sent++
+		return true
+	})
+	if sent > 0 {
+		log.Infof("sent %d spooled events by request", sent)
+	}
+	return sent, err
+}
+
+// newReplayCommand creates the replay command
+func newReplayCommand() *cobra.Command {
+	var user, since, until string
+	cmd := &cobra.Command{
+		Use:   "replay",
+		Short: "send the spooled events now, while the proxy is stopped",
+		Args:  cobra.NoArgs,
+	}
+	cmd.Flags().StringVar(&user, "user", "", "only send the events of the `user`")
+	cmd.Flags().StringVar(&since, "since", "", "only send the events from the RFC 3339 `time` on")
+	cmd.Flags().StringVar(&until, "until", "", "only send the events before the RFC 3339 `time`")
+	configFlags := addConfigFlags(cmd.Flags())
+	cmd.RunE = func(*cobra.Command, []string) error {
+		configFlags.apply()
+		return runReplay(user, since, until)
+	}
+	return cmd
+}
+
+// runReplay is the replay command, it sends the spooled events the flags
+// pick with the messenger of the configuration. The proxy must be stopped
+// meanwhile, while it runs POST /spool/replay does the same.
+func runReplay(user, since, until string) error {
+	f, err := newSpoolFilter(user, since, until)
+	if err != nil {
+		return err
+	}
+
+	config, err := NewConfig()
+	if err != nil {
+		return err
+	}
+	if config.Broker.spool.dir == "" {
+		return fmt.Errorf("broker.spool.dir is not set, there is no spool to replay")
+	}
+	tlsBroker, err := TLSConfigBroker(config)
+	if err != nil {
+		return err
+	}
+	base, err := NewMessenger(config.Broker, tlsBroker)
+	if err != nil {
+		return err
+	}
+	messenger, err := wrapMessenger(base, config.Broker)
+	if err != nil {
+		return err
+	}
+	spool, err := NewSpoolingMessenger(messenger, config.Broker.spool)
+	if err != nil {
+		return err
+	}
+
+	sent, err := spool.ReplayMatching(f)
+	if flushErr := flushEvents(base); flushErr != nil && err == nil {
+		err = flushErr
+	}
+	log.Infof("sent %d spooled events, %d are left in %s", sent, len(spool.spooled), config.Broker.spool.dir)
+	return err
+}
+
+// spoolHandler serves the listing and the replay of the spool
+func spoolHandler(spool *SpoolingMessenger) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/spool", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		f, err := parseSpoolFilter(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		writeSpoolJSON(w, http.StatusOK, spool.List(f))
+	})
+	mux.HandleFunc("/spool/replay", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		f, err := parseSpoolFilter(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		result := struct {
+			Sent  int    `json:"sent"`
+			Error string `json:"error,omitempty"`
+		}{}
+		status := http.StatusOK
+		result.Sent, err = spool.ReplayMatching(f)
+		if err != nil {
+			result.Error = err.Error()
+			status = http.StatusBadGateway
+		}
+		writeSpoolJSON(w, status, result)
+	})
+	return mux
+}
+
+func writeSpoolJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Errorf("writing spool response: %v", err)
+	}
+}
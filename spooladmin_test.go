@@ -0,0 +1,105 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSpoolHandler(t *testing.T) {
+	relay := &recordingMessenger{err: errors.New("broker down")}
+	m, err := NewSpoolingMessenger(relay, spoolConfig{dir: t.TempDir(), maxSize: 1024 * 1024, interval: time.Second})
+	assert.NoError(t, err)
+	for _, event := range []Event{
+		{Operation: "upload", Username: "alice", Filepath: "alice/a.c4gh", Timestamp: "2024-01-01T10:00:00Z"},
+		{Operation: "upload", Username: "bob", Filepath: "bob/b.c4gh", Timestamp: "2024-01-01T11:00:00Z"},
+		{Operation: "upload", Username: "alice", Filepath: "alice/c.c4gh", Timestamp: "2024-01-01T12:00:00Z", RequestID: "abc"},
+	} {
+		assert.NoError(t, m.SendMessage(event))
+	}
+	handler := spoolHandler(m)
+
+	list := func(query string) []spoolEntry {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("GET", "/spool"+query, nil))
+		assert.Equal(t, http.StatusOK, w.Code)
+		var entries []spoolEntry
+		assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &entries))
+		return entries
+	}
+	assert.Len(t, list(""), 3)
+	alice := list("?user=alice")
+	if assert.Len(t, alice, 2) {
+		assert.Equal(t, "alice/a.c4gh", alice[0].Event.Filepath)
+		assert.Equal(t, "abc", alice[1].RequestID)
+	}
+	assert.Len(t, list("?since=2024-01-01T11:00:00Z&until=2024-01-01T12:00:00Z"), 1)
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/spool?since=yesterday", nil))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	// A replay that fails tells so and keeps the events
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("POST", "/spool/replay?user=alice", nil))
+	assert.Equal(t, http.StatusBadGateway, w.Code)
+	assert.Contains(t, w.Body.String(), "broker down")
+	assert.Len(t, list(""), 3)
+
+	relay.err = nil
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("POST", "/spool/replay?user=alice", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `{"sent":2}`, w.Body.String())
+	if assert.Len(t, relay.events, 2) {
+		assert.Equal(t, "alice/a.c4gh", relay.events[0].Filepath)
+		assert.Equal(t, "abc", relay.events[1].RequestID)
+	}
+	remaining := list("")
+	if assert.Len(t, remaining, 1) {
+		assert.Equal(t, "bob", remaining[0].Event.Username)
+	}
+	assert.Len(t, m.spooled, 1)
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/spool/replay", nil))
+	assert.Equal(t, http.StatusMethodNotAllowed, w.Code)
+}
+
+func TestRunReplay(t *testing.T) {
+	t.Cleanup(viper.Reset)
+	dir := t.TempDir()
+	spool, err := NewSpoolingMessenger(&recordingMessenger{err: errors.New("broker down")}, spoolConfig{dir: filepath.Join(dir, "spool"), maxSize: 1024 * 1024, interval: time.Second})
+	assert.NoError(t, err)
+	for _, user := range []string{"alice", "bob"} {
+		assert.NoError(t, spool.SendMessage(Event{Operation: "upload", Username: user, Filepath: user + "/a.c4gh"}))
+	}
+
+	events := filepath.Join(dir, "events.jsonl")
+	settings := []string{"broker.type=file", "broker.file.path=" + events, "broker.spool.dir=" + filepath.Join(dir, "spool"),
+		"aws.url=http://localhost:9000", "aws.accessKey=access", "aws.secretKey=secret", "aws.bucket=inbox",
+		"server.jwtpubkeypath=dev_utils/keys"}
+	args := []string{"replay", "--user", "alice"}
+	for _, setting := range settings {
+		args = append(args, "--set", setting)
+	}
+	assert.NoError(t, runCommand(args))
+
+	sent, err := ioutil.ReadFile(events)
+	assert.NoError(t, err)
+	assert.Contains(t, string(sent), "alice/a.c4gh")
+	assert.NotContains(t, string(sent), "bob/a.c4gh", "only the picked events are sent")
+	files, _ := ioutil.ReadDir(filepath.Join(dir, "spool"))
+	assert.Len(t, files, 1)
+
+	viper.Reset()
+	assert.Error(t, runCommand([]string{"replay", "--since", "yesterday"}))
+}
@@ -0,0 +1,26 @@
+//go:build !windows
+
+package main
+
+import (
+	"fmt"
+	"log/syslog"
+	"net/url"
+
+	log "github.com/sirupsen/logrus"
+	lsyslog "github.com/sirupsen/logrus/hooks/syslog"
+)
+
+// newSyslogHook sends the log to syslog, the local one when the address is
+// empty or the one at a udp:// or tcp:// address
+func newSyslogHook(address, tag string) (log.Hook, error) {
+	network, raddr := "", ""
+	if address != "" {
+		u, err := url.Parse(address)
+		if err != nil || (u.Scheme != "udp" && u.Scheme != "tcp") || u.Host == "" {
+			return nil, fmt.Errorf("syslog address %q is not udp://host:port or tcp://host:port", address)
+		}
+		network, raddr = u.Scheme, u.Host
+	}
+	return lsyslog.NewSyslogHook(network, raddr, syslog.LOG_INFO|syslog.LOG_DAEMON, tag)
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+
+	"github.com/spf13/viper"
+)
+
+// tlsVersions are the TLS versions that can be set as minimum
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// tlsSettings restricts the TLS versions and cipher suites of connections.
+// The cipher suites only apply up to TLS 1.2, those of TLS 1.3 can't be
+// configured.
+type tlsSettings struct {
+	minVersion   uint16
+	cipherSuites []uint16
+	// only FIPS-approved curves are used
+	fips bool
+}
+
+// fipsCipherSuites are the FIPS-approved cipher suites up to TLS 1.2, the
+// same that crypto/tls/fipsonly allows
+var fipsCipherSuites = []uint16{
+	tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+	tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+	tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+	tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+}
+
+// readTLSSettings reads the tlsMinVersion and tlsCipherSuites settings of a
+// section of the configuration, the minimum version defaults to TLS 1.2
+func readTLSSettings(section string) (tlsSettings, error) {
+	settings := tlsSettings{minVersion: tls.VersionTLS12}
+
+	if viper.IsSet(section + ".tlsMinVersion") {
+		version := viper.GetString(section + ".tlsMinVersion")
+		v, ok := tlsVersions[version]
+		if !ok {
+			return settings, fmt.Errorf("%s.tlsMinVersion must be one of 1.0, 1.1, 1.2 or 1.3, not %q", section, version)
+		}
+		settings.minVersion = v
+	}
+
+	if viper.IsSet(section + ".tlsCipherSuites") {
+		for _, name := range viper.GetStringSlice(section + ".tlsCipherSuites") {
+			id, ok := cipherSuiteID(name)
+			if !ok {
+				return settings, fmt.Errorf("%s.tlsCipherSuites: unknown or insecure cipher suite %q", section, name)
+			}
+			settings.cipherSuites = append(settings.cipherSuites, id)
+		}
+	}
+
+	return settings, nil
+}
+
+// cipherSuiteID returns the id of the secure cipher suite with the name
+func cipherSuiteID(name string) (uint16, bool) {
+	for _, suite := range tls.CipherSuites() {
+		if suite.Name == name {
+			return suite.ID, true
+		}
+	}
+	return 0, false
+}
+
+// restrictToFIPS limits the settings of a section to what
+// crypto/tls/fipsonly allows: TLS 1.2 or later, AES-GCM cipher suites and
+// the P-256 and P-384 curves
+func (t *tlsSettings) restrictToFIPS(section string) error {
+	if t.minVersion < tls.VersionTLS12 {
+		return fmt.Errorf("%s.tlsMinVersion must be at least 1.2 in FIPS mode", section)
+	}
+	for _, id := range t.cipherSuites {
+		if !containsCipherSuite(fipsCipherSuites, id) {
+			return fmt.Errorf("%s.tlsCipherSuites: %s is not FIPS-approved", section, tls.CipherSuiteName(id))
+		}
+	}
+	if t.cipherSuites == nil {
+		t.cipherSuites = fipsCipherSuites
+	}
+	t.fips = true
+	return nil
+}
+
+func containsCipherSuite(suites []uint16, id uint16) bool {
+	for _, suite := range suites {
+		if suite == id {
+			return true
+		}
+	}
+	return false
+}
+
+// apply sets the restrictions on cfg, unset ones leave cfg as it is
+func (t tlsSettings) apply(cfg *tls.Config) {
+	if t.minVersion != 0 {
+		cfg.MinVersion = t.minVersion
+	}
+	if t.cipherSuites != nil {
+		cfg.CipherSuites = t.cipherSuites
+	}
+	if t.fips {
+		cfg.CurvePreferences = []tls.CurveID{tls.CurveP256, tls.CurveP384}
+	}
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"crypto/tls"
+	"testing"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReadTLSSettings(t *testing.T) {
+	defer viper.Reset()
+
+	settings, err := readTLSSettings("aws")
+	assert.NoError(t, err)
+	assert.Equal(t, tlsSettings{minVersion: tls.VersionTLS12}, settings)
+
+	viper.Set("aws.tlsMinVersion", "1.3")
+	viper.Set("aws.tlsCipherSuites", []string{"TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384"})
+	settings, err = readTLSSettings("aws")
+	assert.NoError(t, err)
+	assert.Equal(t, uint16(tls.VersionTLS13), settings.minVersion)
+	assert.Equal(t, []uint16{tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384}, settings.cipherSuites)
+
+	viper.Set("aws.tlsMinVersion", "1.4")
+	_, err = readTLSSettings("aws")
+	assert.Error(t, err)
+
+	viper.Set("aws.tlsMinVersion", "1.2")
+	viper.Set("aws.tlsCipherSuites", []string{"TLS_RSA_WITH_RC4_128_SHA"})
+	_, err = readTLSSettings("aws")
+	assert.Error(t, err, "insecure cipher suites should be rejected")
+}
+
+func TestTLSSettingsApply(t *testing.T) {
+	cfg := &tls.Config{MinVersion: tls.VersionTLS12}
+	tlsSettings{}.apply(cfg)
+	assert.Equal(t, uint16(tls.VersionTLS12), cfg.MinVersion)
+	assert.Nil(t, cfg.CipherSuites)
+
+	tlsSettings{minVersion: tls.VersionTLS13, cipherSuites: []uint16{tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384}}.apply(cfg)
+	assert.Equal(t, uint16(tls.VersionTLS13), cfg.MinVersion)
+	assert.Equal(t, []uint16{tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384}, cfg.CipherSuites)
+}
+
+func TestRestrictToFIPS(t *testing.T) {
+	settings := tlsSettings{minVersion: tls.VersionTLS12}
+	assert.NoError(t, settings.restrictToFIPS("aws"))
+	assert.Equal(t, fipsCipherSuites, settings.cipherSuites)
+
+	cfg := &tls.Config{}
+	settings.apply(cfg)
+	assert.Equal(t, []tls.CurveID{tls.CurveP256, tls.CurveP384}, cfg.CurvePreferences)
+
+	settings = tlsSettings{minVersion: tls.VersionTLS13, cipherSuites: []uint16{tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384}}
+	assert.NoError(t, settings.restrictToFIPS("aws"))
+	assert.Equal(t, []uint16{tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384}, settings.cipherSuites)
+
+	settings = tlsSettings{minVersion: tls.VersionTLS11}
+	assert.Error(t, settings.restrictToFIPS("aws"))
+
+	settings = tlsSettings{minVersion: tls.VersionTLS12, cipherSuites: []uint16{tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256}}
+	assert.Error(t, settings.restrictToFIPS("aws"), "ChaCha20 is not FIPS-approved")
+}
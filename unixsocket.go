@@ -0,0 +1,36 @@
+//go:build !windows
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"syscall"
+)
+
+// umaskLock keeps the umask from being changed by two listeners at once
+var umaskLock sync.Mutex
+
+// listenUnix listens on the unix socket at the path with the mode. The socket
+// is created with a umask that leaves out the group and others, so no one
+// else can connect before it has its mode. The umask is that of the whole
+// process, so it only leaves out the group and others, and not the owner's
+// search permission on the directories made meanwhile.
+func listenUnix(path string, mode os.FileMode) (net.Listener, error) {
+	umaskLock.Lock()
+	old := syscall.Umask(0077)
+	l, err := net.Listen("unix", path)
+	syscall.Umask(old)
+	umaskLock.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := os.Chmod(path, mode); err != nil {
+		l.Close()
+		return nil, fmt.Errorf("failed to set permissions on %s: %v", path, err)
+	}
+	return l, nil
+}
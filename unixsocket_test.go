@@ -0,0 +1,29 @@
+//go:build !windows
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestListenUnix(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "proxy.sock")
+	old := syscall.Umask(0)
+	defer syscall.Umask(old)
+
+	l, err := listenUnix(path, 0660)
+	assert.NoError(t, err)
+	defer l.Close()
+	fi, err := os.Stat(path)
+	assert.NoError(t, err)
+	assert.Equal(t, os.FileMode(0660), fi.Mode().Perm())
+	assert.Equal(t, 0, syscall.Umask(0), "the umask is put back")
+
+	_, err = listenUnix(path, 0660)
+	assert.Error(t, err, "the socket is in use")
+}
@@ -66,6 +66,23 @@ func NewValidateFromToken(pubkeys map[string][]byte) *ValidateFromToken {
 	return &ValidateFromToken{pubkeys}
 }
 
+// loadJWTKeys returns a ValidateFromToken with the keys from the configured
+// JWK URL and directory of public keys
+func loadJWTKeys(s ServerConfig) (*ValidateFromToken, error) {
+	auth := NewValidateFromToken(make(map[string][]byte))
+	if s.jwtpubkeyurl != "" {
+		if err := auth.getjwtpubkey(s.jwtpubkeyurl); err != nil {
+			return nil, fmt.Errorf("error while getting key %s: %v", s.jwtpubkeyurl, err)
+		}
+	}
+	if s.jwtpubkeypath != "" {
+		if err := auth.getjwtkey(s.jwtpubkeypath); err != nil {
+			return nil, fmt.Errorf("error while getting key %s: %v", s.jwtpubkeypath, err)
+		}
+	}
+	return auth, nil
+}
+
 // Authenticate checks whether the http.Request is signed by any of the users
 // in the supplied file.
 func (u *ValidateFromFile) Authenticate(r *http.Request) error {
@@ -75,8 +92,7 @@ func (u *ValidateFromFile) Authenticate(r *http.Request) error {
 	if tmp := re.FindStringSubmatch(auth); tmp != nil {
 		// Check if user requested own bucket
 		curAccessKey = tmp[1]
-		re := regexp.MustCompile("/([^/]+)/")
-		if curAccessKey != re.FindStringSubmatch(r.URL.Path)[1] {
+		if username, err := usernameFromPath(r.URL.Path); err != nil || curAccessKey != username {
 			return fmt.Errorf("user not authorized to access location")
 		}
 	} else {
@@ -103,6 +119,10 @@ func (u *ValidateFromFile) Authenticate(r *http.Request) error {
 			// Add required headers
 			nr.Header.Set("X-Amz-Date", r.Header.Get("X-Amz-Date"))
 			nr.Header.Set("X-Amz-Content-Sha256", r.Header.Get("X-Amz-Content-Sha256"))
+			// Range requests are signed including the range
+			if r.Header.Get("Range") != "" && signedHeader(auth, "range") {
+				nr.Header.Set("Range", r.Header.Get("Range"))
+			}
 			nr.Host = r.Host
 			nr.URL.RawQuery = r.URL.RawQuery
 
@@ -128,6 +148,22 @@ func (u *ValidateFromFile) Authenticate(r *http.Request) error {
 	return nil
 }
 
+// signedHeader tells if the header is part of the signature in the
+// Authorization header
+func signedHeader(auth, header string) bool {
+	re := regexp.MustCompile("SignedHeaders=([^,]+)")
+	signed := re.FindStringSubmatch(auth)
+	if signed == nil {
+		return false
+	}
+	for _, h := range strings.Split(signed[1], ";") {
+		if h == header {
+			return true
+		}
+	}
+	return false
+}
+
 func (u *ValidateFromFile) secretFromID(id string) (string, error) {
 	f, e := os.Open(u.filename)
 	if e != nil {
@@ -197,8 +233,10 @@ func (u *ValidateFromToken) Authenticate(r *http.Request) error {
 		}
 	}
 	// Check whether token username and filepath match
-	re := regexp.MustCompile("/([^/]+)/")
-	username := re.FindStringSubmatch(r.URL.Path)[1]
+	username, err := usernameFromPath(r.URL.Path)
+	if err != nil {
+		return err
+	}
 	if claims, ok := token.Claims.(jwt.MapClaims); ok {
 		// Case for Elixir usernames - Remove everything after @ character
 		if strings.Contains(fmt.Sprintf("%v", claims["sub"]), "@") {
@@ -300,3 +338,13 @@ func (u *ValidateFromToken) getjwtpubkey(jwtpubkeyurl string) error {
 	log.Debugf("Registered public key for %s", key)
 	return nil
 }
+
+// usernameFromPath returns the first segment of the request path, which is
+// the user the request is for, with or without a trailing slash
+func usernameFromPath(path string) (string, error) {
+	re := regexp.MustCompile("^/([^/]+)")
+	if tmp := re.FindStringSubmatch(path); tmp != nil {
+		return tmp[1], nil
+	}
+	return "", fmt.Errorf("no username in path %q", path)
+}
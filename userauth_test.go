@@ -161,3 +161,47 @@ func TestUserTokenAuthenticator_ValidateSignature(t *testing.T) {
 	r.URL.Path = "/username/"
 	assert.Error(t, a.Authenticate(r))
 }
+
+func TestSignedHeader(t *testing.T) {
+	auth := "AWS4-HMAC-SHA256 Credential=username/20200101/us-east-1/s3/aws4_request, SignedHeaders=host;range;x-amz-content-sha256;x-amz-date, Signature=abc"
+	assert.True(t, signedHeader(auth, "range"))
+	assert.False(t, signedHeader(auth, "if-range"))
+	assert.False(t, signedHeader("", "range"))
+}
+
+func TestUsernameFromPath(t *testing.T) {
+	for path, username := range map[string]string{
+		"/username":          "username",
+		"/username/":         "username",
+		"/username/dir/file": "username",
+	} {
+		u, err := usernameFromPath(path)
+		assert.NoError(t, err)
+		assert.Equal(t, username, u)
+	}
+
+	for _, path := range []string{"", "/", "//file", "username/file"} {
+		_, err := usernameFromPath(path)
+		assert.Error(t, err, path)
+	}
+}
+
+func TestUserFileAuthenticator_UsernameInPath(t *testing.T) {
+	a := NewValidateFromFile("dev_utils/users.csv")
+
+	r, _ := http.NewRequest("POST", "/", nil)
+	r.Host = "localhost"
+	r.Header.Set("X-Amz-Content-Sha256", "Just needs to be here")
+
+	// Requests on the user's prefix itself, like listing uploads
+	r.URL.Path = "/username"
+	s3signer.SignV4(*r, "username", "testpass", "", "us-east-1")
+	assert.Nil(t, a.Authenticate(r))
+
+	// Mismatched users are refused with or without a trailing slash
+	for _, path := range []string{"/notvalid", "/usernameother", "/usernameother/file", "/"} {
+		r.URL.Path = path
+		s3signer.SignV4(*r, "username", "testpass", "", "us-east-1")
+		assert.Error(t, a.Authenticate(r), path)
+	}
+}
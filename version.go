@@ -0,0 +1,83 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"runtime"
+	"runtime/debug"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+// The version, commit and build date are set when building, with
+//
+//	go build -ldflags "-X main.version=v1.2.3 -X main.commit=$(git rev-parse HEAD) -X main.buildDate=$(date -u +%Y-%m-%dT%H:%M:%SZ)"
+//
+// otherwise the commit and date are taken from what the go tool recorded.
+var (
+	version   = "dev"
+	commit    = ""
+	buildDate = ""
+)
+
+// versionInfo tells what is running
+type versionInfo struct {
+	Version   string `json:"version"`
+	Commit    string `json:"commit,omitempty"`
+	BuildDate string `json:"buildDate,omitempty"`
+	GoVersion string `json:"goVersion"`
+}
+
+// currentVersion returns the version information of the binary
+func currentVersion() versionInfo {
+	v := versionInfo{Version: version, Commit: commit, BuildDate: buildDate, GoVersion: runtime.Version()}
+	if info, ok := debug.ReadBuildInfo(); ok {
+		for _, s := range info.Settings {
+			switch {
+			case s.Key == "vcs.revision" && v.Commit == "":
+				v.Commit = s.Value
+			case s.Key == "vcs.time" && v.BuildDate == "":
+				v.BuildDate = s.Value
+			case s.Key == "vcs.modified" && s.Value == "true" && commit == "":
+				v.Commit += "-dirty"
+			}
+		}
+	}
+	return v
+}
+
+func (v versionInfo) String() string {
+	s := "s3inbox " + v.Version
+	if v.Commit != "" {
+		s += ", commit " + v.Commit
+	}
+	if v.BuildDate != "" {
+		s += ", built " + v.BuildDate
+	}
+	return s + " with " + v.GoVersion
+}
+
+// newVersionCommand creates the version command, which prints what is
+// running like --version
+func newVersionCommand() *cobra.Command {
+	return &cobra.Command{
+		Use:   "version",
+		Short: "print the version, commit and build date",
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, _ []string) {
+			fmt.Fprintln(cmd.OutOrStdout(), currentVersion())
+		},
+	}
+}
+
+// versionHandler serves the version information as JSON
+func versionHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(currentVersion()); err != nil {
+			log.Errorf("writing version response: %v", err)
+		}
+	})
+}
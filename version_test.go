@@ -0,0 +1,27 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCurrentVersion(t *testing.T) {
+	defer func(v, c, d string) { version, commit, buildDate = v, c, d }(version, commit, buildDate)
+	version, commit, buildDate = "v1.2.3", "abc123", "2024-01-01T00:00:00Z"
+
+	v := currentVersion()
+	assert.Equal(t, versionInfo{Version: "v1.2.3", Commit: "abc123", BuildDate: "2024-01-01T00:00:00Z", GoVersion: runtime.Version()}, v)
+	assert.Equal(t, "s3inbox v1.2.3, commit abc123, built 2024-01-01T00:00:00Z with "+runtime.Version(), v.String())
+
+	w := httptest.NewRecorder()
+	versionHandler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/version", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	var served versionInfo
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &served))
+	assert.Equal(t, v, served)
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// webhookConfig stores the settings of the webhook messenger
+type webhookConfig struct {
+	urls []string
+	// key of the HMAC-SHA256 signature of the events, empty sends them
+	// unsigned
+	secret string
+	// how long to wait for each attempt
+	timeout time.Duration
+	// how many times a failed delivery is retried, and the wait before the
+	// first retry, which doubles for each one after it
+	retries int
+	backoff time.Duration
+}
+
+func init() {
+	registerMessenger("webhook", messengerType{
+		required: []string{"broker.webhook.urls"},
+		create: func(c BrokerConfig, tlsConfig *tls.Config) (Messenger, error) {
+			return NewWebhookMessenger(c, tlsConfig), nil
+		},
+		// Posting a test event could set off the receivers, so there is
+		// nothing to check
+	})
+}
+
+// readWebhookConfig reads the broker.webhook section of the configuration
+func readWebhookConfig() (webhookConfig, error) {
+	w := webhookConfig{
+		urls:    viper.GetStringSlice("broker.webhook.urls"),
+		timeout: 10 * time.Second,
+		retries: 3,
+		backoff: time.Second,
+	}
+
+	for _, u := range w.urls {
+		if !strings.HasPrefix(u, "http://") && !strings.HasPrefix(u, "https://") {
+			return w, fmt.Errorf("broker.webhook.urls: %q is not an http or https url", u)
+		}
+	}
+
+	if viper.IsSet("broker.webhook.secretFile") {
+		secret, err := ioutil.ReadFile(viper.GetString("broker.webhook.secretFile")) // #nosec this file comes from our configuration
+		if err != nil {
+			return w, fmt.Errorf("broker.webhook.secretFile: %v", err)
+		}
+		w.secret = strings.TrimSpace(string(secret))
+	}
+	if viper.IsSet("broker.webhook.timeout") {
+		w.timeout = viper.GetDuration("broker.webhook.timeout")
+		if w.timeout <= 0 {
+			return w, fmt.Errorf("broker.webhook.timeout must be positive")
+		}
+	}
+	if viper.IsSet("broker.webhook.retries") {
+		w.retries = viper.GetInt("broker.webhook.retries")
+		if w.retries < 0 {
+			return w, fmt.Errorf("broker.webhook.retries can not be negative")
+		}
+	}
+	if viper.IsSet("broker.webhook.backoff") {
+		w.backoff = viper.GetDuration("broker.webhook.backoff")
+		if w.backoff <= 0 {
+			return w, fmt.Errorf("broker.webhook.backoff must be positive")
+		}
+	}
+
+	return w, nil
+}
+
+// WebhookMessenger is a Messenger that posts events to web hooks. Every
+// hook has to take the event for it to count as sent, hooks answering with
+// server errors or not at all are tried again.
+//
+// Signed events carry X-S3inbox-Signature, the hex encoded HMAC-SHA256 of
+// the timestamp in X-S3inbox-Timestamp, a dot and the body, which lets the
+// receivers refuse replayed events.
+type WebhookMessenger struct {
+	client *http.Client
+	config webhookConfig
+	// sleep waits between attempts, it is replaced in the tests
+	sleep  func(time.Duration)
+	format eventFormat
+}
+
+// NewWebhookMessenger creates a new messenger that posts to the configured
+// web hooks
+func NewWebhookMessenger(c BrokerConfig, tlsConfig *tls.Config) *WebhookMessenger {
+	return &WebhookMessenger{brokerHTTPClient(c, tlsConfig), c.webhook, time.Sleep, c.format}
+}
+
+// webhookSignature returns the signature of a body sent at the timestamp
+func webhookSignature(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// SendMessage posts the event to all web hooks
+func (m *WebhookMessenger) SendMessage(message Event) error {
+	body, err := m.format.encode(message)
+	if err != nil {
+		return err
+	}
+
+	corrID, _ := uuid.NewRandom()
+
+	var failed []string
+	for _, u := range m.config.urls {
+		if err := m.deliver(u, body, message.RequestID, corrID.String(), messageID(message)); err != nil {
+			log.Errorf("event not delivered to %s: %v", u, err)
+			failed = append(failed, u)
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("event not delivered to %s", strings.Join(failed, ", "))
+	}
+	return nil
+}
+
+// deliver posts the event to one web hook, retrying with backoff
+func (m *WebhookMessenger) deliver(u string, body []byte, requestID, corrID, msgID string) error {
+	backoff := m.config.backoff
+	for attempt := 0; ; attempt++ {
+		retry, err := m.post(u, body, requestID, corrID, msgID)
+		if err == nil {
+			log.Debugf("event delivered to %s", u)
+			return nil
+		}
+		if !retry || attempt >= m.config.retries {
+			return err
+		}
+		log.Warnf("delivering event to %s failed, retrying in %s: %v", u, backoff, err)
+		m.sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// post makes one attempt at posting the event, it tells if a failure is
+// worth another attempt
+func (m *WebhookMessenger) post(u string, body []byte, requestID, corrID, msgID string) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), m.config.timeout)
+	defer cancel()
+	r, err := http.NewRequestWithContext(ctx, http.MethodPost, u, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	r.Header.Set("Content-Type", m.format.contentType())
+	if encoding := m.format.contentEncoding(""); encoding != "" {
+		r.Header.Set("Content-Encoding", encoding)
+	}
+	r.Header.Set("X-Correlation-Id", corrID)
+	r.Header.Set("X-Message-Id", msgID)
+	if requestID != "" {
+		r.Header.Set("X-Request-Id", requestID)
+	}
+	if m.config.secret != "" {
+		timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+		r.Header.Set("X-S3inbox-Timestamp", timestamp)
+		r.Header.Set("X-S3inbox-Signature", webhookSignature(m.config.secret, timestamp, body))
+	}
+
+	response, err := m.client.Do(r)
+	if err != nil {
+		return true, err
+	}
+	defer response.Body.Close()
+	_, _ = io.Copy(ioutil.Discard, io.LimitReader(response.Body, 64*1024))
+
+	switch {
+	case response.StatusCode >= 200 && response.StatusCode < 300:
+		return false, nil
+	case response.StatusCode == http.StatusTooManyRequests || response.StatusCode >= 500:
+		return true, fmt.Errorf("%s", response.Status)
+	default:
+		return false, fmt.Errorf("%s", response.Status)
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWebhookMessenger_SendMessage(t *testing.T) {
+	var received []*http.Request
+	var bodies [][]byte
+	failures := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if failures > 0 {
+			failures--
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		received = append(received, r)
+		bodies = append(bodies, body)
+		if r.URL.Path == "/gone" {
+			w.WriteHeader(http.StatusGone)
+		}
+	}))
+	defer ts.Close()
+
+	var waits []time.Duration
+	m := &WebhookMessenger{
+		client: ts.Client(),
+		config: webhookConfig{urls: []string{ts.URL + "/a", ts.URL + "/b"}, secret: "hunter2", timeout: time.Second, retries: 2, backoff: time.Second},
+		sleep:  func(d time.Duration) { waits = append(waits, d) },
+	}
+
+	event := Event{Operation: "upload", Username: "user", Filepath: "user/file.c4gh", Filesize: 10, RequestID: "abc"}
+	assert.NoError(t, m.SendMessage(event))
+	if assert.Len(t, received, 2, "all hooks get the event") {
+		r := received[0]
+		assert.Equal(t, "abc", r.Header.Get("X-Request-Id"))
+		assert.Equal(t, webhookSignature("hunter2", r.Header.Get("X-S3inbox-Timestamp"), bodies[0]), r.Header.Get("X-S3inbox-Signature"))
+
+		var sent Event
+		assert.NoError(t, json.Unmarshal(bodies[0], &sent))
+		assert.Equal(t, "user/file.c4gh", sent.Filepath)
+	}
+	assert.Empty(t, waits)
+
+	// Server errors are retried with backoff
+	failures = 2
+	assert.NoError(t, m.SendMessage(event))
+	assert.Equal(t, []time.Duration{time.Second, 2 * time.Second}, waits)
+
+	// until the retries run out
+	failures = 3
+	waits = nil
+	assert.Error(t, m.SendMessage(event))
+	assert.Len(t, waits, 2)
+
+	// Client errors are not retried
+	m.config.urls = []string{ts.URL + "/gone"}
+	waits = nil
+	assert.Error(t, m.SendMessage(event))
+	assert.Empty(t, waits)
+
+	// CloudEvents are posted in the structured mode
+	m.config.urls = []string{ts.URL + "/a"}
+	m.format = eventFormat{name: cloudEventsFormat, source: "/s3inbox", typePrefix: "s3inbox."}
+	received, bodies = nil, nil
+	assert.NoError(t, m.SendMessage(event))
+	if assert.Len(t, received, 1) {
+		assert.Equal(t, "application/cloudevents+json", received[0].Header.Get("Content-Type"))
+		var sent cloudEvent
+		assert.NoError(t, json.Unmarshal(bodies[0], &sent))
+		assert.Equal(t, "s3inbox.upload", sent.Type)
+		assert.Equal(t, "user/file.c4gh", sent.Data.Filepath)
+	}
+}
+
+func TestWebhookSignature(t *testing.T) {
+	// echo -n '1700000000.{}' | openssl dgst -sha256 -hmac hunter2
+	assert.Equal(t, "sha256=ff2f975170d2a2ea3d6177dad44d002ac729fec15c2e1053dc096496e07f8401", webhookSignature("hunter2", "1700000000", []byte("{}")))
+}